@@ -142,6 +142,38 @@ func LoadConfiguration(pkg string) (data map[string]interface{}, err error) {
 	return data[pkg].(map[string]interface{}), err
 }
 
+// LoadOptionalConfiguration behaves like LoadConfiguration but returns an
+// empty section when pkg is not present, for sections older config files lack
+func LoadOptionalConfiguration(pkg string) (data map[string]interface{}, err error) {
+	currDir, _ := os.Getwd()
+	defer os.Chdir(currDir)
+
+	filePath, err := ConfigGetVal(ConfigConfigFilePath)
+	if err != nil {
+		panic(fmt.Errorf("error retrieving config file variable: %s", err))
+	}
+	file := filepath.Base(filePath)
+	filePath = filepath.Dir(filePath)
+	os.Chdir(filePath)
+
+	configFile, err := os.Open(file)
+	if err != nil {
+		return data, err
+	}
+	defer configFile.Close()
+	byteValue, _ := ioutil.ReadAll(configFile)
+
+	var all map[string]interface{}
+	err = json.Unmarshal(byteValue, &all)
+
+	data, ok := all[pkg].(map[string]interface{})
+	if !ok {
+		data = make(map[string]interface{})
+	}
+
+	return data, err
+}
+
 func DownloadConfig(fullURLFile string) {
 	fileURL, err := url.Parse(fullURLFile)
 	if err != nil {
@@ -11,6 +11,15 @@ type ConfigRead struct {
 	DisableStratumv1    bool
 	ListenIP            string
 	ListenPort          string
+	Stratumv2ListenPort string
+	Stratumv2AuthKey    string
+	VardiffInterval     int
+	VardiffWindow       int
+	TLSListenPort       string
+	TLSCertFile         string
+	TLSKeyFile          string
+	TLSCAFile           string
+	ProxyProtocol       bool
 	DefaultPoolAddr     string
 	DisableSchedule     bool
 	SchedulePassthrough bool
@@ -31,6 +40,22 @@ type ConfigRead struct {
 	LogLevel            int
 	LogFilePath         string
 	Scheduler           string
+	PersistDir          string
+	SnapshotEvery       int
+	OpLog               string
+	BridgeListen        string
+	BridgeToken         string
+	BridgeExport        map[string]string
+	BridgeRemote        string
+	BridgeMirror        map[string]string
+	BridgeConflict      string
+	AuthMethods         []string
+	AuthAllowlistFile   string
+	AuthCIDRs           []string
+	AuthWorkerRegex     string
+	AuthURL             string
+	AuthTimeout         int
+	Listeners           []ListenerConfig
 }
 
 func ReadConfigs() (configs ConfigRead) {
@@ -62,6 +87,24 @@ func ReadConfigs() (configs ConfigRead) {
 		configs.ListenPort = connectionConfig["listenPort"].(string)
 		configs.DefaultPoolAddr = connectionConfig["defaultPoolAddr"].(string)
 		configs.Scheduler = connectionConfig["schedulermethod"].(string)
+		configs.Stratumv2ListenPort, _ = connectionConfig["stratumv2ListenPort"].(string)
+		configs.Stratumv2AuthKey, _ = connectionConfig["stratumv2AuthorityKey"].(string)
+		configs.TLSListenPort, _ = connectionConfig["tlsListenPort"].(string)
+		configs.TLSCertFile, _ = connectionConfig["tlsCertFile"].(string)
+		configs.TLSKeyFile, _ = connectionConfig["tlsKeyFile"].(string)
+		configs.TLSCAFile, _ = connectionConfig["tlsCAFile"].(string)
+		configs.ProxyProtocol, _ = connectionConfig["proxyProtocol"].(bool)
+		configs.VardiffWindow = 120
+		if interval, ok := connectionConfig["vardiffShareInterval"].(float64); ok {
+			configs.VardiffInterval = int(interval)
+		}
+		if window, ok := connectionConfig["vardiffRetargetWindow"].(float64); ok {
+			configs.VardiffWindow = int(window)
+		}
+		configs.Listeners, err = listenerList(connectionConfig["listeners"], &configs)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to load listeners configuration: %v", err))
+		}
 
 		//
 		// Scheduler Configs
@@ -120,6 +163,53 @@ func ReadConfigs() (configs ConfigRead) {
 		}
 		configs.LogLevel = int(loggingConfig["level"].(float64))
 		configs.LogFilePath = loggingConfig["filePath"].(string)
+
+		//
+		// MsgBus Configs
+		//
+		msgbusConfig, err := LoadOptionalConfiguration("msgbus")
+		if err != nil {
+			panic(fmt.Sprintf("Failed to load msgbus configuration: %v", err))
+		}
+		if persistDir, ok := msgbusConfig["persistDir"].(string); ok {
+			configs.PersistDir = persistDir
+		}
+		if snapshotEvery, ok := msgbusConfig["snapshotEvery"].(float64); ok {
+			configs.SnapshotEvery = int(snapshotEvery)
+		}
+		if opLog, ok := msgbusConfig["opLog"].(string); ok {
+			configs.OpLog = opLog
+		}
+
+		//
+		// MsgBus Bridge Configs
+		//
+		bridgeConfig, err := LoadOptionalConfiguration("bridge")
+		if err != nil {
+			panic(fmt.Sprintf("Failed to load bridge configuration: %v", err))
+		}
+		configs.BridgeListen, _ = bridgeConfig["listen"].(string)
+		configs.BridgeToken, _ = bridgeConfig["token"].(string)
+		configs.BridgeRemote, _ = bridgeConfig["remote"].(string)
+		configs.BridgeConflict, _ = bridgeConfig["conflict"].(string)
+		configs.BridgeExport = accessMap(bridgeConfig["export"])
+		configs.BridgeMirror = accessMap(bridgeConfig["mirror"])
+
+		//
+		// Miner Authentication Configs
+		//
+		authConfig, err := LoadOptionalConfiguration("auth")
+		if err != nil {
+			panic(fmt.Sprintf("Failed to load auth configuration: %v", err))
+		}
+		configs.AuthMethods = stringList(authConfig["methods"])
+		configs.AuthAllowlistFile, _ = authConfig["allowlistFile"].(string)
+		configs.AuthCIDRs = stringList(authConfig["cidrs"])
+		configs.AuthWorkerRegex, _ = authConfig["workerRegex"].(string)
+		configs.AuthURL, _ = authConfig["url"].(string)
+		if timeout, ok := authConfig["timeout"].(float64); ok {
+			configs.AuthTimeout = int(timeout)
+		}
 	} else {
 		//
 		// Config Configs
@@ -164,6 +254,51 @@ func ReadConfigs() (configs ConfigRead) {
 		if err != nil {
 			panic(fmt.Sprintf("Getting Default Pool Addr val failed: %s\n", err))
 		}
+		configs.Stratumv2ListenPort, err = ConfigGetVal(ConfigStratumv2ListenPort)
+		if err != nil {
+			panic(fmt.Sprintf("Getting StratumV2 Listen Port val failed: %s\n", err))
+		}
+		configs.Stratumv2AuthKey, err = ConfigGetVal(ConfigStratumv2AuthorityKey)
+		if err != nil {
+			panic(fmt.Sprintf("Getting StratumV2 Authority Key val failed: %s\n", err))
+		}
+		configs.TLSListenPort, err = ConfigGetVal(ConfigTLSListenPort)
+		if err != nil {
+			panic(fmt.Sprintf("Getting TLS Listen Port val failed: %s\n", err))
+		}
+		configs.TLSCertFile, err = ConfigGetVal(ConfigTLSCertFile)
+		if err != nil {
+			panic(fmt.Sprintf("Getting TLS Cert File val failed: %s\n", err))
+		}
+		configs.TLSKeyFile, err = ConfigGetVal(ConfigTLSKeyFile)
+		if err != nil {
+			panic(fmt.Sprintf("Getting TLS Key File val failed: %s\n", err))
+		}
+		configs.TLSCAFile, err = ConfigGetVal(ConfigTLSCAFile)
+		if err != nil {
+			panic(fmt.Sprintf("Getting TLS CA File val failed: %s\n", err))
+		}
+		proxyProtocolStr, err := ConfigGetVal(ConfigProxyProtocol)
+		if err != nil {
+			panic(fmt.Sprintf("Getting Proxy Protocol val failed: %s\n", err))
+		}
+		configs.ProxyProtocol = proxyProtocolStr == "true"
+		vardiffIntervalStr, err := ConfigGetVal(ConfigVardiffShareInterval)
+		if err != nil {
+			panic(fmt.Sprintf("Getting Vardiff Share Interval val failed: %s\n", err))
+		}
+		configs.VardiffInterval, err = strconv.Atoi(vardiffIntervalStr)
+		if err != nil {
+			panic(fmt.Sprintf("Converting Vardiff Share Interval string to int failed: %s\n", err))
+		}
+		vardiffWindowStr, err := ConfigGetVal(ConfigVardiffRetargetWindow)
+		if err != nil {
+			panic(fmt.Sprintf("Getting Vardiff Retarget Window val failed: %s\n", err))
+		}
+		configs.VardiffWindow, err = strconv.Atoi(vardiffWindowStr)
+		if err != nil {
+			panic(fmt.Sprintf("Converting Vardiff Retarget Window string to int failed: %s\n", err))
+		}
 
 		//
 		// Scheduler Configs
@@ -294,7 +429,43 @@ func ReadConfigs() (configs ConfigRead) {
 		if err != nil {
 			panic(fmt.Sprintf("Getting Log File Path val failed: %s\n", err))
 		}
+
+		//
+		// MsgBus Configs
+		//
+		configs.PersistDir, err = ConfigGetVal(ConfigMsgBusPersistDir)
+		if err != nil {
+			panic(fmt.Sprintf("Getting MsgBus Persist Dir val failed: %s\n", err))
+		}
+		configs.OpLog, err = ConfigGetVal(ConfigMsgBusOpLog)
+		if err != nil {
+			panic(fmt.Sprintf("Getting MsgBus Op Log val failed: %s\n", err))
+		}
 	}
 
 	return configs
 }
+
+// accessMap reads a {"MsgType": "ro"|"rw"} object from the config file
+func stringList(v interface{}) (l []string) {
+	if list, ok := v.([]interface{}); ok {
+		for _, s := range list {
+			if str, ok := s.(string); ok {
+				l = append(l, str)
+			}
+		}
+	}
+	return l
+}
+
+func accessMap(v interface{}) map[string]string {
+	m := make(map[string]string)
+	if obj, ok := v.(map[string]interface{}); ok {
+		for k, a := range obj {
+			if access, ok := a.(string); ok {
+				m[k] = access
+			}
+		}
+	}
+	return m
+}
@@ -18,6 +18,15 @@ const (
 	ConfigConnectionListenIP          ConfigConst = "ConfigConnectionListenIP"
 	ConfigConnectionListenPort        ConfigConst = "ConfigConnectionListenPort"
 	ConfigConnectionSwitchMethod      ConfigConst = "ConfigConnectionSwitchMethod"
+	ConfigStratumv2ListenPort         ConfigConst = "ConfigStratumv2ListenPort"
+	ConfigStratumv2AuthorityKey       ConfigConst = "ConfigStratumv2AuthorityKey"
+	ConfigVardiffShareInterval        ConfigConst = "ConfigVardiffShareInterval"
+	ConfigVardiffRetargetWindow       ConfigConst = "ConfigVardiffRetargetWindow"
+	ConfigTLSListenPort               ConfigConst = "ConfigTLSListenPort"
+	ConfigTLSCertFile                 ConfigConst = "ConfigTLSCertFile"
+	ConfigTLSKeyFile                  ConfigConst = "ConfigTLSKeyFile"
+	ConfigTLSCAFile                   ConfigConst = "ConfigTLSCAFile"
+	ConfigProxyProtocol               ConfigConst = "ConfigProxyProtocol"
 	ConfigConfigFilePath              ConfigConst = "ConfigConfigFilePath"
 	ConfigConfigDownloadPath          ConfigConst = "ConfigConfigDownloadPath"
 	ConfigLogFilePath                 ConfigConst = "ConfigLogFilePath"
@@ -31,6 +40,8 @@ const (
 	DisableValidate                   ConfigConst = "DisableValidator"
 	DisableStratumv1                  ConfigConst = "DisableStratumV1"
 	DisableAPI                        ConfigConst = "DisableAPI"
+	ConfigMsgBusPersistDir            ConfigConst = "ConfigMsgBusPersistDir"
+	ConfigMsgBusOpLog                 ConfigConst = "ConfigMsgBusOpLog"
 )
 
 // Config Structure
@@ -259,6 +270,87 @@ var ConfigMap = map[ConfigConst]configitem{
 		envval:    nil,
 		flagval:   nil,
 	},
+	ConfigStratumv2ListenPort: {
+		flagname:  "stratumv2port",
+		flagusage: "Port to listen on for Stratum V2 miners, empty disables Stratum V2",
+		envname:   "STRATUMV2PORT",
+		defval:    "",
+		configval: nil,
+		envval:    nil,
+		flagval:   nil,
+	},
+	ConfigStratumv2AuthorityKey: {
+		flagname:  "stratumv2authoritykey",
+		flagusage: "Hex private key the Stratum V2 certificates are signed with, empty uses a random key",
+		envname:   "STRATUMV2AUTHORITYKEY",
+		defval:    "",
+		configval: nil,
+		envval:    nil,
+		flagval:   nil,
+	},
+	ConfigVardiffShareInterval: {
+		flagname:  "vardiffshareinterval",
+		flagusage: "Seconds between shares the proxy tunes each miner's difficulty to, 0 passes the pool's difficulty",
+		envname:   "VARDIFFSHAREINTERVAL",
+		defval:    "0",
+		configval: nil,
+		envval:    nil,
+		flagval:   nil,
+	},
+	ConfigVardiffRetargetWindow: {
+		flagname:  "vardiffretargetwindow",
+		flagusage: "Seconds the miner's share rate is measured over before its difficulty is retargeted",
+		envname:   "VARDIFFRETARGETWINDOW",
+		defval:    "120",
+		configval: nil,
+		envval:    nil,
+		flagval:   nil,
+	},
+	ConfigTLSListenPort: {
+		flagname:  "tlslistenport",
+		flagusage: "Port to listen on for Stratum V1 miners over TLS, empty disables the TLS listener",
+		envname:   "TLSLISTENPORT",
+		defval:    "",
+		configval: nil,
+		envval:    nil,
+		flagval:   nil,
+	},
+	ConfigTLSCertFile: {
+		flagname:  "tlscertfile",
+		flagusage: "PEM certificate (chain) file the TLS listener serves",
+		envname:   "TLSCERTFILE",
+		defval:    "",
+		configval: nil,
+		envval:    nil,
+		flagval:   nil,
+	},
+	ConfigTLSKeyFile: {
+		flagname:  "tlskeyfile",
+		flagusage: "PEM private key file of the TLS listener certificate",
+		envname:   "TLSKEYFILE",
+		defval:    "",
+		configval: nil,
+		envval:    nil,
+		flagval:   nil,
+	},
+	ConfigTLSCAFile: {
+		flagname:  "tlscafile",
+		flagusage: "PEM file of extra CAs stratum+ssl pools are checked against, on top of the system roots",
+		envname:   "TLSCAFILE",
+		defval:    "",
+		configval: nil,
+		envval:    nil,
+		flagval:   nil,
+	},
+	ConfigProxyProtocol: {
+		flagname:  "proxyprotocol",
+		flagusage: "Miner listeners read a HAProxy PROXY protocol v1 or v2 header off every connection and record the client address it carries",
+		envname:   "PROXYPROTOCOL",
+		defval:    "false",
+		configval: nil,
+		envval:    nil,
+		flagval:   nil,
+	},
 	DisableValidate: {
 		flagname:  "disablevalidate",
 		flagusage: "Disable the Validator",
@@ -277,4 +369,22 @@ var ConfigMap = map[ConfigConst]configitem{
 		envval:    nil,
 		flagval:   nil,
 	},
+	ConfigMsgBusPersistDir: {
+		flagname:  "persistdir",
+		flagusage: "Directory for the message bus snapshot and journal, empty keeps the bus in memory only",
+		envname:   "PERSISTDIR",
+		defval:    "",
+		configval: nil,
+		envval:    nil,
+		flagval:   nil,
+	},
+	ConfigMsgBusOpLog: {
+		flagname:  "oplog",
+		flagusage: "File to write the message bus operation log to, for replay with msgbusreplay",
+		envname:   "OPLOG",
+		defval:    "",
+		configval: nil,
+		envval:    nil,
+		flagval:   nil,
+	},
 }
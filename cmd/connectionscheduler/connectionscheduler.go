@@ -67,20 +67,13 @@ func (cs *ConnectionScheduler) Start() (err error) {
 	contextlib.Logf(cs.Ctx, log.LevelInfo, "Connection Scheduler Starting")
 
 	// Update connection scheduler with current contracts
-	event, err := cs.Ps.GetWait(msgbus.ContractMsg, "")
+	contracts, err := cs.Ps.Contracts().List(nil)
 	if err != nil {
-		contextlib.Logf(cs.Ctx, log.LevelError, "Failed to get all contract ids, Fileline::%s, Error::%v", lumerinlib.FileLine(), err)
+		contextlib.Logf(cs.Ctx, log.LevelError, "Failed to get contracts, Fileline::%s, Error::%v", lumerinlib.FileLine(), err)
 		return err
 	}
-	contracts := event.Data.(msgbus.IDIndex)
-	for i := range contracts {
-		event, err := cs.Ps.GetWait(msgbus.ContractMsg, contracts[i])
-		if err != nil {
-			contextlib.Logf(cs.Ctx, log.LevelError, "Failed to get contract, Fileline::%s, Error::%v", lumerinlib.FileLine(), err)
-			return err
-		}
-		contract := event.Data.(msgbus.Contract)
-		cs.Contracts.Set(string(contracts[i]), contract)
+	for _, contract := range contracts {
+		cs.Contracts.Set(string(contract.ID), contract)
 	}
 
 	// Monitor Contract Events
@@ -123,7 +116,7 @@ func (cs *ConnectionScheduler) Start() (err error) {
 
 		if miner.State == msgbus.OnlineState {
 
-			if miner.Dest == cs.NodeOperator.DefaultDest {
+			if miner.Dest == cs.minerDefaultDest(miner) {
 				connection.SetAvailable(true)
 				cs.ReadyMiners.Set(string(miners[i]), *miner)
 			} else {
@@ -357,21 +350,15 @@ func (cs *ConnectionScheduler) RunningContractsManager() {
 			contracts := cs.Contracts.GetAll()
 
 			// Fill up ready and busy miners map
-			miners, err := cs.Ps.MinerGetAllWait()
+			miners, err := cs.Ps.MinerQueryWait(msgbus.Filter{msgbus.FieldEq("State", msgbus.OnlineState)})
 			if err != nil {
 				contextlib.Logf(cs.Ctx, log.LevelPanic, lumerinlib.FileLine()+"Error:%v", err)
 			}
-			for i := range miners {
-				miner, err := cs.Ps.MinerGetWait(miners[i])
-				if err != nil {
-					contextlib.Logf(cs.Ctx, log.LevelPanic, lumerinlib.FileLine()+"Error:%v", err)
-				}
-				if miner.State == msgbus.OnlineState {
-					if len(miner.Contracts) == 0 {
-						cs.ReadyMiners.Set(string(miners[i]), *miner)
-					} else {
-						cs.BusyMiners.Set(string(miners[i]), *miner)
-					}
+			for _, miner := range miners {
+				if len(miner.Contracts) == 0 {
+					cs.ReadyMiners.Set(string(miner.ID), miner)
+				} else {
+					cs.BusyMiners.Set(string(miner.ID), miner)
 				}
 			}
 			readyMiners := cs.ReadyMiners.GetAll()
@@ -424,11 +411,11 @@ func (cs *ConnectionScheduler) ContractRunningPassthrough(contractId msgbus.Cont
 	defer cs.wg.Done()
 	contextlib.Logf(cs.Ctx, log.LevelInfo, lumerinlib.FileLine()+"Contract Running in Passthrough Mode: %s", contractId)
 
-	event, err := cs.Ps.GetWait(msgbus.ContractMsg, msgbus.IDString(contractId))
+	contract, err := cs.Ps.Contracts().Get(contractId)
 	if err != nil {
-		contextlib.Logf(cs.Ctx, log.LevelPanic, lumerinlib.FileLine()+"Error:%v", event)
+		contextlib.Logf(cs.Ctx, log.LevelError, lumerinlib.FileLine()+"Error:%v", err)
+		return
 	}
-	contract := event.Data.(msgbus.Contract)
 	destid := contract.Dest
 
 	if destid == "" {
@@ -439,11 +426,7 @@ func (cs *ConnectionScheduler) ContractRunningPassthrough(contractId msgbus.Cont
 	miners := cs.ReadyMiners.GetAll()
 
 	for _, m := range miners {
-		_, err = cs.Ps.MinerSetContractWait(m.(msgbus.Miner).ID, contract.ID, 1, false)
-		if err != nil {
-			contextlib.Logf(cs.Ctx, log.LevelWarn, lumerinlib.FileLine()+"Error:%v", err)
-		}
-		miner, err := cs.Ps.MinerSetDestWait(m.(msgbus.Miner).ID, destid)
+		miner, err := cs.Ps.MinerAssignContractWait(m.(msgbus.Miner).ID, contract.ID, 1, false, destid)
 		if err != nil {
 			contextlib.Logf(cs.Ctx, log.LevelWarn, lumerinlib.FileLine()+"Error:%v", err)
 		}
@@ -464,11 +447,11 @@ func (cs *ConnectionScheduler) ContractRunning(contractId msgbus.ContractID) {
 	defer cs.wg.Done()
 	contextlib.Logf(cs.Ctx, log.LevelInfo, lumerinlib.FileLine()+"Contract Running, ID: %s", contractId)
 
-	event, err := cs.Ps.GetWait(msgbus.ContractMsg, msgbus.IDString(contractId))
+	contract, err := cs.Ps.Contracts().Get(contractId)
 	if err != nil {
-		contextlib.Logf(cs.Ctx, log.LevelPanic, lumerinlib.FileLine()+"Error:%v", err)
+		contextlib.Logf(cs.Ctx, log.LevelError, lumerinlib.FileLine()+"Error:%v", err)
+		return
 	}
-	contract := event.Data.(msgbus.Contract)
 
 	hashrateTolerance := float64(HASHRATE_LIMIT) / 100
 
@@ -553,11 +536,7 @@ func (cs *ConnectionScheduler) SetMinerTarget(contract msgbus.Contract) {
 			}
 			slicedMiners = append(slicedMiners, *miner)
 		} else {
-			_, err = cs.Ps.MinerSetContractWait(v.id, contract.ID, slicePercent, false)
-			if err != nil {
-				contextlib.Logf(cs.Ctx, log.LevelPanic, lumerinlib.FileLine()+"Error:%v", err)
-			}
-			miner, err = cs.Ps.MinerSetDestWait(v.id, destid)
+			miner, err = cs.Ps.MinerAssignContractWait(v.id, contract.ID, slicePercent, false, destid)
 			if err != nil {
 				contextlib.Logf(cs.Ctx, log.LevelPanic, lumerinlib.FileLine()+"Error:%v", err)
 			}
@@ -583,12 +562,14 @@ func (cs *ConnectionScheduler) SetMinerTarget(contract msgbus.Contract) {
 				}
 			}
 
-			// check if contract went to available periodically
-			event, err := cs.Ps.GetWait(msgbus.ContractMsg, msgbus.IDString(contract.ID))
+			// check if contract went to available periodically, or is gone
+			current, err := cs.Ps.Contracts().Get(contract.ID)
 			if err != nil {
-				contextlib.Logf(cs.Ctx, log.LevelPanic, lumerinlib.FileLine()+"Error:%v", err)
+				contextlib.Logf(cs.Ctx, log.LevelWarn, lumerinlib.FileLine()+"Error:%v", err)
+				contractStateChanged = true
+				break loop1
 			}
-			contract = event.Data.(msgbus.Contract)
+			contract = current
 			if contract.State == msgbus.ContAvailableState {
 				contractStateChanged = true
 				break loop1
@@ -607,24 +588,26 @@ func (cs *ConnectionScheduler) SetMinerTarget(contract msgbus.Contract) {
 					}
 				}
 
-				// check if contract went to available
-				event, err := cs.Ps.GetWait(msgbus.ContractMsg, msgbus.IDString(contract.ID))
+				// check if contract went to available, or is gone
+				current, err := cs.Ps.Contracts().Get(contract.ID)
 				if err != nil {
-					contextlib.Logf(cs.Ctx, log.LevelPanic, lumerinlib.FileLine()+"Error:%v", err)
+					contextlib.Logf(cs.Ctx, log.LevelWarn, lumerinlib.FileLine()+"Error:%v", err)
+					contractStateChanged = true
+					break loop2
 				}
-				contract = event.Data.(msgbus.Contract)
+				contract = current
 				if contract.State == msgbus.ContAvailableState {
 					contractStateChanged = true
 					break loop2
 				}
 
 				contextlib.Logf(cs.Ctx, log.LevelInfo, "Switching Sliced Miner %s Dest to service Contract: %s", m.ID, i)
-				event, err = cs.Ps.GetWait(msgbus.ContractMsg, msgbus.IDString(i))
+				sliced, err := cs.Ps.Contracts().Get(i)
 				if err != nil {
-					contextlib.Logf(cs.Ctx, log.LevelPanic, lumerinlib.FileLine()+"Error:%v", err)
+					contextlib.Logf(cs.Ctx, log.LevelWarn, lumerinlib.FileLine()+"Error:%v", err)
+					continue
 				}
-				contract = event.Data.(msgbus.Contract)
-				miner, err := cs.Ps.MinerSetDestWait(m.ID, contract.Dest)
+				miner, err := cs.Ps.MinerSetDestWait(m.ID, sliced.Dest)
 				if err != nil {
 					contextlib.Logf(cs.Ctx, log.LevelPanic, lumerinlib.FileLine()+"Error:%v", err)
 				}
@@ -640,7 +623,7 @@ func (cs *ConnectionScheduler) SetMinerTarget(contract msgbus.Contract) {
 			}
 			if (i == len(slicedMiners)-1) && (durationPassed < totalDuration) {
 				contextlib.Logf(cs.Ctx, log.LevelInfo, "Switching Sliced Miner Dest to Default Dest, Miner: %s", m.ID)
-				miner, err := cs.Ps.MinerSetDestWait(m.ID, cs.NodeOperator.DefaultDest)
+				miner, err := cs.Ps.MinerSetDestWait(m.ID, cs.minerDefaultDest(&m))
 				if err != nil {
 					contextlib.Logf(cs.Ctx, log.LevelPanic, lumerinlib.FileLine()+"Error:%v", err)
 				}
@@ -673,6 +656,15 @@ func (cs *ConnectionScheduler) SetMinerTarget(contract msgbus.Contract) {
 	}
 }
 
+// minerDefaultDest is where the miner goes when it serves no contract, the
+// default Dest of its listener or else the node operator's
+func (cs *ConnectionScheduler) minerDefaultDest(miner *msgbus.Miner) msgbus.DestID {
+	if miner.DefaultDest != "" {
+		return miner.DefaultDest
+	}
+	return cs.NodeOperator.DefaultDest
+}
+
 func (cs *ConnectionScheduler) calculateHashrateAvailability(id msgbus.ContractID) (availableHashrate int, contractHashrate int) {
 	miners := cs.ReadyMiners.GetAll()
 	for _, v := range miners {
@@ -2,6 +2,7 @@ package contractmanager
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
@@ -130,11 +131,10 @@ func (seller *SellerContractManager) init(Ctx *context.Context, contractManagerC
 	cs := contextlib.GetContextStruct(seller.Ctx)
 	seller.Ps = cs.MsgBus
 
-	event, err := seller.Ps.GetWait(msgbus.ContractManagerConfigMsg, contractManagerConfigID)
+	contractManagerConfig, err := seller.Ps.ContractManagerConfigs().Get(msgbus.ContractManagerConfigID(contractManagerConfigID))
 	if err != nil {
 		return err
 	}
-	contractManagerConfig := event.Data.(msgbus.ContractManagerConfig)
 	seller.ClaimFunds = contractManagerConfig.ClaimFunds
 	ethNodeAddr := contractManagerConfig.EthNodeAddr
 	mnemonic := contractManagerConfig.Mnemonic
@@ -435,10 +435,15 @@ func (seller *SellerContractManager) watchHashrateContract(addr msgbus.ContractI
 					contractMsg.Dest = destMsg.ID
 					contractMsg.State = msgbus.ContRunningState
 					contractMsg.Buyer = string(buyer.Hex())
-					seller.Ps.SetWait(msgbus.ContractMsg, msgbus.IDString(addr), contractMsg)
-
 					seller.NodeOperator.Contracts[addr] = msgbus.ContRunningState
-					seller.Ps.SetWait(msgbus.NodeOperatorMsg, msgbus.IDString(seller.NodeOperator.ID), seller.NodeOperator)
+
+					_, err = seller.Ps.Txn().
+						Set(msgbus.ContractMsg, msgbus.IDString(addr), contractMsg).
+						Set(msgbus.NodeOperatorMsg, msgbus.IDString(seller.NodeOperator.ID), seller.NodeOperator).
+						CommitWait()
+					if err != nil {
+						contextlib.Logf(seller.Ctx, log.LevelError, "Setting Purchased Contract Failed: %v", err)
+					}
 
 				case cipherTextUpdatedSigHash.Hex():
 					contextlib.Logf(seller.Ctx, log.LevelInfo, "Hashrate Contract %s Cipher Text Updated \n\n", addr)
@@ -481,10 +486,15 @@ func (seller *SellerContractManager) watchHashrateContract(addr msgbus.ContractI
 					if contractMsg.State == msgbus.ContRunningState {
 						contractMsg.State = msgbus.ContAvailableState
 						contractMsg.Buyer = ""
-						seller.Ps.SetWait(msgbus.ContractMsg, msgbus.IDString(contractMsg.ID), contractMsg)
-
 						seller.NodeOperator.Contracts[addr] = msgbus.ContAvailableState
-						seller.Ps.SetWait(msgbus.NodeOperatorMsg, msgbus.IDString(seller.NodeOperator.ID), seller.NodeOperator)
+
+						_, err = seller.Ps.Txn().
+							Set(msgbus.ContractMsg, msgbus.IDString(contractMsg.ID), contractMsg).
+							Set(msgbus.NodeOperatorMsg, msgbus.IDString(seller.NodeOperator.ID), seller.NodeOperator).
+							CommitWait()
+						if err != nil {
+							contextlib.Logf(seller.Ctx, log.LevelError, "Setting Closed Contract Failed: %v", err)
+						}
 					}
 
 				case purchaseInfoUpdatedSigHash.Hex():
@@ -510,7 +520,11 @@ func (seller *SellerContractManager) watchHashrateContract(addr msgbus.ContractI
 		}
 	}()
 
-	_, err = seller.Ps.Sub(msgbus.ContractMsg, msgbus.IDString(addr), contractEventChan)
+	// only state changes matter here, the channel is closed along with the context
+	_, err = seller.Ps.Sub(msgbus.ContractMsg, msgbus.IDString(addr), contractEventChan,
+		msgbus.OnlyEvents(msgbus.UpdateEvent),
+		msgbus.OnlyFieldChanges("State"),
+		msgbus.WithContext(seller.Ctx))
 	if err != nil {
 		contextlib.Logf(seller.Ctx, log.LevelPanic, "Subscribing to Contract Failed: %v", err)
 	}
@@ -520,7 +534,10 @@ func (seller *SellerContractManager) watchHashrateContract(addr msgbus.ContractI
 		case <-seller.Ctx.Done():
 			contextlib.Logf(seller.Ctx, log.LevelInfo, "Cancelling current contract manager context: cancelling watchHashrateContract go routine")
 			return
-		case event := <-contractEventChan:
+		case event, ok := <-contractEventChan:
+			if !ok {
+				return
+			}
 			if event.EventType == msgbus.UpdateEvent {
 				runningContractMsg := event.Data.(msgbus.Contract)
 				if runningContractMsg.State == msgbus.ContRunningState {
@@ -596,11 +613,10 @@ func (buyer *BuyerContractManager) init(Ctx *context.Context, contractManagerCon
 	cs := contextlib.GetContextStruct(buyer.Ctx)
 	buyer.Ps = cs.MsgBus
 
-	event, err := buyer.Ps.GetWait(msgbus.ContractManagerConfigMsg, contractManagerConfigID)
+	contractManagerConfig, err := buyer.Ps.ContractManagerConfigs().Get(msgbus.ContractManagerConfigID(contractManagerConfigID))
 	if err != nil {
 		return err
 	}
-	contractManagerConfig := event.Data.(msgbus.ContractManagerConfig)
 	buyer.TimeThreshold = contractManagerConfig.TimeThreshold
 	ethNodeAddr := contractManagerConfig.EthNodeAddr
 	mnemonic := contractManagerConfig.Mnemonic
@@ -641,13 +657,6 @@ func (buyer *BuyerContractManager) start() (err error) {
 	}
 	go buyer.watchContractPurchase(cfLogs, cfSub)
 
-	// miner event channel for miner monitor that checks miner publishes, updates, and deletes
-	minerEventChan := msgbus.NewEventChan()
-	_, err = buyer.Ps.Sub(msgbus.MinerMsg, msgbus.IDString(""), minerEventChan)
-	if err != nil {
-		contextlib.Logf(buyer.Ctx, log.LevelPanic, fmt.Sprintf("Failed to subscribe to miner events on msgbus, Fileline::%s, Error::", lumerinlib.FileLine()), err)
-	}
-
 	// routine starts routines for buyers's contracts that monitors contract running and close events
 	go func() {
 		// start watch hashrate contract for existing running contracts
@@ -657,13 +666,7 @@ func (buyer *BuyerContractManager) start() (err error) {
 				contextlib.Logf(buyer.Ctx, log.LevelPanic, fmt.Sprintf("Failed to subscribe to events on hashrate contract %s, Fileline::%s, Error::", addr, lumerinlib.FileLine()), err)
 			}
 			go buyer.watchHashrateContract(addr, hrLogs, hrSub)
-
-			contractEventChan := msgbus.NewEventChan()
-			_, err = buyer.Ps.Sub(msgbus.ContractMsg, msgbus.IDString(addr), contractEventChan)
-			if err != nil {
-				contextlib.Logf(buyer.Ctx, log.LevelPanic, fmt.Sprintf("Failed to subscribe to contract %s events, Fileline::%s, Error::", addr, lumerinlib.FileLine()), err)
-			}
-			go buyer.closeOutMonitor(minerEventChan, contractEventChan, addr)
+			go buyer.closeOutMonitor(addr)
 		}
 
 		// monitor new contracts getting purchased and start watch hashrate conrtract routine when they are purchased
@@ -686,13 +689,7 @@ func (buyer *BuyerContractManager) start() (err error) {
 						contextlib.Logf(buyer.Ctx, log.LevelPanic, fmt.Sprintf("Failed to subscribe to events on hashrate contract %s, Fileline::%s, Error::", addr, lumerinlib.FileLine()), err)
 					}
 					go buyer.watchHashrateContract(msgbus.ContractID(addr.Hex()), hrLogs, hrSub)
-
-					newContractEventChan := msgbus.NewEventChan()
-					_, err = buyer.Ps.Sub(msgbus.ContractMsg, msgbus.IDString(newContract.ID), newContractEventChan)
-					if err != nil {
-						contextlib.Logf(buyer.Ctx, log.LevelPanic, fmt.Sprintf("Failed to subscribe to contract %s events, Fileline::%s, Error::", newContract.ID, lumerinlib.FileLine()), err)
-					}
-					go buyer.closeOutMonitor(minerEventChan, newContractEventChan, newContract.ID)
+					go buyer.closeOutMonitor(newContract.ID)
 				}
 			}
 		}
@@ -853,10 +850,10 @@ func (buyer *BuyerContractManager) watchHashrateContract(addr msgbus.ContractID,
 			case contractClosedSigHash.Hex():
 				contextlib.Logf(buyer.Ctx, log.LevelInfo, "Hashrate Contract %s Closed \n\n", addr)
 
-				buyer.Ps.Unpub(msgbus.ContractMsg, msgbus.IDString(addr))
-
-				delete(buyer.NodeOperator.Contracts, addr)
-				buyer.Ps.SetWait(msgbus.NodeOperatorMsg, msgbus.IDString(buyer.NodeOperator.ID), buyer.NodeOperator)
+				err := buyer.removeClosedContract(addr)
+				if err != nil {
+					contextlib.Logf(buyer.Ctx, log.LevelError, "Removing Closed Contract Failed: %v", err)
+				}
 
 			case purchaseInfoUpdatedSigHash.Hex():
 				contextlib.Logf(buyer.Ctx, log.LevelInfo, "Hashrate Contract %s Purchase Info Updated \n\n", addr)
@@ -908,13 +905,56 @@ func (buyer *BuyerContractManager) watchHashrateContract(addr msgbus.ContractID,
 	}
 }
 
-func (buyer *BuyerContractManager) closeOutMonitor(minerCh msgbus.EventChan, contractCh msgbus.EventChan, contractId msgbus.ContractID) {
+// removeClosedContract drops a closed contract from the node operator and
+// unpublishes it, the node operator is still updated when the contract
+// record has already gone
+func (buyer *BuyerContractManager) removeClosedContract(addr msgbus.ContractID) error {
+	delete(buyer.NodeOperator.Contracts, addr)
+
+	_, err := buyer.Ps.Txn().
+		Unpub(msgbus.ContractMsg, msgbus.IDString(addr)).
+		Set(msgbus.NodeOperatorMsg, msgbus.IDString(buyer.NodeOperator.ID), buyer.NodeOperator).
+		CommitWait()
+	if !errors.Is(err, msgbus.ErrNotFound) {
+		return err
+	}
+
+	// either record may be the missing one, only the node operator is left to try
+	event, err := buyer.Ps.SetWait(msgbus.NodeOperatorMsg, msgbus.IDString(buyer.NodeOperator.ID), buyer.NodeOperator)
+	if err != nil {
+		return err
+	}
+	return event.Err
+}
+
+func (buyer *BuyerContractManager) closeOutMonitor(contractId msgbus.ContractID) {
+	// the monitor's subscriptions are removed and their channels closed when it returns
+	ctx, cancel := context.WithCancel(buyer.Ctx)
+	defer cancel()
+
+	recordEvents := msgbus.OnlyEvents(msgbus.PublishEvent, msgbus.UpdateEvent, msgbus.UnpublishEvent)
+
+	minerCh := msgbus.NewEventChan()
+	_, err := buyer.Ps.Sub(msgbus.MinerMsg, "", minerCh, recordEvents, msgbus.WithContext(ctx))
+	if err != nil {
+		contextlib.Logf(buyer.Ctx, log.LevelPanic, fmt.Sprintf("Failed to subscribe to miner events on msgbus, Fileline::%s, Error::", lumerinlib.FileLine()), err)
+	}
+
+	contractCh := msgbus.NewEventChan()
+	_, err = buyer.Ps.Sub(msgbus.ContractMsg, msgbus.IDString(contractId), contractCh, recordEvents, msgbus.WithContext(ctx))
+	if err != nil {
+		contextlib.Logf(buyer.Ctx, log.LevelPanic, fmt.Sprintf("Failed to subscribe to contract %s events, Fileline::%s, Error::", contractId, lumerinlib.FileLine()), err)
+	}
+
 	for {
 		select {
 		case <-buyer.Ctx.Done():
 			contextlib.Logf(buyer.Ctx, log.LevelInfo, "Cancelling current contract manager context: cancelling closeOutMonitor go routine")
 			return
-		case event := <-minerCh:
+		case event, ok := <-minerCh:
+			if !ok {
+				return
+			}
 			if event.EventType == msgbus.PublishEvent || event.EventType == msgbus.UpdateEvent || event.EventType == msgbus.UnpublishEvent {
 				// check hashrate is being fulfilled for all running contracts
 				time.Sleep(time.Second * time.Duration(buyer.TimeThreshold)) // give buffer time for total hashrate to adjust to multiple updates
@@ -923,7 +963,10 @@ func (buyer *BuyerContractManager) closeOutMonitor(minerCh msgbus.EventChan, con
 					return
 				}
 			}
-		case event := <-contractCh:
+		case event, ok := <-contractCh:
+			if !ok {
+				return
+			}
 			if event.EventType == msgbus.UnpublishEvent {
 				return
 			}
@@ -946,20 +989,13 @@ func (buyer *BuyerContractManager) checkHashRate(contractId msgbus.ContractID) b
 		contextlib.Logf(buyer.Ctx, log.LevelPanic, "Getting Hashrate Contract Failed: %v", err)
 	}
 	contract := event.Data.(msgbus.Contract)
-	miners, err := buyer.Ps.MinerGetAllWait()
+	miners, err := buyer.Ps.MinerQueryWait(msgbus.Filter{msgbus.FieldNotHasKey("Contracts", contractId)})
 	if err != nil {
-		contextlib.Logf(buyer.Ctx, log.LevelPanic, fmt.Sprintf("Failed to get all miners, Fileline::%s, Error::", lumerinlib.FileLine()), err)
+		contextlib.Logf(buyer.Ctx, log.LevelPanic, fmt.Sprintf("Failed to get miners, Fileline::%s, Error::", lumerinlib.FileLine()), err)
 	}
 
-	var miner *msgbus.Miner
-	for i := range miners {
-		miner, err = buyer.Ps.MinerGetWait(miners[i])
-		if err != nil {
-			contextlib.Logf(buyer.Ctx, log.LevelPanic, fmt.Sprintf("Failed to get miner, Fileline::%s, Error::", lumerinlib.FileLine()), err)
-		}
-		if _, ok := miner.Contracts[contractId]; !ok {
-			totalHashrate += miner.CurrentHashRate
-		}
+	for _, miner := range miners {
+		totalHashrate += miner.CurrentHashRate
 	}
 
 	//hashrateTolerance := float64(contract.Limit) / 100
@@ -1172,10 +1208,12 @@ func setContractCloseOut(client *ethclient.Client, fromAddress common.Address, p
 	if contractMsg.State == msgbus.ContRunningState {
 		contractMsg.State = msgbus.ContAvailableState
 		contractMsg.Buyer = ""
-		Ps.SetWait(msgbus.ContractMsg, msgbus.IDString(contractMsg.ID), contractMsg)
-
 		NodeOperator.Contracts[msgbus.ContractID(contractAddress.Hex())] = msgbus.ContAvailableState
-		Ps.SetWait(msgbus.NodeOperatorMsg, msgbus.IDString(NodeOperator.ID), NodeOperator)
+
+		_, err = Ps.Txn().
+			Set(msgbus.ContractMsg, msgbus.IDString(contractMsg.ID), contractMsg).
+			Set(msgbus.NodeOperatorMsg, msgbus.IDString(NodeOperator.ID), NodeOperator).
+			CommitWait()
 	}
 	return err
 }
@@ -196,10 +196,10 @@ loop2:
 	// connection scheduler sets contract to correct miners
 	m1, _ := ps.MinerGetWait(miner1.ID)
 	m2, _ := ps.MinerGetWait(miner2.ID)
-	if m1.Contracts[msgbus.ContractID(hashrateContractAddress[0].Hex())] {
+	if m1.Contracts[msgbus.ContractID(hashrateContractAddress[0].Hex())] != 0 {
 		t.Errorf("Miner contracts not set correctly")
 	}
-	if m2.Contracts[msgbus.ContractID(hashrateContractAddress[0].Hex())] {
+	if m2.Contracts[msgbus.ContractID(hashrateContractAddress[0].Hex())] != 0 {
 		t.Errorf("Miner contracts not set correctly")
 	}
 
@@ -240,13 +240,13 @@ loop4:
 	m2, _ = ps.MinerGetWait(miner2.ID)
 	m3, _ := ps.MinerGetWait(miner3.ID)
 	time.Sleep(time.Millisecond * time.Duration(sleepTime/5))
-	if m1.Contracts[msgbus.ContractID(hashrateContractAddress[0].Hex())] {
+	if m1.Contracts[msgbus.ContractID(hashrateContractAddress[0].Hex())] != 0 {
 		t.Errorf("Miner contracts not set correctly")
 	}
-	if m2.Contracts[msgbus.ContractID(hashrateContractAddress[0].Hex())] {
+	if m2.Contracts[msgbus.ContractID(hashrateContractAddress[0].Hex())] != 0 {
 		t.Errorf("Miner contracts not set correctly")
 	}
-	if m3.Contracts[msgbus.ContractID(hashrateContractAddress[1].Hex())] {
+	if m3.Contracts[msgbus.ContractID(hashrateContractAddress[1].Hex())] != 0 {
 		t.Errorf("Miner contracts not set correctly")
 	}
 
@@ -320,16 +320,16 @@ loop6:
 	m3, _ = ps.MinerGetWait(miner3.ID)
 	m4, _ := ps.MinerGetWait(miner4.ID)
 	time.Sleep(time.Millisecond * time.Duration(sleepTime/5))
-	if m1.Contracts[msgbus.ContractID(hashrateContractAddress[0].Hex())] {
+	if m1.Contracts[msgbus.ContractID(hashrateContractAddress[0].Hex())] != 0 {
 		t.Errorf("Miner contracts not set correctly")
 	}
-	if m2.Contracts[msgbus.ContractID(hashrateContractAddress[0].Hex())] {
+	if m2.Contracts[msgbus.ContractID(hashrateContractAddress[0].Hex())] != 0 {
 		t.Errorf("Miner contracts not set correctly")
 	}
-	if m3.Contracts[msgbus.ContractID(hashrateContractAddress[1].Hex())] {
+	if m3.Contracts[msgbus.ContractID(hashrateContractAddress[1].Hex())] != 0 {
 		t.Errorf("Miner contracts not set correctly")
 	}
-	if m4.Contracts[msgbus.ContractID(hashrateContractAddress[2].Hex())] {
+	if m4.Contracts[msgbus.ContractID(hashrateContractAddress[2].Hex())] != 0 {
 		t.Errorf("Miner contracts not set correctly")
 	}
 
@@ -409,3 +409,35 @@ loop6:
 		t.Errorf("Contract manager's configuration was not updated after msgbus update")
 	}
 }
+
+// A contract closed after its record has already been unpublished still
+// comes off the node operator
+func TestBuyerRemoveClosedContractGone(t *testing.T) {
+	ps := msgbus.New(10, log.New())
+
+	addr := msgbus.ContractID("0x0000000000000000000000000000000000000001")
+	nodeOperator := msgbus.NodeOperator{
+		ID:        msgbus.NodeOperatorID(msgbus.GetRandomIDString()),
+		Contracts: map[msgbus.ContractID]msgbus.ContractState{addr: msgbus.ContRunningState},
+	}
+	if _, err := ps.PubWait(msgbus.NodeOperatorMsg, msgbus.IDString(nodeOperator.ID), nodeOperator); err != nil {
+		t.Fatalf("PubWait returned error: %s", err)
+	}
+
+	buyer := BuyerContractManager{
+		Ps:           ps,
+		NodeOperator: nodeOperator,
+		Ctx:          context.Background(),
+	}
+	if err := buyer.removeClosedContract(addr); err != nil {
+		t.Fatalf("removeClosedContract returned error: %s", err)
+	}
+
+	event, err := ps.GetWait(msgbus.NodeOperatorMsg, msgbus.IDString(nodeOperator.ID))
+	if err != nil {
+		t.Fatalf("GetWait returned error: %s", err)
+	}
+	if _, ok := event.Data.(msgbus.NodeOperator).Contracts[addr]; ok {
+		t.Errorf("closed contract still on the node operator: %+v", event.Data)
+	}
+}
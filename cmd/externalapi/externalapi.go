@@ -18,6 +18,8 @@ import (
 type api struct {
 	*gin.Engine
 
+	Ps *msgbus.PubSub
+
 	Config                *msgdata.ConfigInfoRepo
 	ContractManagerConfig *msgdata.ContractManagerConfigRepo
 	Connection            *msgdata.ConnectionRepo
@@ -31,6 +33,7 @@ type api struct {
 func New(ps *msgbus.PubSub, connectionCollection interfaces.IConnectionController) *api {
 	api := &api{
 		Engine:                gin.Default(),
+		Ps:                    ps,
 		Config:                msgdata.NewConfigInfo(ps),
 		ContractManagerConfig: msgdata.NewContractManagerConfig(ps),
 		Connection:            msgdata.NewConnection(ps),
@@ -125,6 +128,11 @@ func (api *api) Run(port string, l *log.Logger) {
 		nodeOperatorRoutes.DELETE("/:id", handlers.NodeOperatorDELETE(api.NodeOperator))
 	}
 
+	msgbusRoutes := api.Group("/msgbus")
+	{
+		msgbusRoutes.GET("/stats", handlers.MsgBusStatsGET(api.Ps))
+	}
+
 	server := &http.Server{
 		Addr:              fmt.Sprintf(":%s", port),
 		Handler:           api,
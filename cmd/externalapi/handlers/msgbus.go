@@ -0,0 +1,14 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	"github.com/gin-gonic/gin"
+)
+
+func MsgBusStatsGET(ps *msgbus.PubSub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, ps.Stats())
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/daniel-888/proxy-router/cmd/config"
+	"github.com/daniel-888/proxy-router/cmd/log"
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	"github.com/daniel-888/proxy-router/cmd/protocol/minerauth"
+	"github.com/daniel-888/proxy-router/cmd/protocol/stratumv1"
+	"github.com/daniel-888/proxy-router/cmd/protocol/stratumv2"
+	"github.com/daniel-888/proxy-router/lumerinlib"
+)
+
+// The default Dest of a listener with a pool of its own is published under
+// this prefix and the listener name
+const listenerDestPrefix = "ListenerDestID:"
+
+//
+// publishDest()
+// Adds the Dest to the msgbus. A persisted bus may already hold it, the
+// config file wins.
+//
+func publishDest(ps *msgbus.PubSub, dest *msgbus.Dest) (err error) {
+	var event *msgbus.Event
+	if ps.DestExistsWait(dest.ID) {
+		event, err = ps.SetWait(msgbus.DestMsg, msgbus.IDString(dest.ID), dest)
+	} else {
+		event, err = ps.PubWait(msgbus.DestMsg, msgbus.IDString(dest.ID), dest)
+	}
+	if err != nil {
+		return err
+	}
+	return event.Err
+}
+
+//
+// newMinerAuth()
+// The Authenticator of an auth policy, nil accepts every miner
+//
+func newMinerAuth(l *log.Logger, c config.AuthConfig) minerauth.Authenticator {
+	auth, err := minerauth.New(minerauth.Config{
+		Methods:       c.Methods,
+		AllowlistFile: c.AllowlistFile,
+		CIDRs:         c.CIDRs,
+		WorkerRegex:   c.WorkerRegex,
+		URL:           c.URL,
+		Timeout:       time.Duration(c.Timeout) * time.Second,
+	})
+	if err != nil {
+		l.Logf(log.LevelFatal, "Miner authentication failed: %v", err)
+	}
+	if auth == nil {
+		l.Logf(log.LevelWarn, "No miner authentication configured, every miner is accepted")
+	}
+	return auth
+}
+
+//
+// startStratumv1()
+// Fires up a StratumV1 listener, over TLS for the stratumv1+tls protocol
+//
+func startStratumv1(ctx context.Context, l *log.Logger, listener config.ListenerConfig, dest *msgbus.Dest, auth minerauth.Authenticator, configs config.ConfigRead) {
+
+	var src net.Addr
+	if listener.Protocol == config.ProtocolStratumv1TLS {
+		cert, err := tls.LoadX509KeyPair(listener.TLSCertFile, listener.TLSKeyFile)
+		if err != nil {
+			l.Logf(log.LevelFatal, "TLS listener %s certificate failed: %v", listener.Name, err)
+		}
+		src = lumerinlib.NewTLSListenAddr(listener.Listen, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+	} else {
+		addr, err := net.ResolveTCPAddr("tcp", listener.Listen)
+		if err != nil {
+			l.Logf(log.LevelPanic, "Listener %s address %s failed: %v", listener.Name, listener.Listen, err)
+		}
+		src = addr
+	}
+
+	if listener.ProxyProtocol {
+		src = lumerinlib.NewProxyListenAddr(src)
+	}
+
+	l.Logf(log.LevelInfo, "Listening for stratum messages on %s %v for listener %s, default pool %s\n\n", src.Network(), src.String(), listener.Name, dest.ID)
+
+	stratum, err := stratumv1.NewListener(ctx, src, dest)
+	if err != nil {
+		panic(fmt.Sprintf("Stratum Protocol New() failed:%s", err))
+	}
+
+	switch strings.ToLower(listener.Scheduler) {
+	case "ondemand":
+		stratum.SetScheduler(stratumv1.OnDemand)
+	case "onsubmit":
+		stratum.SetScheduler(stratumv1.OnSubmit)
+	default:
+		l.Logf(log.LevelPanic, "Scheduler value: %s Not Supported", listener.Scheduler)
+	}
+
+	if configs.VardiffInterval > 0 {
+		stratum.SetVardiff(&stratumv1.VardiffConfig{
+			ShareInterval:  time.Duration(configs.VardiffInterval) * time.Second,
+			RetargetWindow: time.Duration(configs.VardiffWindow) * time.Second,
+		})
+	}
+
+	stratum.SetAuthenticator(auth)
+	stratum.Run()
+}
+
+//
+// startStratumv2()
+// Fires up a StratumV2 listener
+//
+func startStratumv2(ctx context.Context, l *log.Logger, listener config.ListenerConfig, dest *msgbus.Dest, auth minerauth.Authenticator, configs config.ConfigRead) {
+
+	src, err := net.ResolveTCPAddr("tcp", listener.Listen)
+	if err != nil {
+		l.Logf(log.LevelPanic, "Listener %s address %s failed: %v", listener.Name, listener.Listen, err)
+	}
+
+	l.Logf(log.LevelInfo, "Listening for stratum v2 messages on %v for listener %s, default pool %s\n\n", src.String(), listener.Name, dest.ID)
+
+	var listenAddr net.Addr = src
+	if listener.ProxyProtocol {
+		listenAddr = lumerinlib.NewProxyListenAddr(src)
+	}
+
+	stratum, err := stratumv2.NewListener(ctx, listenAddr, dest)
+	if err != nil {
+		panic(fmt.Sprintf("StratumV2 Protocol New() failed:%s", err))
+	}
+
+	switch strings.ToLower(listener.Scheduler) {
+	case "ondemand":
+		stratum.SetScheduler(stratumv2.OnDemand)
+	case "onsubmit":
+		stratum.SetScheduler(stratumv2.OnSubmit)
+	default:
+		l.Logf(log.LevelPanic, "Scheduler value: %s Not Supported", listener.Scheduler)
+	}
+
+	if configs.Stratumv2AuthKey != "" {
+		key, err := hex.DecodeString(configs.Stratumv2AuthKey)
+		if err == nil {
+			err = stratum.SetAuthorityKey(key)
+		}
+		if err != nil {
+			l.Logf(log.LevelPanic, "StratumV2 authority key failed: %v", err)
+		}
+	} else {
+		l.Logf(log.LevelWarn, "No StratumV2 authority key configured, using a random key")
+	}
+	l.Logf(log.LevelInfo, "StratumV2 authority public key: %s", hex.EncodeToString(stratum.AuthorityPubKey()))
+
+	stratum.SetAuthenticator(auth)
+	stratum.Run()
+}
@@ -128,6 +128,7 @@ const MsgUnpublishEvent EventType = EventType(msgbus.UnpublishEvent)
 const MsgSubscribedEvent EventType = EventType(msgbus.SubscribedEvent)
 const MsgUnsubscribedEvent EventType = EventType(msgbus.UnsubscribedEvent)
 const MsgRemovedEvent EventType = EventType(msgbus.RemovedEvent)
+const MsgStreamEvent EventType = EventType(msgbus.StreamEvent)
 const ConnOpenEvent EventType = "connopen"
 const ConnReadEvent EventType = "connread"
 const ConnEOFEvent EventType = "conneof"
@@ -466,15 +467,15 @@ func (s *SimpleStruct) Cancel() {
 	//
 	// Close all channles if they are still open
 	//
+	// The msgbus stops delivering to the channel and closes it
+	if s.msgbus != nil {
+		s.msgbus.RemoveAndCloseEventChan(s.msgbusChan)
+	}
 	var ok bool
 	_, ok = <-s.eventChan
 	if ok {
 		close(s.eventChan)
 	}
-	_, ok = <-s.msgbusChan
-	if ok {
-		close(s.msgbusChan)
-	}
 	_, ok = <-s.openChan
 	if ok {
 		close(s.openChan)
@@ -532,6 +533,15 @@ func (s *SimpleStruct) AsyncDial(dest *msgbus.Dest) (e error) {
 // Reconnect dropped connection
 //
 func (s *SimpleStruct) AsyncReDial(uid ConnUniqueID) error {
+	return s.AsyncReDialDest(uid, nil, 0)
+}
+
+//
+// AsyncReDialDest
+// Reconnect the connection to a new Dest after wait, the open event carries
+// the Dest. A nil dest redials the same address.
+//
+func (s *SimpleStruct) AsyncReDialDest(uid ConnUniqueID, dest *msgbus.Dest, wait time.Duration) error {
 
 	contextlib.Logf(s.ctx, contextlib.LevelTrace, lumerinlib.FileLineFunc()+" called UID:%d", uid)
 
@@ -542,21 +552,35 @@ func (s *SimpleStruct) AsyncReDial(uid ConnUniqueID) error {
 		return errors.New(lumerinlib.FileLineFunc() + " SimpleStruct.ConnectionStruct == nil ")
 	}
 
+	var addr net.Addr
+	if dest != nil {
+		var e error
+		addr, e = dest.NetAddr()
+		if e != nil {
+			return e
+		}
+	}
+
+	//
+	// Keep from redialing too quickly.
+	//
+	if min := time.Duration(reDialTimeDealySec) * time.Second; wait < min {
+		wait = min
+	}
+
 	go func() {
 
-		//
-		// Keep from redialing too quickly.
-		//
-		<-time.After(time.Duration(reDialTimeDealySec) * time.Second)
+		<-time.After(wait)
 
-		e := s.ConnectionStruct.ReDialIdx(int(uid))
+		e := s.ConnectionStruct.ReDialIdxAddr(int(uid), addr)
 		if e != nil {
 			contextlib.Logf(s.ctx, contextlib.LevelError, lumerinlib.FileLineFunc()+"UID:%d (re)Dial error:%s", uid, e)
 		}
 
 		open := &SimpleConnOpenEvent{
-			uID: ConnUniqueID(uid),
-			err: e,
+			uID:  ConnUniqueID(uid),
+			dest: dest,
+			err:  e,
 		}
 
 		if !s.Done() {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 
 	"github.com/daniel-888/proxy-router/cmd/lumerinnetwork/lumerinconnection"
 	"github.com/daniel-888/proxy-router/lumerinlib"
@@ -46,6 +47,7 @@ type ConnectionListenStruct struct {
 // Struct for existing SRC connections and the associated outgoing DST connections
 type ConnectionStruct struct {
 	src      *lumerinconnection.LumerinSocketStruct
+	dstmu    sync.Mutex // Held to change dst, and to read it off the protocol go routine
 	dst      map[int]*lumerinconnection.LumerinSocketStruct
 	defidx   int
 	ctx      context.Context
@@ -177,7 +179,7 @@ FORLOOP:
 			}
 
 			cls.accept <- cs
-			go cs.goRead(SrcIdx)
+			go cs.goRead(SrcIdx, l)
 		}
 	}
 
@@ -219,20 +221,16 @@ func (cls *ConnectionListenStruct) Cancel() {
 
 //
 // func (cs *ConnectionStruct) goRead()
-// Reads from the lumerinconnection socket, packages it up and passes it to the readChan
+// Reads from the lumerinconnection socket l of index, packages it up and passes it to the readChan
 //
-func (cs *ConnectionStruct) goRead(index int) {
+func (cs *ConnectionStruct) goRead(index int, l *lumerinconnection.LumerinSocketStruct) {
 
 	//	contextlib.Logf(cs.ctx, contextlib.LevelTrace, fmt.Sprint(lumerinlib.FileLineFunc()+" enter - %d", index))
 
-	var l *lumerinconnection.LumerinSocketStruct
-
 	var name string
 	if index < 0 {
-		l = cs.src
 		name = "SRC"
 	} else {
-		l = cs.dst[index]
 		name = fmt.Sprintf("DST:%d", index)
 	}
 
@@ -268,6 +266,12 @@ FORLOOP:
 		//
 		if e != nil {
 
+			// A redial replaced the socket, its own reader carries on
+			if index >= 0 && cs.getDst(index) != l {
+				contextlib.Logf(cs.ctx, contextlib.LevelInfo, fmt.Sprintf(lumerinlib.FileLineFunc()+" %s replaced socket closed", name))
+				return
+			}
+
 			//
 			// Notate the error Here
 			//
@@ -340,9 +344,11 @@ func (cs *ConnectionStruct) Close() {
 
 	// Close out all of the Lumerin connections
 	cs.src.Close()
+	cs.dstmu.Lock()
 	for i := 0; i < len(cs.dst); i++ {
 		cs.dst[i].Close()
 	}
+	cs.dstmu.Unlock()
 
 	cs.Cancel() // This should close all open src and dst connections
 
@@ -395,8 +401,8 @@ func (cs *ConnectionStruct) Dial(addr net.Addr) (idx int, e error) {
 		contextlib.Logf(cs.ctx, contextlib.LevelPanic, lumerinlib.FileLineFunc()+" cannot be here, idx:%d", idx)
 	}
 
-	cs.dst[idx] = dst
-	go cs.goRead(idx)
+	cs.setDst(idx, dst)
+	go cs.goRead(idx, dst)
 
 	return idx, nil
 }
@@ -439,6 +445,14 @@ func (cs *ConnectionStruct) GetRemoteAddrIdx(idx int) (addr net.Addr, e error) {
 // It is used in case a connection is severed
 //
 func (cs *ConnectionStruct) ReDialIdx(idx int) (e error) {
+	return cs.ReDialIdxAddr(idx, nil)
+}
+
+//
+// ReDialIdxAddr() reconnects the dst slot to addr, or to the address it was
+// dialed with when addr is nil
+//
+func (cs *ConnectionStruct) ReDialIdxAddr(idx int, addr net.Addr) (e error) {
 
 	if cs == nil {
 		panic("ConnectionStruct is nil...")
@@ -462,15 +476,21 @@ func (cs *ConnectionStruct) ReDialIdx(idx int) (e error) {
 		contextlib.Logf(cs.ctx, contextlib.LevelPanic, lumerinlib.FileLineFunc()+" cannot be here, idx:%d", idx)
 	}
 
-	addr, e := cs.dst[idx].GetRemoteAddr()
-	if e != nil {
-		contextlib.Logf(cs.ctx, contextlib.LevelError, lumerinlib.FileLineFunc()+" GetRemoteAddr() IDX:%d, error:%s", idx, e)
-		return ErrConnMgrBadDest
+	if addr == nil {
+		addr, e = cs.dst[idx].GetDialAddr()
+		if e != nil {
+			contextlib.Logf(cs.ctx, contextlib.LevelError, lumerinlib.FileLineFunc()+" GetDialAddr() IDX:%d, error:%s", idx, e)
+			return ErrConnMgrBadDest
+		}
 	}
 
-	if !cs.dst[idx].Done() {
-		cs.dst[idx].Close()
-	}
+	// The old socket is closed once replaced, so its reader goes quietly
+	old := cs.dst[idx]
+	defer func() {
+		if !old.Done() {
+			old.Close()
+		}
+	}()
 
 	dst, e := lumerinconnection.Dial(cs.ctx, addr)
 	if e != nil {
@@ -478,7 +498,8 @@ func (cs *ConnectionStruct) ReDialIdx(idx int) (e error) {
 		return e
 	}
 
-	cs.dst[idx] = dst
+	cs.setDst(idx, dst)
+	go cs.goRead(idx, dst)
 
 	return nil
 }
@@ -781,11 +802,28 @@ func (cs *ConnectionStruct) IdxClose(idx int) (e error) {
 	}
 
 	e = cs.dst[idx].Close()
-	cs.dst[idx] = nil
+	cs.setDst(idx, nil)
 
 	return e
 }
 
+//
+// getDst() and setDst()
+// The protocol go routine is the only one changing dst, and reads it freely.
+// The read go routines and Close() hold dstmu to read it.
+//
+func (cs *ConnectionStruct) getDst(idx int) *lumerinconnection.LumerinSocketStruct {
+	cs.dstmu.Lock()
+	defer cs.dstmu.Unlock()
+	return cs.dst[idx]
+}
+
+func (cs *ConnectionStruct) setDst(idx int, dst *lumerinconnection.LumerinSocketStruct) {
+	cs.dstmu.Lock()
+	defer cs.dstmu.Unlock()
+	cs.dst[idx] = dst
+}
+
 //
 //
 //
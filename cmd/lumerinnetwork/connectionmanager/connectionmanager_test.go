@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"net"
 	"testing"
 	"time"
 
@@ -245,6 +246,70 @@ func TestSrcIdxDstDial(t *testing.T) {
 
 }
 
+//
+// A redialed slot reads from the new socket, and the reader of the replaced
+// one goes without reporting an error
+//
+func TestReDialIdxAddr(t *testing.T) {
+
+	ctx := context.Background()
+	ctxs := &contextlib.ContextStruct{}
+	ctxs.SetLog(log.New())
+	ctx = context.WithValue(ctx, contextlib.ContextKey, ctxs)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cs := &ConnectionStruct{
+		dst:      map[int]*lumerinconnection.LumerinSocketStruct{},
+		defidx:   -1,
+		ctx:      ctx,
+		cancel:   cancel,
+		readChan: make(chan *ConnectionReadEvent, DefaultReadEventChanSize),
+	}
+
+	var pools [2]net.Listener
+	for i := range pools {
+		pool, e := net.Listen("tcp", "127.0.0.1:0")
+		if e != nil {
+			t.Fatalf("Listen() error:%s", e)
+		}
+		defer pool.Close()
+		pools[i] = pool
+	}
+
+	idx, e := cs.Dial(pools[0].Addr())
+	if e != nil {
+		t.Fatalf("Dial() error:%s", e)
+	}
+	old, e := pools[0].Accept()
+	if e != nil {
+		t.Fatalf("Accept() error:%s", e)
+	}
+	defer old.Close()
+
+	if e = cs.ReDialIdxAddr(idx, pools[1].Addr()); e != nil {
+		t.Fatalf("ReDialIdxAddr() error:%s", e)
+	}
+	redialed, e := pools[1].Accept()
+	if e != nil {
+		t.Fatalf("Accept() error:%s", e)
+	}
+	defer redialed.Close()
+
+	if _, e = redialed.Write([]byte(TestString)); e != nil {
+		t.Fatalf("Write() error:%s", e)
+	}
+
+	select {
+	case event := <-cs.GetReadChan():
+		if event.Index() != idx || event.Err() != nil || string(event.Data()) != TestString {
+			t.Errorf("read event index:%d data:%q error:%v", event.Index(), event.Data(), event.Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no read event from the redialed socket")
+	}
+}
+
 // ---------------------------------------------------------------------------------------------------
 
 //
@@ -29,12 +29,14 @@ const LumerinReadChannelLen int = 10
 
 var ErrLumConListenClosed = errors.New("Lumerin Connection Listen Socket closed")
 var ErrLumConSocketClosed = errors.New("Lumerin Connection Listen Socket closed")
+var ErrLumConBadTLSAddr = errors.New("Lumerin Connection TLS address without TLS options")
 
 type LumProto string
 
 const TCP LumProto = "tcp"
 const TCP4 LumProto = "tcp4"
 const TCP6 LumProto = "tcp6"
+const TLS LumProto = "tls"
 const UDP LumProto = "udp"
 const UDP4 LumProto = "udp4"
 const UDP6 LumProto = "udp6"
@@ -99,6 +101,12 @@ func NewListen(ctx context.Context, addr net.Addr) (l *LumerinListenStruct, e er
 
 	ctx, cancel := context.WithCancel(ctx)
 
+	proxy := false
+	if proxyaddr, ok := addr.(*lumerinlib.ProxyListenAddr); ok {
+		addr = proxyaddr.Addr
+		proxy = true
+	}
+
 	proto := addr.Network()
 	ipaddr := addr.String()
 
@@ -117,6 +125,33 @@ func NewListen(ctx context.Context, addr net.Addr) (l *LumerinListenStruct, e er
 		if e != nil {
 			contextlib.Logf(ctx, contextlib.LevelError, lumerinlib.FileLineFunc()+" NewListen() error:%s", e)
 		} else {
+			if proxy {
+				tcp.SetProxyProtocol()
+			}
+			accept := make(chan *LumerinSocketStruct)
+			l = &LumerinListenStruct{
+				ctx:      ctx,
+				cancel:   cancel,
+				listener: tcp,
+				accept:   accept,
+			}
+		}
+
+	case TLS:
+		tlsaddr, ok := addr.(*lumerinlib.TLSNetAddr)
+		if !ok {
+			contextlib.Logf(ctx, contextlib.LevelError, lumerinlib.FileLineFunc()+" TLS address type:%T not supported", addr)
+			cancel()
+			return nil, ErrLumConBadTLSAddr
+		}
+		var tcp *sockettcp.ListenTCPStruct
+		tcp, e = sockettcp.NewListenTLS(ctx, string(TCP), ipaddr, tlsaddr.Config)
+		if e != nil {
+			contextlib.Logf(ctx, contextlib.LevelError, lumerinlib.FileLineFunc()+" NewListenTLS() error:%s", e)
+		} else {
+			if proxy {
+				tcp.SetProxyProtocol()
+			}
 			accept := make(chan *LumerinSocketStruct)
 			l = &LumerinListenStruct{
 				ctx:      ctx,
@@ -331,6 +366,26 @@ func Dial(ctx context.Context, addr net.Addr) (lci *LumerinSocketStruct, e error
 			remoteaddr: addr,
 		}
 
+	case TLS:
+		tlsaddr, ok := addr.(*lumerinlib.TLSNetAddr)
+		if !ok {
+			contextlib.Logf(ctx, contextlib.LevelError, lumerinlib.FileLineFunc()+" TLS address type:%T not supported", addr)
+			return nil, ErrLumConBadTLSAddr
+		}
+		var tcp *sockettcp.SocketTCPStruct
+		tcp, e = sockettcp.DialTLS(ctx, string(TCP), ipaddr, sockettcp.ClientTLSConfig(tlsaddr.ServerName, tlsaddr.Pins))
+		if e != nil {
+			contextlib.Logf(ctx, contextlib.LevelError, lumerinlib.FileLineFunc()+" DialTLS() error returned: %v", e)
+			return nil, e
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		lci = &LumerinSocketStruct{
+			ctx:        ctx,
+			cancel:     cancel,
+			socket:     tcp,
+			remoteaddr: addr,
+		}
+
 	case UDP:
 		fallthrough
 	case UDP4:
@@ -496,6 +551,20 @@ func (l *LumerinSocketStruct) GetRemoteAddr() (addr net.Addr, e error) {
 	// return l.remoteaddr
 }
 
+//
+// GetDialAddr()
+// The address the socket was dialed with, a TLS address keeps its options
+// for the redial
+//
+func (l *LumerinSocketStruct) GetDialAddr() (addr net.Addr, e error) {
+
+	if l.remoteaddr == nil {
+		return nil, ErrLumConSocketClosed
+	}
+
+	return l.remoteaddr, nil
+}
+
 //
 //
 //
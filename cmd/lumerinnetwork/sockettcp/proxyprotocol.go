@@ -0,0 +1,273 @@
+package sockettcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daniel-888/proxy-router/lumerinlib"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+//
+// PROXY protocol
+// Listeners behind a TCP load balancer read the HAProxy PROXY protocol v1
+// or v2 header the balancer sends ahead of every connection, and report
+// the client address it carries as the connection's RemoteAddr. Connections
+// without a valid header are dropped. The headers are read off the raw
+// connections, before TLS, each in its own go routine so a slow one holds
+// up no other.
+//
+
+const ProxyHeaderTimeout = 5 * time.Second
+
+const proxyV1MaxLen = 107 // "PROXY TCP6 " with the longest addresses and "\r\n"
+
+var ErrSocTCPBadProxyHeader = errors.New("socket TCP: bad PROXY protocol header")
+
+var proxyV1Prefix = []byte("PROXY ")
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//
+// proxyListener hands out the accepted connections once their header is read
+//
+type proxyListener struct {
+	net.Listener
+	ctx   context.Context
+	conns chan net.Conn
+	done  chan struct{}
+	err   error // Set before done is closed
+}
+
+//
+// proxyConn reads what follows the header, and reports the client address
+//
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(buf []byte) (int, error) {
+	return c.reader.Read(buf)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+//
+// newProxyListener()
+//
+func newProxyListener(ctx context.Context, listener net.Listener) (l *proxyListener) {
+	l = &proxyListener{
+		Listener: listener,
+		ctx:      ctx,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.goAccept()
+	return l
+}
+
+//
+// Accept()
+//
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+//
+// goAccept() accepts the connections and reads their header until the
+// listener closes
+//
+func (l *proxyListener) goAccept() {
+	for {
+		conn, e := l.Listener.Accept()
+		if e != nil {
+			l.err = e
+			close(l.done)
+			return
+		}
+		go l.goReadHeader(conn)
+	}
+}
+
+//
+// goReadHeader()
+//
+func (l *proxyListener) goReadHeader(conn net.Conn) {
+
+	conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+	pconn, e := readProxyHeader(conn)
+	if e != nil {
+		contextlib.Logf(l.ctx, contextlib.LevelWarn, lumerinlib.FileLineFunc()+" dropping connection from %s: %s", conn.RemoteAddr(), e)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	contextlib.Logf(l.ctx, contextlib.LevelDebug, lumerinlib.FileLineFunc()+" connection from %s for %s", conn.RemoteAddr(), pconn.RemoteAddr())
+
+	select {
+	case l.conns <- pconn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+//
+// readProxyHeader()
+// Reads a v1 or v2 header off conn. The connection keeps its own address
+// when the header carries none: v1 UNKNOWN, v2 LOCAL or a v2 family other
+// than TCP over IPv4 or IPv6.
+//
+func readProxyHeader(conn net.Conn) (pconn *proxyConn, e error) {
+
+	pconn = &proxyConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+		remote: conn.RemoteAddr(),
+	}
+
+	sig, e := pconn.reader.Peek(len(proxyV2Signature))
+	if e != nil {
+		return nil, e
+	}
+
+	var remote net.Addr
+	switch {
+	case bytes.HasPrefix(sig, proxyV1Prefix):
+		remote, e = readProxyV1(pconn.reader)
+	case bytes.Equal(sig, proxyV2Signature):
+		remote, e = readProxyV2(pconn.reader)
+	default:
+		e = ErrSocTCPBadProxyHeader
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	if remote != nil {
+		pconn.remote = remote
+	}
+
+	return pconn, nil
+}
+
+//
+// readProxyV1()
+// "PROXY TCP4|TCP6 <src ip> <dst ip> <src port> <dst port>\r\n" or
+// "PROXY UNKNOWN ...\r\n"
+//
+func readProxyV1(r *bufio.Reader) (remote net.Addr, e error) {
+
+	var line []byte
+	for len(line) <= proxyV1MaxLen {
+		var b byte
+		if b, e = r.ReadByte(); e != nil {
+			return nil, e
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrSocTCPBadProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, ErrSocTCPBadProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	dst := net.ParseIP(fields[3])
+	if ip == nil || dst == nil {
+		return nil, ErrSocTCPBadProxyHeader
+	}
+	switch fields[1] {
+	case "TCP4":
+		if ip.To4() == nil || dst.To4() == nil {
+			return nil, ErrSocTCPBadProxyHeader
+		}
+	case "TCP6":
+		if ip.To4() != nil || dst.To4() != nil {
+			return nil, ErrSocTCPBadProxyHeader
+		}
+	default:
+		return nil, ErrSocTCPBadProxyHeader
+	}
+
+	port, e := strconv.ParseUint(fields[4], 10, 16)
+	if e != nil {
+		return nil, ErrSocTCPBadProxyHeader
+	}
+	if _, e = strconv.ParseUint(fields[5], 10, 16); e != nil {
+		return nil, ErrSocTCPBadProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+//
+// readProxyV2()
+// The 16 byte header, then the addresses and TLVs, which are skipped
+//
+func readProxyV2(r *bufio.Reader) (remote net.Addr, e error) {
+
+	header := make([]byte, 16)
+	if _, e = io.ReadFull(r, header); e != nil {
+		return nil, e
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, ErrSocTCPBadProxyHeader
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, e = io.ReadFull(r, payload); e != nil {
+		return nil, e
+	}
+
+	switch command {
+	case 0x0: // LOCAL, the balancer's own health check
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, ErrSocTCPBadProxyHeader
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, ErrSocTCPBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, ErrSocTCPBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
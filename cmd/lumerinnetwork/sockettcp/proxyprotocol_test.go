@@ -0,0 +1,154 @@
+package sockettcp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+
+	v2 := func(command byte, family byte, payload ...byte) string {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|command, family, byte(len(payload)>>8), byte(len(payload)))
+		return string(append(header, payload...))
+	}
+	v2tcp4 := []byte{192, 0, 2, 7, 10, 0, 0, 1, 0x0f, 0xa1, 0x0d, 0x05}
+	v2tcp6 := make([]byte, 36)
+	copy(v2tcp6, net.ParseIP("2001:db8::7"))
+	copy(v2tcp6[16:], net.ParseIP("2001:db8::1"))
+	v2tcp6[32], v2tcp6[33] = 0x0f, 0xa1
+
+	tests := []struct {
+		header string
+		remote string // "" keeps the connection's address
+		ok     bool
+	}{
+		{"PROXY TCP4 192.0.2.7 10.0.0.1 4001 3333\r\n", "192.0.2.7:4001", true},
+		{"PROXY TCP6 2001:db8::7 2001:db8::1 4001 3333\r\n", "[2001:db8::7]:4001", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY TCP4 192.0.2.7 10.0.0.1 4001 3333\n", "", false},
+		{"PROXY TCP4 2001:db8::7 10.0.0.1 4001 3333\r\n", "", false},
+		{"PROXY TCP4 192.0.2.7 10.0.0.1 70000 3333\r\n", "", false},
+		{"PROXY TCP4 192.0.2.7 10.0.0.1 4001\r\n", "", false},
+		{"PROXY UDP4 192.0.2.7 10.0.0.1 4001 3333\r\n", "", false},
+		{v2(0x1, 0x11, v2tcp4...), "192.0.2.7:4001", true},
+		{v2(0x1, 0x11, append(v2tcp4, 0x03, 0x00, 0x04, 1, 2, 3, 4)...), "192.0.2.7:4001", true}, // with a TLV
+		{v2(0x1, 0x21, v2tcp6...), "[2001:db8::7]:4001", true},
+		{v2(0x0, 0x00), "", true},
+		{v2(0x1, 0x31, make([]byte, 216)...), "", true}, // AF_UNIX
+		{v2(0x1, 0x11, v2tcp4[:8]...), "", false},
+		{v2(0x2, 0x11, v2tcp4...), "", false},
+		{`{"id":1,"method":"mining.subscribe","params":[]}`, "", false},
+	}
+
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(test.header + "next"))
+		}()
+		server.SetDeadline(time.Now().Add(time.Second))
+
+		pconn, e := readProxyHeader(server)
+		if (e == nil) != test.ok {
+			t.Errorf("readProxyHeader(%q) error:%v", test.header, e)
+		}
+		if e == nil {
+			remote := test.remote
+			if remote == "" {
+				remote = server.RemoteAddr().String()
+			}
+			if pconn.RemoteAddr().String() != remote {
+				t.Errorf("readProxyHeader(%q) remote:%s want:%s", test.header, pconn.RemoteAddr(), remote)
+			}
+			buf := make([]byte, 4)
+			if n, e := pconn.Read(buf); e != nil || string(buf[:n]) != "next" {
+				t.Errorf("readProxyHeader(%q) then read:%q error:%v", test.header, buf[:n], e)
+			}
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+//
+// The listener reports the address of the header, over TLS too, and drops
+// the connections without one
+//
+func TestProxyProtocolListen(t *testing.T) {
+
+	cert, _ := newTestCert(t)
+
+	for _, tlsconfig := range []*tls.Config{nil, {Certificates: []tls.Certificate{cert}}} {
+
+		ctx, _ := contextlib.CreateNewContext(context.Background())
+		addr := fmt.Sprintf("127.0.0.1:%d", getRandPort())
+
+		var l *ListenTCPStruct
+		var e error
+		if tlsconfig == nil {
+			l, e = NewListen(ctx, "tcp", addr)
+		} else {
+			l, e = NewListenTLS(ctx, "tcp", addr, tlsconfig)
+		}
+		if e != nil {
+			t.Fatalf("NewListen() error:%s", e)
+		}
+		defer l.Cancel()
+		defer l.Close()
+		l.SetProxyProtocol()
+		l.Run()
+
+		dial := func(header string) net.Conn {
+			conn, e := net.Dial("tcp", addr)
+			if e != nil {
+				t.Fatalf("Dial() error:%s", e)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, e = conn.Write([]byte(header)); e != nil {
+				t.Fatalf("Write() error:%s", e)
+			}
+			if tlsconfig != nil {
+				conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+			}
+			return conn
+		}
+
+		// No header, dropped without holding up the next one
+		bad := dial(TestString)
+		defer bad.Close()
+
+		good := dial("PROXY TCP4 192.0.2.7 10.0.0.1 4001 3333\r\n")
+		defer good.Close()
+		go good.Write([]byte(TestString))
+
+		var s *SocketTCPStruct
+		select {
+		case accepted := <-l.GetAcceptChan():
+			s = accepted.(*SocketTCPStruct)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no connection accepted, TLS:%t", tlsconfig != nil)
+		}
+		defer s.Close()
+
+		remote, e := s.RemoteAddr()
+		if e != nil || remote.String() != "192.0.2.7:4001" {
+			t.Errorf("RemoteAddr() got:%v error:%v, TLS:%t", remote, e, tlsconfig != nil)
+		}
+		buf := make([]byte, len(TestString))
+		if n, e := s.Read(buf); e != nil || string(buf[:n]) != TestString {
+			t.Errorf("Read() got:%q error:%v, TLS:%t", buf[:n], e, tlsconfig != nil)
+		}
+
+		select {
+		case accepted := <-l.GetAcceptChan():
+			t.Errorf("accepted a connection without a header:%v", accepted)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
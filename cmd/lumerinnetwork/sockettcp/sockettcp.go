@@ -2,6 +2,7 @@ package sockettcp
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
@@ -28,6 +29,7 @@ var ErrSocTCPListerClosed = errors.New("socket TCP: Listener closed")
 var ErrSocTCPClosed = errors.New("socket TCP: socket closed")
 var ErrSocTCPBadNetwork = errors.New("socket TCP: bad network protocol")
 var ErrSocTCPEmtpyWriteBuf = errors.New("socket TCP: Emtpy Write Buffer")
+var ErrSocTCPNoTLSConfig = errors.New("socket TCP: no TLS config")
 
 //
 // ----------------
@@ -49,11 +51,13 @@ type ListenerStatusStruct struct {
 //
 
 type ListenTCPStruct struct {
-	listener net.Listener
-	ctx      context.Context
-	cancel   func()
-	accept   chan interface{}
-	status   ListenerStatusStruct
+	listener  net.Listener
+	ctx       context.Context
+	cancel    func()
+	accept    chan interface{}
+	status    ListenerStatusStruct
+	tlsconfig *tls.Config // Serves TLS if set
+	proxy     bool        // Connections start with a PROXY protocol header
 }
 
 type SocketTCPStruct struct {
@@ -146,9 +150,27 @@ func NewListen(ctx context.Context, network string, addr string) (l *ListenTCPSt
 //
 func (l *ListenTCPStruct) Run() {
 	//	contextlib.Logf(l.ctx, contextlib.LevelTrace, lumerinlib.FileLineFunc()+" called")
+
+	// The PROXY protocol header comes ahead of the TLS handshake
+	if l.proxy {
+		l.listener = newProxyListener(l.ctx, l.listener)
+	}
+	if l.tlsconfig != nil {
+		l.listener = tls.NewListener(l.listener, l.tlsconfig)
+	}
+
 	go l.goListenAccept()
 }
 
+//
+// SetProxyProtocol()
+// Has the listener read a PROXY protocol v1 or v2 header off every
+// connection and report the client address it carries, before Run()
+//
+func (l *ListenTCPStruct) SetProxyProtocol() {
+	l.proxy = true
+}
+
 //
 //
 //
@@ -275,6 +297,24 @@ func (s *ListenTCPStruct) Done() bool {
 // or returns an error
 //
 func Dial(ctx context.Context, network string, addr string) (s *SocketTCPStruct, e error) {
+	return dial(ctx, network, addr, nil)
+}
+
+//
+// DialTLS() creates a new TLS connection to the target address, the
+// handshake is done before it returns
+//
+func DialTLS(ctx context.Context, network string, addr string, config *tls.Config) (s *SocketTCPStruct, e error) {
+	if config == nil {
+		return nil, ErrSocTCPNoTLSConfig
+	}
+	return dial(ctx, network, addr, config)
+}
+
+//
+// dial() config nil dials plain TCP
+//
+func dial(ctx context.Context, network string, addr string, config *tls.Config) (s *SocketTCPStruct, e error) {
 
 	contextlib.Logf(ctx, contextlib.LevelTrace, lumerinlib.FileLineFunc()+" called")
 
@@ -302,6 +342,10 @@ func Dial(ctx context.Context, network string, addr string) (s *SocketTCPStruct,
 	var d net.Dialer
 	conn, e = d.DialContext(dialctx, network, addr)
 
+	if e == nil && config != nil {
+		conn, e = handshake(dialctx, conn, config)
+	}
+
 	if e != nil {
 		contextlib.Logf(ctx, contextlib.LevelError, lumerinlib.FileLineFunc()+" DialContext Error:%s", e)
 		_ = cancel
@@ -0,0 +1,141 @@
+package sockettcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/daniel-888/proxy-router/lumerinlib"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+//
+// TLS
+// Listeners wrap accepted connections in TLS, the handshake happens on the
+// first Read(). Dialed connections finish the handshake in Dial, checking
+// the server against the root CAs, or against certificate pins if the
+// address has any.
+//
+
+var ErrSocTCPPinMismatch = errors.New("socket TCP: server certificate does not match a pin")
+
+var rootCAsMutex sync.RWMutex
+var rootCAs *x509.CertPool // nil uses the system roots
+
+//
+// SetRootCAs() sets the CAs dialed TLS servers are checked against,
+// nil uses the system roots
+//
+func SetRootCAs(pool *x509.CertPool) {
+	rootCAsMutex.Lock()
+	defer rootCAsMutex.Unlock()
+	rootCAs = pool
+}
+
+//
+// LoadRootCAs() returns the system roots plus the PEM certificates in file
+//
+func LoadRootCAs(file string) (pool *x509.CertPool, e error) {
+
+	pem, e := ioutil.ReadFile(file)
+	if e != nil {
+		return nil, e
+	}
+
+	pool, e = x509.SystemCertPool()
+	if e != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("socket TCP: no certificates in %s", file)
+	}
+
+	return pool, nil
+}
+
+//
+// ClientTLSConfig() returns the config to dial serverName with. With pins
+// the chain is not checked, only that the server's key is pinned.
+//
+func ClientTLSConfig(serverName string, pins [][]byte) (config *tls.Config) {
+
+	rootCAsMutex.RLock()
+	defer rootCAsMutex.RUnlock()
+
+	config = &tls.Config{
+		ServerName: serverName,
+		RootCAs:    rootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(pins) > 0 {
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrSocTCPPinMismatch
+			}
+			cert, e := x509.ParseCertificate(rawCerts[0])
+			if e != nil {
+				return e
+			}
+			spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(pin, spki[:]) {
+					return nil
+				}
+			}
+			return ErrSocTCPPinMismatch
+		}
+	}
+
+	return config
+}
+
+//
+// NewListenTLS() opens a listening socket that serves TLS with config
+//
+func NewListenTLS(ctx context.Context, network string, addr string, config *tls.Config) (l *ListenTCPStruct, e error) {
+
+	contextlib.Logf(ctx, contextlib.LevelTrace, lumerinlib.FileLineFunc()+" called")
+
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil) {
+		return nil, ErrSocTCPNoTLSConfig
+	}
+
+	l, e = NewListen(ctx, network, addr)
+	if e != nil {
+		return l, e
+	}
+
+	l.tlsconfig = config
+
+	return l, e
+}
+
+//
+// handshake() runs the client side of the TLS handshake on conn
+//
+func handshake(ctx context.Context, conn net.Conn, config *tls.Config) (tlsconn net.Conn, e error) {
+
+	c := tls.Client(conn, config)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	e = c.Handshake()
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	c.SetDeadline(time.Time{})
+
+	return c, nil
+}
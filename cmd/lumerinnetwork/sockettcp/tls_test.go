@@ -0,0 +1,133 @@
+package sockettcp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+//
+// Echo over TLS, the server checked by CA, by pin, and refused on a bad pin
+//
+func TestTLSListenDial(t *testing.T) {
+
+	cert, leaf := newTestCert(t)
+
+	ctx, _ := contextlib.CreateNewContext(context.Background())
+	addr := fmt.Sprintf("127.0.0.1:%d", getRandPort())
+
+	l, e := NewListenTLS(ctx, "tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if e != nil {
+		t.Fatalf("NewListenTLS() error:%s", e)
+	}
+	defer l.Cancel()
+	l.Run()
+
+	go func() {
+		for s := range l.GetAcceptChan() {
+			go func(s *SocketTCPStruct) {
+				buf := make([]byte, TCPReadBufferSize)
+				for {
+					n, e := s.Read(buf)
+					if e != nil {
+						return
+					}
+					s.Write(buf[:n])
+				}
+			}(s.(*SocketTCPStruct))
+		}
+	}()
+
+	echo := func(config *tls.Config) (e error) {
+		s, e := DialTLS(ctx, "tcp", addr, config)
+		if e != nil {
+			return e
+		}
+		defer s.Close()
+		if _, e = s.Write([]byte(TestString)); e != nil {
+			return e
+		}
+		buf := make([]byte, len(TestString))
+		if _, e = s.Read(buf); e != nil {
+			return e
+		}
+		if string(buf) != TestString {
+			return fmt.Errorf("echo got:%q", buf)
+		}
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	SetRootCAs(pool)
+	defer SetRootCAs(nil)
+
+	if e = echo(ClientTLSConfig("127.0.0.1", nil)); e != nil {
+		t.Errorf("DialTLS() checked by CA error:%s", e)
+	}
+
+	SetRootCAs(nil)
+	if e = echo(ClientTLSConfig("127.0.0.1", nil)); e == nil {
+		t.Errorf("DialTLS() accepted an unknown CA")
+	}
+
+	pin := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	if e = echo(ClientTLSConfig("pool.example.com", [][]byte{pin[:]})); e != nil {
+		t.Errorf("DialTLS() checked by pin error:%s", e)
+	}
+
+	pin[0] ^= 0xff
+	if e = echo(ClientTLSConfig("127.0.0.1", [][]byte{pin[:]})); e == nil {
+		t.Errorf("DialTLS() accepted a bad pin")
+	}
+
+	if _, e = NewListenTLS(ctx, "tcp", addr, &tls.Config{}); e != ErrSocTCPNoTLSConfig {
+		t.Errorf("NewListenTLS() without a certificate got:%v", e)
+	}
+}
+
+//
+// newTestCert() a self signed certificate for 127.0.0.1
+//
+func newTestCert(t *testing.T) (cert tls.Certificate, leaf *x509.Certificate) {
+
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatalf("GenerateKey() error:%s", e)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sockettcp test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, e := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if e != nil {
+		t.Fatalf("CreateCertificate() error:%s", e)
+	}
+	leaf, e = x509.ParseCertificate(der)
+	if e != nil {
+		t.Fatalf("ParseCertificate() error:%s", e)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf
+}
@@ -3,10 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
-	"net"
 	"os"
 	"os/signal"
-	"strings"
 	"time"
 
 	"github.com/daniel-888/proxy-router/cmd/config"
@@ -14,8 +12,9 @@ import (
 	"github.com/daniel-888/proxy-router/cmd/contractmanager"
 	"github.com/daniel-888/proxy-router/cmd/externalapi"
 	"github.com/daniel-888/proxy-router/cmd/log"
+	"github.com/daniel-888/proxy-router/cmd/lumerinnetwork/sockettcp"
 	"github.com/daniel-888/proxy-router/cmd/msgbus"
-	"github.com/daniel-888/proxy-router/cmd/protocol/stratumv1"
+	"github.com/daniel-888/proxy-router/cmd/msgbus/bridge"
 	"github.com/daniel-888/proxy-router/cmd/validator/validator"
 	"github.com/daniel-888/proxy-router/connections"
 	"github.com/daniel-888/proxy-router/lumerinlib"
@@ -56,7 +55,29 @@ func main() {
 	//
 	// Fire up the Message Bus
 	//
-	ps := msgbus.New(10, l)
+	var ps *msgbus.PubSub
+	if configs.PersistDir != "" {
+		ps, err = msgbus.NewPersistent(10, l, msgbus.PersistConfig{
+			Dir:           configs.PersistDir,
+			SnapshotEvery: configs.SnapshotEvery,
+		})
+		if err != nil {
+			l.Logf(log.LevelFatal, "error restoring message bus from %s: %v", configs.PersistDir, err)
+		}
+	} else {
+		ps = msgbus.New(10, l)
+	}
+
+	if configs.OpLog != "" {
+		opLogFile, err := os.OpenFile(configs.OpLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			l.Logf(log.LevelFatal, "error opening message bus operation log: %v", err)
+		}
+		defer opLogFile.Close()
+		if err = ps.SetOpLogWait(opLogFile); err != nil {
+			l.Logf(log.LevelFatal, "error starting message bus operation log: %v", err)
+		}
+	}
 
 	//
 	// Create Connection Collection
@@ -87,13 +108,9 @@ func main() {
 		NetUrl: msgbus.DestNetUrl(configs.DefaultPoolAddr),
 	}
 
-	event, err := ps.PubWait(msgbus.DestMsg, msgbus.IDString(msgbus.DEFAULT_DEST_ID), dest)
-	if err != nil {
+	if err = publishDest(ps, dest); err != nil {
 		panic(fmt.Sprintf("Adding Default Dest Failed: %s", err))
 	}
-	if event.Err != nil {
-		panic(fmt.Sprintf("Adding Default Dest Failed: %s", event.Err))
-	}
 
 	//
 	// Setup Node Operator Msg in msgbus
@@ -103,7 +120,27 @@ func main() {
 		IsBuyer:     configs.BuyerNode,
 		DefaultDest: dest.ID,
 	}
-	event, err = ps.PubWait(msgbus.NodeOperatorMsg, msgbus.IDString(nodeOperator.ID), nodeOperator)
+
+	// Pick up the node operator restored from a persisted bus, keeping its contracts
+	restoredNodeOperator := false
+	event, err := ps.GetWait(msgbus.NodeOperatorMsg, "")
+	if err == nil && len(event.Data.(msgbus.IDIndex)) > 0 {
+		id := event.Data.(msgbus.IDIndex)[0]
+		event, err = ps.GetWait(msgbus.NodeOperatorMsg, id)
+		if err == nil {
+			if restored, ok := event.Data.(msgbus.NodeOperator); ok {
+				nodeOperator.ID = restored.ID
+				nodeOperator.Contracts = restored.Contracts
+				restoredNodeOperator = true
+			}
+		}
+	}
+
+	if restoredNodeOperator {
+		event, err = ps.SetWait(msgbus.NodeOperatorMsg, msgbus.IDString(nodeOperator.ID), nodeOperator)
+	} else {
+		event, err = ps.PubWait(msgbus.NodeOperatorMsg, msgbus.IDString(nodeOperator.ID), nodeOperator)
+	}
 	if err != nil {
 		panic(fmt.Sprintf("Adding Node Operator Failed: %s", err))
 	}
@@ -112,38 +149,96 @@ func main() {
 	}
 
 	//
-	// Fire up the StratumV1 Potocol
+	// Share msgbus records with other proxy-routers
 	//
-	if !configs.DisableStratumv1 {
-
-		listenAddress := fmt.Sprintf("%s:%s", configs.ListenIP, configs.ListenPort)
+	if configs.BridgeListen != "" {
+		exports := make(map[msgbus.MsgType]bridge.Access)
+		for msg, access := range configs.BridgeExport {
+			exports[msgbus.MsgType(msg)] = bridge.Access(access)
+		}
+		server, err := bridge.NewServer(ps, bridge.ServerConfig{Token: configs.BridgeToken, Exports: exports}, l)
+		if err != nil {
+			l.Logf(log.LevelFatal, "Bridge server failed: %v", err)
+		}
+		go func() {
+			if err := server.Serve(mainContext, configs.BridgeListen); err != nil {
+				l.Logf(log.LevelError, "Bridge server on %s stopped: %v", configs.BridgeListen, err)
+			}
+		}()
+	}
 
-		src, err := net.ResolveTCPAddr("tcp", listenAddress)
+	if configs.BridgeRemote != "" {
+		mirrored := make(map[msgbus.MsgType]bridge.Access)
+		for msg, access := range configs.BridgeMirror {
+			mirrored[msgbus.MsgType(msg)] = bridge.Access(access)
+		}
+		mirror, err := bridge.NewMirror(ps, bridge.MirrorConfig{
+			Remote:   configs.BridgeRemote,
+			Token:    configs.BridgeToken,
+			Mirror:   mirrored,
+			Conflict: bridge.ConflictPolicy(configs.BridgeConflict),
+		}, l)
 		if err != nil {
-			lumerinlib.PanicHere("")
+			l.Logf(log.LevelFatal, "Bridge mirror failed: %v", err)
 		}
+		go func() {
+			if err := mirror.Run(mainContext); err != nil {
+				l.Logf(log.LevelError, "Bridge mirror of %s stopped: %v", configs.BridgeRemote, err)
+			}
+		}()
+	}
 
-		l.Logf(log.LevelInfo, "Listening for stratum messages on %v\n\n", src.String())
+	//
+	// CAs stratum+ssl pools are checked against
+	//
+	if configs.TLSCAFile != "" {
+		pool, err := sockettcp.LoadRootCAs(configs.TLSCAFile)
+		if err != nil {
+			l.Logf(log.LevelFatal, "TLS CA file failed: %v", err)
+		}
+		sockettcp.SetRootCAs(pool)
+	}
 
-		stratum, err := stratumv1.NewListener(mainContext, src, dest)
-		scheduler := configs.Scheduler
-		scheduler = strings.ToLower(scheduler)
+	//
+	// Decides which miners may attach to the stratum listeners without an
+	// auth policy of their own
+	//
+	minerAuth := newMinerAuth(l, config.AuthConfig{
+		Methods:       configs.AuthMethods,
+		AllowlistFile: configs.AuthAllowlistFile,
+		CIDRs:         configs.AuthCIDRs,
+		WorkerRegex:   configs.AuthWorkerRegex,
+		URL:           configs.AuthURL,
+		Timeout:       configs.AuthTimeout,
+	})
 
-		switch scheduler {
-		case "ondemand":
-			stratum.SetScheduler(stratumv1.OnDemand)
-		case "onsubmit":
-			stratum.SetScheduler(stratumv1.OnSubmit)
-		default:
-			l.Logf(log.LevelPanic, "Scheduler value: %s Not Supported", scheduler)
+	//
+	// Fire up the stratum listeners, each with its own default Dest
+	//
+	for _, listener := range configs.ListenerConfigs() {
+
+		listenerDest := dest
+		if listener.DefaultPoolAddr != configs.DefaultPoolAddr {
+			listenerDest = &msgbus.Dest{
+				ID:     msgbus.DestID(listenerDestPrefix + listener.Name),
+				NetUrl: msgbus.DestNetUrl(listener.DefaultPoolAddr),
+			}
+			if err = publishDest(ps, listenerDest); err != nil {
+				panic(fmt.Sprintf("Adding Dest of listener %s Failed: %s", listener.Name, err))
+			}
 		}
 
-		if err != nil {
-			panic(fmt.Sprintf("Stratum Protocol New() failed:%s", err))
+		auth := minerAuth
+		if listener.Auth != nil {
+			auth = newMinerAuth(l, *listener.Auth)
 		}
 
-		stratum.Run()
-
+		switch listener.Protocol {
+		case config.ProtocolStratumv1, config.ProtocolStratumv1TLS:
+			startStratumv1(mainContext, l, listener, listenerDest, auth, configs)
+		case config.ProtocolStratumv2:
+			startStratumv2(mainContext, l, listener, listenerDest, auth, configs)
+		}
 	}
 
 	//
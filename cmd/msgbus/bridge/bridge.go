@@ -0,0 +1,249 @@
+package bridge
+
+//
+// The bridge lets msgbus instances in separate proxy-router processes share
+// records. A Server exposes selected message classes of its bus, a Mirror
+// connects to a Server and keeps the same message classes of its own bus in
+// step with it, and for read-write classes sends local changes back.
+//
+// Both ends exchange JSON frames, one per line over plain TCP (tcp://host:port)
+// or one per text message over a WebSocket (ws://host:port/path). The first
+// frame a client sends is a hello carrying the shared token, nothing else is
+// accepted until it checks out. The token travels in the clear, so bridges
+// should be kept to the site network or run over wss behind a terminating proxy.
+//
+// Conflicts are detected with record revisions: every change a Mirror sends
+// names the server revision it was based on, and is refused with the current
+// record if another writer got there first. The Mirror then either takes the
+// server's record (RemoteWins) or re-sends its own on top of it (LocalWins).
+//
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolVersion is sent in the hello and welcome frames, both ends must match
+const ProtocolVersion = 1
+
+type Access string
+
+const (
+	// ReadOnly classes are copied from the server and local changes stay local
+	ReadOnly Access = "ro"
+	// ReadWrite classes are copied from the server and local changes are sent back
+	ReadWrite Access = "rw"
+)
+
+type ConflictPolicy string
+
+const (
+	// RemoteWins drops a refused local change and takes the server's record
+	RemoteWins ConflictPolicy = "remote"
+	// LocalWins re-sends a refused local change on top of the server's record
+	LocalWins ConflictPolicy = "local"
+)
+
+type frameType string
+
+const (
+	frameHello   frameType = "hello"
+	frameWelcome frameType = "welcome"
+	frameSub     frameType = "sub"
+	frameRecord  frameType = "record"
+	frameSynced  frameType = "synced"
+	frameWrite   frameType = "write"
+	frameAck     frameType = "ack"
+	frameError   frameType = "error"
+)
+
+type op string
+
+const (
+	opPub   op = "pub"
+	opSet   op = "set"
+	opUnpub op = "unpub"
+)
+
+var (
+	ErrUnauthorized = errors.New("bridge: unauthorized")
+	ErrVersion      = errors.New("bridge: protocol version mismatch")
+	ErrAccess       = errors.New("bridge: message type not exported with the requested access")
+)
+
+//
+// frame is the single message shape used in both directions, fields are
+// filled in according to Type
+//
+type frame struct {
+	Type    frameType       `json:"type"`
+	Version int             `json:"v,omitempty"`
+	Token   string          `json:"token,omitempty"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Op      op              `json:"op,omitempty"`
+	Msg     msgbus.MsgType  `json:"msg,omitempty"`
+	ID      msgbus.IDString `json:"id,omitempty"`
+	Rev     uint64          `json:"rev,omitempty"`
+	Access  Access          `json:"access,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	// Conflict marks an ack refusing a write, Op, Rev and Data then carry
+	// the server's current record
+	Conflict bool   `json:"conflict,omitempty"`
+	Err      string `json:"err,omitempty"`
+}
+
+type recordKey struct {
+	msg msgbus.MsgType
+	id  msgbus.IDString
+}
+
+func validAccess(a Access) bool {
+	return a == ReadOnly || a == ReadWrite
+}
+
+func tokenMatches(want, got string) bool {
+	return subtle.ConstantTimeCompare([]byte(want), []byte(got)) == 1
+}
+
+//-----------------------------------------
+// frameConn reads and writes whole frames over one of the transports
+//-----------------------------------------
+type frameConn interface {
+	ReadFrame(f *frame) error
+	WriteFrame(f *frame) error
+	Close() error
+}
+
+type tcpConn struct {
+	c   net.Conn
+	dec *json.Decoder
+	enc *json.Encoder
+}
+
+func newTCPConn(c net.Conn) *tcpConn {
+	return &tcpConn{
+		c:   c,
+		dec: json.NewDecoder(c),
+		enc: json.NewEncoder(c),
+	}
+}
+
+func (t *tcpConn) ReadFrame(f *frame) error  { return t.dec.Decode(f) }
+func (t *tcpConn) WriteFrame(f *frame) error { return t.enc.Encode(f) }
+func (t *tcpConn) Close() error              { return t.c.Close() }
+
+type wsConn struct {
+	c *websocket.Conn
+}
+
+func (w *wsConn) ReadFrame(f *frame) error  { return w.c.ReadJSON(f) }
+func (w *wsConn) WriteFrame(f *frame) error { return w.c.WriteJSON(f) }
+func (w *wsConn) Close() error              { return w.c.Close() }
+
+//-----------------------------------------
+// dial connects to a tcp://, ws:// or wss:// bridge address
+//-----------------------------------------
+func dial(ctx context.Context, remote string) (frameConn, error) {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return newTCPConn(c), nil
+	case "ws", "wss":
+		c, _, err := websocket.DefaultDialer.DialContext(ctx, remote, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &wsConn{c: c}, nil
+	default:
+		return nil, fmt.Errorf("bridge: unsupported address scheme %q", u.Scheme)
+	}
+}
+
+//-----------------------------------------
+// outbox queues frames for a connection and writes them from its own
+// goroutine, so nothing holding a lock ever waits on the network. Each
+// end reads continuously, which is what keeps two bridges that are both
+// sending from deadlocking each other.
+//-----------------------------------------
+type outbox struct {
+	fc     frameConn
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*frame
+	closed bool
+	err    error
+	done   chan struct{}
+}
+
+func newOutbox(fc frameConn) *outbox {
+	o := &outbox{
+		fc:   fc,
+		done: make(chan struct{}),
+	}
+	o.cond = sync.NewCond(&o.mu)
+	go o.run()
+	return o
+}
+
+func (o *outbox) send(f *frame) {
+	o.mu.Lock()
+	if !o.closed {
+		o.queue = append(o.queue, f)
+		o.cond.Broadcast()
+	}
+	o.mu.Unlock()
+}
+
+func (o *outbox) close() {
+	o.mu.Lock()
+	o.closed = true
+	o.cond.Broadcast()
+	o.mu.Unlock()
+}
+
+func (o *outbox) run() {
+	defer close(o.done)
+
+	for {
+		o.mu.Lock()
+		for len(o.queue) == 0 && !o.closed {
+			o.cond.Wait()
+		}
+		if len(o.queue) == 0 {
+			o.mu.Unlock()
+			return
+		}
+		f := o.queue[0]
+		o.queue[0] = nil
+		o.queue = o.queue[1:]
+		o.mu.Unlock()
+
+		if err := o.fc.WriteFrame(f); err != nil {
+			o.mu.Lock()
+			o.err = err
+			o.closed = true
+			o.queue = nil
+			o.mu.Unlock()
+			o.fc.Close()
+			return
+		}
+	}
+}
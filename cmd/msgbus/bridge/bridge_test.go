@@ -0,0 +1,263 @@
+package bridge
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/daniel-888/proxy-router/cmd/log"
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+)
+
+const testToken = "secret"
+
+func startServer(t *testing.T, ctx context.Context, ps *msgbus.PubSub, exports map[msgbus.MsgType]Access) string {
+	s, err := NewServer(ps, ServerConfig{Token: testToken, Exports: exports}, log.New())
+	if err != nil {
+		t.Fatalf("NewServer returned error: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned error: %s", err)
+	}
+	go s.ServeListener(ctx, ln)
+	return "tcp://" + ln.Addr().String()
+}
+
+func startMirror(t *testing.T, ctx context.Context, ps *msgbus.PubSub, remote string, mirror map[msgbus.MsgType]Access) *Mirror {
+	m, err := NewMirror(ps, MirrorConfig{Remote: remote, Token: testToken, Mirror: mirror}, log.New())
+	if err != nil {
+		t.Fatalf("NewMirror returned error: %s", err)
+	}
+	go m.Run(ctx)
+
+	for range mirror {
+		select {
+		case <-m.Synced():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("mirror did not sync")
+		}
+	}
+	return m
+}
+
+// waitFor polls the bus until the record satisfies ok
+func waitFor(t *testing.T, ps *msgbus.PubSub, msg msgbus.MsgType, id msgbus.IDString, ok func(data interface{}) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if event, _ := ps.GetWait(msg, id); event != nil && ok(event.Data) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s/%s never reached the expected state", msg, id)
+}
+
+func TestMirrorReadOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := msgbus.New(1, log.New())
+	local := msgbus.New(1, log.New())
+
+	dest := msgbus.Dest{ID: "DestID01", NetUrl: "stratum+tcp://127.0.0.1:3334/"}
+	server.PubWait(msgbus.DestMsg, msgbus.IDString(dest.ID), dest)
+
+	remote := startServer(t, ctx, server, map[msgbus.MsgType]Access{msgbus.DestMsg: ReadOnly})
+	startMirror(t, ctx, local, remote, map[msgbus.MsgType]Access{msgbus.DestMsg: ReadOnly})
+
+	waitFor(t, local, msgbus.DestMsg, msgbus.IDString(dest.ID), func(data interface{}) bool {
+		return data != nil && data.(msgbus.Dest).NetUrl == dest.NetUrl
+	})
+
+	dest.NetUrl = "stratum+tcp://127.0.0.2:3334/"
+	server.SetWait(msgbus.DestMsg, msgbus.IDString(dest.ID), dest)
+	waitFor(t, local, msgbus.DestMsg, msgbus.IDString(dest.ID), func(data interface{}) bool {
+		return data != nil && data.(msgbus.Dest).NetUrl == dest.NetUrl
+	})
+
+	// Local changes to a read only class stay local
+	mine := msgbus.Dest{ID: "DestID02", NetUrl: "stratum+tcp://127.0.0.3:3334/"}
+	local.PubWait(msgbus.DestMsg, msgbus.IDString(mine.ID), mine)
+	time.Sleep(100 * time.Millisecond)
+	if event, _ := server.GetWait(msgbus.DestMsg, msgbus.IDString(mine.ID)); event.Data != nil {
+		t.Errorf("read only change reached the server")
+	}
+
+	server.UnpubWait(msgbus.DestMsg, msgbus.IDString(dest.ID))
+	waitFor(t, local, msgbus.DestMsg, msgbus.IDString(dest.ID), func(data interface{}) bool {
+		return data == nil
+	})
+}
+
+func TestMirrorReadWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := msgbus.New(1, log.New())
+	local := msgbus.New(1, log.New())
+
+	// Attached before the mirror connects, pushed up once it syncs
+	early := msgbus.Miner{ID: "MinerID01", State: msgbus.OnlineState, Contracts: map[msgbus.ContractID]float64{}}
+	local.MinerPubWait(early)
+
+	remote := startServer(t, ctx, server, map[msgbus.MsgType]Access{msgbus.MinerMsg: ReadWrite})
+	startMirror(t, ctx, local, remote, map[msgbus.MsgType]Access{msgbus.MinerMsg: ReadWrite})
+
+	waitFor(t, server, msgbus.MinerMsg, msgbus.IDString(early.ID), func(data interface{}) bool {
+		return data != nil
+	})
+
+	miner := msgbus.Miner{ID: "MinerID02", State: msgbus.OnlineState, Contracts: map[msgbus.ContractID]float64{}}
+	local.MinerPubWait(miner)
+	waitFor(t, server, msgbus.MinerMsg, msgbus.IDString(miner.ID), func(data interface{}) bool {
+		return data != nil
+	})
+
+	for i := 1; i <= 20; i++ {
+		local.MinerUpdateWait(miner.ID, func(m *msgbus.Miner) error {
+			m.CurrentHashRate = i
+			return nil
+		})
+	}
+	waitFor(t, server, msgbus.MinerMsg, msgbus.IDString(miner.ID), func(data interface{}) bool {
+		return data != nil && data.(msgbus.Miner).CurrentHashRate == 20
+	})
+
+	// A change made on the server comes back down
+	server.MinerSetDestWait(miner.ID, "DestID01")
+	waitFor(t, local, msgbus.MinerMsg, msgbus.IDString(miner.ID), func(data interface{}) bool {
+		return data != nil && data.(msgbus.Miner).Dest == "DestID01" && data.(msgbus.Miner).CurrentHashRate == 20
+	})
+
+	local.UnpubWait(msgbus.MinerMsg, msgbus.IDString(early.ID))
+	waitFor(t, server, msgbus.MinerMsg, msgbus.IDString(early.ID), func(data interface{}) bool {
+		return data == nil
+	})
+}
+
+func TestServerRejectsStaleWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := msgbus.New(1, log.New())
+	miner := msgbus.Miner{ID: "MinerID01", Contracts: map[msgbus.ContractID]float64{}}
+	server.MinerPubWait(miner)
+	miner.CurrentHashRate = 100
+	server.MinerSetWait(miner)
+
+	remote := startServer(t, ctx, server, map[msgbus.MsgType]Access{msgbus.MinerMsg: ReadWrite})
+
+	fc, err := dial(ctx, remote)
+	if err != nil {
+		t.Fatalf("dial returned error: %s", err)
+	}
+	defer fc.Close()
+
+	fc.WriteFrame(&frame{Type: frameHello, Version: ProtocolVersion, Token: testToken})
+	fc.WriteFrame(&frame{Type: frameSub, Msg: msgbus.MinerMsg, Access: ReadWrite})
+
+	var f frame
+	for f.Type != frameSynced {
+		if err := fc.ReadFrame(&f); err != nil {
+			t.Fatalf("ReadFrame returned error: %s", err)
+		}
+	}
+
+	fc.WriteFrame(&frame{Type: frameWrite, Seq: 1, Op: opSet, Msg: msgbus.MinerMsg, ID: "MinerID01", Rev: 1, Data: []byte(`{"ID":"MinerID01","CurrentHashRate":5}`)})
+	for f.Type != frameAck {
+		if err := fc.ReadFrame(&f); err != nil {
+			t.Fatalf("ReadFrame returned error: %s", err)
+		}
+	}
+
+	if !f.Conflict || f.Rev != 2 {
+		t.Fatalf("expected a conflict at revision 2, got %+v", f)
+	}
+	if m, _ := server.MinerGetWait(miner.ID); m.CurrentHashRate != 100 {
+		t.Errorf("stale write was applied: %+v", m)
+	}
+}
+
+func TestMirrorUnauthorized(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := msgbus.New(1, log.New())
+	remote := startServer(t, ctx, server, map[msgbus.MsgType]Access{msgbus.DestMsg: ReadOnly})
+
+	m, err := NewMirror(msgbus.New(1, log.New()), MirrorConfig{Remote: remote, Token: "wrong", Mirror: map[msgbus.MsgType]Access{msgbus.DestMsg: ReadOnly}}, log.New())
+	if err != nil {
+		t.Fatalf("NewMirror returned error: %s", err)
+	}
+	if err := m.Run(ctx); err != ErrUnauthorized {
+		t.Errorf("expected ErrUnauthorized, got %v", err)
+	}
+
+	m, _ = NewMirror(msgbus.New(1, log.New()), MirrorConfig{Remote: remote, Token: testToken, Mirror: map[msgbus.MsgType]Access{msgbus.DestMsg: ReadWrite}}, log.New())
+	if err := m.Run(ctx); err != ErrAccess {
+		t.Errorf("expected ErrAccess, got %v", err)
+	}
+}
+
+// captureConn records the frames written to it
+type captureConn struct {
+	frames chan *frame
+}
+
+func (c *captureConn) ReadFrame(f *frame) error  { select {} }
+func (c *captureConn) WriteFrame(f *frame) error { c.frames <- f; return nil }
+func (c *captureConn) Close() error              { return nil }
+
+func conflictMirror(t *testing.T, policy ConflictPolicy) (*Mirror, *msgbus.PubSub, *captureConn) {
+	local := msgbus.New(1, log.New())
+	m, err := NewMirror(local, MirrorConfig{Remote: "tcp://127.0.0.1:1", Token: testToken, Conflict: policy, Mirror: map[msgbus.MsgType]Access{msgbus.MinerMsg: ReadWrite}}, log.New())
+	if err != nil {
+		t.Fatalf("NewMirror returned error: %s", err)
+	}
+
+	cc := &captureConn{frames: make(chan *frame, 10)}
+	m.out = newOutbox(cc)
+	m.remote = map[recordKey]uint64{{msgbus.MinerMsg, "MinerID01"}: 1}
+	m.applied = make(map[recordKey]uint64)
+	m.unpubbed = make(map[recordKey]bool)
+	m.inflight = map[recordKey]bool{{msgbus.MinerMsg, "MinerID01"}: true}
+	m.queued = make(map[recordKey]*msgbus.Event)
+	m.deferred = make(map[recordKey]*frame)
+
+	local.MinerPubWait(msgbus.Miner{ID: "MinerID01", CurrentHashRate: 5, Contracts: map[msgbus.ContractID]float64{}})
+	return m, local, cc
+}
+
+func TestMirrorConflictRemoteWins(t *testing.T) {
+	m, local, _ := conflictMirror(t, RemoteWins)
+
+	m.ack(&frame{Type: frameAck, Seq: 1, Op: opSet, Msg: msgbus.MinerMsg, ID: "MinerID01", Rev: 3, Conflict: true, Data: []byte(`{"ID":"MinerID01","CurrentHashRate":100}`)})
+
+	if miner, _ := local.MinerGetWait("MinerID01"); miner.CurrentHashRate != 100 {
+		t.Errorf("expected the server record, got %+v", miner)
+	}
+	if m.remote[recordKey{msgbus.MinerMsg, "MinerID01"}] != 3 {
+		t.Errorf("remote revision not updated: %v", m.remote)
+	}
+}
+
+func TestMirrorConflictLocalWins(t *testing.T) {
+	m, local, cc := conflictMirror(t, LocalWins)
+
+	m.ack(&frame{Type: frameAck, Seq: 1, Op: opSet, Msg: msgbus.MinerMsg, ID: "MinerID01", Rev: 3, Conflict: true, Data: []byte(`{"ID":"MinerID01","CurrentHashRate":100}`)})
+
+	select {
+	case f := <-cc.frames:
+		if f.Type != frameWrite || f.Op != opSet || f.Rev != 3 {
+			t.Errorf("expected a set on top of revision 3, got %+v", f)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("local record was not re-sent")
+	}
+	if miner, _ := local.MinerGetWait("MinerID01"); miner.CurrentHashRate != 5 {
+		t.Errorf("local record was overwritten: %+v", miner)
+	}
+}
@@ -0,0 +1,437 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/daniel-888/proxy-router/cmd/log"
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+)
+
+const defaultRetryInterval = 5 * time.Second
+
+type MirrorConfig struct {
+	// Remote is the tcp://host:port or ws://host:port/path of the server
+	Remote string
+	Token  string
+	// Mirror lists the message classes to copy from the server and how
+	Mirror map[msgbus.MsgType]Access
+	// Conflict decides who wins when the server refuses a local change,
+	// empty means RemoteWins
+	Conflict ConflictPolicy
+	// RetryInterval is the wait before reconnecting, 0 uses the default
+	RetryInterval time.Duration
+}
+
+//
+// Mirror keeps message classes of the local bus in step with a Server.
+//
+// Records on the server replace local ones when the mirror (re)connects, and
+// local records the server does not have are sent to it for read-write
+// classes. Changes made while disconnected are not replayed.
+//
+type Mirror struct {
+	ps     *msgbus.PubSub
+	cfg    MirrorConfig
+	logger *log.Logger
+
+	mu  sync.Mutex
+	out *outbox
+	seq uint64
+	// remote is the server revision each record was last seen at
+	remote map[recordKey]uint64
+	// applied is the local revision left by applying a server change, so
+	// the resulting local event is not sent straight back
+	applied map[recordKey]uint64
+	// unpubbed marks records removed because the server removed them
+	unpubbed map[recordKey]bool
+	// inflight marks records with a write awaiting its ack, queued holds
+	// the latest local change made meanwhile and deferred the latest server
+	// change, both are dealt with once the ack arrives
+	inflight map[recordKey]bool
+	queued   map[recordKey]*msgbus.Event
+	deferred map[recordKey]*frame
+	synced   chan msgbus.MsgType
+}
+
+//--------------------------------------------------------------------------------
+//
+//--------------------------------------------------------------------------------
+func NewMirror(ps *msgbus.PubSub, cfg MirrorConfig, l *log.Logger) (*Mirror, error) {
+	if cfg.Remote == "" {
+		return nil, fmt.Errorf("bridge: remote not provided")
+	}
+
+	for msg, access := range cfg.Mirror {
+		if !msgbus.IsRecordMsg(msg) {
+			return nil, fmt.Errorf("bridge: %s can not be mirrored", msg)
+		}
+		if !validAccess(access) {
+			return nil, fmt.Errorf("bridge: bad access %q for %s", access, msg)
+		}
+	}
+
+	switch cfg.Conflict {
+	case "":
+		cfg.Conflict = RemoteWins
+	case RemoteWins, LocalWins:
+	default:
+		return nil, fmt.Errorf("bridge: bad conflict policy %q", cfg.Conflict)
+	}
+
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = defaultRetryInterval
+	}
+
+	return &Mirror{
+		ps:     ps,
+		cfg:    cfg,
+		logger: l,
+		synced: make(chan msgbus.MsgType, len(cfg.Mirror)),
+	}, nil
+}
+
+//--------------------------------------------------------------------------------
+// Run keeps the mirror connected until ctx is cancelled. Authentication and
+// access errors are returned, as retrying them will not help.
+//--------------------------------------------------------------------------------
+func (m *Mirror) Run(ctx context.Context) error {
+	for {
+		err := m.runOnce(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrVersion) || errors.Is(err, ErrAccess) {
+			return err
+		}
+		m.logf(log.LevelWarn, "BRIDGE: connection to %s lost: %v, retrying", m.cfg.Remote, err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(m.cfg.RetryInterval):
+		}
+	}
+}
+
+//--------------------------------------------------------------------------------
+// Synced returns a channel that receives each mirrored message class once the
+// server's records for it have been copied in after a (re)connect.
+//--------------------------------------------------------------------------------
+func (m *Mirror) Synced() <-chan msgbus.MsgType {
+	return m.synced
+}
+
+func (m *Mirror) logf(level log.Level, format string, args ...interface{}) {
+	if m.logger != nil {
+		m.logger.Logf(level, format, args...)
+	}
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func (m *Mirror) runOnce(ctx context.Context) error {
+	fc, err := dial(ctx, m.cfg.Remote)
+	if err != nil {
+		return err
+	}
+	defer fc.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		fc.Close()
+	}()
+
+	if err = fc.WriteFrame(&frame{Type: frameHello, Version: ProtocolVersion, Token: m.cfg.Token}); err != nil {
+		return err
+	}
+
+	var welcome frame
+	if err = fc.ReadFrame(&welcome); err != nil {
+		return err
+	}
+	if err = frameErr(&welcome); err != nil {
+		return err
+	}
+	if welcome.Type != frameWelcome {
+		return fmt.Errorf("bridge: expected welcome, got %s", welcome.Type)
+	}
+
+	m.mu.Lock()
+	m.out = newOutbox(fc)
+	m.remote = make(map[recordKey]uint64)
+	m.applied = make(map[recordKey]uint64)
+	m.unpubbed = make(map[recordKey]bool)
+	m.inflight = make(map[recordKey]bool)
+	m.queued = make(map[recordKey]*msgbus.Event)
+	m.deferred = make(map[recordKey]*frame)
+	out := m.out
+	m.mu.Unlock()
+
+	defer func() {
+		out.close()
+		<-out.done
+	}()
+
+	// Local changes to read-write classes are sent to the server
+	ech := msgbus.NewEventChan()
+	for msg, access := range m.cfg.Mirror {
+		if access == ReadWrite {
+			if _, err := m.ps.SubWait(msg, "", ech); err != nil {
+				return err
+			}
+		}
+	}
+	go m.forward(ech)
+	defer m.ps.RemoveAndCloseEventChanWait(ech)
+
+	for msg, access := range m.cfg.Mirror {
+		out.send(&frame{Type: frameSub, Msg: msg, Access: access})
+	}
+
+	for {
+		var f frame
+		if err := fc.ReadFrame(&f); err != nil {
+			return err
+		}
+
+		switch f.Type {
+		case frameRecord:
+			m.record(&f)
+		case frameSynced:
+			m.sync(f.Msg, f.Access)
+		case frameAck:
+			m.ack(&f)
+		case frameError:
+			return frameErr(&f)
+		default:
+			return fmt.Errorf("bridge: unexpected %s frame", f.Type)
+		}
+	}
+}
+
+// frameErr maps an error frame back to the error the server sent
+func frameErr(f *frame) error {
+	if f.Type != frameError {
+		return nil
+	}
+	for _, err := range []error{ErrUnauthorized, ErrVersion, ErrAccess} {
+		if f.Err == err.Error() {
+			return err
+		}
+	}
+	return fmt.Errorf("bridge: %s", f.Err)
+}
+
+//-----------------------------------------
+// record applies a change sent by the server
+//-----------------------------------------
+func (m *Mirror) record(f *frame) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := recordKey{f.Msg, f.ID}
+
+	if m.inflight[k] {
+		m.deferred[k] = f
+		return
+	}
+
+	m.applyLocked(f)
+}
+
+func (m *Mirror) applyLocked(f *frame) {
+	k := recordKey{f.Msg, f.ID}
+
+	if f.Op == opUnpub {
+		delete(m.remote, k)
+		if _, err := m.ps.UnpubWait(f.Msg, f.ID); err == nil {
+			m.unpubbed[k] = true
+		}
+		return
+	}
+
+	if f.Rev <= m.remote[k] {
+		return
+	}
+	m.remote[k] = f.Rev
+
+	data, err := msgbus.DecodeRecord(f.Msg, f.Data)
+	if err != nil {
+		m.logf(log.LevelError, "BRIDGE: decoding %s/%s: %s", f.Msg, f.ID, err)
+		return
+	}
+
+	var event *msgbus.Event
+	current, err := m.ps.GetWait(f.Msg, f.ID)
+	if err == nil && current.Data != nil {
+		if reflect.DeepEqual(current.Data, data) {
+			return
+		}
+		event, err = m.ps.SetWait(f.Msg, f.ID, data)
+	} else {
+		event, err = m.ps.PubWait(f.Msg, f.ID, data)
+	}
+	if err != nil {
+		m.logf(log.LevelError, "BRIDGE: applying %s/%s: %s", f.Msg, f.ID, err)
+		return
+	}
+	m.applied[k] = event.Revision
+}
+
+//-----------------------------------------
+// sync runs once the server's records for msg are in, pushing up local
+// records the server does not have yet
+//-----------------------------------------
+func (m *Mirror) sync(msg msgbus.MsgType, access Access) {
+	if access == ReadWrite {
+		event, err := m.ps.GetWait(msg, "")
+		if err == nil {
+			for _, id := range event.Data.(msgbus.IDIndex) {
+				k := recordKey{msg, id}
+				m.mu.Lock()
+				_, known := m.remote[k]
+				m.mu.Unlock()
+				if known {
+					continue
+				}
+				if e, err := m.ps.GetWait(msg, id); err == nil {
+					m.local(&msgbus.Event{EventType: msgbus.PublishEvent, Msg: msg, ID: id, Revision: e.Revision, Data: e.Data})
+				}
+			}
+		}
+	}
+
+	select {
+	case m.synced <- msg:
+	default:
+	}
+}
+
+//-----------------------------------------
+// forward sends local changes to read-write classes to the server
+//-----------------------------------------
+func (m *Mirror) forward(ech msgbus.EventChan) {
+	for event := range ech {
+		if event.Err != nil {
+			continue
+		}
+		switch event.EventType {
+		case msgbus.PublishEvent, msgbus.UpdateEvent, msgbus.UnpublishEvent:
+			m.local(event)
+		}
+	}
+}
+
+func (m *Mirror) local(event *msgbus.Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := recordKey{event.Msg, event.ID}
+
+	// Our own doing, the server already has it
+	if event.EventType == msgbus.UnpublishEvent {
+		if m.unpubbed[k] {
+			delete(m.unpubbed, k)
+			return
+		}
+	} else if rev, ok := m.applied[k]; ok && rev == event.Revision {
+		delete(m.applied, k)
+		return
+	}
+
+	if m.inflight[k] {
+		m.queued[k] = event
+		return
+	}
+
+	m.writeLocked(k, event)
+}
+
+func (m *Mirror) writeLocked(k recordKey, event *msgbus.Event) {
+	m.seq++
+	f := &frame{Type: frameWrite, Seq: m.seq, Msg: k.msg, ID: k.id}
+
+	if event.EventType == msgbus.UnpublishEvent {
+		if _, ok := m.remote[k]; !ok {
+			return
+		}
+		f.Op = opUnpub
+		delete(m.remote, k)
+	} else {
+		raw, err := json.Marshal(event.Data)
+		if err != nil {
+			m.logf(log.LevelError, "BRIDGE: encoding %s/%s: %s", k.msg, k.id, err)
+			return
+		}
+		f.Data = raw
+		if rev, ok := m.remote[k]; ok {
+			f.Op = opSet
+			f.Rev = rev
+		} else {
+			f.Op = opPub
+		}
+	}
+
+	m.inflight[k] = true
+	m.out.send(f)
+}
+
+//-----------------------------------------
+// ack completes a write, resolving a conflict if the server refused it
+//-----------------------------------------
+func (m *Mirror) ack(f *frame) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := recordKey{f.Msg, f.ID}
+	delete(m.inflight, k)
+
+	switch {
+	case f.Conflict && m.cfg.Conflict == LocalWins:
+		m.logf(log.LevelInfo, "BRIDGE: %s/%s changed on the server, overwriting it", f.Msg, f.ID)
+		if f.Op == opUnpub {
+			delete(m.remote, k)
+		} else {
+			m.remote[k] = f.Rev
+		}
+		delete(m.deferred, k)
+		// Re-send the newest local state on top of the server's record
+		if _, ok := m.queued[k]; !ok {
+			if e, err := m.ps.GetWait(f.Msg, f.ID); err == nil && e.Data != nil {
+				m.queued[k] = &msgbus.Event{EventType: msgbus.UpdateEvent, Msg: f.Msg, ID: f.ID, Data: e.Data}
+			}
+		}
+
+	case f.Conflict:
+		m.logf(log.LevelInfo, "BRIDGE: %s/%s changed on the server, taking its record", f.Msg, f.ID)
+		delete(m.queued, k)
+		delete(m.deferred, k)
+		m.remote[k] = 0
+		m.applyLocked(&frame{Type: frameRecord, Op: f.Op, Msg: f.Msg, ID: f.ID, Rev: f.Rev, Data: f.Data})
+
+	case f.Err != "":
+		m.logf(log.LevelError, "BRIDGE: server refused %s of %s/%s: %s", f.Op, f.Msg, f.ID, f.Err)
+
+	case f.Op != opUnpub && f.Rev > m.remote[k]:
+		m.remote[k] = f.Rev
+	}
+
+	if d, ok := m.deferred[k]; ok {
+		delete(m.deferred, k)
+		m.applyLocked(d)
+	}
+
+	if q, ok := m.queued[k]; ok {
+		delete(m.queued, k)
+		m.writeLocked(k, q)
+	}
+}
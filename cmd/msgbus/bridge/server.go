@@ -0,0 +1,365 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/daniel-888/proxy-router/cmd/log"
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	"github.com/gorilla/websocket"
+)
+
+// helloTimeout is how long a new connection has to authenticate
+const helloTimeout = 10 * time.Second
+
+type ServerConfig struct {
+	// Token must be presented by every client in its hello frame
+	Token string
+	// Exports lists the message classes clients may mirror and how
+	Exports map[msgbus.MsgType]Access
+}
+
+type Server struct {
+	ps       *msgbus.PubSub
+	cfg      ServerConfig
+	logger   *log.Logger
+	upgrader websocket.Upgrader
+}
+
+//
+// serverConn is one authenticated client
+//
+type serverConn struct {
+	s   *Server
+	out *outbox
+	ech msgbus.EventChan
+	// subreq hands sub frames from the reader to the forwarder, which
+	// sends the snapshot so it is ordered with the changes that follow it
+	subreq chan *frame
+	// subs is only touched by the reader
+	subs map[msgbus.MsgType]Access
+}
+
+//--------------------------------------------------------------------------------
+//
+//--------------------------------------------------------------------------------
+func NewServer(ps *msgbus.PubSub, cfg ServerConfig, l *log.Logger) (*Server, error) {
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("bridge: token not provided")
+	}
+
+	for msg, access := range cfg.Exports {
+		if !msgbus.IsRecordMsg(msg) {
+			return nil, fmt.Errorf("bridge: %s can not be exported", msg)
+		}
+		if !validAccess(access) {
+			return nil, fmt.Errorf("bridge: bad access %q for %s", access, msg)
+		}
+	}
+
+	return &Server{
+		ps:     ps,
+		cfg:    cfg,
+		logger: l,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		},
+	}, nil
+}
+
+//--------------------------------------------------------------------------------
+// Serve accepts clients on a tcp://host:port or ws://host:port/path address
+// until ctx is cancelled.
+//--------------------------------------------------------------------------------
+func (s *Server) Serve(ctx context.Context, listen string) error {
+	u, err := url.Parse(listen)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		ln, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			return err
+		}
+		return s.ServeListener(ctx, ln)
+
+	case "ws":
+		path := u.Path
+		if path == "" {
+			path = "/"
+		}
+		mux := http.NewServeMux()
+		mux.Handle(path, s)
+		srv := &http.Server{Addr: u.Host, Handler: mux}
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("bridge: unsupported address scheme %q", u.Scheme)
+	}
+}
+
+//--------------------------------------------------------------------------------
+// ServeListener accepts plain TCP clients on ln until ctx is cancelled
+//--------------------------------------------------------------------------------
+func (s *Server) ServeListener(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.handle(ctx, newTCPConn(c))
+	}
+}
+
+//--------------------------------------------------------------------------------
+// ServeHTTP upgrades the request to a WebSocket bridge connection, so the
+// bridge can also be mounted on an existing HTTP server.
+//--------------------------------------------------------------------------------
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logf(log.LevelWarn, "BRIDGE: websocket upgrade from %s failed: %s", r.RemoteAddr, err)
+		return
+	}
+	s.handle(r.Context(), &wsConn{c: c})
+}
+
+func (s *Server) logf(level log.Level, format string, args ...interface{}) {
+	if s.logger != nil {
+		s.logger.Logf(level, format, args...)
+	}
+}
+
+//-----------------------------------------
+// handle authenticates a client and then serves it until either side hangs up
+//-----------------------------------------
+func (s *Server) handle(ctx context.Context, fc frameConn) {
+	defer fc.Close()
+
+	timer := time.AfterFunc(helloTimeout, func() { fc.Close() })
+
+	var hello frame
+	err := fc.ReadFrame(&hello)
+	timer.Stop()
+	if err != nil {
+		return
+	}
+
+	if hello.Type != frameHello || !tokenMatches(s.cfg.Token, hello.Token) {
+		s.logf(log.LevelWarn, "BRIDGE: rejected client, %s", ErrUnauthorized)
+		fc.WriteFrame(&frame{Type: frameError, Err: ErrUnauthorized.Error()})
+		return
+	}
+	if hello.Version != ProtocolVersion {
+		fc.WriteFrame(&frame{Type: frameError, Err: ErrVersion.Error()})
+		return
+	}
+
+	sc := &serverConn{
+		s:      s,
+		out:    newOutbox(fc),
+		ech:    msgbus.NewEventChan(),
+		subreq: make(chan *frame),
+		subs:   make(map[msgbus.MsgType]Access),
+	}
+	sc.out.send(&frame{Type: frameWelcome, Version: ProtocolVersion})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go sc.forward(ctx)
+	defer func() {
+		s.ps.RemoveAndCloseEventChanWait(sc.ech)
+		sc.out.close()
+		<-sc.out.done
+	}()
+
+	go func() {
+		<-ctx.Done()
+		fc.Close()
+	}()
+
+	for {
+		var f frame
+		if err := fc.ReadFrame(&f); err != nil {
+			return
+		}
+
+		switch f.Type {
+		case frameSub:
+			access, ok := s.cfg.Exports[f.Msg]
+			if !ok || !validAccess(f.Access) || (f.Access == ReadWrite && access != ReadWrite) {
+				sc.out.send(&frame{Type: frameError, Msg: f.Msg, Err: ErrAccess.Error()})
+				return
+			}
+			sc.subs[f.Msg] = f.Access
+			select {
+			case sc.subreq <- &f:
+			case <-ctx.Done():
+				return
+			}
+
+		case frameWrite:
+			sc.out.send(sc.write(&f))
+
+		default:
+			sc.out.send(&frame{Type: frameError, Err: fmt.Sprintf("unexpected %s frame", f.Type)})
+			return
+		}
+	}
+}
+
+//-----------------------------------------
+// forward sends the snapshot for each new subscription followed by every
+// change made to the subscribed message classes
+//-----------------------------------------
+func (sc *serverConn) forward(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case f := <-sc.subreq:
+			sc.subscribe(f)
+
+		case event, ok := <-sc.ech:
+			if !ok {
+				return
+			}
+			if event.Err != nil {
+				continue
+			}
+			switch event.EventType {
+			case msgbus.PublishEvent, msgbus.UpdateEvent:
+				if rf := recordFrame(event.Msg, event.ID, event.Revision, event.Data); rf != nil {
+					sc.out.send(rf)
+				}
+			case msgbus.UnpublishEvent:
+				sc.out.send(&frame{Type: frameRecord, Op: opUnpub, Msg: event.Msg, ID: event.ID})
+			}
+		}
+	}
+}
+
+func (sc *serverConn) subscribe(f *frame) {
+	// Subscribing again to the same class is harmless
+	if _, err := sc.s.ps.SubWait(f.Msg, "", sc.ech); err != nil {
+		sc.out.send(&frame{Type: frameError, Msg: f.Msg, Err: err.Error()})
+		return
+	}
+
+	event, err := sc.s.ps.GetWait(f.Msg, "")
+	if err == nil {
+		for _, id := range event.Data.(msgbus.IDIndex) {
+			e, err := sc.s.ps.GetWait(f.Msg, id)
+			if err != nil {
+				continue
+			}
+			if rf := recordFrame(f.Msg, id, e.Revision, e.Data); rf != nil {
+				sc.out.send(rf)
+			}
+		}
+	}
+
+	sc.out.send(&frame{Type: frameSynced, Msg: f.Msg, Access: f.Access})
+}
+
+//-----------------------------------------
+// write applies a change sent by the client and returns the ack for it
+//-----------------------------------------
+func (sc *serverConn) write(f *frame) *frame {
+	ps := sc.s.ps
+
+	ack := &frame{Type: frameAck, Seq: f.Seq, Op: f.Op, Msg: f.Msg, ID: f.ID}
+
+	if sc.subs[f.Msg] != ReadWrite {
+		ack.Err = ErrAccess.Error()
+		return ack
+	}
+
+	switch f.Op {
+	case opPub, opSet:
+		data, err := msgbus.DecodeRecord(f.Msg, f.Data)
+		if err != nil {
+			ack.Err = err.Error()
+			return ack
+		}
+
+		var event *msgbus.Event
+		if f.Op == opPub {
+			event, err = ps.PubWait(f.Msg, f.ID, data)
+		} else if f.Rev == 0 {
+			event, err = ps.SetWait(f.Msg, f.ID, data)
+		} else {
+			event, err = ps.SetIfRevisionWait(f.Msg, f.ID, f.Rev, data)
+		}
+		if err != nil {
+			// Published by someone else, changed since f.Rev, or removed
+			return sc.conflict(ack)
+		}
+		ack.Rev = event.Revision
+
+	case opUnpub:
+		if _, err := ps.UnpubWait(f.Msg, f.ID); err != nil {
+			ack.Err = err.Error()
+		}
+
+	default:
+		ack.Err = fmt.Sprintf("unknown op %s", f.Op)
+	}
+
+	return ack
+}
+
+// conflict fills in the ack with the record as it now stands
+func (sc *serverConn) conflict(ack *frame) *frame {
+	ack.Conflict = true
+
+	event, err := sc.s.ps.GetWait(ack.Msg, ack.ID)
+	if err != nil || event.Data == nil {
+		ack.Op = opUnpub
+		return ack
+	}
+
+	rf := recordFrame(ack.Msg, ack.ID, event.Revision, event.Data)
+	if rf == nil {
+		ack.Conflict = false
+		ack.Err = "unable to encode current record"
+		return ack
+	}
+	ack.Op = opSet
+	ack.Rev = rf.Rev
+	ack.Data = rf.Data
+	return ack
+}
+
+func recordFrame(msg msgbus.MsgType, id msgbus.IDString, rev uint64, data interface{}) *frame {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil
+	}
+	return &frame{Type: frameRecord, Op: opSet, Msg: msg, ID: id, Rev: rev, Data: raw}
+}
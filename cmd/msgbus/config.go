@@ -0,0 +1,308 @@
+package msgbus
+
+import (
+	"context"
+	"sort"
+)
+
+//---------------------------------------------------------------
+// ConfigInfoRepo reads and writes the ConfigInfo records on the bus, see repo.go
+//---------------------------------------------------------------
+type ConfigInfoRepo struct {
+	recordRepo
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (ps *PubSub) Configs() ConfigInfoRepo {
+	return ConfigInfoRepo{recordRepo{ps: ps, msg: ConfigMsg}}
+}
+
+//---------------------------------------------------------------
+// Pub publishes config, under a random ID if it has none, and fails with
+// ErrDuplicate if the ID is taken
+//---------------------------------------------------------------
+func (r ConfigInfoRepo) Pub(config ConfigInfo) (ConfigInfo, error) {
+	if config.ID == "" {
+		config.ID = ConfigID(GetRandomIDString())
+	}
+	_, err := r.pub(IDString(config.ID), config)
+	return config, err
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r ConfigInfoRepo) Get(id ConfigID) (config ConfigInfo, err error) {
+	data, err := r.get(IDString(id))
+	if err != nil {
+		return config, err
+	}
+	return r.decode(IDString(id), data)
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r ConfigInfoRepo) Exists(id ConfigID) bool {
+	_, err := r.Get(id)
+	return err == nil
+}
+
+//---------------------------------------------------------------
+// Set replaces the stored config, failing with ErrNotFound if it was never
+// published
+//---------------------------------------------------------------
+func (r ConfigInfoRepo) Set(config ConfigInfo) error {
+	return r.set(IDString(config.ID), config)
+}
+
+//---------------------------------------------------------------
+// Update applies update to a copy of the current config and stores the
+// result, calling update again on a fresh copy if another writer changed it
+// in between.
+//---------------------------------------------------------------
+func (r ConfigInfoRepo) Update(id ConfigID, update func(c *ConfigInfo) error) (config ConfigInfo, err error) {
+	err = r.update(IDString(id), func(old interface{}) (interface{}, error) {
+		c, err := r.decode(IDString(id), old)
+		if err != nil {
+			return nil, err
+		}
+		if err := update(&c); err != nil {
+			return nil, err
+		}
+
+		config = c
+		return c, nil
+	})
+	return config, err
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r ConfigInfoRepo) Unpub(id ConfigID) error {
+	return r.unpub(IDString(id))
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r ConfigInfoRepo) IDs() (ids []ConfigID, err error) {
+	index, err := r.ids()
+	if err != nil {
+		return nil, err
+	}
+	ids = make([]ConfigID, len(index))
+	for i, id := range index {
+		ids[i] = ConfigID(id)
+	}
+	return ids, nil
+}
+
+//---------------------------------------------------------------
+// List returns the records matching filter ordered by ID, a nil filter
+// returns every record
+//---------------------------------------------------------------
+func (r ConfigInfoRepo) List(filter Filter) (configs []ConfigInfo, err error) {
+	result, err := r.query(filter)
+	if err != nil {
+		return nil, err
+	}
+	for id, data := range result {
+		c, err := r.decode(id, data)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, c)
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].ID < configs[j].ID })
+	return configs, nil
+}
+
+//---------------------------------------------------------------
+// Watch returns a channel receiving the events of every ConfigInfo, or only of
+// id if it is not empty, until ctx is done. Decode gives the record an
+// event carries.
+//---------------------------------------------------------------
+func (r ConfigInfoRepo) Watch(ctx context.Context, id ConfigID, opts ...SubOption) (EventChan, error) {
+	return r.watch(ctx, IDString(id), opts)
+}
+
+//---------------------------------------------------------------
+// Decode returns the record carried by an event, an UnpublishEvent carries
+// none and gives ErrNotFound
+//---------------------------------------------------------------
+func (r ConfigInfoRepo) Decode(e *Event) (config ConfigInfo, err error) {
+	if e.Err != nil {
+		return config, r.recordError(e.ID, e.Err)
+	}
+	if e.EventType == UnpublishEvent {
+		return config, r.recordError(e.ID, ErrNotFound)
+	}
+	return r.decode(e.ID, e.Data)
+}
+
+func (r ConfigInfoRepo) decode(id IDString, data interface{}) (config ConfigInfo, err error) {
+	switch d := data.(type) {
+	case ConfigInfo:
+		return d, nil
+	case *ConfigInfo:
+		if d != nil {
+			return *d, nil
+		}
+	}
+	return config, r.badRecord(id, data)
+}
+
+//---------------------------------------------------------------
+// ContractManagerConfigRepo reads and writes the ContractManagerConfig records on the bus, see repo.go
+//---------------------------------------------------------------
+type ContractManagerConfigRepo struct {
+	recordRepo
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (ps *PubSub) ContractManagerConfigs() ContractManagerConfigRepo {
+	return ContractManagerConfigRepo{recordRepo{ps: ps, msg: ContractManagerConfigMsg}}
+}
+
+//---------------------------------------------------------------
+// Pub publishes config, under a random ID if it has none, and fails with
+// ErrDuplicate if the ID is taken
+//---------------------------------------------------------------
+func (r ContractManagerConfigRepo) Pub(config ContractManagerConfig) (ContractManagerConfig, error) {
+	if config.ID == "" {
+		config.ID = ContractManagerConfigID(GetRandomIDString())
+	}
+	_, err := r.pub(IDString(config.ID), config)
+	return config, err
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r ContractManagerConfigRepo) Get(id ContractManagerConfigID) (config ContractManagerConfig, err error) {
+	data, err := r.get(IDString(id))
+	if err != nil {
+		return config, err
+	}
+	return r.decode(IDString(id), data)
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r ContractManagerConfigRepo) Exists(id ContractManagerConfigID) bool {
+	_, err := r.Get(id)
+	return err == nil
+}
+
+//---------------------------------------------------------------
+// Set replaces the stored config, failing with ErrNotFound if it was never
+// published
+//---------------------------------------------------------------
+func (r ContractManagerConfigRepo) Set(config ContractManagerConfig) error {
+	return r.set(IDString(config.ID), config)
+}
+
+//---------------------------------------------------------------
+// Update applies update to a copy of the current config and stores the
+// result, calling update again on a fresh copy if another writer changed it
+// in between.
+//---------------------------------------------------------------
+func (r ContractManagerConfigRepo) Update(id ContractManagerConfigID, update func(c *ContractManagerConfig) error) (config ContractManagerConfig, err error) {
+	err = r.update(IDString(id), func(old interface{}) (interface{}, error) {
+		c, err := r.decode(IDString(id), old)
+		if err != nil {
+			return nil, err
+		}
+		if err := update(&c); err != nil {
+			return nil, err
+		}
+
+		config = c
+		return c, nil
+	})
+	return config, err
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r ContractManagerConfigRepo) Unpub(id ContractManagerConfigID) error {
+	return r.unpub(IDString(id))
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r ContractManagerConfigRepo) IDs() (ids []ContractManagerConfigID, err error) {
+	index, err := r.ids()
+	if err != nil {
+		return nil, err
+	}
+	ids = make([]ContractManagerConfigID, len(index))
+	for i, id := range index {
+		ids[i] = ContractManagerConfigID(id)
+	}
+	return ids, nil
+}
+
+//---------------------------------------------------------------
+// List returns the records matching filter ordered by ID, a nil filter
+// returns every record
+//---------------------------------------------------------------
+func (r ContractManagerConfigRepo) List(filter Filter) (configs []ContractManagerConfig, err error) {
+	result, err := r.query(filter)
+	if err != nil {
+		return nil, err
+	}
+	for id, data := range result {
+		c, err := r.decode(id, data)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, c)
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].ID < configs[j].ID })
+	return configs, nil
+}
+
+//---------------------------------------------------------------
+// Watch returns a channel receiving the events of every ContractManagerConfig, or only of
+// id if it is not empty, until ctx is done. Decode gives the record an
+// event carries.
+//---------------------------------------------------------------
+func (r ContractManagerConfigRepo) Watch(ctx context.Context, id ContractManagerConfigID, opts ...SubOption) (EventChan, error) {
+	return r.watch(ctx, IDString(id), opts)
+}
+
+//---------------------------------------------------------------
+// Decode returns the record carried by an event, an UnpublishEvent carries
+// none and gives ErrNotFound
+//---------------------------------------------------------------
+func (r ContractManagerConfigRepo) Decode(e *Event) (config ContractManagerConfig, err error) {
+	if e.Err != nil {
+		return config, r.recordError(e.ID, e.Err)
+	}
+	if e.EventType == UnpublishEvent {
+		return config, r.recordError(e.ID, ErrNotFound)
+	}
+	return r.decode(e.ID, e.Data)
+}
+
+func (r ContractManagerConfigRepo) decode(id IDString, data interface{}) (config ContractManagerConfig, err error) {
+	switch d := data.(type) {
+	case ContractManagerConfig:
+		return d, nil
+	case *ContractManagerConfig:
+		if d != nil {
+			return *d, nil
+		}
+	}
+	return config, r.badRecord(id, data)
+}
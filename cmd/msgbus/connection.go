@@ -49,17 +49,9 @@ func (ps *PubSub) ConnPubWait(conn Connection) (c Connection, err error) {
 		conn.ID = ConnectionID(GetRandomIDString())
 	}
 
-	event, err := ps.PubWait(ConnectionMsg, IDString(conn.ID), conn)
-	if err != nil || event.Err != nil {
-		panic(fmt.Sprintf(lumerinlib.Funcname()+"Unable to add Record %s, %s\n", err, event.Err))
-	}
-
-	c = event.Data.(Connection)
-	if err != nil || event.Err != nil {
-		fmt.Printf(lumerinlib.Funcname()+" PubWait returned err: %s, %s\n", err, event.Err)
-	}
+	_, err = recordRepo{ps: ps, msg: ConnectionMsg}.pub(IDString(conn.ID), conn)
 
-	return c, err
+	return conn, err
 }
 
 //---------------------------------------------------------------
@@ -67,20 +59,15 @@ func (ps *PubSub) ConnPubWait(conn Connection) (c Connection, err error) {
 //---------------------------------------------------------------
 func (ps *PubSub) ConnGetWait(id ConnectionID) (conn *Connection, err error) {
 
-	if id == "" {
-		panic(fmt.Sprintf(lumerinlib.Funcname() + " ID not provided\n"))
-	}
-
-	event, err := ps.GetWait(ConnectionMsg, IDString(id))
-	if err != nil || event.Err != nil {
-		fmt.Printf(lumerinlib.Funcname()+" ID not found %s, %s\n", err, event.Err)
-	}
+	data, err := recordRepo{ps: ps, msg: ConnectionMsg}.get(IDString(id))
 
-	if event.Data == nil {
-		conn = nil
-	} else {
-		c := event.Data.(Connection)
+	switch c := data.(type) {
+	case Connection:
 		conn = &c
+	case *Connection:
+		conn = c
+	default:
+		conn = nil
 	}
 	return conn, err
 }
@@ -90,26 +77,37 @@ func (ps *PubSub) ConnGetWait(id ConnectionID) (conn *Connection, err error) {
 //---------------------------------------------------------------
 func (ps *PubSub) ConnSetWait(conn Connection) (err error) {
 
-	if conn.ID == "" {
-		panic(fmt.Sprintf(lumerinlib.Funcname() + " ID not provided\n"))
-	}
+	return recordRepo{ps: ps, msg: ConnectionMsg}.set(IDString(conn.ID), conn)
+}
 
-	_, err = ps.ConnGetWait(conn.ID)
-	if err != nil {
-		return err
-	}
+//---------------------------------------------------------------
+// ConnUpdateWait applies update to a copy of the current connection record
+// and stores the result, retrying if another writer got there first.
+//---------------------------------------------------------------
+func (ps *PubSub) ConnUpdateWait(id ConnectionID, update func(c *Connection) error) (conn *Connection, err error) {
 
-	e, err := ps.SetWait(ConnectionMsg, IDString(conn.ID), conn)
-	if err != nil {
-		return err
+	if id == "" {
+		return nil, getCommandError(MsgBusErrNoID)
 	}
 
-	if e.Err != nil {
-		return e.Err
-	}
+	_, err = ps.UpdateWait(ConnectionMsg, IDString(id), func(old interface{}) (interface{}, error) {
+		c, ok := old.(Connection)
+		if !ok {
+			return nil, getCommandError(MsgBusErrBadData)
+		}
 
-	return nil
+		if err := update(&c); err != nil {
+			return nil, err
+		}
 
+		conn = &c
+		return c, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
 }
 
 //---------------------------------------------------------------
@@ -118,7 +116,7 @@ func (ps *PubSub) ConnSetWait(conn Connection) (err error) {
 func (ps *PubSub) ConnUpdateStateWait(id ConnectionID, state ConnectionState) (err error) {
 
 	if id == "" {
-		panic(fmt.Sprintf(lumerinlib.Funcname() + " ID not provided\n"))
+		return getCommandError(MsgBusErrNoID)
 	}
 
 	conn, err := ps.ConnGetWait(id)
@@ -127,14 +125,17 @@ func (ps *PubSub) ConnUpdateStateWait(id ConnectionID, state ConnectionState) (e
 		return err
 	}
 
-	if state != conn.State {
-		conn.State = state
-		err = ps.ConnSetWait(*conn)
-		if err != nil {
-			fmt.Printf(lumerinlib.Funcname()+" ConnSetWait failed %s\n", err)
-			return err
-		}
+	if conn == nil || state == conn.State {
+		return nil
+	}
 
+	_, err = ps.ConnUpdateWait(id, func(c *Connection) error {
+		c.State = state
+		return nil
+	})
+	if err != nil {
+		fmt.Printf(lumerinlib.Funcname()+" ConnUpdateWait failed %s\n", err)
+		return err
 	}
 
 	return nil
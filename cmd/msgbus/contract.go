@@ -0,0 +1,157 @@
+package msgbus
+
+import (
+	"context"
+	"sort"
+)
+
+//---------------------------------------------------------------
+// ContractRepo reads and writes the Contract records on the bus, see repo.go
+//---------------------------------------------------------------
+type ContractRepo struct {
+	recordRepo
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (ps *PubSub) Contracts() ContractRepo {
+	return ContractRepo{recordRepo{ps: ps, msg: ContractMsg}}
+}
+
+//---------------------------------------------------------------
+// Pub publishes contract, under a random ID if it has none, and fails with
+// ErrDuplicate if the ID is taken
+//---------------------------------------------------------------
+func (r ContractRepo) Pub(contract Contract) (Contract, error) {
+	if contract.ID == "" {
+		contract.ID = ContractID(GetRandomIDString())
+	}
+	_, err := r.pub(IDString(contract.ID), contract)
+	return contract, err
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r ContractRepo) Get(id ContractID) (contract Contract, err error) {
+	data, err := r.get(IDString(id))
+	if err != nil {
+		return contract, err
+	}
+	return r.decode(IDString(id), data)
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r ContractRepo) Exists(id ContractID) bool {
+	_, err := r.Get(id)
+	return err == nil
+}
+
+//---------------------------------------------------------------
+// Set replaces the stored contract, failing with ErrNotFound if it was never
+// published
+//---------------------------------------------------------------
+func (r ContractRepo) Set(contract Contract) error {
+	return r.set(IDString(contract.ID), contract)
+}
+
+//---------------------------------------------------------------
+// Update applies update to a copy of the current contract and stores the
+// result, calling update again on a fresh copy if another writer changed it
+// in between.
+//---------------------------------------------------------------
+func (r ContractRepo) Update(id ContractID, update func(c *Contract) error) (contract Contract, err error) {
+	err = r.update(IDString(id), func(old interface{}) (interface{}, error) {
+		c, err := r.decode(IDString(id), old)
+		if err != nil {
+			return nil, err
+		}
+		if err := update(&c); err != nil {
+			return nil, err
+		}
+
+		contract = c
+		return c, nil
+	})
+	return contract, err
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r ContractRepo) Unpub(id ContractID) error {
+	return r.unpub(IDString(id))
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r ContractRepo) IDs() (ids []ContractID, err error) {
+	index, err := r.ids()
+	if err != nil {
+		return nil, err
+	}
+	ids = make([]ContractID, len(index))
+	for i, id := range index {
+		ids[i] = ContractID(id)
+	}
+	return ids, nil
+}
+
+//---------------------------------------------------------------
+// List returns the records matching filter ordered by ID, a nil filter
+// returns every record
+//---------------------------------------------------------------
+func (r ContractRepo) List(filter Filter) (contracts []Contract, err error) {
+	result, err := r.query(filter)
+	if err != nil {
+		return nil, err
+	}
+	for id, data := range result {
+		c, err := r.decode(id, data)
+		if err != nil {
+			return nil, err
+		}
+		contracts = append(contracts, c)
+	}
+	sort.Slice(contracts, func(i, j int) bool { return contracts[i].ID < contracts[j].ID })
+	return contracts, nil
+}
+
+//---------------------------------------------------------------
+// Watch returns a channel receiving the events of every Contract, or only of
+// id if it is not empty, until ctx is done. Decode gives the record an
+// event carries.
+//---------------------------------------------------------------
+func (r ContractRepo) Watch(ctx context.Context, id ContractID, opts ...SubOption) (EventChan, error) {
+	return r.watch(ctx, IDString(id), opts)
+}
+
+//---------------------------------------------------------------
+// Decode returns the record carried by an event, an UnpublishEvent carries
+// none and gives ErrNotFound
+//---------------------------------------------------------------
+func (r ContractRepo) Decode(e *Event) (contract Contract, err error) {
+	if e.Err != nil {
+		return contract, r.recordError(e.ID, e.Err)
+	}
+	if e.EventType == UnpublishEvent {
+		return contract, r.recordError(e.ID, ErrNotFound)
+	}
+	return r.decode(e.ID, e.Data)
+}
+
+func (r ContractRepo) decode(id IDString, data interface{}) (contract Contract, err error) {
+	switch d := data.(type) {
+	case Contract:
+		return d, nil
+	case *Contract:
+		if d != nil {
+			return *d, nil
+		}
+	}
+	return contract, r.badRecord(id, data)
+}
@@ -0,0 +1,499 @@
+package msgbus
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type OverflowPolicy string
+
+const (
+	// OverflowBlock holds up the registry until the subscriber makes room
+	OverflowBlock OverflowPolicy = "Block"
+	// OverflowDropOldest discards the oldest queued event, subscribers that
+	// can lose events opt in to it
+	OverflowDropOldest OverflowPolicy = "DropOldest"
+	// OverflowCoalesce folds an update into a queued event for the same
+	// record, and blocks like OverflowBlock for any other event
+	OverflowCoalesce OverflowPolicy = "Coalesce"
+	// OverflowDisconnect folds updates like OverflowCoalesce, any other event
+	// cuts the subscriber off: what it has queued is discarded and its
+	// channel closed, so the reader learns it fell behind
+	OverflowDisconnect OverflowPolicy = "Disconnect"
+)
+
+type DeliveryConfig struct {
+	Capacity int
+	Overflow OverflowPolicy
+}
+
+// DefaultDeliveryConfig applies to every event channel until
+// ConfigureDeliveryWait is called for it. A slow subscriber gets the latest
+// state of each record, one whose reader is gone never holds up the bus, and
+// none silently misses a publish or unpublish.
+var DefaultDeliveryConfig = DeliveryConfig{
+	Capacity: 1024,
+	Overflow: OverflowDisconnect,
+}
+
+type DeliveryStats struct {
+	EventChan EventChan `json:"-"`
+	// Chan names the event channel when the stats are encoded
+	Chan      string
+	Capacity  int
+	Overflow  OverflowPolicy
+	Queued    int
+	Delivered uint64
+	Dropped   uint64
+	Coalesced uint64
+	// Waiting is how long the reader has been keeping the next event waiting
+	Waiting time.Duration
+}
+
+//
+// subscriber owns the ordered queue of events waiting to be written to one
+// event channel, and the goroutine that writes them while there are any.
+// The registry lets go of it once the last subscription of the channel is
+// gone, without closing the channel.
+//
+type subscriber struct {
+	ch    EventChan
+	cfg   DeliveryConfig
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []*Event
+	// running is set while a goroutine writes the queue to ch
+	running bool
+	// subscriptions counts the subscriptions of ch, configured is set by
+	// ConfigureDeliveryWait. Without either the subscriber is reaped once
+	// its queue is empty.
+	subscriptions int
+	configured    bool
+	// idle is called by the writing goroutine when it leaves the queue empty
+	idle   func(*subscriber)
+	closed bool
+	// keepCh leaves ch open when delivery stops
+	keepCh bool
+	// reaped is set once the registry let go of the subscriber, a delivery
+	// that finds it looks the channel up again
+	reaped    bool
+	quit      chan struct{}
+	delivered uint64
+	dropped   uint64
+	coalesced uint64
+	// sending is when the event being written to ch was taken off the queue
+	sending time.Time
+}
+
+//--------------------------------------------------------------------------------
+// ConfigureDeliveryWait sets the queue capacity and overflow policy used for
+// events sent to ech.
+//--------------------------------------------------------------------------------
+func (ps *PubSub) ConfigureDeliveryWait(ech EventChan, cfg DeliveryConfig) (e *Event, err error) {
+
+	if ech == nil {
+		return e, getCommandError(MsgBusErrNoEventChan)
+	}
+
+	c := cmd{
+		op:      opDelivery,
+		sync:    true,
+		msg:     NoMsg,
+		data:    cfg,
+		eventch: ech,
+	}
+
+	return ps.dispatch(&c)
+}
+
+//--------------------------------------------------------------------------------
+// DeliveryStatsWait reports the queue depth and counters of every event
+// channel the bus is delivering to. The event Data is a []DeliveryStats.
+//--------------------------------------------------------------------------------
+func (ps *PubSub) DeliveryStatsWait() (e *Event, err error) {
+
+	c := cmd{
+		op:      opDeliveryStats,
+		sync:    true,
+		msg:     NoMsg,
+		data:    nil,
+		eventch: nil,
+	}
+
+	return ps.dispatch(&c)
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func (reg *registry) configureDelivery(c *cmd) {
+
+	event := Event{
+		EventType: DeliveryEvent,
+		Msg:       c.msg,
+		RequestID: c.requestID,
+		Data:      c.data,
+		Err:       nil,
+	}
+
+	cfg, ok := c.data.(DeliveryConfig)
+	if !ok || cfg.Capacity <= 0 {
+		event.Err = getCommandError(MsgBusErrBadData)
+	} else {
+		switch cfg.Overflow {
+		case OverflowBlock, OverflowDropOldest, OverflowCoalesce, OverflowDisconnect:
+			reg.subsMu.Lock()
+			reg.subscriberLocked(c.eventch).configure(cfg)
+			reg.subsMu.Unlock()
+		default:
+			event.Err = getCommandError(MsgBusErrBadData)
+		}
+	}
+
+	if c.sync {
+		reg.reply(c, &event)
+	}
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func (reg *registry) deliveryStats(c *cmd) {
+
+	reg.subsMu.Lock()
+	stats := make([]DeliveryStats, 0, len(reg.subs))
+	for _, s := range reg.subs {
+		stats = append(stats, s.stats())
+	}
+	reg.subsMu.Unlock()
+
+	event := Event{
+		EventType: DeliveryEvent,
+		Msg:       c.msg,
+		RequestID: c.requestID,
+		Data:      stats,
+		Err:       nil,
+	}
+
+	if c.sync {
+		reg.reply(c, &event)
+	}
+}
+
+//-----------------------------------------
+// deliver queues event for ech behind anything already queued for it
+//-----------------------------------------
+func (reg *registry) deliver(ech EventChan, event *Event) {
+	if reg.oplog != nil {
+		reg.oplog.event(event)
+	}
+	for !reg.subscriber(ech).enqueue(event) {
+		// Reaped meanwhile, ech gets a new subscriber
+	}
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func (reg *registry) subscriber(ech EventChan) *subscriber {
+	reg.subsMu.Lock()
+	defer reg.subsMu.Unlock()
+
+	return reg.subscriberLocked(ech)
+}
+
+//-----------------------------------------
+// subscriberLocked is subscriber with subsMu held
+//-----------------------------------------
+func (reg *registry) subscriberLocked(ech EventChan) *subscriber {
+	s, ok := reg.subs[ech]
+	if !ok {
+		s = newSubscriber(ech, DefaultDeliveryConfig)
+		s.idle = func(s *subscriber) { reg.reap(s, false) }
+		reg.subs[ech] = s
+		reg.metrics.addSubscriber(s)
+	}
+	return s
+}
+
+//-----------------------------------------
+// addSubscription counts a new subscription of ech
+//-----------------------------------------
+func (reg *registry) addSubscription(ech EventChan) {
+	reg.subsMu.Lock()
+	defer reg.subsMu.Unlock()
+
+	s := reg.subscriberLocked(ech)
+	s.mu.Lock()
+	s.subscriptions++
+	s.mu.Unlock()
+}
+
+//-----------------------------------------
+// endSubscription counts a subscription of ech gone. With the last one gone
+// the subscriber is reaped, at once with what it holds discarded, or with
+// drain once it has written it. Returns true if it was reaped.
+//-----------------------------------------
+func (reg *registry) endSubscription(ech EventChan, drain bool) (reaped bool) {
+	reg.subsMu.Lock()
+	s, ok := reg.subs[ech]
+	reg.subsMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	s.mu.Lock()
+	if s.subscriptions > 0 {
+		s.subscriptions--
+	}
+	last := s.subscriptions == 0
+	if last {
+		s.configured = false
+	}
+	s.mu.Unlock()
+
+	if !last {
+		return false
+	}
+	return reg.reap(s, !drain)
+}
+
+//-----------------------------------------
+// reap lets go of s if ech has no subscriptions left and s holds nothing to
+// write, or regardless of what it holds with force. ch is left open.
+//-----------------------------------------
+func (reg *registry) reap(s *subscriber, force bool) bool {
+	reg.subsMu.Lock()
+	defer reg.subsMu.Unlock()
+
+	s.mu.Lock()
+	ok := !s.reaped && s.subscriptions == 0 && !s.configured &&
+		(force || s.closed || (!s.running && len(s.queue) == 0))
+	if ok {
+		s.reaped = true
+		if !s.closed {
+			s.keepCh = true
+			s.stopLocked()
+		}
+	}
+	s.mu.Unlock()
+
+	if ok && reg.subs[s.ch] == s {
+		delete(reg.subs, s.ch)
+		reg.metrics.removeSubscriber(s)
+	}
+	return ok
+}
+
+//-----------------------------------------
+// closeSubscriber stops delivery to ech, discarding anything still queued,
+// and closes the channel.
+//-----------------------------------------
+func (reg *registry) closeSubscriber(ech EventChan) {
+	reg.subsMu.Lock()
+	s, ok := reg.subs[ech]
+	delete(reg.subs, ech)
+	reg.subsMu.Unlock()
+
+	if ok {
+		s.stop()
+		reg.metrics.removeSubscriber(s)
+	} else {
+		close(ech)
+	}
+}
+
+func newSubscriber(ch EventChan, cfg DeliveryConfig) *subscriber {
+	s := &subscriber{
+		ch:   ch,
+		cfg:  cfg,
+		quit: make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *subscriber) configure(cfg DeliveryConfig) {
+	s.mu.Lock()
+	s.cfg = cfg
+	s.configured = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+//-----------------------------------------
+// enqueue queues event, false if the subscriber has been reaped
+//-----------------------------------------
+func (s *subscriber) enqueue(event *Event) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reaped {
+		return false
+	}
+	if s.closed {
+		return true
+	}
+
+	if len(s.queue) >= s.cfg.Capacity {
+		switch s.cfg.Overflow {
+		case OverflowBlock:
+			if !s.waitRoom() {
+				return true
+			}
+
+		case OverflowCoalesce:
+			if s.coalesce(event) {
+				s.coalesced++
+				return true
+			}
+			if !s.waitRoom() {
+				return true
+			}
+
+		case OverflowDisconnect:
+			if s.coalesce(event) {
+				s.coalesced++
+				return true
+			}
+			s.dropped += uint64(len(s.queue)) + 1
+			s.stopLocked()
+			return true
+
+		default:
+			s.dropOldest()
+		}
+	}
+
+	s.queue = append(s.queue, event)
+	s.cond.Broadcast()
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	return true
+}
+
+// coalesce replaces the newest queued event for the same record with event,
+// keeping its place in the queue so events for a record stay in order.
+func (s *subscriber) coalesce(event *Event) bool {
+	if event.EventType != UpdateEvent || event.ID == "" {
+		return false
+	}
+
+	for i := len(s.queue) - 1; i >= 0; i-- {
+		q := s.queue[i]
+		if q.Msg != event.Msg || q.ID != event.ID {
+			continue
+		}
+		if q.EventType != UpdateEvent && q.EventType != PublishEvent {
+			return false
+		}
+		merged := *event
+		merged.EventType = q.EventType
+		s.queue[i] = &merged
+		return true
+	}
+
+	return false
+}
+
+// waitRoom holds up the caller until the queue has room, false when the
+// subscriber was closed meanwhile
+func (s *subscriber) waitRoom() bool {
+	for len(s.queue) >= s.cfg.Capacity && !s.closed {
+		s.cond.Wait()
+	}
+	return !s.closed
+}
+
+func (s *subscriber) dropOldest() {
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	s.dropped++
+}
+
+func (s *subscriber) stop() {
+	s.mu.Lock()
+	s.stopLocked()
+	s.mu.Unlock()
+}
+
+//-----------------------------------------
+// stopLocked ends delivery, discarding what is queued, and closes ch unless
+// keepCh is set. A goroutine still writing closes it on its way out.
+//-----------------------------------------
+func (s *subscriber) stopLocked() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.queue = nil
+	close(s.quit)
+	s.cond.Broadcast()
+	if !s.running && !s.keepCh {
+		close(s.ch)
+	}
+}
+
+func (s *subscriber) stats() DeliveryStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var waiting time.Duration
+	if !s.sending.IsZero() {
+		waiting = time.Since(s.sending)
+	}
+
+	return DeliveryStats{
+		EventChan: s.ch,
+		Chan:      fmt.Sprintf("%p", s.ch),
+		Waiting:   waiting,
+		Capacity:  s.cfg.Capacity,
+		Overflow:  s.cfg.Overflow,
+		Queued:    len(s.queue),
+		Delivered: s.delivered,
+		Dropped:   s.dropped,
+		Coalesced: s.coalesced,
+	}
+}
+
+//-----------------------------------------
+// run writes queued events to the channel one at a time, in order, until
+// the queue is empty or delivery stops
+//-----------------------------------------
+func (s *subscriber) run() {
+	for {
+		s.mu.Lock()
+		if s.closed || len(s.queue) == 0 {
+			s.running = false
+			closeCh := s.closed && !s.keepCh
+			idle := !s.closed
+			s.mu.Unlock()
+
+			if closeCh {
+				close(s.ch)
+			}
+			if idle && s.idle != nil {
+				s.idle(s)
+			}
+			return
+		}
+		event := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.sending = time.Now()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		select {
+		case s.ch <- event:
+			s.mu.Lock()
+			s.delivered++
+			s.sending = time.Time{}
+			s.mu.Unlock()
+		case <-s.quit:
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package msgbus
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func deliveryStatsFor(t *testing.T, mb *PubSub, ech EventChan) DeliveryStats {
+	event, err := mb.DeliveryStatsWait()
+	if err != nil {
+		t.Fatalf("DeliveryStatsWait returned error: %s", err)
+	}
+	for _, s := range event.Data.([]DeliveryStats) {
+		if s.EventChan == ech {
+			return s
+		}
+	}
+	t.Fatalf("no delivery stats for event channel")
+	return DeliveryStats{}
+}
+
+func TestDeliveryOrdered(t *testing.T) {
+	mb := New(1, l)
+
+	miner := Miner{ID: "MinerID01", Contracts: map[ContractID]float64{}}
+	if _, err := mb.MinerPubWait(miner); err != nil {
+		t.Fatalf("MinerPubWait returned error: %s", err)
+	}
+
+	ech := NewEventChan()
+	if _, err := mb.Sub(MinerMsg, IDString(miner.ID), ech); err != nil {
+		t.Fatalf("Sub returned error: %s", err)
+	}
+
+	const updates = 500
+	for i := 1; i <= updates; i++ {
+		miner.CurrentHashRate = i
+		if _, err := mb.Set(MinerMsg, IDString(miner.ID), miner); err != nil {
+			t.Fatalf("Set returned error: %s", err)
+		}
+	}
+
+	last := 0
+	for last < updates {
+		select {
+		case event := <-ech:
+			if event.EventType != UpdateEvent {
+				continue
+			}
+			rate := event.Data.(Miner).CurrentHashRate
+			if rate <= last {
+				t.Fatalf("update %d arrived after %d", rate, last)
+			}
+			last = rate
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after update %d", last)
+		}
+	}
+}
+
+func TestDeliveryDropOldest(t *testing.T) {
+	mb := New(1, l)
+
+	ech := NewEventChan()
+	if _, err := mb.ConfigureDeliveryWait(ech, DeliveryConfig{Capacity: 2, Overflow: OverflowDropOldest}); err != nil {
+		t.Fatalf("ConfigureDeliveryWait returned error: %s", err)
+	}
+	if _, err := mb.SubWait(DestMsg, "", ech); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := mb.DestPubWait(Dest{NetUrl: DestNetUrl(testurl)}); err != nil {
+			t.Fatalf("DestPubWait returned error: %s", err)
+		}
+	}
+
+	// Eleven events including the subscribe, at most one is held by the
+	// writer, two are queued and the rest dropped
+	s := deliveryStatsFor(t, mb, ech)
+	if s.Queued != 2 || s.Dropped < 8 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestDeliveryCoalesce(t *testing.T) {
+	mb := New(1, l)
+
+	miner := Miner{ID: "MinerID01", Contracts: map[ContractID]float64{}}
+	if _, err := mb.MinerPubWait(miner); err != nil {
+		t.Fatalf("MinerPubWait returned error: %s", err)
+	}
+
+	ech := NewEventChan()
+	if _, err := mb.ConfigureDeliveryWait(ech, DeliveryConfig{Capacity: 1, Overflow: OverflowCoalesce}); err != nil {
+		t.Fatalf("ConfigureDeliveryWait returned error: %s", err)
+	}
+	if _, err := mb.SubWait(MinerMsg, IDString(miner.ID), ech); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+
+	// let the writer pick up the subscribed event
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 1; i <= 5; i++ {
+		miner.CurrentHashRate = i
+		if err := mb.MinerSetWait(miner); err != nil {
+			t.Fatalf("MinerSetWait returned error: %s", err)
+		}
+	}
+
+	s := deliveryStatsFor(t, mb, ech)
+	if s.Coalesced != 4 || s.Dropped != 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	if event := <-ech; event.EventType != SubscribedEvent {
+		t.Fatalf("expected subscribed event, got %s", event.EventType)
+	}
+	if event := <-ech; event.Data.(Miner).CurrentHashRate != 5 {
+		t.Errorf("expected the latest update, got %+v", event.Data)
+	}
+}
+
+// A full coalescing subscriber still gets every publish and unpublish, the
+// bus waits for it rather than drop one
+func TestDeliveryCoalesceNeverDrops(t *testing.T) {
+	mb := New(1, l)
+
+	ech := NewEventChan()
+	if _, err := mb.ConfigureDeliveryWait(ech, DeliveryConfig{Capacity: 1, Overflow: OverflowCoalesce}); err != nil {
+		t.Fatalf("ConfigureDeliveryWait returned error: %s", err)
+	}
+	if _, err := mb.SubWait(DestMsg, "", ech); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			d, _ := mb.DestPubWait(Dest{NetUrl: DestNetUrl(testurl)})
+			mb.UnpubWait(DestMsg, IDString(d.ID))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("publisher was not held up by a full subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	published, unpublished := 0, 0
+	for published < 5 || unpublished < 5 {
+		select {
+		case event := <-ech:
+			switch event.EventType {
+			case PublishEvent:
+				published++
+			case UnpublishEvent:
+				unpublished++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d publish and %d unpublish events", published, unpublished)
+		}
+	}
+	<-done
+
+	if s := deliveryStatsFor(t, mb, ech); s.Dropped != 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestDeliveryBlock(t *testing.T) {
+	mb := New(1, l)
+
+	ech := NewEventChan()
+	if _, err := mb.ConfigureDeliveryWait(ech, DeliveryConfig{Capacity: 1, Overflow: OverflowBlock}); err != nil {
+		t.Fatalf("ConfigureDeliveryWait returned error: %s", err)
+	}
+	if _, err := mb.SubWait(DestMsg, "", ech); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			mb.DestPubWait(Dest{NetUrl: DestNetUrl(testurl)})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("publisher was not held up by a full subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < 6; i++ {
+		<-ech
+	}
+	<-done
+
+	// The delivered count is bumped just after the receive completes
+	s := deliveryStatsFor(t, mb, ech)
+	for deadline := time.Now().Add(time.Second); s.Delivered != 6 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		s = deliveryStatsFor(t, mb, ech)
+	}
+	if s.Dropped != 0 || s.Delivered != 6 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestRemoveAndCloseEventChan(t *testing.T) {
+	mb := New(1, l)
+
+	ech := NewEventChan()
+	if _, err := mb.SubWait(DestMsg, "", ech); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+	if _, err := mb.RemoveAndCloseEventChanWait(ech); err != nil {
+		t.Fatalf("RemoveAndCloseEventChanWait returned error: %s", err)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ech:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("event channel was not closed")
+		}
+	}
+}
+
+// A channel nobody reads any more is let go of with its last subscription,
+// the bus keeps going and no goroutine is left writing to it
+func TestDeliveryReapedOnUnsub(t *testing.T) {
+	mb := New(1, l)
+
+	dest, err := mb.DestPubWait(Dest{NetUrl: DestNetUrl(testurl)})
+	if err != nil {
+		t.Fatalf("DestPubWait returned error: %s", err)
+	}
+	before := runtime.NumGoroutine()
+
+	ech := NewEventChan()
+	if _, err := mb.SubWait(DestMsg, IDString(dest.ID), ech); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+	if _, err := mb.UnsubWait(DestMsg, IDString(dest.ID), ech); err != nil {
+		t.Fatalf("UnsubWait returned error: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < DefaultDeliveryConfig.Capacity+100; i++ {
+			mb.SetWait(DestMsg, IDString(dest.ID), dest)
+			mb.DestPubWait(Dest{NetUrl: DestNetUrl(testurl)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("publisher held up by an unsubscribed channel")
+	}
+
+	n := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); n > before && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	if n > before {
+		t.Errorf("goroutines before:%d after:%d", before, n)
+	}
+
+	event, err := mb.DeliveryStatsWait()
+	if err != nil {
+		t.Fatalf("DeliveryStatsWait returned error: %s", err)
+	}
+	for _, s := range event.Data.([]DeliveryStats) {
+		if s.EventChan == ech {
+			t.Errorf("unsubscribed channel still has delivery stats: %+v", s)
+		}
+	}
+}
+
+// A subscriber that falls a full queue behind is cut off rather than hold
+// up the bus, its channel is closed
+func TestDeliveryDisconnect(t *testing.T) {
+	mb := New(1, l)
+
+	ech := NewEventChan()
+	if _, err := mb.ConfigureDeliveryWait(ech, DeliveryConfig{Capacity: 1, Overflow: OverflowDisconnect}); err != nil {
+		t.Fatalf("ConfigureDeliveryWait returned error: %s", err)
+	}
+	if _, err := mb.SubWait(DestMsg, "", ech); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			mb.DestPubWait(Dest{NetUrl: DestNetUrl(testurl)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("publisher held up by a full subscriber")
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ech:
+			if !ok {
+				if s := deliveryStatsFor(t, mb, ech); s.Dropped == 0 {
+					t.Errorf("unexpected stats: %+v", s)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("event channel was not closed")
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package msgbus
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/url"
+	"sort"
 
 	"github.com/daniel-888/proxy-router/lumerinlib"
 )
@@ -14,6 +16,10 @@ type DestID IDString
 
 const DEFAULT_DEST_ID DestID = "DefaultDestID"
 
+// Dest URL schemes of pools dialed with TLS
+const DestSchemeSSL = "stratum+ssl"
+const DestSchemeTLS = "stratum+tls"
+
 type Dest struct {
 	ID     DestID
 	NetUrl DestNetUrl
@@ -28,17 +34,7 @@ func (ps *PubSub) DestPubWait(dest Dest) (d Dest, err error) {
 		dest.ID = DestID(GetRandomIDString())
 	}
 
-	event, err := ps.PubWait(DestMsg, IDString(dest.ID), dest)
-	if err != nil || event.Err != nil {
-		panic(fmt.Sprintf(lumerinlib.Funcname()+"Unable to add Record %s, %s\n", err, event.Err))
-	}
-
-	d = event.Data.(Dest)
-	if err != nil || event.Err != nil {
-		fmt.Printf(lumerinlib.Funcname()+" PubWait returned err: %s, %s\n", err, event.Err)
-	}
-
-	return d, err
+	return ps.Dests().Pub(dest)
 }
 
 //---------------------------------------------------------------
@@ -46,26 +42,12 @@ func (ps *PubSub) DestPubWait(dest Dest) (d Dest, err error) {
 //---------------------------------------------------------------
 func (ps *PubSub) DestGetWait(id DestID) (dest *Dest, err error) {
 
-	if id == "" {
-		return nil, fmt.Errorf(lumerinlib.FileLine() + " empty DestID passed in\n")
-	}
-
-	event, err := ps.GetWait(DestMsg, IDString(id))
-	if err != nil || event.Err != nil {
-		fmt.Printf(lumerinlib.Funcname()+" ID not found %s, %s\n", err, event.Err)
-	}
-
-	switch event.Data.(type) {
-	case Dest:
-		d := event.Data.(Dest)
-		dest = &d
-	case *Dest:
-		dest = event.Data.(*Dest)
-	default:
-		dest = nil
+	d, err := ps.Dests().Get(id)
+	if err != nil {
+		return nil, err
 	}
 
-	return dest, err
+	return &d, nil
 }
 
 //---------------------------------------------------------------
@@ -73,6 +55,28 @@ func (ps *PubSub) DestGetWait(id DestID) (dest *Dest, err error) {
 //---------------------------------------------------------------
 func (d *Dest) NetAddr() (addr net.Addr, e error) {
 
+	u, e := url.Parse(string(d.NetUrl))
+	if e != nil {
+		return nil, e
+	}
+
+	//
+	// TLS pools, ?pin= (repeatable) pins the server's public key instead of
+	// checking its certificate chain
+	//
+	switch u.Scheme {
+	case DestSchemeSSL, DestSchemeTLS:
+		var pins [][]byte
+		for _, p := range u.Query()["pin"] {
+			pin, e := lumerinlib.ParsePin(p)
+			if e != nil {
+				return nil, e
+			}
+			pins = append(pins, pin)
+		}
+		return lumerinlib.NewTLSNetAddr(net.JoinHostPort(d.Host(), d.Port()), d.Host(), pins), nil
+	}
+
 	// Assum TCP for the moment.
 
 	tcp, e := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%s", d.Host(), d.Port()))
@@ -127,6 +131,23 @@ func (d *Dest) Port() (port string) {
 	return port
 }
 
+//---------------------------------------------------------------
+// SetHostPort points the dest at a new endpoint, keeping the scheme,
+// the worker and the options
+//---------------------------------------------------------------
+func (d *Dest) SetHostPort(host string, port string) (e error) {
+
+	u, e := url.Parse(string(d.NetUrl))
+	if e != nil {
+		return e
+	}
+
+	u.Host = net.JoinHostPort(host, port)
+	d.NetUrl = DestNetUrl(u.String())
+
+	return nil
+}
+
 //---------------------------------------------------------------
 //
 //---------------------------------------------------------------
@@ -161,3 +182,154 @@ func (d *Dest) Password() string {
 		return ""
 	}
 }
+
+//---------------------------------------------------------------
+// DestRepo reads and writes the Dest records on the bus, see repo.go
+//---------------------------------------------------------------
+type DestRepo struct {
+	recordRepo
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (ps *PubSub) Dests() DestRepo {
+	return DestRepo{recordRepo{ps: ps, msg: DestMsg}}
+}
+
+//---------------------------------------------------------------
+// Pub publishes dest, under a random ID if it has none, and fails with
+// ErrDuplicate if the ID is taken
+//---------------------------------------------------------------
+func (r DestRepo) Pub(dest Dest) (Dest, error) {
+	if dest.ID == "" {
+		dest.ID = DestID(GetRandomIDString())
+	}
+	_, err := r.pub(IDString(dest.ID), dest)
+	return dest, err
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r DestRepo) Get(id DestID) (dest Dest, err error) {
+	data, err := r.get(IDString(id))
+	if err != nil {
+		return dest, err
+	}
+	return r.decode(IDString(id), data)
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r DestRepo) Exists(id DestID) bool {
+	_, err := r.Get(id)
+	return err == nil
+}
+
+//---------------------------------------------------------------
+// Set replaces the stored dest, failing with ErrNotFound if it was never
+// published
+//---------------------------------------------------------------
+func (r DestRepo) Set(dest Dest) error {
+	return r.set(IDString(dest.ID), dest)
+}
+
+//---------------------------------------------------------------
+// Update applies update to a copy of the current dest and stores the
+// result, calling update again on a fresh copy if another writer changed it
+// in between.
+//---------------------------------------------------------------
+func (r DestRepo) Update(id DestID, update func(d *Dest) error) (dest Dest, err error) {
+	err = r.update(IDString(id), func(old interface{}) (interface{}, error) {
+		d, err := r.decode(IDString(id), old)
+		if err != nil {
+			return nil, err
+		}
+		if err := update(&d); err != nil {
+			return nil, err
+		}
+
+		dest = d
+		return d, nil
+	})
+	return dest, err
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r DestRepo) Unpub(id DestID) error {
+	return r.unpub(IDString(id))
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r DestRepo) IDs() (ids []DestID, err error) {
+	index, err := r.ids()
+	if err != nil {
+		return nil, err
+	}
+	ids = make([]DestID, len(index))
+	for i, id := range index {
+		ids[i] = DestID(id)
+	}
+	return ids, nil
+}
+
+//---------------------------------------------------------------
+// List returns the records matching filter ordered by ID, a nil filter
+// returns every record
+//---------------------------------------------------------------
+func (r DestRepo) List(filter Filter) (dests []Dest, err error) {
+	result, err := r.query(filter)
+	if err != nil {
+		return nil, err
+	}
+	for id, data := range result {
+		d, err := r.decode(id, data)
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, d)
+	}
+	sort.Slice(dests, func(i, j int) bool { return dests[i].ID < dests[j].ID })
+	return dests, nil
+}
+
+//---------------------------------------------------------------
+// Watch returns a channel receiving the events of every Dest, or only of
+// id if it is not empty, until ctx is done. Decode gives the record an
+// event carries.
+//---------------------------------------------------------------
+func (r DestRepo) Watch(ctx context.Context, id DestID, opts ...SubOption) (EventChan, error) {
+	return r.watch(ctx, IDString(id), opts)
+}
+
+//---------------------------------------------------------------
+// Decode returns the record carried by an event, an UnpublishEvent carries
+// none and gives ErrNotFound
+//---------------------------------------------------------------
+func (r DestRepo) Decode(e *Event) (dest Dest, err error) {
+	if e.Err != nil {
+		return dest, r.recordError(e.ID, e.Err)
+	}
+	if e.EventType == UnpublishEvent {
+		return dest, r.recordError(e.ID, ErrNotFound)
+	}
+	return r.decode(e.ID, e.Data)
+}
+
+func (r DestRepo) decode(id IDString, data interface{}) (dest Dest, err error) {
+	switch d := data.(type) {
+	case Dest:
+		return d, nil
+	case *Dest:
+		if d != nil {
+			return *d, nil
+		}
+	}
+	return dest, r.badRecord(id, data)
+}
@@ -1,9 +1,11 @@
 package msgbus
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/daniel-888/proxy-router/cmd/log"
+	"github.com/daniel-888/proxy-router/lumerinlib"
 )
 
 var (
@@ -99,3 +101,48 @@ func TestUsername(t *testing.T) {
 	}
 
 }
+
+func TestDestNetAddrTLS(t *testing.T) {
+
+	pin := "0f0e0d0c0b0a09080706050403020100000102030405060708090a0b0c0d0e0f"
+	dest := Dest{NetUrl: DestNetUrl("stratum+ssl://" + username + ":@pool.example.com:" + port + "/?pin=" + pin)}
+
+	addr, err := dest.NetAddr()
+	if err != nil {
+		t.Fatalf("NetAddr returned error: %s\n", err)
+	}
+	tlsaddr, ok := addr.(*lumerinlib.TLSNetAddr)
+	if !ok || addr.Network() != string(lumerinlib.TLS) || addr.String() != "pool.example.com:"+port {
+		t.Fatalf("NetAddr returned %T %s %s\n", addr, addr.Network(), addr)
+	}
+	if tlsaddr.ServerName != "pool.example.com" || len(tlsaddr.Pins) != 1 || fmt.Sprintf("%x", tlsaddr.Pins[0]) != pin {
+		t.Errorf("NetAddr returned wrong TLS options: %s %x\n", tlsaddr.ServerName, tlsaddr.Pins)
+	}
+
+	dest.NetUrl = DestNetUrl("stratum+tls://" + username + ":@pool.example.com:" + port + "/?pin=bad")
+	if _, err = dest.NetAddr(); err == nil {
+		t.Errorf("NetAddr accepted a bad pin\n")
+	}
+
+	dest.NetUrl = DestNetUrl(testurl)
+	if addr, err = dest.NetAddr(); err != nil || addr.Network() != "tcp" {
+		t.Errorf("NetAddr for stratum+tcp returned %v %v\n", addr, err)
+	}
+}
+
+func TestSetHostPort(t *testing.T) {
+
+	var dest Dest
+
+	dest.ID = DestID(GetRandomIDString())
+	dest.NetUrl = DestNetUrl("stratum+ssl://" + username + ":@pool.example.com:" + port + "/?pin=00")
+
+	if err := dest.SetHostPort("pool2.example.com", "3335"); err != nil {
+		t.Fatalf("SetHostPort returned error: %s\n", err)
+	}
+
+	want := "stratum+ssl://" + username + ":@pool2.example.com:3335/?pin=00"
+	if string(dest.NetUrl) != want {
+		t.Errorf("Got %s, wanted %s", dest.NetUrl, want)
+	}
+}
@@ -25,9 +25,64 @@ type Miner struct {
 	State                   MinerState
 	Contracts               map[ContractID]float64 // Updated by Connection Scheduler
 	Dest                    DestID                 // Updated by Connection Scheduler
+	DefaultDest             DestID                 // Default Dest of the listener the miner came in on
 	InitialMeasuredHashRate int
 	CurrentHashRate         int
 	TimeSlice               bool
+	Shares                  map[DestID]ShareStats // Updated by the stratum layer
+	LocalRejects            ShareStats            // Shares the stratum layer refused without a pool
+}
+
+type ShareResult string
+
+const (
+	ShareAccepted      ShareResult = "Accepted"
+	ShareDuplicate     ShareResult = "Duplicate"
+	ShareLowDifficulty ShareResult = "LowDifficulty"
+	ShareStale         ShareResult = "Stale"
+	ShareUnknownJob    ShareResult = "UnknownJob"
+	ShareRejected      ShareResult = "Rejected"  // Any other reason the pool gave
+	ShareMalformed     ShareResult = "Malformed" // Refused by the proxy, never sent to a pool
+)
+
+//
+// ShareStats counts the pool's answers to the shares a miner sent to one
+// Dest. A contract's delivery is the AcceptedWork of its miners at the
+// contract's Dest. A miner's LocalRejects count the same way the shares the
+// proxy answered itself.
+//
+type ShareStats struct {
+	Accepted      uint64
+	Duplicate     uint64
+	LowDifficulty uint64
+	Stale         uint64
+	UnknownJob    uint64
+	Rejected      uint64
+	Malformed     uint64
+	AcceptedWork  float64 // Sum of the pool difficulties of the accepted shares
+}
+
+//
+// Add() counts one share at the pool difficulty diff
+//
+func (s *ShareStats) Add(result ShareResult, diff float64) {
+	switch result {
+	case ShareAccepted:
+		s.Accepted++
+		s.AcceptedWork += diff
+	case ShareDuplicate:
+		s.Duplicate++
+	case ShareLowDifficulty:
+		s.LowDifficulty++
+	case ShareStale:
+		s.Stale++
+	case ShareUnknownJob:
+		s.UnknownJob++
+	case ShareMalformed:
+		s.Malformed++
+	default:
+		s.Rejected++
+	}
 }
 
 //---------------------------------------------------------------
@@ -38,34 +93,22 @@ func (ps *PubSub) MinerPubWait(miner Miner) (m Miner, err error) {
 		miner.ID = MinerID(GetRandomIDString())
 	}
 
-	event, err := ps.PubWait(MinerMsg, IDString(miner.ID), miner)
-	if err != nil || event.Err != nil {
-		panic(fmt.Sprintf(lumerinlib.Funcname()+" Unable to add Record %s, %s\n", err, event.Err))
-	}
-
-	m = event.Data.(Miner)
-	if err != nil || event.Err != nil {
-		fmt.Printf(lumerinlib.Funcname()+" PubWait returned err: %s, %s\n", err, event.Err)
-	}
+	_, err = recordRepo{ps: ps, msg: MinerMsg}.pub(IDString(miner.ID), miner)
 
-	return m, err
+	return miner, err
 }
 
 //---------------------------------------------------------------
 //
 //---------------------------------------------------------------
 func (ps *PubSub) MinerGetWait(id MinerID) (miner *Miner, err error) {
-	event, err := ps.GetWait(MinerMsg, IDString(id))
-	if err != nil || event.Err != nil {
-		fmt.Printf(lumerinlib.Funcname()+" ID not found %s, %s\n", err, event.Err)
-	}
+	data, err := recordRepo{ps: ps, msg: MinerMsg}.get(IDString(id))
 
-	switch event.Data.(type) {
+	switch m := data.(type) {
 	case Miner:
-		m := event.Data.(Miner)
 		miner = &m
 	case *Miner:
-		miner = event.Data.(*Miner)
+		miner = m
 	default:
 		miner = nil
 	}
@@ -77,57 +120,23 @@ func (ps *PubSub) MinerGetWait(id MinerID) (miner *Miner, err error) {
 //
 //---------------------------------------------------------------
 func (ps *PubSub) MinerSetWait(miner Miner) (err error) {
-	if miner.ID == "" {
-		panic(fmt.Sprintf(lumerinlib.Funcname() + " ID not provided\n"))
-	}
-
-	_, err = ps.MinerGetWait(miner.ID)
-	if err != nil {
-		return err
-	}
-
-	e, err := ps.SetWait(MinerMsg, IDString(miner.ID), miner)
-	if err != nil {
-		return err
-	}
-
-	if e.Err != nil {
-		return e.Err
-	}
-
-	return nil
-
+	return recordRepo{ps: ps, msg: MinerMsg}.set(IDString(miner.ID), miner)
 }
 
 //---------------------------------------------------------------
 //
 //---------------------------------------------------------------
 func (ps *PubSub) MinerGetAllWait() (miners []MinerID, err error) {
-	event, err := ps.GetWait(MinerMsg, "")
-	if err != nil || event.Err != nil {
-		fmt.Printf(lumerinlib.Funcname()+" Error gettig all  %s, %s\n", err, event.Err)
-		if err != nil {
-			return nil, err
-		} else {
-			return nil, event.Err
-		}
+	index, err := recordRepo{ps: ps, msg: MinerMsg}.ids()
+	if err != nil {
+		return nil, err
 	}
 
-	if event.EventType != GetIndexEvent {
-		panic(fmt.Sprint(lumerinlib.FileLine()+" Error:%v\n", event))
+	miners = make([]MinerID, len(index))
+	for i, v := range index {
+		miners[i] = MinerID(v)
 	}
-
-	count := len(event.Data.(IDIndex))
-	miners = make([]MinerID, count)
-
-	if count == 0 {
-		fmt.Printf(lumerinlib.FileLine() + " No miners are online\n")
-	} else {
-		for i, v := range event.Data.(IDIndex) {
-			miners[i] = MinerID(v)
-		}
-	}
-	return miners, err
+	return miners, nil
 }
 
 //---------------------------------------------------------------
@@ -138,20 +147,62 @@ func (ps *PubSub) MinerExistsWait(id MinerID) bool {
 	return miner != nil
 }
 
+//---------------------------------------------------------------
+// MinerUpdateWait applies update to a copy of the current miner record and
+// stores the result, calling update again on a fresh copy if another writer
+// changed the miner in between.
+//---------------------------------------------------------------
+func (ps *PubSub) MinerUpdateWait(id MinerID, update func(m *Miner) error) (m *Miner, err error) {
+	_, err = ps.UpdateWait(MinerMsg, IDString(id), func(old interface{}) (interface{}, error) {
+		var miner Miner
+		switch o := old.(type) {
+		case Miner:
+			miner = o
+		case *Miner:
+			miner = *o
+		default:
+			return nil, getCommandError(MsgBusErrBadData)
+		}
+
+		// The stored record shares its map, update must only touch a copy
+		contracts := make(map[ContractID]float64, len(miner.Contracts))
+		for k, v := range miner.Contracts {
+			contracts[k] = v
+		}
+		miner.Contracts = contracts
+
+		if miner.Shares != nil {
+			shares := make(map[DestID]ShareStats, len(miner.Shares))
+			for k, v := range miner.Shares {
+				shares[k] = v
+			}
+			miner.Shares = shares
+		}
+
+		if err := update(&miner); err != nil {
+			return nil, err
+		}
+
+		m = &miner
+		return miner, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
 //---------------------------------------------------------------
 //
 //---------------------------------------------------------------
 func (ps *PubSub) MinerSetDestWait(miner MinerID, dest DestID) (m *Miner, err error) {
-	m, err = ps.MinerGetWait(miner)
-	if err != nil {
-		fmt.Printf(lumerinlib.FileLine()+" MinerGetWait errored out:%s\n", err)
-		return m, err
-	} else {
+	m, err = ps.MinerUpdateWait(miner, func(m *Miner) error {
 		m.Dest = dest
-		err = ps.MinerSetWait(*m)
-		if err != nil {
-			fmt.Printf(lumerinlib.FileLine()+" MinerSetWait errored out:%s\n", err)
-		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf(lumerinlib.FileLine()+" MinerUpdateWait errored out:%s\n", err)
 	}
 	return m, err
 }
@@ -160,33 +211,85 @@ func (ps *PubSub) MinerSetDestWait(miner MinerID, dest DestID) (m *Miner, err er
 //
 //---------------------------------------------------------------
 func (ps *PubSub) MinerSetContractWait(miner MinerID, contract ContractID, slicePercent float64, timeSlice bool) (m *Miner, err error) {
-	m, err = ps.MinerGetWait(miner)
+	m, err = ps.MinerUpdateWait(miner, func(m *Miner) error {
+		m.Contracts[contract] = slicePercent
+		m.TimeSlice = timeSlice
+		return nil
+	})
 	if err != nil {
-		fmt.Printf(lumerinlib.FileLine()+" MinerGetWait errored out:%s\n", err)
-		return m, err
-	} else {
+		fmt.Printf(lumerinlib.FileLine()+" MinerUpdateWait errored out:%s\n", err)
+	}
+	return m, err
+}
+
+//---------------------------------------------------------------
+// MinerAssignContractWait records the contract slice and points the miner at
+// dest in a single update, so subscribers never see the miner sent to a
+// destination before its contract slice is recorded.
+//---------------------------------------------------------------
+func (ps *PubSub) MinerAssignContractWait(miner MinerID, contract ContractID, slicePercent float64, timeSlice bool, dest DestID) (m *Miner, err error) {
+	m, err = ps.MinerUpdateWait(miner, func(m *Miner) error {
 		m.Contracts[contract] = slicePercent
 		m.TimeSlice = timeSlice
-		err = ps.MinerSetWait(*m)
-		if err != nil {
-			fmt.Printf(lumerinlib.FileLine()+" MinerSetWait errored out:%s\n", err)
+		m.Dest = dest
+		return nil
+	})
+	if err != nil {
+		fmt.Printf(lumerinlib.FileLine()+" MinerUpdateWait errored out:%s\n", err)
+	}
+	return m, err
+}
+
+//---------------------------------------------------------------
+// MinerAddShareWait counts a share answered by dest at the pool
+// difficulty diff
+//---------------------------------------------------------------
+func (ps *PubSub) MinerAddShareWait(miner MinerID, dest DestID, result ShareResult, diff float64) (m *Miner, err error) {
+	m, err = ps.MinerUpdateWait(miner, func(m *Miner) error {
+		if m.Shares == nil {
+			m.Shares = make(map[DestID]ShareStats)
 		}
+		stats := m.Shares[dest]
+		stats.Add(result, diff)
+		m.Shares[dest] = stats
+		return nil
+	})
+	if err != nil {
+		fmt.Printf(lumerinlib.FileLine()+" MinerUpdateWait errored out:%s\n", err)
 	}
 	return m, err
 }
 
-func (ps *PubSub) MinerRemoveContractWait(miner MinerID, contract ContractID, defaultDest DestID) (m *Miner, err error) {
-	m, err = ps.MinerGetWait(miner)
+//---------------------------------------------------------------
+// MinerAddLocalRejectWait counts a share the stratum layer refused
+// without sending it to a pool
+//---------------------------------------------------------------
+func (ps *PubSub) MinerAddLocalRejectWait(miner MinerID, result ShareResult) (m *Miner, err error) {
+	m, err = ps.MinerUpdateWait(miner, func(m *Miner) error {
+		m.LocalRejects.Add(result, 0)
+		return nil
+	})
 	if err != nil {
-		fmt.Printf(lumerinlib.FileLine()+" MinerGetWait errored out:%s\n", err)
-		return m, err
-	} else {
+		fmt.Printf(lumerinlib.FileLine()+" MinerUpdateWait errored out:%s\n", err)
+	}
+	return m, err
+}
+
+//
+// MinerRemoveContractWait() sends a miner left without contracts back to its
+// own DefaultDest, or defaultDest when it has none
+//
+func (ps *PubSub) MinerRemoveContractWait(miner MinerID, contract ContractID, defaultDest DestID) (m *Miner, err error) {
+	m, err = ps.MinerUpdateWait(miner, func(m *Miner) error {
 		if _, ok := m.Contracts[contract]; !ok {
 			fmt.Println(lumerinlib.FileLine() + "Trying to remove contract from Miner that doesn't contain it")
 		}
 		delete(m.Contracts, contract)
 		if len(m.Contracts) == 0 {
 			m.Dest = defaultDest
+			if m.DefaultDest != "" {
+				m.Dest = m.DefaultDest
+			}
 			m.TimeSlice = false
 		} else {
 			sliced := false
@@ -199,29 +302,44 @@ func (ps *PubSub) MinerRemoveContractWait(miner MinerID, contract ContractID, de
 			}
 			m.TimeSlice = sliced
 		}
-		err = ps.MinerSetWait(*m)
-		if err != nil {
-			fmt.Printf(lumerinlib.FileLine()+" MinerSetWait errored out:%s\n", err)
-		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf(lumerinlib.FileLine()+" MinerUpdateWait errored out:%s\n", err)
 	}
 	return m, err
 }
 
 func (ps *PubSub) MinersContainContract(contract ContractID) (result []Miner) {
-	miners, err := ps.MinerGetAllWait()
+	miners, err := ps.MinerQueryWait(Filter{FieldHasKey("Contracts", contract)})
 	if err != nil {
-		panic(fmt.Sprintf(lumerinlib.Funcname()+" Error gettig all miners, error %v\n", err))
+		panic(fmt.Sprintf(lumerinlib.Funcname()+" Error gettig miners, error %v\n", err))
 	}
-	for _, m := range miners {
-		miner, err := ps.MinerGetWait(m)
-		if err != nil {
-			panic(fmt.Sprintf(lumerinlib.Funcname()+" Error gettig miner, error %v\n", err))
-		}
-		if _, ok := miner.Contracts[contract]; ok {
-			result = append(result, *miner)
+	return miners
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (ps *PubSub) MinerQueryWait(filter Filter) (miners []Miner, err error) {
+	event, err := ps.QueryWait(MinerMsg, filter)
+	if err != nil {
+		return nil, err
+	}
+	if event.Err != nil {
+		return nil, event.Err
+	}
+
+	for _, data := range event.Data.(QueryResult) {
+		switch m := data.(type) {
+		case Miner:
+			miners = append(miners, m)
+		case *Miner:
+			miners = append(miners, *m)
 		}
 	}
-	return result
+
+	return miners, nil
 }
 
 func (ps *PubSub) MinerSlicedUtilization(id MinerID) float64 {
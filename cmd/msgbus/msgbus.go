@@ -3,6 +3,9 @@ package msgbus
 import (
 	"crypto/rand"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/daniel-888/proxy-router/cmd/log"
 	"github.com/daniel-888/proxy-router/lumerinlib"
@@ -14,16 +17,24 @@ type MsgType string
 type MsgBusError string
 
 const (
-	opNop      operation = "opNop"
-	opPub      operation = "opPub"
-	opSub      operation = "opSub"
-	opGet      operation = "opGet"
-	opSet      operation = "opSet"
-	opSearch   operation = "opSearch"
-	opUnsub    operation = "opUnsub"
-	opUnpub    operation = "opUnpub"
-	opRemove   operation = "opRemove"
-	opShutdown operation = "opShutdown"
+	opNop           operation = "opNop"
+	opPub           operation = "opPub"
+	opSub           operation = "opSub"
+	opGet           operation = "opGet"
+	opSet           operation = "opSet"
+	opSetIf         operation = "opSetIf"
+	opSearch        operation = "opSearch"
+	opUnsub         operation = "opUnsub"
+	opUnpub         operation = "opUnpub"
+	opRemove        operation = "opRemove"
+	opStream        operation = "opStream"
+	opQuery         operation = "opQuery"
+	opIndex         operation = "opIndex"
+	opTxn           operation = "opTxn"
+	opDelivery      operation = "opDelivery"
+	opDeliveryStats operation = "opDeliveryStats"
+	opOpLog         operation = "opOpLog"
+	opShutdown      operation = "opShutdown"
 )
 
 const (
@@ -39,6 +50,11 @@ const (
 	SubscribedEvent   EventType = "SubEvent"
 	UnsubscribedEvent EventType = "UnsubEvent"
 	RemovedEvent      EventType = "RemovedEvent"
+	StreamEvent       EventType = "StreamEvent"
+	QueryEvent        EventType = "QueryEvent"
+	IndexedEvent      EventType = "IndexedEvent"
+	DeliveryEvent     EventType = "DeliveryEvent"
+	TxnEvent          EventType = "TxnEvent"
 )
 
 const (
@@ -54,13 +70,22 @@ const (
 	ValidateMsg              MsgType = "ValidateMsg"
 )
 
+// streamMsgTypes are message classes that are fanned out to subscribers as
+// they arrive and never stored in the registry, so they cost nothing once
+// delivered no matter how many are sent.
+var streamMsgTypes = map[MsgType]bool{
+	ValidateMsg: true,
+}
+
 type Event struct {
 	EventType EventType
 	Msg       MsgType
 	ID        IDString
 	RequestID int
-	Data      interface{}
-	Err       error
+	// Revision of the record after a Pub or Set, or as read by a Get
+	Revision uint64
+	Data     interface{}
+	Err      error
 }
 
 type EventChan chan *Event
@@ -72,24 +97,49 @@ type Subscribers struct {
 type registryData struct {
 	sub  Subscribers
 	data interface{}
+	// rev starts at 1 on publish and increments on every set
+	rev uint64
 }
 
 type IDIndex []IDString
 
 type registry struct {
-	data   map[MsgType]map[IDString]registryData
-	notify map[MsgType]map[chan *Event]interface{}
+	data    map[MsgType]map[IDString]registryData
+	notify  map[MsgType]map[chan *Event]interface{}
+	indexes map[MsgType]map[string]fieldIndex
+	subs    map[EventChan]*subscriber
+	store   *persistStore
+	oplog   *opLog
+	// subscriptions holds the options of the subscriptions that have any
+	subscriptions map[subKey]*subscription
+	metrics       *metrics
+	// snapshots serve GetWait, one for each message type with a shard
+	snapshots map[MsgType]*snapshot
+	// subsMu and subscriptionsMu guard subs and subscriptions, which every
+	// shard delivers through
+	subsMu          sync.Mutex
+	subscriptionsMu sync.RWMutex
 }
 
 // PubSub is a collection of topics.
 type PubSub struct {
+	// cmdChan feeds the coordinator, shards the per message type workers
 	cmdChan  chan *cmd
+	shards   map[MsgType]*shard
 	capacity int
+	// gate is held shared by shard commands and exclusively by coordinator
+	// commands, from dispatch until the command has been handled
+	gate sync.RWMutex
+	// serial is set while every command has to go through the coordinator
+	serial int32
+	// quit stops the shard workers on shutdown
+	quit chan struct{}
 	// requestIDChan carries the incrementing request IDs
 	requestIDChan chan int
 	// done signals to close the requestIDChan
 	done   chan struct{}
 	logger *log.Logger
+	reg    *registry
 }
 
 const (
@@ -106,8 +156,24 @@ const (
 	MsgBusErrBadSearchTerm MsgBusError = "BadSearchTerm"
 	MsgBusErrDupID         MsgBusError = "DupID"
 	MsgBusErrDupData       MsgBusError = "DupData"
+	MsgBusErrRevision      MsgBusError = "RevisionConflict"
+)
+
+// ErrRevisionConflict is returned when a SetIfRevision finds the record has
+// been changed since the expected revision was read.
+var ErrRevisionConflict = getCommandError(MsgBusErrRevision)
+
+// ErrNotFound and ErrDuplicate are matched with errors.Is against the errors
+// returned for a missing record and for publishing an existing one.
+var (
+	ErrNotFound  error = MsgBusErrBadID
+	ErrDuplicate error = MsgBusErrDupData
 )
 
+// maxUpdateRetries bounds how many times UpdateWait re-reads a record that
+// keeps changing underneath it.
+const maxUpdateRetries = 16
+
 type cmd struct {
 	op operation
 	// sync indicates how the response should be sent back to the caller,
@@ -117,12 +183,16 @@ type cmd struct {
 	ID   IDString
 	// requestID is an incrementing value to keep track of each async call.
 	requestID int
-	Name      string
-	IP        string
-	MAC       string
-	data      interface{}
-	eventch   EventChan
-	returnch  EventChan
+	// rev is the revision an opSetIf expects the record to be at
+	rev      uint64
+	Name     string
+	IP       string
+	MAC      string
+	data     interface{}
+	eventch  EventChan
+	returnch EventChan
+	// queued is when the command was sent to the registry
+	queued time.Time
 }
 
 var SubmitCountChan chan int
@@ -140,7 +210,14 @@ func init() {
 //
 //--------------------------------------------------------------------------------
 func getCommandError(e MsgBusError) error {
-	return fmt.Errorf("command Error: %s", e)
+	return fmt.Errorf("command Error: %w", e)
+}
+
+//--------------------------------------------------------------------------------
+// Error lets callers test for a MsgBusError with errors.Is
+//--------------------------------------------------------------------------------
+func (e MsgBusError) Error() string {
+	return string(e)
 }
 
 // New creates a new PubSub and starts a goroutine for handling operations.
@@ -151,12 +228,43 @@ func New(capacity int, l *log.Logger) *PubSub {
 		capacity:      capacity,
 		requestIDChan: make(chan int),
 		logger:        l,
+		reg:           newRegistry(),
 	}
+	ps.newShards()
 	go ps.start()
 
 	return ps
 }
 
+// NewPersistent creates a PubSub backed by a snapshot and write-ahead journal
+// in cfg.Dir. Records left by a previous run are replayed before New returns,
+// so subsystems started afterwards see the restored state.
+func NewPersistent(capacity int, l *log.Logger, cfg PersistConfig) (ps *PubSub, err error) {
+	store, err := openPersistStore(cfg, l)
+	if err != nil {
+		return nil, err
+	}
+
+	reg := newRegistry()
+	if err = store.load(reg); err != nil {
+		return nil, err
+	}
+	reg.store = store
+	reg.recount(reg.msgTypes())
+
+	ps = &PubSub{
+		cmdChan:       make(chan *cmd),
+		capacity:      capacity,
+		requestIDChan: make(chan int),
+		logger:        l,
+		reg:           reg,
+	}
+	ps.newShards()
+	go ps.start()
+
+	return ps, nil
+}
+
 // NewEventChan creates a new event channel for passing events.
 func NewEventChan() EventChan {
 	return make(EventChan)
@@ -245,7 +353,8 @@ func (ps *PubSub) PubWait(msg MsgType, id IDString, data interface{}) (e *Event,
 }
 
 // Sub subscribes to a message/command, asynchronously.
-func (ps *PubSub) Sub(msg MsgType, id IDString, ech EventChan) (requestID int, err error) {
+// See SubOption for narrowing what the subscription is sent.
+func (ps *PubSub) Sub(msg MsgType, id IDString, ech EventChan, opts ...SubOption) (requestID int, err error) {
 	requestID = <-ps.requestIDChan
 
 	if msg == NoMsg {
@@ -256,13 +365,16 @@ func (ps *PubSub) Sub(msg MsgType, id IDString, ech EventChan) (requestID int, e
 		return requestID, getCommandError(MsgBusErrNoEventChan)
 	}
 
+	sub := newSubscription(opts)
+	sub.watch(ps, ech)
+
 	c := cmd{
 		op:        opSub,
 		sync:      false,
 		msg:       msg,
 		ID:        id,
 		requestID: requestID,
-		data:      nil,
+		data:      sub,
 		eventch:   ech,
 	}
 
@@ -272,7 +384,8 @@ func (ps *PubSub) Sub(msg MsgType, id IDString, ech EventChan) (requestID int, e
 }
 
 // SubWait subscribes to a message/command, synchronously.
-func (ps *PubSub) SubWait(msg MsgType, id IDString, ech EventChan) (e *Event, err error) {
+// See SubOption for narrowing what the subscription is sent.
+func (ps *PubSub) SubWait(msg MsgType, id IDString, ech EventChan, opts ...SubOption) (e *Event, err error) {
 
 	if msg == NoMsg {
 		return e, getCommandError(MsgBusErrNoMsg)
@@ -282,12 +395,15 @@ func (ps *PubSub) SubWait(msg MsgType, id IDString, ech EventChan) (e *Event, er
 		return e, getCommandError(MsgBusErrNoEventChan)
 	}
 
+	sub := newSubscription(opts)
+	sub.watch(ps, ech)
+
 	c := cmd{
 		op:      opSub,
 		sync:    true,
 		msg:     msg,
 		ID:      id,
-		data:    nil,
+		data:    sub,
 		eventch: ech,
 	}
 
@@ -332,6 +448,14 @@ func (ps *PubSub) GetWait(msg MsgType, id IDString) (e *Event, err error) {
 		return e, getCommandError(MsgBusErrNoMsg)
 	}
 
+	// Served from the snapshot without waiting for the shard, unless the op
+	// log has to see it or a write to msg is still on its way
+	if s, ok := ps.reg.snapshots[msg]; ok && atomic.LoadInt32(&ps.serial) == 0 && atomic.LoadInt64(&s.pending) == 0 {
+		atomic.AddUint64(&ps.reg.metrics.snapshotReads, 1)
+		e = s.get(msg, id)
+		return e, e.Err
+	}
+
 	c := cmd{
 		op:      opGet,
 		sync:    true,
@@ -588,6 +712,101 @@ func (ps *PubSub) SetWait(msg MsgType, id IDString, data interface{}) (e *Event,
 
 }
 
+//--------------------------------------------------------------------------------
+// SetIfRevisionWait sets the record only if it is still at revision rev,
+// otherwise the event carries ErrRevisionConflict and the current revision.
+//--------------------------------------------------------------------------------
+func (ps *PubSub) SetIfRevisionWait(msg MsgType, id IDString, rev uint64, data interface{}) (e *Event, err error) {
+
+	if msg == NoMsg {
+		return e, getCommandError(MsgBusErrNoMsg)
+	}
+
+	if id == "" {
+		return e, getCommandError(MsgBusErrNoID)
+	}
+
+	if data == nil {
+		return e, getCommandError(MsgBusErrNoData)
+	}
+
+	c := cmd{
+		op:      opSetIf,
+		sync:    true,
+		msg:     msg,
+		ID:      id,
+		rev:     rev,
+		data:    data,
+		eventch: nil,
+	}
+
+	return ps.dispatch(&c)
+
+}
+
+//--------------------------------------------------------------------------------
+// UpdateWait reads the record, passes it to update and writes back the
+// result if nobody else changed the record in between, re-reading and
+// calling update again when they did.
+//--------------------------------------------------------------------------------
+func (ps *PubSub) UpdateWait(msg MsgType, id IDString, update func(old interface{}) (interface{}, error)) (e *Event, err error) {
+
+	var data interface{}
+	for i := 0; i < maxUpdateRetries; i++ {
+		e, err = ps.GetWait(msg, id)
+		if err != nil {
+			return e, err
+		}
+
+		data, err = update(e.Data)
+		if err != nil {
+			return e, err
+		}
+
+		e, err = ps.SetIfRevisionWait(msg, id, e.Revision, data)
+		if err != ErrRevisionConflict {
+			return e, err
+		}
+	}
+
+	// Every attempt lost to another writer
+	return e, ErrRevisionConflict
+}
+
+//--------------------------------------------------------------------------------
+// Stream sends data to the subscribers of a stream message class without
+// storing it, asynchronously.
+//--------------------------------------------------------------------------------
+func (ps *PubSub) Stream(msg MsgType, id IDString, data interface{}) (requestID int, err error) {
+	requestID = <-ps.requestIDChan
+
+	if msg == NoMsg {
+		return requestID, getCommandError(MsgBusErrNoMsg)
+	}
+
+	if !streamMsgTypes[msg] {
+		return requestID, getCommandError(MsgBusErrBadMsg)
+	}
+
+	if data == nil {
+		return requestID, getCommandError(MsgBusErrNoData)
+	}
+
+	c := cmd{
+		op:        opStream,
+		sync:      false,
+		msg:       msg,
+		ID:        id,
+		requestID: requestID,
+		data:      data,
+		eventch:   nil,
+	}
+
+	_, err = ps.dispatch(&c)
+
+	return requestID, err
+}
+
 //--------------------------------------------------------------------------------
 // Request removal of events for the topic
 //--------------------------------------------------------------------------------
@@ -822,7 +1041,10 @@ func (ps *PubSub) dispatch(c *cmd) (event *Event, e error) {
 		c.returnch = make(EventChan)
 	}
 
-	ps.cmdChan <- c
+	c.queued = time.Now()
+	atomic.AddInt64(&ps.reg.metrics.pending, 1)
+	ps.reg.pendingWrites(c, 1)
+	ps.send(c)
 
 	if c.sync {
 		event = <-c.returnch
@@ -853,9 +1075,134 @@ func (ps *PubSub) start() {
 		}
 	}(ps.requestIDChan)
 
-	reg := registry{
-		data:   make(map[MsgType]map[IDString]registryData),
-		notify: make(map[MsgType]map[chan *Event]interface{}),
+	reg := ps.reg
+
+loop:
+	for cmdptr := range ps.cmdChan {
+		atomic.AddInt64(&reg.metrics.pending, -1)
+
+		if ps.logger != nil {
+			ps.logger.Logf(log.LevelTrace, "MSGBUS: %+v", *cmdptr)
+		}
+
+		switch cmdptr.op {
+		case opShutdown:
+			break loop
+
+		case opOpLog:
+			reg.setOpLog(cmdptr, ps.logger)
+			if reg.oplog != nil {
+				atomic.StoreInt32(&ps.serial, 1)
+			} else {
+				atomic.StoreInt32(&ps.serial, 0)
+			}
+
+		default:
+			reg.handle(cmdptr)
+		}
+
+		ps.gate.Unlock()
+	}
+
+	// The gate is left held, nothing is handled after shutdown
+	close(ps.quit)
+
+	if reg.store != nil {
+		if err := reg.store.close(reg); err != nil {
+			ps.logger.Logf(log.LevelError, "MSGBUS: closing persist store: %s", err)
+		}
+	}
+
+	ps.done <- struct{}{}
+
+	fmt.Printf("Closing PubSub Command chan\n")
+
+	// clean up here
+	// Close any open channels
+	// Delete registry
+
+}
+
+//-----------------------------------------
+// handle runs c against the registry, from a shard worker or the coordinator
+//-----------------------------------------
+func (reg *registry) handle(cmdptr *cmd) {
+
+	if cmdptr.op == opNop {
+		return
+	}
+
+	started := time.Now()
+
+	switch cmdptr.op {
+	case opPub:
+		reg.pub(cmdptr)
+
+	case opSub:
+		reg.sub(cmdptr)
+
+	case opSet, opSetIf:
+		reg.set(cmdptr)
+
+	case opGet:
+		reg.get(cmdptr)
+
+	case opSearch:
+		reg.search(cmdptr)
+
+	case opUnpub:
+		reg.unpub(cmdptr)
+
+	case opUnsub:
+		reg.unsub(cmdptr)
+
+	case opRemove:
+		reg.removeAndClose(cmdptr)
+
+	case opStream:
+		reg.stream(cmdptr)
+
+	case opQuery:
+		reg.query(cmdptr)
+
+	case opIndex:
+		reg.addIndex(cmdptr)
+
+	case opTxn:
+		reg.txn(cmdptr)
+
+	case opDelivery:
+		reg.configureDelivery(cmdptr)
+
+	case opDeliveryStats:
+		reg.deliveryStats(cmdptr)
+
+	default:
+		panic("default reached for cmd.op")
+	}
+
+	if reg.oplog != nil {
+		reg.oplog.write(cmdptr, started)
+	}
+
+	reg.count(cmdptr)
+	reg.metrics.observe(cmdptr)
+	reg.pendingWrites(cmdptr, -1)
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func newRegistry() *registry {
+	reg := &registry{
+		data:    make(map[MsgType]map[IDString]registryData),
+		notify:  make(map[MsgType]map[chan *Event]interface{}),
+		indexes: make(map[MsgType]map[string]fieldIndex),
+		subs:    make(map[EventChan]*subscriber),
+
+		subscriptions: make(map[subKey]*subscription),
+		metrics:       newMetrics(),
+		snapshots:     make(map[MsgType]*snapshot),
 	}
 
 	reg.data[ConfigMsg] = make(map[IDString]registryData)
@@ -876,60 +1223,64 @@ func (ps *PubSub) start() {
 	reg.notify[ConnectionMsg] = make(map[chan *Event]interface{})
 	reg.notify[ValidateMsg] = make(map[chan *Event]interface{})
 
-loop:
-	for cmdptr := range ps.cmdChan {
-		ps.logger.Logf(log.LevelInfo, "MSGBUS: %+v", *cmdptr)
-
-		if cmdptr.op == opNop {
-			continue loop
-		}
+	// The outer maps are only read by the shards once they are started
+	for msg := range reg.data {
+		reg.indexes[msg] = make(map[string]fieldIndex)
+		reg.snapshots[msg] = newSnapshot()
+	}
 
-		if cmdptr.op == opShutdown {
-			break loop
+	for msg, fields := range defaultIndexes {
+		for _, field := range fields {
+			reg.buildIndex(msg, field)
 		}
+	}
 
-		switch cmdptr.op {
-		case opPub:
-			reg.pub(cmdptr)
-
-		case opSub:
-			reg.sub(cmdptr)
-
-		case opSet:
-			reg.set(cmdptr)
-
-		case opGet:
-			reg.get(cmdptr)
-
-		case opSearch:
-			reg.search(cmdptr)
-
-		case opUnpub:
-			reg.unpub(cmdptr)
-
-		case opUnsub:
-			reg.unsub(cmdptr)
+	return reg
+}
 
-		case opRemove:
-			reg.removeAndClose(cmdptr)
+//-----------------------------------------
+// restore loads a record without generating events, used while replaying
+// the persisted registry before the bus is started.
+//-----------------------------------------
+func (reg *registry) restore(msg MsgType, id IDString, data interface{}, rev uint64) {
+	if _, ok := reg.data[msg]; !ok {
+		reg.data[msg] = make(map[IDString]registryData)
+	}
 
-		default:
-			panic("default reached for cmd.op")
+	if d, ok := reg.data[msg][id]; ok {
+		reg.reindex(msg, id, d.data, data)
+		d.data = data
+		d.rev = rev
+		reg.data[msg][id] = d
+	} else {
+		reg.reindex(msg, id, nil, data)
+		reg.data[msg][id] = registryData{
+			sub:  Subscribers{eventchan: make(map[EventChan]int)},
+			data: data,
+			rev:  rev,
 		}
 	}
+	reg.publish(msg, id)
+}
 
-	ps.done <- struct{}{}
-
-	fmt.Printf("Closing PubSub Command chan\n")
-
-	// clean up here
-	// Close any open channels
-	// Delete registry
+//-----------------------------------------
+//
+//-----------------------------------------
+func (reg *registry) persist(op operation, msg MsgType, id IDString, data interface{}, rev uint64) {
+	if reg.store == nil {
+		return
+	}
 
+	if err := reg.store.append(reg, op, msg, id, data, rev); err != nil {
+		if reg.store.logger != nil {
+			reg.store.logger.Logf(log.LevelError, "MSGBUS: persisting %s %s/%s: %s", op, msg, id, err)
+		}
+	}
 }
 
 //-----------------------------------------
-//
+// send answers a synchronous request, subscriber channels go through
+// registry.deliver to keep them in order.
 //-----------------------------------------
 func (event *Event) send(e EventChan) {
 
@@ -947,6 +1298,12 @@ func (event *Event) send(e EventChan) {
 //-----------------------------------------
 func (reg *registry) pub(c *cmd) {
 
+	// Stream classes are never stored
+	if streamMsgTypes[c.msg] {
+		reg.stream(c)
+		return
+	}
+
 	event := Event{
 		EventType: PublishEvent,
 		Msg:       c.msg,
@@ -966,30 +1323,65 @@ func (reg *registry) pub(c *cmd) {
 		reg.data[c.msg][c.ID] = registryData{
 			sub:  Subscribers{eventchan: make(map[EventChan]int)},
 			data: c.data,
+			rev:  1,
 		}
+		event.Revision = 1
+		reg.reindex(c.msg, c.ID, nil, c.data)
+		reg.publish(c.msg, c.ID)
+		reg.persist(opPub, c.msg, c.ID, c.data, 1)
 	}
 
 	// If sync, return the event
 	if c.sync {
 		// sendEvent(c.returnch, event)
-		event.send(c.returnch)
+		reg.reply(c, &event)
 	}
 
 	if c.eventch != nil {
 		// sendEvent(c.eventch, event)
-		event.send(c.eventch)
+		reg.deliver(c.eventch, &event)
 	}
 
 	// If no error, copy the event to everyone interested
 	if event.Err == nil {
 		for ech := range reg.notify[c.msg] {
 			//sendEvent(ech, event)
-			event.send(ech)
+			reg.notifySub(c.msg, "", ech, &event, nil)
 		}
 	}
 
 }
 
+//-----------------------------------------
+// msg contains the stream message type
+// ID identifies the item within the stream
+// data contains the item
+//
+//-----------------------------------------
+func (reg *registry) stream(c *cmd) {
+
+	event := Event{
+		EventType: StreamEvent,
+		Msg:       c.msg,
+		ID:        c.ID,
+		RequestID: c.requestID,
+		Data:      c.data,
+		Err:       nil,
+	}
+
+	if c.sync {
+		reg.reply(c, &event)
+	}
+
+	if c.eventch != nil {
+		reg.deliver(c.eventch, &event)
+	}
+
+	for ech := range reg.notify[c.msg] {
+		reg.notifySub(c.msg, "", ech, &event, nil)
+	}
+}
+
 //-----------------------------------------
 // msg
 // ID (optional)
@@ -1003,10 +1395,12 @@ func (reg *registry) sub(c *cmd) {
 		Msg:       c.msg,
 		ID:        c.ID,
 		RequestID: c.requestID,
-		Data:      c.data,
+		Data:      nil,
 		Err:       nil,
 	}
 
+	sub, _ := c.data.(*subscription)
+
 	if c.ID == "" {
 		if _, ok := reg.notify[c.msg]; !ok {
 			event.Err = getCommandError(MsgBusErrBadMsg)
@@ -1027,12 +1421,25 @@ func (reg *registry) sub(c *cmd) {
 		}
 	}
 
+	if event.Err == nil {
+		reg.addSubscription(c.eventch)
+	}
+
+	if event.Err == nil && sub != nil {
+		reg.subscriptionsMu.Lock()
+		reg.subscriptions[subKey{msg: c.msg, id: c.ID, ech: c.eventch}] = sub
+		reg.subscriptionsMu.Unlock()
+	} else {
+		// Not subscribed, or already subscribed with the options given then
+		sub.end()
+	}
+
 	if c.sync {
-		event.send(c.returnch)
+		reg.reply(c, &event)
 	}
 
 	if c.eventch != nil {
-		event.send(c.eventch)
+		reg.deliver(c.eventch, &event)
 	}
 }
 
@@ -1052,6 +1459,8 @@ func (reg *registry) set(c *cmd) {
 		Err:       nil,
 	}
 
+	var old interface{}
+
 	if c.ID == "" {
 		event.Err = getCommandError(MsgBusErrNoID)
 		fmt.Printf(lumerinlib.FileLine()+"Error:%s\n", event.Err)
@@ -1064,6 +1473,9 @@ func (reg *registry) set(c *cmd) {
 	} else if _, ok := reg.data[c.msg][c.ID]; !ok {
 		event.Err = getCommandError(MsgBusErrBadID)
 		fmt.Printf(lumerinlib.FileLine()+"Error:%s\n", event.Err)
+	} else if c.op == opSetIf && reg.data[c.msg][c.ID].rev != c.rev {
+		event.Err = ErrRevisionConflict
+		event.Revision = reg.data[c.msg][c.ID].rev
 	} else {
 
 		//
@@ -1074,27 +1486,38 @@ func (reg *registry) set(c *cmd) {
 		// Set the data
 
 		d := reg.data[c.msg][c.ID]
+		old = d.data
+		reg.reindex(c.msg, c.ID, d.data, c.data)
 		d.data = c.data
+		d.rev++
 		reg.data[c.msg][c.ID] = d
+		event.Revision = d.rev
+		reg.publish(c.msg, c.ID)
+		reg.persist(opSet, c.msg, c.ID, c.data, d.rev)
 
 	}
 
 	if c.sync {
-		event.send(c.returnch)
+		reg.reply(c, &event)
 	}
 
 	if c.eventch != nil {
-		event.send(c.eventch)
+		reg.deliver(c.eventch, &event)
+	}
+
+	// A rejected set changed nothing, there is nothing to tell subscribers
+	if event.Err != nil {
+		return
 	}
 
 	// Notify anyone listening for the message class
 	for nch := range reg.notify[c.msg] {
-		event.send(nch)
+		reg.notifySub(c.msg, "", nch, &event, old)
 	}
 	// Notify anyone listening for the specific ID
 	for ech := range reg.data[c.msg][c.ID].sub.eventchan {
 		if _, ok := reg.data[c.msg][c.ID].sub.eventchan[ech]; ok {
-			event.send(ech)
+			reg.notifySub(c.msg, c.ID, ech, &event, old)
 		} else {
 			panic(fmt.Sprintf(lumerinlib.FileLine() + "Error eventchannel not ok"))
 		}
@@ -1132,13 +1555,14 @@ func (reg *registry) get(c *cmd) {
 		event.Err = getCommandError(MsgBusErrBadID)
 	} else {
 		event.Data = reg.data[c.msg][c.ID].data
+		event.Revision = reg.data[c.msg][c.ID].rev
 	}
 
 	if c.sync {
-		event.send(c.returnch)
+		reg.reply(c, &event)
 	}
 	if c.eventch != nil {
-		event.send(c.eventch)
+		reg.deliver(c.eventch, &event)
 	}
 
 }
@@ -1157,53 +1581,36 @@ func (reg *registry) search(c *cmd) {
 		RequestID: c.requestID,
 	}
 
-	// Only works for Miner messages at the moment.
-	if c.msg != MinerMsg {
-		event.Err = getCommandError(MsgBusErrBadMsg)
-		return
-	}
-
-	if c.Name == "" && c.IP == "" && c.MAC != "" {
-		event.Err = getCommandError(MsgBusErrBadSearchTerm)
-		return
-	}
-
-	if _, ok := reg.data[c.msg]; !ok {
-		event.Err = getCommandError(MsgBusErrNoData)
-		return
-	}
-
-	var index IDIndex
+	var filter Filter
 	switch {
 	case c.Name != "":
-		for i := range reg.data[c.msg] {
-			if reg.data[c.msg][i].data.(Miner).Name == c.Name {
-				index = append(index, i)
-			}
-		}
+		filter = Filter{FieldEq("Name", c.Name)}
 	case c.IP != "":
-		for i := range reg.data[c.msg] {
-			if reg.data[c.msg][i].data.(Miner).IP == c.IP {
-				index = append(index, i)
-			}
-		}
+		filter = Filter{FieldEq("IP", c.IP)}
 	case c.MAC != "":
-		for i := range reg.data[c.msg] {
-			if reg.data[c.msg][i].data.(Miner).MAC == c.MAC {
-				index = append(index, i)
-			}
+		filter = Filter{FieldEq("MAC", c.MAC)}
+	}
+
+	if filter == nil {
+		event.Err = getCommandError(MsgBusErrBadSearchTerm)
+	} else if _, ok := reg.data[c.msg]; !ok {
+		event.Err = getCommandError(MsgBusErrBadMsg)
+	} else if result, err := reg.match(c.msg, filter); err != nil {
+		event.Err = err
+	} else {
+		var index IDIndex
+		for id := range result {
+			index = append(index, id)
 		}
-	default:
-		panic("")
+		event.EventType = SearchIndexEvent
+		event.Data = index
 	}
-	event.EventType = SearchIndexEvent
-	event.Data = index
 
 	if c.sync {
-		event.send(c.returnch)
+		reg.reply(c, &event)
 	}
 	if c.eventch != nil {
-		event.send(c.eventch)
+		reg.deliver(c.eventch, &event)
 	}
 
 }
@@ -1233,6 +1640,7 @@ func (reg *registry) unsub(c *cmd) {
 			event.Err = getCommandError(MsgBusErrNoSub)
 		} else {
 			delete(reg.notify[c.msg], c.eventch)
+			reg.endSub(c.msg, "", c.eventch)
 		}
 	} else {
 		if _, ok := reg.data[c.msg][c.ID]; !ok {
@@ -1241,14 +1649,19 @@ func (reg *registry) unsub(c *cmd) {
 			event.Err = getCommandError(MsgBusErrNoSub)
 		} else {
 			delete(reg.data[c.msg][c.ID].sub.eventchan, c.eventch)
+			reg.endSub(c.msg, c.ID, c.eventch)
 		}
 	}
 
+	// With its last subscription gone nothing more is written to the
+	// channel, its reader may already have left
+	reaped := event.Err == nil && reg.endSubscription(c.eventch, false)
+
 	if c.sync {
-		event.send(c.returnch)
+		reg.reply(c, &event)
 	}
-	if c.eventch != nil {
-		event.send(c.eventch)
+	if c.eventch != nil && !reaped {
+		reg.deliver(c.eventch, &event)
 	}
 
 }
@@ -1278,22 +1691,31 @@ func (reg *registry) unpub(c *cmd) {
 	}
 
 	if c.sync {
-		event.send(c.returnch)
+		reg.reply(c, &event)
 	}
 
 	if c.eventch != nil {
-		event.send(c.eventch)
+		reg.deliver(c.eventch, &event)
 	}
 
 	for ech := range reg.data[c.msg][c.ID].sub.eventchan {
-		event.send(ech)
+		reg.notifySub(c.msg, c.ID, ech, &event, nil)
+		reg.endSub(c.msg, c.ID, ech)
+		if event.Err == nil {
+			reg.endSubscription(ech, true)
+		}
 	}
 
 	for ech := range reg.notify[c.msg] {
-		event.send(ech)
+		reg.notifySub(c.msg, "", ech, &event, nil)
 	}
 
-	delete(reg.data[c.msg], c.ID)
+	if event.Err == nil {
+		reg.reindex(c.msg, c.ID, reg.data[c.msg][c.ID].data, nil)
+		delete(reg.data[c.msg], c.ID)
+		reg.publish(c.msg, c.ID)
+		reg.persist(opUnpub, c.msg, c.ID, nil, 0)
+	}
 
 }
 
@@ -1305,6 +1727,11 @@ func (reg *registry) unpub(c *cmd) {
 //---------------------------------------
 func (reg *registry) removeAndClose(c *cmd) {
 
+	// Sent when a subscription's context ends, see subscription.watch
+	if s, ok := c.data.(*subscription); ok && !reg.active(s, c.eventch) {
+		return
+	}
+
 	event := Event{
 		EventType: RemovedEvent,
 		Msg:       c.msg,
@@ -1325,15 +1752,18 @@ func (reg *registry) removeAndClose(c *cmd) {
 	for msg := range reg.data {
 		for id := range reg.data[msg] {
 			if _, ok := reg.data[msg][id].sub.eventchan[c.eventch]; ok {
-				delete(reg.data[c.msg][c.ID].sub.eventchan, c.eventch)
+				delete(reg.data[msg][id].sub.eventchan, c.eventch)
 			}
 		}
 	}
 
-	close(c.eventch)
+	if c.eventch != nil {
+		reg.endSubs(c.eventch)
+		reg.closeSubscriber(c.eventch)
+	}
 
 	if c.sync {
-		event.send(c.returnch)
+		reg.reply(c, &event)
 	}
 
 }
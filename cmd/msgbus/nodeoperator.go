@@ -0,0 +1,165 @@
+package msgbus
+
+import (
+	"context"
+	"sort"
+)
+
+//---------------------------------------------------------------
+// NodeOperatorRepo reads and writes the NodeOperator records on the bus, see repo.go
+//---------------------------------------------------------------
+type NodeOperatorRepo struct {
+	recordRepo
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (ps *PubSub) NodeOperators() NodeOperatorRepo {
+	return NodeOperatorRepo{recordRepo{ps: ps, msg: NodeOperatorMsg}}
+}
+
+//---------------------------------------------------------------
+// Pub publishes nodeOperator, under a random ID if it has none, and fails with
+// ErrDuplicate if the ID is taken
+//---------------------------------------------------------------
+func (r NodeOperatorRepo) Pub(nodeOperator NodeOperator) (NodeOperator, error) {
+	if nodeOperator.ID == "" {
+		nodeOperator.ID = NodeOperatorID(GetRandomIDString())
+	}
+	_, err := r.pub(IDString(nodeOperator.ID), nodeOperator)
+	return nodeOperator, err
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r NodeOperatorRepo) Get(id NodeOperatorID) (nodeOperator NodeOperator, err error) {
+	data, err := r.get(IDString(id))
+	if err != nil {
+		return nodeOperator, err
+	}
+	return r.decode(IDString(id), data)
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r NodeOperatorRepo) Exists(id NodeOperatorID) bool {
+	_, err := r.Get(id)
+	return err == nil
+}
+
+//---------------------------------------------------------------
+// Set replaces the stored nodeOperator, failing with ErrNotFound if it was never
+// published
+//---------------------------------------------------------------
+func (r NodeOperatorRepo) Set(nodeOperator NodeOperator) error {
+	return r.set(IDString(nodeOperator.ID), nodeOperator)
+}
+
+//---------------------------------------------------------------
+// Update applies update to a copy of the current nodeOperator and stores the
+// result, calling update again on a fresh copy if another writer changed it
+// in between.
+//---------------------------------------------------------------
+func (r NodeOperatorRepo) Update(id NodeOperatorID, update func(n *NodeOperator) error) (nodeOperator NodeOperator, err error) {
+	err = r.update(IDString(id), func(old interface{}) (interface{}, error) {
+		n, err := r.decode(IDString(id), old)
+		if err != nil {
+			return nil, err
+		}
+
+		// The stored record shares its map, update must only touch a copy
+		contracts := make(map[ContractID]ContractState, len(n.Contracts))
+		for k, v := range n.Contracts {
+			contracts[k] = v
+		}
+		n.Contracts = contracts
+
+		if err := update(&n); err != nil {
+			return nil, err
+		}
+
+		nodeOperator = n
+		return n, nil
+	})
+	return nodeOperator, err
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r NodeOperatorRepo) Unpub(id NodeOperatorID) error {
+	return r.unpub(IDString(id))
+}
+
+//---------------------------------------------------------------
+//
+//---------------------------------------------------------------
+func (r NodeOperatorRepo) IDs() (ids []NodeOperatorID, err error) {
+	index, err := r.ids()
+	if err != nil {
+		return nil, err
+	}
+	ids = make([]NodeOperatorID, len(index))
+	for i, id := range index {
+		ids[i] = NodeOperatorID(id)
+	}
+	return ids, nil
+}
+
+//---------------------------------------------------------------
+// List returns the records matching filter ordered by ID, a nil filter
+// returns every record
+//---------------------------------------------------------------
+func (r NodeOperatorRepo) List(filter Filter) (nodeOperators []NodeOperator, err error) {
+	result, err := r.query(filter)
+	if err != nil {
+		return nil, err
+	}
+	for id, data := range result {
+		n, err := r.decode(id, data)
+		if err != nil {
+			return nil, err
+		}
+		nodeOperators = append(nodeOperators, n)
+	}
+	sort.Slice(nodeOperators, func(i, j int) bool { return nodeOperators[i].ID < nodeOperators[j].ID })
+	return nodeOperators, nil
+}
+
+//---------------------------------------------------------------
+// Watch returns a channel receiving the events of every NodeOperator, or only of
+// id if it is not empty, until ctx is done. Decode gives the record an
+// event carries.
+//---------------------------------------------------------------
+func (r NodeOperatorRepo) Watch(ctx context.Context, id NodeOperatorID, opts ...SubOption) (EventChan, error) {
+	return r.watch(ctx, IDString(id), opts)
+}
+
+//---------------------------------------------------------------
+// Decode returns the record carried by an event, an UnpublishEvent carries
+// none and gives ErrNotFound
+//---------------------------------------------------------------
+func (r NodeOperatorRepo) Decode(e *Event) (nodeOperator NodeOperator, err error) {
+	if e.Err != nil {
+		return nodeOperator, r.recordError(e.ID, e.Err)
+	}
+	if e.EventType == UnpublishEvent {
+		return nodeOperator, r.recordError(e.ID, ErrNotFound)
+	}
+	return r.decode(e.ID, e.Data)
+}
+
+func (r NodeOperatorRepo) decode(id IDString, data interface{}) (nodeOperator NodeOperator, err error) {
+	switch d := data.(type) {
+	case NodeOperator:
+		return d, nil
+	case *NodeOperator:
+		if d != nil {
+			return *d, nil
+		}
+	}
+	return nodeOperator, r.badRecord(id, data)
+}
@@ -0,0 +1,323 @@
+package msgbus
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/daniel-888/proxy-router/cmd/log"
+)
+
+//
+// Operation log
+//
+// When enabled with SetOpLogWait every command the registry handles is
+// written to the log as one JSON line, followed by a line for each event
+// it produced:
+//
+//	{"ts":"...","kind":"cmd","op":"opSet","req":12,"msg":"MinerMsg","id":"...","data":{...}}
+//	{"ts":"...","kind":"event","event":"UpdEvent","req":12,"msg":"MinerMsg","id":"...","rev":3,"data":{...}}
+//
+// Command lines carry the error the command failed with, if any, so a log
+// can be replayed with Replay into a fresh PubSub to reproduce the state the
+// original bus went through. Unlike the persist journal this is a debugging
+// aid, it records reads and failed commands too and is never read back on
+// start up.
+//
+
+const (
+	OpLogCmd   = "cmd"
+	OpLogEvent = "event"
+)
+
+type OpLogEntry struct {
+	Time      time.Time       `json:"ts"`
+	Kind      string          `json:"kind"`
+	Op        operation       `json:"op,omitempty"`
+	EventType EventType       `json:"event,omitempty"`
+	RequestID int             `json:"req,omitempty"`
+	Msg       MsgType         `json:"msg,omitempty"`
+	ID        IDString        `json:"id,omitempty"`
+	Rev       uint64          `json:"rev,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	// Ops holds the staged operations of an opTxn command
+	Ops []OpLogEntry `json:"ops,omitempty"`
+	Err string       `json:"err,omitempty"`
+}
+
+type opLog struct {
+	enc    *json.Encoder
+	logger *log.Logger
+	// events produced by the command being handled, in the order they
+	// were first sent or queued
+	events []*Event
+	seen   map[*Event]bool
+}
+
+type ReplayConfig struct {
+	// Rewrite, if set, is called with every record a replayed Pub or Set is
+	// about to store. It returns the record to store in its place, or false
+	// to drop the write.
+	Rewrite func(msg MsgType, id IDString, data interface{}) (interface{}, bool)
+	// Speed scales the recorded gaps between commands, 1 replays at the
+	// original pace and 0 replays without pausing
+	Speed float64
+}
+
+//--------------------------------------------------------------------------------
+// SetOpLogWait starts writing the operation log to w, a nil w stops it
+//--------------------------------------------------------------------------------
+func (ps *PubSub) SetOpLogWait(w io.Writer) (err error) {
+	c := cmd{
+		op:   opOpLog,
+		sync: true,
+		data: w,
+	}
+
+	_, err = ps.dispatch(&c)
+	return err
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func (reg *registry) setOpLog(c *cmd, l *log.Logger) {
+
+	event := Event{
+		EventType: NoEvent,
+		RequestID: c.requestID,
+	}
+
+	if w, _ := c.data.(io.Writer); w != nil {
+		reg.oplog = &opLog{
+			enc:    json.NewEncoder(w),
+			logger: l,
+			seen:   make(map[*Event]bool),
+		}
+	} else {
+		reg.oplog = nil
+	}
+
+	if c.sync {
+		event.send(c.returnch)
+	}
+}
+
+//-----------------------------------------
+// reply sends the result of a sync command back to the caller
+//-----------------------------------------
+func (reg *registry) reply(c *cmd, event *Event) {
+	if reg.oplog != nil {
+		reg.oplog.event(event)
+	}
+	event.send(c.returnch)
+}
+
+func (o *opLog) event(event *Event) {
+	if !o.seen[event] {
+		o.seen[event] = true
+		o.events = append(o.events, event)
+	}
+}
+
+//-----------------------------------------
+// write logs c, started at ts, and the events it produced
+//-----------------------------------------
+func (o *opLog) write(c *cmd, ts time.Time) {
+
+	entry := OpLogEntry{
+		Time:      ts,
+		Kind:      OpLogCmd,
+		Op:        c.op,
+		RequestID: c.requestID,
+		Msg:       c.msg,
+		ID:        c.ID,
+		Rev:       c.rev,
+	}
+
+	if ops, ok := c.data.([]txnOp); ok {
+		for _, op := range ops {
+			entry.Ops = append(entry.Ops, OpLogEntry{
+				Op:   op.op,
+				Msg:  op.msg,
+				ID:   op.id,
+				Rev:  op.rev,
+				Data: opLogData(op.data),
+			})
+		}
+	} else {
+		entry.Data = opLogData(c.data)
+	}
+
+	for _, event := range o.events {
+		if event.Err != nil {
+			entry.Err = event.Err.Error()
+			break
+		}
+	}
+
+	err := o.enc.Encode(&entry)
+
+	for _, event := range o.events {
+		if err != nil {
+			break
+		}
+		e := OpLogEntry{
+			Time:      ts,
+			Kind:      OpLogEvent,
+			EventType: event.EventType,
+			RequestID: event.RequestID,
+			Msg:       event.Msg,
+			ID:        event.ID,
+			Rev:       event.Revision,
+			Data:      opLogData(event.Data),
+		}
+		if event.Err != nil {
+			e.Err = event.Err.Error()
+		}
+		err = o.enc.Encode(&e)
+	}
+
+	o.events = o.events[:0]
+	for event := range o.seen {
+		delete(o.seen, event)
+	}
+
+	if err != nil && o.logger != nil {
+		o.logger.Logf(log.LevelError, "MSGBUS: writing operation log: %s", err)
+	}
+}
+
+// opLogData encodes data as JSON, leaving out what can not be encoded
+// such as query predicates and event channels
+func opLogData(data interface{}) json.RawMessage {
+	if data == nil {
+		return nil
+	}
+	if _, ok := data.(io.Writer); ok {
+		return nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+//--------------------------------------------------------------------------------
+// Replay reads an operation log from r and applies the Pub, Set, Unpub and
+// Txn commands that succeeded when it was recorded. Reads, subscriptions
+// and failed commands are skipped. A write that fails again is logged and
+// the replay carries on, so the log can start part way through a run.
+// Returns the number of commands applied.
+//--------------------------------------------------------------------------------
+func (ps *PubSub) Replay(r io.Reader, cfg ReplayConfig) (n int, err error) {
+	dec := json.NewDecoder(r)
+
+	var last time.Time
+
+	for {
+		var entry OpLogEntry
+		if err = dec.Decode(&entry); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		if entry.Kind != OpLogCmd || entry.Err != "" {
+			continue
+		}
+
+		if cfg.Speed > 0 && !last.IsZero() && entry.Time.After(last) {
+			time.Sleep(time.Duration(float64(entry.Time.Sub(last)) / cfg.Speed))
+		}
+		last = entry.Time
+
+		applied, err := ps.replayEntry(&entry, cfg)
+		if err != nil {
+			if ps.logger != nil {
+				ps.logger.Logf(log.LevelWarn, "MSGBUS: replaying request %d %s %s/%s: %s", entry.RequestID, entry.Op, entry.Msg, entry.ID, err)
+			}
+			continue
+		}
+		if applied {
+			n++
+		}
+	}
+}
+
+//-----------------------------------------
+// replayEntry re-issues one logged command, recorded revisions are not
+// checked as the replayed bus need not be at the same ones
+//-----------------------------------------
+func (ps *PubSub) replayEntry(entry *OpLogEntry, cfg ReplayConfig) (applied bool, err error) {
+
+	switch entry.Op {
+	case opPub, opSet, opSetIf:
+		data, ok, err := replayRecord(entry, cfg)
+		if err != nil || !ok {
+			return false, err
+		}
+		if entry.Op == opPub {
+			_, err = ps.PubWait(entry.Msg, entry.ID, data)
+		} else {
+			_, err = ps.SetWait(entry.Msg, entry.ID, data)
+		}
+		return err == nil, err
+
+	case opUnpub:
+		if !IsRecordMsg(entry.Msg) {
+			return false, nil
+		}
+		_, err = ps.UnpubWait(entry.Msg, entry.ID)
+		return err == nil, err
+
+	case opTxn:
+		txn := ps.Txn()
+		staged := 0
+		for i := range entry.Ops {
+			op := &entry.Ops[i]
+			if op.Op == opUnpub && IsRecordMsg(op.Msg) {
+				txn.Unpub(op.Msg, op.ID)
+				staged++
+				continue
+			}
+			data, ok, err := replayRecord(op, cfg)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				continue
+			}
+			if op.Op == opPub {
+				txn.Pub(op.Msg, op.ID, data)
+			} else {
+				txn.Set(op.Msg, op.ID, data)
+			}
+			staged++
+		}
+		if staged == 0 {
+			return false, nil
+		}
+		_, err = txn.CommitWait()
+		return err == nil, err
+	}
+
+	return false, nil
+}
+
+func replayRecord(entry *OpLogEntry, cfg ReplayConfig) (data interface{}, ok bool, err error) {
+	if !IsRecordMsg(entry.Msg) {
+		// Config and stream messages are rebuilt by whoever runs the replay
+		return nil, false, nil
+	}
+	data, err = DecodeRecord(entry.Msg, entry.Data)
+	if err != nil {
+		return nil, false, err
+	}
+	if cfg.Rewrite == nil {
+		return data, true, nil
+	}
+	data, ok = cfg.Rewrite(entry.Msg, entry.ID, data)
+	return data, ok, nil
+}
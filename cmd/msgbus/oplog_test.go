@@ -0,0 +1,84 @@
+package msgbus
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestOpLogReplay(t *testing.T) {
+	mb := New(1, l)
+
+	var buf bytes.Buffer
+	if err := mb.SetOpLogWait(&buf); err != nil {
+		t.Fatalf("SetOpLogWait returned error: %s", err)
+	}
+
+	miner := Miner{ID: "MinerID01", State: OnlineState, Contracts: map[ContractID]float64{}}
+	mb.MinerPubWait(miner)
+	if _, err := mb.PubWait(MinerMsg, IDString(miner.ID), miner); err == nil {
+		t.Fatalf("expected duplicate publish to fail")
+	}
+	mb.MinerUpdateWait(miner.ID, func(m *Miner) error {
+		m.CurrentHashRate = 100
+		return nil
+	})
+
+	contract := Contract{ID: "ContractID01", State: ContRunningState}
+	dest := Dest{ID: "DestID01", NetUrl: DestNetUrl(testurl)}
+	if _, err := mb.Txn().
+		Pub(ContractMsg, IDString(contract.ID), contract).
+		Pub(DestMsg, IDString(dest.ID), dest).
+		CommitWait(); err != nil {
+		t.Fatalf("CommitWait returned error: %s", err)
+	}
+	mb.UnpubWait(DestMsg, IDString(dest.ID))
+
+	if err := mb.SetOpLogWait(nil); err != nil {
+		t.Fatalf("SetOpLogWait returned error: %s", err)
+	}
+	mb.MinerSetDestWait(miner.ID, "DestID02")
+
+	var cmds, failed int
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for dec.More() {
+		var entry OpLogEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("bad operation log line: %s", err)
+		}
+		if entry.Kind == OpLogCmd {
+			cmds++
+			if entry.Err != "" {
+				failed++
+			}
+		}
+	}
+	if failed != 1 {
+		t.Errorf("expected 1 failed command, got %d", failed)
+	}
+
+	replayed := New(1, l)
+	n, err := replayed.Replay(bytes.NewReader(buf.Bytes()), ReplayConfig{
+		Rewrite: func(msg MsgType, id IDString, data interface{}) (interface{}, bool) {
+			return data, msg != ContractMsg
+		},
+	})
+	if err != nil {
+		t.Fatalf("Replay returned error: %s", err)
+	}
+	// pub, set, txn and unpub, the duplicate pub and the reads are skipped
+	if n != 4 {
+		t.Errorf("expected 4 commands replayed out of %d, got %d", cmds, n)
+	}
+
+	m, err := replayed.MinerGetWait(miner.ID)
+	if err != nil || m.CurrentHashRate != 100 || m.Dest != "" {
+		t.Errorf("unexpected replayed miner %+v, %v", m, err)
+	}
+	if event, _ := replayed.GetWait(ContractMsg, IDString(contract.ID)); event.Data != nil {
+		t.Errorf("rewritten contract was replayed")
+	}
+	if event, _ := replayed.GetWait(DestMsg, IDString(dest.ID)); event.Data != nil {
+		t.Errorf("unpublished dest was replayed")
+	}
+}
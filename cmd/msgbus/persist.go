@@ -0,0 +1,539 @@
+package msgbus
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/daniel-888/proxy-router/cmd/log"
+)
+
+//
+// On-disk layout of a persistent registry
+//
+// <dir>/snapshot.json - full copy of the persisted records as of Seq
+// <dir>/journal.log   - one journalEntry per successful opPub/opSet/opUnpub,
+//                       or one opTxn entry holding every change of a Txn
+//
+// Every entry and snapshot carries the schema version it was written with.
+// Record data is kept as raw JSON and decoded into the current struct
+// definitions on load, so fields added to Miner, Contract, etc. are simply
+// zero valued when an older journal is replayed.
+//
+const PersistSchemaVersion = 1
+
+const (
+	persistSnapshotFile = "snapshot.json"
+	persistJournalFile  = "journal.log"
+
+	defaultSnapshotEvery = 1000
+)
+
+// persistMsgTypes lists the message classes that survive a restart.
+// ConfigMsg and ContractManagerConfigMsg are rebuilt from the config file
+// on start up (the latter holds the wallet mnemonic and is never written
+// to disk), ValidateMsg records are transient. MinerMsg and ConnectionMsg
+// records are live session state, the sessions they describe are gone
+// after a restart; journals written before they were left out still hold
+// them, and they are skipped on load.
+var persistMsgTypes = map[MsgType]bool{
+	DestMsg:         true,
+	NodeOperatorMsg: true,
+	ContractMsg:     true,
+}
+
+// recordMsgTypes lists the message classes whose records decode from JSON,
+// the persisted ones and the live session state the bridge mirrors.
+var recordMsgTypes = map[MsgType]bool{
+	DestMsg:         true,
+	NodeOperatorMsg: true,
+	ContractMsg:     true,
+	MinerMsg:        true,
+	ConnectionMsg:   true,
+}
+
+type PersistConfig struct {
+	// Dir holds the snapshot and journal files, it is created if missing
+	Dir string
+	// SnapshotEvery is the number of journal entries written before the
+	// registry is snapshotted and the journal truncated, 0 uses the default
+	SnapshotEvery int
+}
+
+type journalEntry struct {
+	Version int             `json:"v"`
+	Seq     uint64          `json:"seq"`
+	Op      operation       `json:"op"`
+	Msg     MsgType         `json:"msg"`
+	ID      IDString        `json:"id"`
+	Rev     uint64          `json:"rev,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	// Ops holds the changes of an opTxn entry, replayed all or nothing
+	Ops []journalEntry `json:"ops,omitempty"`
+}
+
+type snapshotFile struct {
+	Version int                                      `json:"v"`
+	Seq     uint64                                   `json:"seq"`
+	Records map[MsgType]map[IDString]json.RawMessage `json:"records"`
+	// Revisions is absent from snapshots written before record revisions
+	Revisions map[MsgType]map[IDString]uint64 `json:"revisions,omitempty"`
+}
+
+type persistStore struct {
+	// mu serialises the journal between the shards, see shard.go
+	mu            sync.Mutex
+	dir           string
+	snapshotEvery int
+	journal       *os.File
+	seq           uint64
+	sinceSnapshot int
+	logger        *log.Logger
+}
+
+//--------------------------------------------------------------------------------
+//
+//--------------------------------------------------------------------------------
+func openPersistStore(cfg PersistConfig, l *log.Logger) (s *persistStore, err error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("persist directory not provided")
+	}
+
+	if err = os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating persist directory: %w", err)
+	}
+
+	s = &persistStore{
+		dir:           cfg.Dir,
+		snapshotEvery: cfg.SnapshotEvery,
+		logger:        l,
+	}
+
+	if s.snapshotEvery <= 0 {
+		s.snapshotEvery = defaultSnapshotEvery
+	}
+
+	return s, nil
+}
+
+//--------------------------------------------------------------------------------
+// load replays the snapshot and then the journal into reg, and leaves the
+// journal open for appending.
+//--------------------------------------------------------------------------------
+func (s *persistStore) load(reg *registry) (err error) {
+
+	snap, err := s.readSnapshot()
+	if err != nil {
+		return err
+	}
+
+	if snap != nil {
+		s.seq = snap.Seq
+		for msg, records := range snap.Records {
+			if !persistMsgTypes[msg] {
+				continue
+			}
+			for id, raw := range records {
+				data, err := decodeRecord(snap.Version, msg, raw)
+				if err != nil {
+					return fmt.Errorf("snapshot record %s/%s: %w", msg, id, err)
+				}
+				rev := snap.Revisions[msg][id]
+				if rev == 0 {
+					rev = 1
+				}
+				reg.restore(msg, id, data, rev)
+			}
+		}
+	}
+
+	journalPath := filepath.Join(s.dir, persistJournalFile)
+
+	f, err := os.OpenFile(journalPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("opening journal: %w", err)
+	}
+
+	good, err := s.replayJournal(f, reg)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// Drop a partially written trailing entry left by a crash
+	if err = f.Truncate(good); err != nil {
+		f.Close()
+		return fmt.Errorf("truncating journal: %w", err)
+	}
+
+	if _, err = f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("seeking journal: %w", err)
+	}
+
+	s.journal = f
+
+	return nil
+}
+
+//--------------------------------------------------------------------------------
+//
+//--------------------------------------------------------------------------------
+func (s *persistStore) readSnapshot() (snap *snapshotFile, err error) {
+
+	b, err := os.ReadFile(filepath.Join(s.dir, persistSnapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	snap = &snapshotFile{}
+	if err = json.Unmarshal(b, snap); err != nil {
+		return nil, fmt.Errorf("decoding snapshot: %w", err)
+	}
+
+	if snap.Version > PersistSchemaVersion {
+		return nil, fmt.Errorf("snapshot schema version %d is newer than supported version %d", snap.Version, PersistSchemaVersion)
+	}
+
+	return snap, nil
+}
+
+//--------------------------------------------------------------------------------
+// replayJournal applies every complete entry newer than the snapshot and
+// returns the offset just past the last good entry.
+//--------------------------------------------------------------------------------
+func (s *persistStore) replayJournal(f *os.File, reg *registry) (good int64, err error) {
+
+	r := bufio.NewReader(f)
+
+	for {
+		line, rerr := r.ReadBytes('\n')
+		if rerr == io.EOF {
+			if len(line) > 0 && s.logger != nil {
+				s.logger.Logf(log.LevelWarn, "MSGBUS: discarding incomplete journal entry at offset %d", good)
+			}
+			return good, nil
+		}
+		if rerr != nil {
+			return good, fmt.Errorf("reading journal: %w", rerr)
+		}
+
+		var entry journalEntry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			if s.logger != nil {
+				s.logger.Logf(log.LevelWarn, "MSGBUS: discarding corrupt journal from offset %d: %s", good, err)
+			}
+			return good, nil
+		}
+
+		if entry.Version > PersistSchemaVersion {
+			return good, fmt.Errorf("journal schema version %d is newer than supported version %d", entry.Version, PersistSchemaVersion)
+		}
+
+		good += int64(len(line))
+
+		// Already contained in the snapshot
+		if entry.Seq <= s.seq {
+			continue
+		}
+		s.seq = entry.Seq
+		s.sinceSnapshot++
+
+		if entry.Op == opTxn {
+			for _, op := range entry.Ops {
+				if err = replayEntry(reg, entry.Seq, op); err != nil {
+					return good, err
+				}
+			}
+		} else if err = replayEntry(reg, entry.Seq, entry); err != nil {
+			return good, err
+		}
+	}
+}
+
+//--------------------------------------------------------------------------------
+//
+//--------------------------------------------------------------------------------
+func replayEntry(reg *registry, seq uint64, entry journalEntry) error {
+
+	if !persistMsgTypes[entry.Msg] {
+		return nil
+	}
+
+	switch entry.Op {
+	case opPub, opSet:
+		data, err := decodeRecord(entry.Version, entry.Msg, entry.Data)
+		if err != nil {
+			return fmt.Errorf("journal record %s/%s: %w", entry.Msg, entry.ID, err)
+		}
+		rev := entry.Rev
+		if rev == 0 {
+			rev = reg.data[entry.Msg][entry.ID].rev + 1
+		}
+		reg.restore(entry.Msg, entry.ID, data, rev)
+	case opUnpub:
+		if rd, ok := reg.data[entry.Msg][entry.ID]; ok {
+			reg.reindex(entry.Msg, entry.ID, rd.data, nil)
+			delete(reg.data[entry.Msg], entry.ID)
+			reg.publish(entry.Msg, entry.ID)
+		}
+	default:
+		return fmt.Errorf("journal entry %d has unknown op %s", seq, entry.Op)
+	}
+
+	return nil
+}
+
+//--------------------------------------------------------------------------------
+// append records a successful registry change, snapshotting when due.
+//--------------------------------------------------------------------------------
+func (s *persistStore) append(reg *registry, op operation, msg MsgType, id IDString, data interface{}, rev uint64) (err error) {
+
+	if !persistMsgTypes[msg] {
+		return nil
+	}
+
+	entry, err := newJournalEntry(op, msg, id, data, rev)
+	if err != nil {
+		return err
+	}
+
+	return s.write(reg, entry)
+}
+
+//--------------------------------------------------------------------------------
+// appendTxn records the changes of a committed Txn as a single entry, so a
+// crash part way through writing it loses the whole transaction.
+//--------------------------------------------------------------------------------
+func (s *persistStore) appendTxn(reg *registry, ops []txnOp) (err error) {
+
+	txn := journalEntry{
+		Version: PersistSchemaVersion,
+		Op:      opTxn,
+	}
+
+	for _, op := range ops {
+		if !persistMsgTypes[op.msg] {
+			continue
+		}
+		entry, err := newJournalEntry(op.journalOp(), op.msg, op.id, op.data, op.rev)
+		if err != nil {
+			return err
+		}
+		txn.Ops = append(txn.Ops, entry)
+	}
+
+	if len(txn.Ops) == 0 {
+		return nil
+	}
+
+	return s.write(reg, txn)
+}
+
+func newJournalEntry(op operation, msg MsgType, id IDString, data interface{}, rev uint64) (entry journalEntry, err error) {
+
+	entry = journalEntry{
+		Version: PersistSchemaVersion,
+		Op:      op,
+		Msg:     msg,
+		ID:      id,
+		Rev:     rev,
+	}
+
+	if op != opUnpub {
+		entry.Data, err = json.Marshal(data)
+		if err != nil {
+			return entry, fmt.Errorf("encoding %s/%s: %w", msg, id, err)
+		}
+	}
+
+	return entry, nil
+}
+
+//--------------------------------------------------------------------------------
+// write appends entry to the journal under the next sequence number
+//--------------------------------------------------------------------------------
+func (s *persistStore) write(reg *registry, entry journalEntry) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.Seq = s.seq + 1
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encoding journal entry: %w", err)
+	}
+
+	if _, err = s.journal.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+
+	s.seq = entry.Seq
+	s.sinceSnapshot++
+
+	if s.sinceSnapshot >= s.snapshotEvery {
+		return s.snapshot(reg)
+	}
+
+	return nil
+}
+
+//--------------------------------------------------------------------------------
+// snapshot writes the persisted part of the registry to a new snapshot file
+// and starts a fresh journal.
+//
+// Other shards keep changing the registry meanwhile, so the records are read
+// from the GetWait snapshots, which a change reaches before its journal entry
+// is written. Every entry up to Seq is therefore included. A change journaled
+// after Seq may be included too, replaying it again on load is harmless.
+//--------------------------------------------------------------------------------
+func (s *persistStore) snapshot(reg *registry) (err error) {
+
+	snap := snapshotFile{
+		Version: PersistSchemaVersion,
+		Seq:     s.seq,
+		Records:   make(map[MsgType]map[IDString]json.RawMessage),
+		Revisions: make(map[MsgType]map[IDString]uint64),
+	}
+
+	for msg := range persistMsgTypes {
+		records := make(map[IDString]json.RawMessage)
+		revisions := make(map[IDString]uint64)
+		for id, rd := range reg.records(msg) {
+			raw, err := json.Marshal(rd.data)
+			if err != nil {
+				return fmt.Errorf("encoding %s/%s: %w", msg, id, err)
+			}
+			records[id] = raw
+			revisions[id] = rd.rev
+		}
+		snap.Records[msg] = records
+		snap.Revisions[msg] = revisions
+	}
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("encoding snapshot: %w", err)
+	}
+
+	tmp := filepath.Join(s.dir, persistSnapshotFile+".tmp")
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("creating snapshot: %w", err)
+	}
+
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+
+	if err = os.Rename(tmp, filepath.Join(s.dir, persistSnapshotFile)); err != nil {
+		return fmt.Errorf("installing snapshot: %w", err)
+	}
+
+	// Entries up to Seq are now in the snapshot, any left behind by a crash
+	// before this point are skipped on replay.
+	if err = s.journal.Truncate(0); err != nil {
+		return fmt.Errorf("truncating journal: %w", err)
+	}
+	if _, err = s.journal.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seeking journal: %w", err)
+	}
+
+	s.sinceSnapshot = 0
+
+	return nil
+}
+
+//--------------------------------------------------------------------------------
+//
+//--------------------------------------------------------------------------------
+func (s *persistStore) close(reg *registry) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.journal == nil {
+		return nil
+	}
+
+	err = s.snapshot(reg)
+	if cerr := s.journal.Close(); err == nil {
+		err = cerr
+	}
+	s.journal = nil
+
+	return err
+}
+
+//--------------------------------------------------------------------------------
+// IsRecordMsg reports whether records of msg can be written out as JSON and
+// read back with DecodeRecord, which is what persistence and the bridge need.
+//--------------------------------------------------------------------------------
+func IsRecordMsg(msg MsgType) bool {
+	return recordMsgTypes[msg]
+}
+
+//--------------------------------------------------------------------------------
+// DecodeRecord decodes the JSON form of a record into the value type the
+// registry stores for msg.
+//--------------------------------------------------------------------------------
+func DecodeRecord(msg MsgType, raw json.RawMessage) (data interface{}, err error) {
+	if !IsRecordMsg(msg) {
+		return nil, getCommandError(MsgBusErrBadMsg)
+	}
+	return decodeRecord(PersistSchemaVersion, msg, raw)
+}
+
+//--------------------------------------------------------------------------------
+// decodeRecord turns the stored JSON for a record back into the value type
+// the rest of the node expects to find on the bus.
+//--------------------------------------------------------------------------------
+func decodeRecord(version int, msg MsgType, raw json.RawMessage) (data interface{}, err error) {
+
+	// Schema migrations from older versions hook in here, keyed on version.
+	_ = version
+
+	switch msg {
+	case DestMsg:
+		var d Dest
+		err = json.Unmarshal(raw, &d)
+		data = d
+	case NodeOperatorMsg:
+		var n NodeOperator
+		err = json.Unmarshal(raw, &n)
+		data = n
+	case ContractMsg:
+		var c Contract
+		err = json.Unmarshal(raw, &c)
+		data = c
+	case MinerMsg:
+		var m Miner
+		err = json.Unmarshal(raw, &m)
+		if m.Contracts == nil {
+			m.Contracts = make(map[ContractID]float64)
+		}
+		data = m
+	case ConnectionMsg:
+		var c Connection
+		err = json.Unmarshal(raw, &c)
+		data = c
+	default:
+		err = getCommandError(MsgBusErrBadMsg)
+	}
+
+	return data, err
+}
@@ -0,0 +1,177 @@
+package msgbus
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPersistJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	mb, err := NewPersistent(1, l, PersistConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewPersistent returned error: %s", err)
+	}
+
+	dest := Dest{ID: "DestID01", NetUrl: DestNetUrl(testurl)}
+	if _, err := mb.DestPubWait(dest); err != nil {
+		t.Fatalf("DestPubWait returned error: %s", err)
+	}
+
+	contract := Contract{ID: "ContractID02", State: ContAvailableState, Dest: dest.ID}
+	if _, err := mb.PubWait(ContractMsg, IDString(contract.ID), contract); err != nil {
+		t.Fatalf("PubWait returned error: %s", err)
+	}
+
+	contract.State = ContRunningState
+	if _, err := mb.SetWait(ContractMsg, IDString(contract.ID), contract); err != nil {
+		t.Fatalf("SetWait returned error: %s", err)
+	}
+
+	// Live session state, not persisted
+	miner := Miner{
+		ID:        "MinerID01",
+		Name:      "worker01",
+		IP:        "10.0.0.1",
+		Contracts: map[ContractID]float64{"ContractID01": 0.5},
+		Dest:      dest.ID,
+	}
+	if _, err := mb.MinerPubWait(miner); err != nil {
+		t.Fatalf("MinerPubWait returned error: %s", err)
+	}
+	if _, err := mb.PubWait(ConnectionMsg, "ConnectionID01", Connection{ID: "ConnectionID01"}); err != nil {
+		t.Fatalf("PubWait returned error: %s", err)
+	}
+
+	if _, err := mb.PubWait(ContractMsg, "ContractID01", Contract{ID: "ContractID01", State: ContRunningState}); err != nil {
+		t.Fatalf("PubWait returned error: %s", err)
+	}
+	if _, err := mb.UnpubWait(ContractMsg, "ContractID01"); err != nil {
+		t.Fatalf("UnpubWait returned error: %s", err)
+	}
+
+	// Not persisted
+	if _, err := mb.PubWait(ConfigMsg, "ConfigID01", ConfigInfo{ID: "ConfigID01"}); err != nil {
+		t.Fatalf("PubWait returned error: %s", err)
+	}
+
+	restored, err := NewPersistent(1, l, PersistConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewPersistent returned error on reload: %s", err)
+	}
+
+	if e, _ := restored.GetWait(ContractMsg, IDString(contract.ID)); e.Err != nil || e.Data.(Contract).State != ContRunningState {
+		t.Errorf("restored contract does not match: %+v", e.Data)
+	}
+
+	if e, _ := restored.GetWait(MinerMsg, IDString(miner.ID)); e.Err == nil {
+		t.Errorf("miner record should not be persisted")
+	}
+
+	if e, _ := restored.GetWait(ConnectionMsg, "ConnectionID01"); e.Err == nil {
+		t.Errorf("connection record should not be persisted")
+	}
+
+	d, _ := restored.DestGetWait(dest.ID)
+	if d == nil || d.NetUrl != dest.NetUrl {
+		t.Errorf("dest not restored: %+v", d)
+	}
+
+	if e, _ := restored.GetWait(ContractMsg, "ContractID01"); e.Err == nil {
+		t.Errorf("unpublished contract was restored")
+	}
+
+	if e, _ := restored.GetWait(ConfigMsg, "ConfigID01"); e.Err == nil {
+		t.Errorf("config record should not be persisted")
+	}
+}
+
+func TestPersistSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	mb, err := NewPersistent(1, l, PersistConfig{Dir: dir, SnapshotEvery: 2})
+	if err != nil {
+		t.Fatalf("NewPersistent returned error: %s", err)
+	}
+
+	for _, id := range []DestID{"DestID01", "DestID02", "DestID03"} {
+		if _, err := mb.DestPubWait(Dest{ID: id, NetUrl: DestNetUrl(testurl)}); err != nil {
+			t.Fatalf("DestPubWait returned error: %s", err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, persistSnapshotFile)); err != nil {
+		t.Fatalf("snapshot not written: %s", err)
+	}
+
+	restored, err := NewPersistent(1, l, PersistConfig{Dir: dir, SnapshotEvery: 2})
+	if err != nil {
+		t.Fatalf("NewPersistent returned error on reload: %s", err)
+	}
+
+	ids, err := restored.GetWait(DestMsg, "")
+	if err != nil {
+		t.Fatalf("GetWait returned error: %s", err)
+	}
+	if len(ids.Data.(IDIndex)) != 3 {
+		t.Errorf("expected 3 restored dests, got %v", ids.Data)
+	}
+}
+
+func TestPersistOldSchemaAndTornEntry(t *testing.T) {
+	dir := t.TempDir()
+
+	// A journal written before Contract lost a field and while miners were
+	// still persisted, followed by a partially written entry.
+	var b []byte
+	for _, old := range []journalEntry{
+		{
+			Version: 1,
+			Seq:     1,
+			Op:      opPub,
+			Msg:     ContractMsg,
+			ID:      "ContractID01",
+			Data:    json.RawMessage(`{"ID":"ContractID01","Buyer":"buyer01","RetiredField":true}`),
+		},
+		{
+			Version: 1,
+			Seq:     2,
+			Op:      opPub,
+			Msg:     MinerMsg,
+			ID:      "MinerID01",
+			Data:    json.RawMessage(`{"ID":"MinerID01","Name":"worker01"}`),
+		},
+	} {
+		entry, _ := json.Marshal(old)
+		b = append(b, entry...)
+		b = append(b, '\n')
+	}
+	b = append(b, []byte(`{"v":1,"seq":3,"op":"opSet","msg":"Con`)...)
+
+	if err := os.WriteFile(filepath.Join(dir, persistJournalFile), b, 0600); err != nil {
+		t.Fatalf("writing journal: %s", err)
+	}
+
+	mb, err := NewPersistent(1, l, PersistConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewPersistent returned error: %s", err)
+	}
+
+	if e, _ := mb.GetWait(ContractMsg, "ContractID01"); e.Err != nil || e.Data.(Contract).Buyer != "buyer01" {
+		t.Errorf("contract not restored from old journal: %+v", e.Data)
+	}
+
+	if e, _ := mb.GetWait(MinerMsg, "MinerID01"); e.Err == nil {
+		t.Errorf("miner restored from old journal")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, persistJournalFile))
+	if err != nil {
+		t.Fatalf("stat journal: %s", err)
+	}
+	if info.Size() != int64(len(b))-int64(len(`{"v":1,"seq":3,"op":"opSet","msg":"Con`)) {
+		t.Errorf("torn journal entry was not truncated, size %d", info.Size())
+	}
+}
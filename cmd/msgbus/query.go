@@ -0,0 +1,526 @@
+package msgbus
+
+import (
+	"fmt"
+	"reflect"
+)
+
+type PredicateOp string
+
+const (
+	PredEq        PredicateOp = "eq"
+	PredNe        PredicateOp = "ne"
+	PredLt        PredicateOp = "lt"
+	PredLe        PredicateOp = "le"
+	PredGt        PredicateOp = "gt"
+	PredGe        PredicateOp = "ge"
+	PredHasKey    PredicateOp = "haskey"
+	PredNotHasKey PredicateOp = "nothaskey"
+)
+
+//
+// Predicate tests one exported field of a record.
+// Eq/Ne work on any scalar field, Lt/Le/Gt/Ge on numeric and string fields,
+// HasKey/NotHasKey on map fields such as Miner.Contracts. Numbers compare
+// by value whatever their Go type, so 200 matches a float64 field of 200.
+// Any other predicate on a map or slice field fails with MsgBusErrBadData.
+//
+type Predicate struct {
+	Field string
+	Op    PredicateOp
+	Value interface{}
+}
+
+// Filter matches records that satisfy every predicate, an empty Filter
+// matches every record of the message type.
+type Filter []Predicate
+
+// QueryResult holds the matching records keyed by ID
+type QueryResult map[IDString]interface{}
+
+func FieldEq(field string, value interface{}) Predicate {
+	return Predicate{Field: field, Op: PredEq, Value: value}
+}
+
+func FieldNe(field string, value interface{}) Predicate {
+	return Predicate{Field: field, Op: PredNe, Value: value}
+}
+
+func FieldLt(field string, value interface{}) Predicate {
+	return Predicate{Field: field, Op: PredLt, Value: value}
+}
+
+func FieldLe(field string, value interface{}) Predicate {
+	return Predicate{Field: field, Op: PredLe, Value: value}
+}
+
+func FieldGt(field string, value interface{}) Predicate {
+	return Predicate{Field: field, Op: PredGt, Value: value}
+}
+
+func FieldGe(field string, value interface{}) Predicate {
+	return Predicate{Field: field, Op: PredGe, Value: value}
+}
+
+func FieldHasKey(field string, key interface{}) Predicate {
+	return Predicate{Field: field, Op: PredHasKey, Value: key}
+}
+
+func FieldNotHasKey(field string, key interface{}) Predicate {
+	return Predicate{Field: field, Op: PredNotHasKey, Value: key}
+}
+
+//
+// defaultIndexes are maintained from start up, more can be added with AddIndex
+//
+var defaultIndexes = map[MsgType][]string{
+	ContractMsg:   {"State"},
+	MinerMsg:      {"Dest", "Contracts", "State"},
+	ConnectionMsg: {"Miner"},
+}
+
+// fieldIndex maps a normalized field value (or map key) to the IDs holding it
+type fieldIndex map[interface{}]map[IDString]struct{}
+
+//--------------------------------------------------------------------------------
+// Query retrieves the records of msg matching filter, asynchronously.
+//--------------------------------------------------------------------------------
+func (ps *PubSub) Query(msg MsgType, filter Filter, ech EventChan) (requestID int, err error) {
+	requestID = <-ps.requestIDChan
+
+	if msg == NoMsg {
+		return requestID, getCommandError(MsgBusErrNoMsg)
+	}
+
+	if ech == nil {
+		return requestID, getCommandError(MsgBusErrNoEventChan)
+	}
+
+	c := cmd{
+		op:        opQuery,
+		sync:      false,
+		msg:       msg,
+		requestID: requestID,
+		data:      filter,
+		eventch:   ech,
+	}
+
+	_, err = ps.dispatch(&c)
+
+	return requestID, err
+}
+
+//--------------------------------------------------------------------------------
+// QueryWait retrieves the records of msg matching filter, synchronously.
+// The event Data is a QueryResult.
+//--------------------------------------------------------------------------------
+func (ps *PubSub) QueryWait(msg MsgType, filter Filter) (e *Event, err error) {
+
+	if msg == NoMsg {
+		return e, getCommandError(MsgBusErrNoMsg)
+	}
+
+	c := cmd{
+		op:      opQuery,
+		sync:    true,
+		msg:     msg,
+		data:    filter,
+		eventch: nil,
+	}
+
+	return ps.dispatch(&c)
+}
+
+//--------------------------------------------------------------------------------
+// AddIndexWait has the registry maintain a secondary index on field, used by
+// Query for Eq and HasKey predicates on that field.
+//--------------------------------------------------------------------------------
+func (ps *PubSub) AddIndexWait(msg MsgType, field string) (e *Event, err error) {
+
+	if msg == NoMsg {
+		return e, getCommandError(MsgBusErrNoMsg)
+	}
+
+	if field == "" {
+		return e, getCommandError(MsgBusErrNoSearchTerm)
+	}
+
+	c := cmd{
+		op:      opIndex,
+		sync:    true,
+		msg:     msg,
+		Name:    field,
+		data:    nil,
+		eventch: nil,
+	}
+
+	return ps.dispatch(&c)
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func (reg *registry) query(c *cmd) {
+
+	event := Event{
+		EventType: QueryEvent,
+		Msg:       c.msg,
+		RequestID: c.requestID,
+		Data:      nil,
+		Err:       nil,
+	}
+
+	filter, _ := c.data.(Filter)
+
+	if _, ok := reg.data[c.msg]; !ok {
+		event.Err = getCommandError(MsgBusErrBadMsg)
+	} else if result, err := reg.match(c.msg, filter); err != nil {
+		event.Err = err
+	} else {
+		event.Data = result
+	}
+
+	if c.sync {
+		reg.reply(c, &event)
+	}
+	if c.eventch != nil {
+		reg.deliver(c.eventch, &event)
+	}
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func (reg *registry) addIndex(c *cmd) {
+
+	event := Event{
+		EventType: IndexedEvent,
+		Msg:       c.msg,
+		RequestID: c.requestID,
+		Data:      c.Name,
+		Err:       nil,
+	}
+
+	if _, ok := reg.data[c.msg]; !ok {
+		event.Err = getCommandError(MsgBusErrBadMsg)
+	} else {
+		reg.buildIndex(c.msg, c.Name)
+	}
+
+	if c.sync {
+		reg.reply(c, &event)
+	}
+	if c.eventch != nil {
+		reg.deliver(c.eventch, &event)
+	}
+}
+
+//-----------------------------------------
+// match narrows the candidates with any usable index and then checks every
+// predicate against the remaining records.
+//-----------------------------------------
+func (reg *registry) match(msg MsgType, filter Filter) (result QueryResult, err error) {
+
+	// Records of one message type share a type, any one shows the fields
+	for _, rd := range reg.data[msg] {
+		if err = filter.check(rd.data); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	var candidates map[IDString]struct{}
+	indexed := false
+
+	for _, p := range filter {
+		if p.Op != PredEq && p.Op != PredHasKey {
+			continue
+		}
+		idx, ok := reg.indexes[msg][p.Field]
+		if !ok {
+			continue
+		}
+		ids := idx[normalizeValue(reflect.ValueOf(p.Value))]
+		if !indexed {
+			candidates = make(map[IDString]struct{}, len(ids))
+			for id := range ids {
+				candidates[id] = struct{}{}
+			}
+			indexed = true
+		} else {
+			for id := range candidates {
+				if _, ok := ids[id]; !ok {
+					delete(candidates, id)
+				}
+			}
+		}
+	}
+
+	result = make(QueryResult)
+
+	check := func(id IDString, rd registryData) error {
+		ok, err := filter.matches(rd.data)
+		if err != nil {
+			return err
+		}
+		if ok {
+			result[id] = rd.data
+		}
+		return nil
+	}
+
+	if indexed {
+		for id := range candidates {
+			if rd, ok := reg.data[msg][id]; ok {
+				if err = check(id, rd); err != nil {
+					return nil, err
+				}
+			}
+		}
+	} else {
+		for id, rd := range reg.data[msg] {
+			if err = check(id, rd); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func (reg *registry) buildIndex(msg MsgType, field string) {
+	if _, ok := reg.indexes[msg]; !ok {
+		reg.indexes[msg] = make(map[string]fieldIndex)
+	}
+
+	idx := make(fieldIndex)
+	reg.indexes[msg][field] = idx
+
+	for id, rd := range reg.data[msg] {
+		idx.add(id, rd.data, field)
+	}
+}
+
+//-----------------------------------------
+// reindex moves id between index buckets when its data changes, old or
+// data may be nil for a new or removed record.
+//-----------------------------------------
+func (reg *registry) reindex(msg MsgType, id IDString, old interface{}, data interface{}) {
+	for field, idx := range reg.indexes[msg] {
+		if old != nil {
+			idx.remove(id, old, field)
+		}
+		if data != nil {
+			idx.add(id, data, field)
+		}
+	}
+}
+
+func (idx fieldIndex) add(id IDString, data interface{}, field string) {
+	for _, k := range indexKeys(data, field) {
+		if _, ok := idx[k]; !ok {
+			idx[k] = make(map[IDString]struct{})
+		}
+		idx[k][id] = struct{}{}
+	}
+}
+
+func (idx fieldIndex) remove(id IDString, data interface{}, field string) {
+	for _, k := range indexKeys(data, field) {
+		delete(idx[k], id)
+		if len(idx[k]) == 0 {
+			delete(idx, k)
+		}
+	}
+}
+
+// indexKeys returns the map keys of a map field or the value of a scalar field
+func indexKeys(data interface{}, field string) (keys []interface{}) {
+	f, ok := fieldValue(data, field)
+	if !ok {
+		return nil
+	}
+
+	if f.Kind() == reflect.Map {
+		for _, k := range f.MapKeys() {
+			keys = append(keys, normalizeValue(k))
+		}
+		return keys
+	}
+
+	return []interface{}{normalizeValue(f)}
+}
+
+//-----------------------------------------
+// check fails if a predicate can not be applied to the field it names on
+// data, fields data does not have are left to match nothing
+//-----------------------------------------
+func (f Filter) check(data interface{}) error {
+	for _, p := range f {
+		if v, ok := fieldValue(data, p.Field); ok {
+			if err := p.check(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p Predicate) check(f reflect.Value) error {
+	switch p.Op {
+	case PredHasKey, PredNotHasKey:
+		if f.Kind() != reflect.Map {
+			return fmt.Errorf("%w: %s is not a map field", getCommandError(MsgBusErrBadData), p.Field)
+		}
+	default:
+		if f.Kind() == reflect.Map || f.Kind() == reflect.Slice {
+			return fmt.Errorf("%w: %s is a %s field", getCommandError(MsgBusErrBadData), p.Field, f.Kind())
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func (f Filter) matches(data interface{}) (bool, error) {
+	for _, p := range f {
+		ok, err := p.matches(data)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func (p Predicate) matches(data interface{}) (bool, error) {
+
+	f, ok := fieldValue(data, p.Field)
+	if !ok {
+		return false, nil
+	}
+
+	if err := p.check(f); err != nil {
+		return false, err
+	}
+
+	switch p.Op {
+	case PredHasKey, PredNotHasKey:
+		want := normalizeValue(reflect.ValueOf(p.Value))
+		found := false
+		for _, k := range f.MapKeys() {
+			if normalizeValue(k) == want {
+				found = true
+				break
+			}
+		}
+		return found == (p.Op == PredHasKey), nil
+
+	case PredEq:
+		return normalizeValue(f) == normalizeValue(reflect.ValueOf(p.Value)), nil
+
+	case PredNe:
+		return normalizeValue(f) != normalizeValue(reflect.ValueOf(p.Value)), nil
+
+	case PredLt, PredLe, PredGt, PredGe:
+		cmp, err := compareValues(normalizeValue(f), normalizeValue(reflect.ValueOf(p.Value)))
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", p.Field, err)
+		}
+		switch p.Op {
+		case PredLt:
+			return cmp < 0, nil
+		case PredLe:
+			return cmp <= 0, nil
+		case PredGt:
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+
+	default:
+		return false, fmt.Errorf("unknown predicate op %s", p.Op)
+	}
+}
+
+// fieldValue looks up an exported field on a record or pointer to a record
+func fieldValue(data interface{}, field string) (f reflect.Value, ok bool) {
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return f, false
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return f, false
+	}
+
+	f = v.FieldByName(field)
+
+	return f, f.IsValid()
+}
+
+// normalizeValue strips named types so ContractState("x") and "x" compare
+// and index the same, every number becomes a float64 so int 2 and 2.0 do too
+func normalizeValue(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.Bool:
+		return v.Bool()
+	default:
+		if v.CanInterface() {
+			return fmt.Sprint(v.Interface())
+		}
+		return nil
+	}
+}
+
+func compareValues(a interface{}, b interface{}) (int, error) {
+	switch av := a.(type) {
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+		}
+		switch {
+		case av < bv:
+			return -1, nil
+		case av > bv:
+			return 1, nil
+		}
+		return 0, nil
+	case float64:
+		bf, ok := b.(float64)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+		}
+		switch {
+		case av < bf:
+			return -1, nil
+		case av > bf:
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("cannot order %T", a)
+	}
+}
@@ -0,0 +1,211 @@
+package msgbus
+
+import (
+	"errors"
+	"testing"
+)
+
+func queryTestBus(t *testing.T) *PubSub {
+	mb := New(1, l)
+
+	miners := []Miner{
+		{ID: "MinerID01", Name: "worker01", IP: "10.0.0.1", State: OnlineState, Dest: "DestID01", CurrentHashRate: 100, Contracts: map[ContractID]float64{"ContractID01": 1}},
+		{ID: "MinerID02", Name: "worker02", IP: "10.0.0.2", State: OnlineState, Dest: "DestID02", CurrentHashRate: 200, Contracts: map[ContractID]float64{"ContractID01": 0.5, "ContractID02": 0.5}},
+		{ID: "MinerID03", Name: "worker03", IP: "10.0.0.2", State: OfflineState, Dest: "DestID01", CurrentHashRate: 300, Contracts: map[ContractID]float64{}},
+	}
+	for _, m := range miners {
+		if _, err := mb.MinerPubWait(m); err != nil {
+			t.Fatalf("MinerPubWait returned error: %s", err)
+		}
+	}
+
+	contracts := []Contract{
+		{ID: "ContractID01", State: ContRunningState, Speed: 100},
+		{ID: "ContractID02", State: ContAvailableState, Speed: 200},
+	}
+	for _, c := range contracts {
+		if _, err := mb.PubWait(ContractMsg, IDString(c.ID), c); err != nil {
+			t.Fatalf("PubWait returned error: %s", err)
+		}
+	}
+
+	return mb
+}
+
+func TestQueryPredicates(t *testing.T) {
+	mb := queryTestBus(t)
+
+	tests := []struct {
+		msg    MsgType
+		filter Filter
+		want   []IDString
+	}{
+		{MinerMsg, Filter{FieldHasKey("Contracts", ContractID("ContractID01"))}, []IDString{"MinerID01", "MinerID02"}},
+		{MinerMsg, Filter{FieldNotHasKey("Contracts", ContractID("ContractID01"))}, []IDString{"MinerID03"}},
+		{MinerMsg, Filter{FieldEq("Dest", DestID("DestID01"))}, []IDString{"MinerID01", "MinerID03"}},
+		{MinerMsg, Filter{FieldEq("Dest", "DestID01"), FieldEq("State", OnlineState)}, []IDString{"MinerID01"}},
+		{MinerMsg, Filter{FieldGe("CurrentHashRate", 200)}, []IDString{"MinerID02", "MinerID03"}},
+		{MinerMsg, Filter{FieldLt("CurrentHashRate", 150.5)}, []IDString{"MinerID01"}},
+		{MinerMsg, Filter{FieldEq("IP", "10.0.0.2"), FieldNe("Name", "worker02")}, []IDString{"MinerID03"}},
+		{ContractMsg, Filter{FieldEq("State", ContRunningState)}, []IDString{"ContractID01"}},
+		{ContractMsg, Filter{}, []IDString{"ContractID01", "ContractID02"}},
+	}
+
+	for i, tt := range tests {
+		event, err := mb.QueryWait(tt.msg, tt.filter)
+		if err != nil {
+			t.Fatalf("%d: QueryWait returned error: %s", i, err)
+		}
+		result := event.Data.(QueryResult)
+		if len(result) != len(tt.want) {
+			t.Errorf("%d: expected %v, got %v", i, tt.want, result)
+			continue
+		}
+		for _, id := range tt.want {
+			if _, ok := result[id]; !ok {
+				t.Errorf("%d: %s missing from result", i, id)
+			}
+		}
+	}
+
+	if _, err := mb.QueryWait(MinerMsg, Filter{FieldHasKey("Name", "x")}); err == nil {
+		t.Errorf("HasKey on a non map field should fail")
+	}
+}
+
+// Numbers match by value whatever their Go type, on indexed fields too
+func TestQueryNumericKinds(t *testing.T) {
+	type rates struct {
+		Int   int
+		Float float64
+		Uint  uint32
+	}
+	data := rates{Int: 200, Float: 200, Uint: 200}
+
+	tests := []struct {
+		p    Predicate
+		want bool
+	}{
+		{FieldEq("Int", 200), true},
+		{FieldEq("Int", 200.0), true},
+		{FieldEq("Int", 200.5), false},
+		{FieldEq("Float", 200), true},
+		{FieldEq("Float", int64(200)), true},
+		{FieldEq("Float", uint8(200)), true},
+		{FieldEq("Uint", 200.0), true},
+		{FieldNe("Float", 200), false},
+		{FieldGe("Int", 199.5), true},
+		{FieldLt("Float", 201), true},
+	}
+	for i, tt := range tests {
+		got, err := tt.p.matches(data)
+		if err != nil || got != tt.want {
+			t.Errorf("%d: %+v expected %t, got %t error %v", i, tt.p, tt.want, got, err)
+		}
+	}
+
+	mb := queryTestBus(t)
+	if _, err := mb.AddIndexWait(MinerMsg, "CurrentHashRate"); err != nil {
+		t.Fatalf("AddIndexWait returned error: %s", err)
+	}
+	event, err := mb.QueryWait(MinerMsg, Filter{FieldEq("CurrentHashRate", 200.0)})
+	if err != nil {
+		t.Fatalf("QueryWait returned error: %s", err)
+	}
+	if result := event.Data.(QueryResult); len(result) != 1 || result["MinerID02"] == nil {
+		t.Errorf("expected MinerID02, got %v", result)
+	}
+}
+
+// Predicates other than HasKey and NotHasKey on map or slice fields are
+// rejected, whether or not the field is indexed
+func TestQueryContainerFields(t *testing.T) {
+	type record struct {
+		Contracts map[ContractID]float64
+		Pins      []string
+	}
+	data := record{Contracts: map[ContractID]float64{"ContractID01": 1}, Pins: []string{"a"}}
+
+	tests := []struct {
+		p   Predicate
+		bad bool
+	}{
+		{FieldEq("Contracts", "ContractID01"), true},
+		{FieldNe("Contracts", 1), true},
+		{FieldGt("Contracts", 0), true},
+		{FieldEq("Pins", "a"), true},
+		{FieldLe("Pins", "a"), true},
+		{FieldHasKey("Pins", "a"), true},
+		{FieldHasKey("Contracts", ContractID("ContractID01")), false},
+		{FieldNotHasKey("Contracts", "ContractID02"), false},
+	}
+	for i, tt := range tests {
+		_, err := tt.p.matches(data)
+		if bad := errors.Is(err, MsgBusErrBadData); bad != tt.bad {
+			t.Errorf("%d: %+v expected bad data %t, got error %v", i, tt.p, tt.bad, err)
+		}
+	}
+
+	// Contracts is indexed on miners, a value nobody has still fails
+	mb := queryTestBus(t)
+	for _, filter := range []Filter{
+		{FieldEq("Contracts", "ContractID01")},
+		{FieldEq("Contracts", "ContractID09")},
+	} {
+		if _, err := mb.QueryWait(MinerMsg, filter); !errors.Is(err, MsgBusErrBadData) {
+			t.Errorf("%+v expected bad data, got error %v", filter, err)
+		}
+	}
+}
+
+func TestQueryIndexFollowsUpdates(t *testing.T) {
+	mb := queryTestBus(t)
+
+	if _, err := mb.MinerSetDestWait("MinerID01", "DestID02"); err != nil {
+		t.Fatalf("MinerSetDestWait returned error: %s", err)
+	}
+	if _, err := mb.UnpubWait(MinerMsg, "MinerID02"); err != nil {
+		t.Fatalf("UnpubWait returned error: %s", err)
+	}
+
+	miners, err := mb.MinerQueryWait(Filter{FieldEq("Dest", "DestID02")})
+	if err != nil {
+		t.Fatalf("MinerQueryWait returned error: %s", err)
+	}
+	if len(miners) != 1 || miners[0].ID != "MinerID01" {
+		t.Errorf("unexpected miners after update: %v", miners)
+	}
+
+	if miners := mb.MinersContainContract("ContractID02"); len(miners) != 0 {
+		t.Errorf("unpublished miner still indexed: %v", miners)
+	}
+
+	if _, err := mb.AddIndexWait(MinerMsg, "IP"); err != nil {
+		t.Fatalf("AddIndexWait returned error: %s", err)
+	}
+	miners, _ = mb.MinerQueryWait(Filter{FieldEq("IP", "10.0.0.2")})
+	if len(miners) != 1 || miners[0].ID != "MinerID03" {
+		t.Errorf("unexpected miners from new index: %v", miners)
+	}
+}
+
+func TestSearchOtherMsgTypes(t *testing.T) {
+	mb := queryTestBus(t)
+
+	event, err := mb.SearchIPWait(MinerMsg, "10.0.0.2")
+	if err != nil {
+		t.Fatalf("SearchIPWait returned error: %s", err)
+	}
+	if len(event.Data.(IDIndex)) != 2 {
+		t.Errorf("expected 2 miners, got %v", event.Data)
+	}
+
+	// Records without the field simply do not match
+	event, err = mb.SearchNameWait(ContractMsg, "worker01")
+	if err != nil {
+		t.Fatalf("SearchNameWait returned error: %s", err)
+	}
+	if len(event.Data.(IDIndex)) != 0 {
+		t.Errorf("expected no contracts, got %v", event.Data)
+	}
+}
@@ -0,0 +1,127 @@
+package msgbus
+
+import (
+	"context"
+	"fmt"
+)
+
+//
+// Typed repositories
+//
+// Each record type has a repository returned by a PubSub method named after
+// it, e.g. ps.Contracts(), whose methods take and return the record type
+// rather than an *Event holding interface{} data. Nothing in a repository
+// panics or prints, a missing record is reported as an error matching
+// ErrNotFound and publishing an existing one as an error matching
+// ErrDuplicate:
+//
+//	contract, err := ps.Contracts().Get(id)
+//	if errors.Is(err, msgbus.ErrNotFound) {
+//		...
+//	}
+//
+// recordRepo holds the parts that do not depend on the record type, the
+// typed repositories convert to and from interface{} around it.
+//
+type recordRepo struct {
+	ps  *PubSub
+	msg MsgType
+}
+
+//-----------------------------------------
+// recordError names the record an error is about, keeping it testable with
+// errors.Is
+//-----------------------------------------
+func (r recordRepo) recordError(id IDString, err error) error {
+	if err == nil {
+		return nil
+	}
+	if id == "" {
+		return fmt.Errorf("%s: %w", r.msg, err)
+	}
+	return fmt.Errorf("%s %s: %w", r.msg, id, err)
+}
+
+func (r recordRepo) pub(id IDString, data interface{}) (*Event, error) {
+	if id == "" {
+		return nil, r.recordError(id, getCommandError(MsgBusErrNoID))
+	}
+	e, err := r.ps.PubWait(r.msg, id, data)
+	return e, r.recordError(id, err)
+}
+
+func (r recordRepo) get(id IDString) (data interface{}, err error) {
+	if id == "" {
+		return nil, r.recordError(id, getCommandError(MsgBusErrNoID))
+	}
+	e, err := r.ps.GetWait(r.msg, id)
+	if err != nil {
+		return nil, r.recordError(id, err)
+	}
+	return e.Data, nil
+}
+
+func (r recordRepo) set(id IDString, data interface{}) error {
+	if id == "" {
+		return r.recordError(id, getCommandError(MsgBusErrNoID))
+	}
+	_, err := r.ps.SetWait(r.msg, id, data)
+	return r.recordError(id, err)
+}
+
+func (r recordRepo) update(id IDString, update func(old interface{}) (interface{}, error)) error {
+	if id == "" {
+		return r.recordError(id, getCommandError(MsgBusErrNoID))
+	}
+	_, err := r.ps.UpdateWait(r.msg, id, update)
+	return r.recordError(id, err)
+}
+
+func (r recordRepo) unpub(id IDString) error {
+	if id == "" {
+		return r.recordError(id, getCommandError(MsgBusErrNoID))
+	}
+	_, err := r.ps.UnpubWait(r.msg, id)
+	return r.recordError(id, err)
+}
+
+func (r recordRepo) ids() (IDIndex, error) {
+	e, err := r.ps.GetWait(r.msg, "")
+	if err != nil {
+		return nil, r.recordError("", err)
+	}
+	index, _ := e.Data.(IDIndex)
+	return index, nil
+}
+
+func (r recordRepo) query(filter Filter) (QueryResult, error) {
+	e, err := r.ps.QueryWait(r.msg, filter)
+	if err != nil {
+		return nil, r.recordError("", err)
+	}
+	result, _ := e.Data.(QueryResult)
+	return result, nil
+}
+
+//-----------------------------------------
+// watch subscribes a new event channel to every record, or to the record id
+// if given, until ctx is done and the channel is closed. The SubscribedEvent
+// is taken off the channel before it is returned.
+//-----------------------------------------
+func (r recordRepo) watch(ctx context.Context, id IDString, opts []SubOption) (EventChan, error) {
+	ech := NewEventChan()
+	opts = append(opts, WithContext(ctx))
+	if _, err := r.ps.SubWait(r.msg, id, ech, opts...); err != nil {
+		r.ps.RemoveAndCloseEventChan(ech)
+		return nil, r.recordError(id, err)
+	}
+	<-ech
+	return ech, nil
+}
+
+//-----------------------------------------
+// badRecord reports data of the wrong type found under msg/id
+//-----------------------------------------
+func (r recordRepo) badRecord(id IDString, data interface{}) error {
+	return r.recordError(id, fmt.Errorf("%w: unexpected %T", getCommandError(MsgBusErrBadData), data))
+}
@@ -0,0 +1,101 @@
+package msgbus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestContractRepo(t *testing.T) {
+	mb := New(1, l)
+	contracts := mb.Contracts()
+
+	if _, err := contracts.Get("ContractID01"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := contracts.Set(Contract{ID: "ContractID01"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound setting a missing contract, got %v", err)
+	}
+
+	for _, id := range []ContractID{"ContractID02", "ContractID01"} {
+		if _, err := contracts.Pub(Contract{ID: id, State: ContAvailableState}); err != nil {
+			t.Fatalf("Pub returned error: %s", err)
+		}
+	}
+	if _, err := contracts.Pub(Contract{ID: "ContractID01"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("expected ErrDuplicate, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ech, err := contracts.Watch(ctx, "", OnlyEvents(UpdateEvent))
+	if err != nil {
+		t.Fatalf("Watch returned error: %s", err)
+	}
+
+	contract, err := contracts.Update("ContractID01", func(c *Contract) error {
+		c.State = ContRunningState
+		return nil
+	})
+	if err != nil || contract.State != ContRunningState {
+		t.Fatalf("Update returned %+v, %v", contract, err)
+	}
+
+	select {
+	case e := <-ech:
+		if c, err := contracts.Decode(e); err != nil || c.ID != "ContractID01" || c.State != ContRunningState {
+			t.Errorf("unexpected watched contract %+v, %v", c, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("update not watched")
+	}
+
+	running, err := contracts.List(Filter{FieldEq("State", ContRunningState)})
+	if err != nil || len(running) != 1 || running[0].ID != "ContractID01" {
+		t.Errorf("unexpected running contracts %+v, %v", running, err)
+	}
+	all, err := contracts.List(nil)
+	if err != nil || len(all) != 2 || all[0].ID != "ContractID01" {
+		t.Errorf("unexpected contracts %+v, %v", all, err)
+	}
+
+	if err := contracts.Unpub("ContractID02"); err != nil {
+		t.Errorf("Unpub returned error: %s", err)
+	}
+	if ids, _ := contracts.IDs(); len(ids) != 1 || contracts.Exists("ContractID02") {
+		t.Errorf("unpublished contract still listed: %v", ids)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ech:
+		if ok {
+			t.Errorf("unexpected event after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("watch channel not closed on cancel")
+	}
+}
+
+func TestRepoWrongType(t *testing.T) {
+	mb := New(1, l)
+
+	// Written without the repository, the record is not a Dest
+	mb.PubWait(DestMsg, "DestID01", "stratum+tcp://127.0.0.1:3334/")
+
+	if _, err := mb.Dests().Get("DestID01"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a bad data error, got %v", err)
+	}
+	if _, err := mb.Dests().Get(""); err == nil {
+		t.Errorf("expected an error for an empty ID")
+	}
+	if d, err := mb.DestGetWait("DestID02"); d != nil || !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v, %v", d, err)
+	}
+	if _, err := mb.MinerPubWait(Miner{ID: "MinerID01"}); err != nil {
+		t.Fatalf("MinerPubWait returned error: %s", err)
+	}
+	if _, err := mb.MinerPubWait(Miner{ID: "MinerID01"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("expected ErrDuplicate, got %v", err)
+	}
+}
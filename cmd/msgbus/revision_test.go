@@ -0,0 +1,228 @@
+package msgbus
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSetIfRevision(t *testing.T) {
+	mb := New(1, l)
+
+	dest := Dest{ID: "DestID01", NetUrl: "stratum+tcp://127.0.0.1:3334/"}
+	event, err := mb.PubWait(DestMsg, IDString(dest.ID), dest)
+	if err != nil || event.Err != nil {
+		t.Fatalf("PubWait returned error: %v, %v", err, event.Err)
+	}
+	if event.Revision != 1 {
+		t.Fatalf("expected revision 1 after publish, got %d", event.Revision)
+	}
+
+	dest.NetUrl = "stratum+tcp://127.0.0.2:3334/"
+	event, err = mb.SetIfRevisionWait(DestMsg, IDString(dest.ID), 1, dest)
+	if err != nil || event.Err != nil {
+		t.Fatalf("SetIfRevisionWait returned error: %v, %v", err, event.Err)
+	}
+	if event.Revision != 2 {
+		t.Fatalf("expected revision 2 after set, got %d", event.Revision)
+	}
+
+	stale := Dest{ID: dest.ID, NetUrl: "stratum+tcp://127.0.0.3:3334/"}
+	event, err = mb.SetIfRevisionWait(DestMsg, IDString(dest.ID), 1, stale)
+	if err != ErrRevisionConflict {
+		t.Fatalf("expected ErrRevisionConflict, got %v", err)
+	}
+	if event.Revision != 2 {
+		t.Fatalf("expected conflict to report revision 2, got %d", event.Revision)
+	}
+
+	event, err = mb.GetWait(DestMsg, IDString(dest.ID))
+	if err != nil || event.Err != nil {
+		t.Fatalf("GetWait returned error: %v, %v", err, event.Err)
+	}
+	if event.Data.(Dest).NetUrl != dest.NetUrl || event.Revision != 2 {
+		t.Errorf("stale set changed the record: %v rev %d", event.Data, event.Revision)
+	}
+}
+
+func TestMinerUpdateWaitConcurrent(t *testing.T) {
+	mb := New(1, l)
+
+	miner := Miner{ID: "MinerID01", State: OnlineState, Contracts: map[ContractID]float64{}}
+	if _, err := mb.MinerPubWait(miner); err != nil {
+		t.Fatalf("MinerPubWait returned error: %s", err)
+	}
+
+	// Each writer adds its own contract, a lost update would drop one
+	contracts := []ContractID{"ContractID01", "ContractID02", "ContractID03", "ContractID04"}
+	var wg sync.WaitGroup
+	for _, c := range contracts {
+		wg.Add(1)
+		go func(c ContractID) {
+			defer wg.Done()
+			if _, err := mb.MinerSetContractWait(miner.ID, c, 0.25, true); err != nil {
+				t.Errorf("MinerSetContractWait returned error: %s", err)
+			}
+		}(c)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := mb.MinerUpdateWait(miner.ID, func(m *Miner) error {
+			m.CurrentHashRate = 100
+			return nil
+		}); err != nil {
+			t.Errorf("MinerUpdateWait returned error: %s", err)
+		}
+	}()
+	wg.Wait()
+
+	m, err := mb.MinerGetWait(miner.ID)
+	if err != nil {
+		t.Fatalf("MinerGetWait returned error: %s", err)
+	}
+	if len(m.Contracts) != len(contracts) {
+		t.Errorf("expected %d contracts, got %v", len(contracts), m.Contracts)
+	}
+	if m.CurrentHashRate != 100 {
+		t.Errorf("expected hashrate 100, got %d", m.CurrentHashRate)
+	}
+}
+
+//
+// A writer that gets in before every retry makes the update fail, not
+// report success for a write that never happened
+//
+func TestUpdateWaitConflictExhausted(t *testing.T) {
+	mb := New(1, l)
+
+	dest := Dest{ID: "DestID01", NetUrl: "stratum+tcp://127.0.0.1:3334/"}
+	if _, err := mb.PubWait(DestMsg, IDString(dest.ID), dest); err != nil {
+		t.Fatalf("PubWait returned error: %v", err)
+	}
+
+	calls := 0
+	_, err := mb.UpdateWait(DestMsg, IDString(dest.ID), func(old interface{}) (interface{}, error) {
+		calls++
+		competing := old.(Dest)
+		competing.NetUrl = DestNetUrl(fmt.Sprintf("stratum+tcp://127.0.0.%d:3334/", calls+1))
+		if _, err := mb.SetWait(DestMsg, IDString(dest.ID), competing); err != nil {
+			t.Fatalf("SetWait returned error: %v", err)
+		}
+		mine := old.(Dest)
+		mine.NetUrl = "stratum+tcp://127.0.0.100:3334/"
+		return mine, nil
+	})
+	if err != ErrRevisionConflict {
+		t.Fatalf("expected ErrRevisionConflict, got %v", err)
+	}
+	if calls != maxUpdateRetries {
+		t.Errorf("expected %d attempts, got %d", maxUpdateRetries, calls)
+	}
+
+	event, err := mb.GetWait(DestMsg, IDString(dest.ID))
+	if err != nil || event.Data.(Dest).NetUrl == "stratum+tcp://127.0.0.100:3334/" {
+		t.Errorf("lost update was stored: %v, %v", event.Data, err)
+	}
+}
+
+func TestMinerAddShareWait(t *testing.T) {
+	mb := New(1, l)
+
+	miner := Miner{ID: "MinerID01", State: OnlineState, Contracts: map[ContractID]float64{}}
+	if _, err := mb.MinerPubWait(miner); err != nil {
+		t.Fatalf("MinerPubWait returned error: %s", err)
+	}
+
+	results := []ShareResult{ShareAccepted, ShareAccepted, ShareStale, ShareDuplicate, ShareLowDifficulty, ShareUnknownJob, "other"}
+	var wg sync.WaitGroup
+	for _, r := range results {
+		wg.Add(1)
+		go func(r ShareResult) {
+			defer wg.Done()
+			if _, err := mb.MinerAddShareWait(miner.ID, "DestID01", r, 1024); err != nil {
+				t.Errorf("MinerAddShareWait returned error: %s", err)
+			}
+		}(r)
+	}
+	wg.Wait()
+	mb.MinerAddShareWait(miner.ID, "DestID02", ShareAccepted, 512)
+
+	m, err := mb.MinerGetWait(miner.ID)
+	if err != nil {
+		t.Fatalf("MinerGetWait returned error: %s", err)
+	}
+	want := ShareStats{Accepted: 2, Duplicate: 1, LowDifficulty: 1, Stale: 1, UnknownJob: 1, Rejected: 1, AcceptedWork: 2048}
+	if m.Shares["DestID01"] != want {
+		t.Errorf("expected %+v, got %+v", want, m.Shares["DestID01"])
+	}
+	if m.Shares["DestID02"].AcceptedWork != 512 {
+		t.Errorf("expected 512 work at DestID02, got %+v", m.Shares["DestID02"])
+	}
+
+	mb.MinerAddLocalRejectWait(miner.ID, ShareMalformed)
+	mb.MinerAddLocalRejectWait(miner.ID, ShareDuplicate)
+	if m, err = mb.MinerGetWait(miner.ID); err != nil {
+		t.Fatalf("MinerGetWait returned error: %s", err)
+	}
+	if want := (ShareStats{Duplicate: 1, Malformed: 1}); m.LocalRejects != want {
+		t.Errorf("expected local rejects %+v, got %+v", want, m.LocalRejects)
+	}
+	if m.Shares["DestID01"].Malformed != 0 {
+		t.Errorf("local reject counted at a Dest %+v", m.Shares["DestID01"])
+	}
+}
+
+func TestMinerRemoveContractWaitDefaultDest(t *testing.T) {
+	mb := New(1, l)
+
+	contracts := map[ContractID]float64{"ContractID01": 1}
+	own := Miner{ID: "MinerID01", State: OnlineState, Dest: "ContractDestID", DefaultDest: "ListenerDestID", Contracts: contracts}
+	other := Miner{ID: "MinerID02", State: OnlineState, Dest: "ContractDestID", Contracts: map[ContractID]float64{"ContractID01": 1}}
+	for _, miner := range []Miner{own, other} {
+		if _, err := mb.MinerPubWait(miner); err != nil {
+			t.Fatalf("MinerPubWait returned error: %s", err)
+		}
+	}
+
+	m, err := mb.MinerRemoveContractWait(own.ID, "ContractID01", DEFAULT_DEST_ID)
+	if err != nil {
+		t.Fatalf("MinerRemoveContractWait returned error: %s", err)
+	}
+	if m.Dest != "ListenerDestID" {
+		t.Errorf("expected the miner's own default dest, got %s", m.Dest)
+	}
+
+	m, err = mb.MinerRemoveContractWait(other.ID, "ContractID01", DEFAULT_DEST_ID)
+	if err != nil {
+		t.Fatalf("MinerRemoveContractWait returned error: %s", err)
+	}
+	if m.Dest != DEFAULT_DEST_ID {
+		t.Errorf("expected %s, got %s", DEFAULT_DEST_ID, m.Dest)
+	}
+}
+
+func TestPersistRevision(t *testing.T) {
+	dir := t.TempDir()
+
+	mb, err := NewPersistent(1, l, PersistConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewPersistent returned error: %s", err)
+	}
+	dest := Dest{ID: "DestID01", NetUrl: "stratum+tcp://127.0.0.1:3334/"}
+	mb.PubWait(DestMsg, IDString(dest.ID), dest)
+	mb.SetWait(DestMsg, IDString(dest.ID), dest)
+
+	restored, err := NewPersistent(1, l, PersistConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewPersistent returned error on reload: %s", err)
+	}
+
+	event, err := restored.GetWait(DestMsg, IDString(dest.ID))
+	if err != nil || event.Err != nil {
+		t.Fatalf("GetWait returned error: %v, %v", err, event.Err)
+	}
+	if event.Revision != 2 {
+		t.Errorf("expected revision 2 after replay, got %d", event.Revision)
+	}
+}
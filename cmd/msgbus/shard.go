@@ -0,0 +1,276 @@
+package msgbus
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/daniel-888/proxy-router/cmd/log"
+)
+
+//
+// Registry sharding
+//
+// Each of the message types created with the registry has its own worker
+// goroutine, so a burst of MinerMsg sets does not queue up behind Contract
+// or Dest traffic. Commands for one message type are still handled one at a
+// time and in the order they were sent.
+//
+// Commands spanning message types (RemoveAndCloseEventChan, a Txn over
+// several types, delivery and op log settings, Shutdown) and commands for
+// message types added at run time go to the coordinator, started by start().
+// The dispatcher takes ps.gate shared for a shard command and exclusive for a
+// coordinator command, the worker releasing it once the command has been
+// handled. A coordinator command therefore runs with every shard idle and
+// after everything the sending goroutine dispatched before it.
+//
+// While an op log is being written every command goes to the coordinator, so
+// the log keeps a single order.
+//
+// GetWait does not go through a worker at all, it reads the record from the
+// immutable snapshot the shard republishes after each change, see snapshot.
+// While a Pub, Set, Unpub or Txn sent without waiting has not been applied
+// to a message type, GetWait for that type goes through the worker instead,
+// behind the writes, so a caller reads back what it has just written.
+//
+
+type shard struct {
+	msg     MsgType
+	cmdChan chan *cmd
+}
+
+// snapshotBuckets splits each message type's snapshot by ID hash, so a set
+// only copies the bucket holding the record
+const snapshotBuckets = 64
+
+//
+// snapshot holds the records of one message type as GetWait sees them. Each
+// bucket is a map that is never changed once stored, a change replaces the
+// bucket with an updated copy.
+//
+type snapshot struct {
+	buckets [snapshotBuckets]atomic.Value
+	// pending counts the writes sent without waiting that have not been
+	// applied yet, updated atomically
+	pending int64
+}
+
+type snapshotRecord struct {
+	data interface{}
+	rev  uint64
+}
+
+func newSnapshot() *snapshot {
+	s := &snapshot{}
+	for i := range s.buckets {
+		s.buckets[i].Store(map[IDString]snapshotRecord{})
+	}
+	return s
+}
+
+func snapshotBucket(id IDString) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % snapshotBuckets)
+}
+
+func (s *snapshot) bucket(i int) map[IDString]snapshotRecord {
+	return s.buckets[i].Load().(map[IDString]snapshotRecord)
+}
+
+//-----------------------------------------
+// update replaces the bucket holding id with a copy where id is set to rd,
+// or removed if !ok
+//-----------------------------------------
+func (s *snapshot) update(id IDString, rd registryData, ok bool) {
+	i := snapshotBucket(id)
+	old := s.bucket(i)
+
+	m := make(map[IDString]snapshotRecord, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	if ok {
+		m[id] = snapshotRecord{data: rd.data, rev: rd.rev}
+	} else {
+		delete(m, id)
+	}
+
+	s.buckets[i].Store(m)
+}
+
+//-----------------------------------------
+// get answers a GetWait the way registry.get does
+//-----------------------------------------
+func (s *snapshot) get(msg MsgType, id IDString) *Event {
+
+	event := &Event{
+		EventType: GetEvent,
+		Msg:       msg,
+		ID:        id,
+	}
+
+	if id == "" {
+		var index IDIndex
+		for i := range s.buckets {
+			for id := range s.bucket(i) {
+				index = append(index, id)
+			}
+		}
+		event.EventType = GetIndexEvent
+		event.Data = index
+	} else if r, ok := s.bucket(snapshotBucket(id))[id]; !ok {
+		event.Err = getCommandError(MsgBusErrBadID)
+	} else {
+		event.Data = r.data
+		event.Revision = r.rev
+	}
+
+	return event
+}
+
+func (s *snapshot) records() map[IDString]snapshotRecord {
+	records := make(map[IDString]snapshotRecord)
+	for i := range s.buckets {
+		for id, r := range s.bucket(i) {
+			records[id] = r
+		}
+	}
+	return records
+}
+
+//-----------------------------------------
+// publish refreshes the snapshot entry of msg/id after a change, it has to
+// happen before the change is journaled, see persistStore.snapshot
+//-----------------------------------------
+func (reg *registry) publish(msg MsgType, id IDString) {
+	if s, ok := reg.snapshots[msg]; ok {
+		rd, ok := reg.data[msg][id]
+		s.update(id, rd, ok)
+	}
+}
+
+//-----------------------------------------
+// pendingWrites adds delta to the pending count of every snapshot c writes
+// to, if c is a write nobody waits for
+//-----------------------------------------
+func (reg *registry) pendingWrites(c *cmd, delta int64) {
+	if c.sync {
+		return
+	}
+
+	var msgs []MsgType
+	switch c.op {
+	case opPub, opSet, opSetIf, opUnpub:
+		msgs = []MsgType{c.msg}
+	case opTxn:
+		ops, _ := c.data.([]txnOp)
+		for _, op := range ops {
+			msgs = append(msgs, op.msg)
+		}
+	}
+
+	for _, msg := range msgs {
+		if s, ok := reg.snapshots[msg]; ok {
+			atomic.AddInt64(&s.pending, delta)
+		}
+	}
+}
+
+//-----------------------------------------
+// newShards starts a worker for every message type the registry was created
+// with
+//-----------------------------------------
+func (ps *PubSub) newShards() {
+	ps.shards = make(map[MsgType]*shard)
+	ps.quit = make(chan struct{})
+
+	for msg := range ps.reg.snapshots {
+		sh := &shard{
+			msg:     msg,
+			cmdChan: make(chan *cmd),
+		}
+		ps.shards[msg] = sh
+		go ps.runShard(sh)
+	}
+}
+
+//-----------------------------------------
+// shardFor returns the worker handling c, nil if c goes to the coordinator
+//-----------------------------------------
+func (ps *PubSub) shardFor(c *cmd) *shard {
+	switch c.op {
+	case opPub, opSub, opSet, opSetIf, opGet, opSearch, opUnsub, opUnpub, opStream, opQuery, opIndex:
+		return ps.shards[c.msg]
+
+	case opTxn:
+		ops, _ := c.data.([]txnOp)
+		if len(ops) == 0 {
+			return nil
+		}
+		for _, op := range ops[1:] {
+			if op.msg != ops[0].msg {
+				return nil
+			}
+		}
+		return ps.shards[ops[0].msg]
+	}
+
+	return nil
+}
+
+//-----------------------------------------
+// send hands c to its worker, taking ps.gate for it
+//-----------------------------------------
+func (ps *PubSub) send(c *cmd) {
+	if sh := ps.shardFor(c); sh != nil {
+		ps.gate.RLock()
+		// Only changed with the gate held exclusively
+		if atomic.LoadInt32(&ps.serial) == 0 {
+			sh.cmdChan <- c
+			return
+		}
+		ps.gate.RUnlock()
+	}
+
+	ps.gate.Lock()
+	ps.cmdChan <- c
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func (ps *PubSub) runShard(sh *shard) {
+	reg := ps.reg
+
+	for {
+		select {
+		case cmdptr := <-sh.cmdChan:
+			atomic.AddInt64(&reg.metrics.pending, -1)
+
+			if ps.logger != nil {
+				ps.logger.Logf(log.LevelTrace, "MSGBUS: %+v", *cmdptr)
+			}
+
+			reg.handle(cmdptr)
+			ps.gate.RUnlock()
+
+		case <-ps.quit:
+			return
+		}
+	}
+}
+
+//-----------------------------------------
+// records returns every record of msg as of the last published change
+//-----------------------------------------
+func (reg *registry) records(msg MsgType) map[IDString]snapshotRecord {
+	if s, ok := reg.snapshots[msg]; ok {
+		return s.records()
+	}
+
+	records := make(map[IDString]snapshotRecord)
+	for id, rd := range reg.data[msg] {
+		records[id] = snapshotRecord{data: rd.data, rev: rd.rev}
+	}
+	return records
+}
@@ -0,0 +1,181 @@
+package msgbus
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardSnapshot(t *testing.T) {
+	mb := New(1, l)
+
+	miner := Miner{ID: "MinerID01", State: OnlineState, Contracts: map[ContractID]float64{}}
+	mb.MinerPubWait(miner)
+	mb.MinerPubWait(Miner{ID: "MinerID02", State: OnlineState})
+
+	// A read straight after a write sees it
+	for i := 1; i <= 10; i++ {
+		miner.CurrentHashRate = i
+		mb.MinerSetWait(miner)
+		e, err := mb.GetWait(MinerMsg, IDString(miner.ID))
+		if err != nil {
+			t.Fatalf("GetWait returned error: %s", err)
+		}
+		if e.Data.(Miner).CurrentHashRate != i || e.Revision != uint64(i+1) {
+			t.Fatalf("stale read %+v after set %d", e, i)
+		}
+	}
+
+	e, _ := mb.GetWait(MinerMsg, "")
+	if e.EventType != GetIndexEvent || len(e.Data.(IDIndex)) != 2 {
+		t.Errorf("expected both miners in the index, got %+v", e)
+	}
+
+	mb.UnpubWait(MinerMsg, "MinerID02")
+	if _, err := mb.GetWait(MinerMsg, "MinerID02"); err == nil {
+		t.Errorf("unpublished miner still readable")
+	}
+
+	// Changes made in a transaction reach the snapshot too
+	miner.State = OfflineState
+	mb.Txn().
+		Set(MinerMsg, IDString(miner.ID), miner).
+		Pub(DestMsg, "DestID01", Dest{ID: "DestID01"}).
+		CommitWait()
+	if m, _ := mb.MinerGetWait(miner.ID); m == nil || m.State != OfflineState {
+		t.Errorf("transaction not visible: %+v", m)
+	}
+	if _, err := mb.GetWait(DestMsg, "DestID01"); err != nil {
+		t.Errorf("transaction not visible: %s", err)
+	}
+
+	if stats := mb.Stats(); stats.SnapshotReads == 0 {
+		t.Errorf("snapshot reads not counted: %+v", stats)
+	}
+}
+
+// A read straight after a write nobody waited for still sees it, and reads
+// go back to the snapshot once the writes are applied
+func TestShardReadOwnAsyncWrite(t *testing.T) {
+	mb := New(1, l)
+
+	miner := Miner{ID: "MinerID01", State: OnlineState, Contracts: map[ContractID]float64{}}
+	mb.MinerPubWait(miner)
+
+	for i := 1; i <= 1000; i++ {
+		miner.CurrentHashRate = i
+		if _, err := mb.Set(MinerMsg, IDString(miner.ID), miner); err != nil {
+			t.Fatalf("Set returned error: %s", err)
+		}
+		e, err := mb.GetWait(MinerMsg, IDString(miner.ID))
+		if err != nil {
+			t.Fatalf("GetWait returned error: %s", err)
+		}
+		if e.Data.(Miner).CurrentHashRate != i {
+			t.Fatalf("stale read %+v after set %d", e.Data, i)
+		}
+	}
+
+	reads := mb.Stats().SnapshotReads
+	mb.GetWait(MinerMsg, IDString(miner.ID))
+	if mb.Stats().SnapshotReads != reads+1 {
+		t.Errorf("read after the writes were applied not served from the snapshot")
+	}
+}
+
+func TestShardIsolation(t *testing.T) {
+	mb := New(1, l)
+
+	ech := NewEventChan()
+	mb.ConfigureDeliveryWait(ech, DeliveryConfig{Capacity: 1, Overflow: OverflowBlock})
+	mb.SubWait(DestMsg, "", ech)
+
+	// Nobody reads ech, the Dest shard blocks on the third publish
+	for i := 1; i <= 3; i++ {
+		go mb.PubWait(DestMsg, IDString(fmt.Sprintf("DestID%02d", i)), Dest{})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		_, err := mb.MinerPubWait(Miner{ID: "MinerID01"})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("MinerPubWait returned error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("miner publish held up by the Dest shard")
+	}
+
+	go func() {
+		for range ech {
+		}
+	}()
+	mb.RemoveAndCloseEventChanWait(ech)
+}
+
+//
+// BenchmarkMiners1k runs the bus traffic of 1000 connected miners, each
+// share submitted streams a Validate and reads and updates the miner's
+// record, while a validator and a contract manager watch the bus.
+//
+func BenchmarkMiners1k(b *testing.B) {
+	const miners = 1000
+
+	mb := New(1, nil)
+
+	for i := 0; i < miners; i++ {
+		id := MinerID(fmt.Sprintf("MinerID%04d", i))
+		mb.MinerPubWait(Miner{ID: id, State: OnlineState, Contracts: map[ContractID]float64{}})
+	}
+	mb.PubWait(ContractMsg, "ContractID01", Contract{ID: "ContractID01", State: ContRunningState})
+
+	watch := func(msg MsgType) EventChan {
+		ech := NewEventChan()
+		mb.SubWait(msg, "", ech)
+		go func() {
+			for range ech {
+			}
+		}()
+		return ech
+	}
+	validator := watch(ValidateMsg)
+	manager := watch(MinerMsg)
+	defer mb.RemoveAndCloseEventChanWait(validator)
+	defer mb.RemoveAndCloseEventChanWait(manager)
+
+	var next uint64
+
+	b.SetParallelism(miners/runtime.GOMAXPROCS(0) + 1)
+	b.ResetTimer()
+	start := time.Now()
+
+	b.RunParallel(func(pb *testing.PB) {
+		id := MinerID(fmt.Sprintf("MinerID%04d", atomic.AddUint64(&next, 1)%miners))
+
+		for pb.Next() {
+			mb.Stream(ValidateMsg, GetRandomIDString(), Validate{MinerID: string(id)})
+
+			m, err := mb.MinerGetWait(id)
+			if err != nil {
+				b.Fatalf("MinerGetWait returned error: %s", err)
+			}
+			m.CurrentHashRate++
+			if err = mb.MinerSetWait(*m); err != nil {
+				b.Fatalf("MinerSetWait returned error: %s", err)
+			}
+
+			if _, err = mb.GetWait(ContractMsg, "ContractID01"); err != nil {
+				b.Fatalf("GetWait returned error: %s", err)
+			}
+		}
+	})
+
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "shares/s")
+}
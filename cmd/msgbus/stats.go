@@ -0,0 +1,290 @@
+package msgbus
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Runtime metrics
+//
+// Everything Stats reports is kept outside the registry workers, so it can
+// still be read while the registry is stuck, e.g. behind a subscriber with
+// OverflowBlock or OverflowCoalesce that has stopped reading.
+//
+
+// latencyBuckets are the upper bounds of the latency histogram buckets,
+// anything slower lands in a final unbounded bucket
+var latencyBuckets = []time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	5 * time.Second,
+}
+
+type Stats struct {
+	Time time.Time
+	// Records and Subscribers are counted per message class, Subscribers
+	// includes subscriptions to a single record
+	Records     map[MsgType]int
+	Subscribers map[MsgType]int
+	// QueueDepth is the number of commands waiting for the registry
+	QueueDepth int
+	// Commands is the number of commands handled since start
+	Commands uint64
+	// SnapshotReads is the number of GetWait calls answered from a snapshot
+	// rather than by a shard, they are not part of Commands or Latency
+	SnapshotReads uint64
+	// Latency is keyed by operation, from the command being sent until the
+	// registry has finished with it
+	Latency map[string]LatencyStats
+	// Delivered, Dropped and Coalesced are totals over every event channel
+	// ever delivered to
+	Delivered uint64
+	Dropped   uint64
+	Coalesced uint64
+	// EventChans holds the current state of each event channel, the ones
+	// waiting longest on their reader first
+	EventChans []DeliveryStats
+}
+
+type LatencyStats struct {
+	Count uint64
+	Mean  time.Duration
+	Max   time.Duration
+	// P50 and P99 are the upper bounds of the buckets the percentiles fall in
+	P50     time.Duration
+	P99     time.Duration
+	Buckets []LatencyBucket
+}
+
+type LatencyBucket struct {
+	// Le is the bucket's upper bound, 0 for the last unbounded bucket
+	Le    time.Duration
+	Count uint64
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+type metrics struct {
+	// pending is updated atomically
+	pending       int64
+	commands      uint64
+	snapshotReads uint64
+
+	mu          sync.Mutex
+	records     map[MsgType]int
+	subscribers map[MsgType]int
+	latency     map[operation]*histogram
+	subs        map[EventChan]*subscriber
+	// totals of the event channels that have been closed
+	delivered uint64
+	dropped   uint64
+	coalesced uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		records:     make(map[MsgType]int),
+		subscribers: make(map[MsgType]int),
+		latency:     make(map[operation]*histogram),
+		subs:        make(map[EventChan]*subscriber),
+	}
+}
+
+//--------------------------------------------------------------------------------
+// Stats reports the record and subscriber counts, command queue depth,
+// per-operation latencies and event delivery counters of the bus. It does
+// not go through the registry, so it answers even when the registry is stuck.
+//--------------------------------------------------------------------------------
+func (ps *PubSub) Stats() Stats {
+	return ps.reg.metrics.stats()
+}
+
+func (m *metrics) stats() Stats {
+	s := Stats{
+		Time:          time.Now(),
+		Records:       make(map[MsgType]int),
+		Subscribers:   make(map[MsgType]int),
+		QueueDepth:    int(atomic.LoadInt64(&m.pending)),
+		Commands:      atomic.LoadUint64(&m.commands),
+		SnapshotReads: atomic.LoadUint64(&m.snapshotReads),
+		Latency:       make(map[string]LatencyStats),
+	}
+
+	m.mu.Lock()
+	for msg, n := range m.records {
+		s.Records[msg] = n
+	}
+	for msg, n := range m.subscribers {
+		s.Subscribers[msg] = n
+	}
+	for op, h := range m.latency {
+		s.Latency[string(op)] = h.stats()
+	}
+	s.Delivered, s.Dropped, s.Coalesced = m.delivered, m.dropped, m.coalesced
+	subs := make([]*subscriber, 0, len(m.subs))
+	for _, sub := range m.subs {
+		subs = append(subs, sub)
+	}
+	m.mu.Unlock()
+
+	for _, sub := range subs {
+		ds := sub.stats()
+		s.Delivered += ds.Delivered
+		s.Dropped += ds.Dropped
+		s.Coalesced += ds.Coalesced
+		s.EventChans = append(s.EventChans, ds)
+	}
+	sort.Slice(s.EventChans, func(i, j int) bool {
+		return s.EventChans[i].Waiting > s.EventChans[j].Waiting
+	})
+
+	return s
+}
+
+//-----------------------------------------
+// observe records that c has been handled
+//-----------------------------------------
+func (m *metrics) observe(c *cmd) {
+	atomic.AddUint64(&m.commands, 1)
+	if c.queued.IsZero() {
+		return
+	}
+	d := time.Since(c.queued)
+
+	m.mu.Lock()
+	h, ok := m.latency[c.op]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.latency[c.op] = h
+	}
+	h.observe(d)
+	m.mu.Unlock()
+}
+
+func (m *metrics) addSubscriber(s *subscriber) {
+	m.mu.Lock()
+	m.subs[s.ch] = s
+	m.mu.Unlock()
+}
+
+func (m *metrics) removeSubscriber(s *subscriber) {
+	ds := s.stats()
+
+	m.mu.Lock()
+	delete(m.subs, s.ch)
+	m.delivered += ds.Delivered
+	m.dropped += ds.Dropped
+	m.coalesced += ds.Coalesced
+	m.mu.Unlock()
+}
+
+//-----------------------------------------
+// count refreshes the record and subscriber counts of the message classes
+// c may have changed
+//-----------------------------------------
+func (reg *registry) count(c *cmd) {
+	var msgs []MsgType
+
+	switch c.op {
+	case opPub, opUnpub, opSub, opUnsub:
+		msgs = []MsgType{c.msg}
+	case opTxn:
+		if ops, ok := c.data.([]txnOp); ok {
+			for _, op := range ops {
+				msgs = append(msgs, op.msg)
+			}
+		}
+	case opRemove:
+		msgs = reg.msgTypes()
+	default:
+		return
+	}
+
+	reg.recount(msgs)
+}
+
+func (reg *registry) msgTypes() (msgs []MsgType) {
+	for msg := range reg.data {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func (reg *registry) recount(msgs []MsgType) {
+	m := reg.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, msg := range msgs {
+		if streamMsgTypes[msg] {
+			m.subscribers[msg] = len(reg.notify[msg])
+			continue
+		}
+		m.records[msg] = len(reg.data[msg])
+		subs := len(reg.notify[msg])
+		for _, d := range reg.data[msg] {
+			subs += len(d.sub.eventchan)
+		}
+		m.subscribers[msg] = subs
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *histogram) stats() LatencyStats {
+	s := LatencyStats{
+		Count:   h.count,
+		Max:     h.max,
+		Buckets: make([]LatencyBucket, len(h.counts)),
+	}
+	if h.count > 0 {
+		s.Mean = h.sum / time.Duration(h.count)
+	}
+
+	var seen uint64
+	for i, n := range h.counts {
+		le := h.max
+		if i < len(latencyBuckets) {
+			le = latencyBuckets[i]
+			s.Buckets[i].Le = le
+		}
+		s.Buckets[i].Count = n
+
+		if n == 0 {
+			continue
+		}
+		seen += n
+		if s.P50 == 0 && seen*2 >= h.count {
+			s.P50 = le
+		}
+		if s.P99 == 0 && seen*100 >= h.count*99 {
+			s.P99 = le
+		}
+	}
+	return s
+}
@@ -0,0 +1,82 @@
+package msgbus
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	mb := New(1, l)
+
+	for _, id := range []MinerID{"MinerID01", "MinerID02", "MinerID03"} {
+		mb.MinerPubWait(Miner{ID: id, Contracts: map[ContractID]float64{}})
+	}
+	mb.UnpubWait(MinerMsg, "MinerID03")
+
+	ech := NewEventChan()
+	mb.SubWait(MinerMsg, "", ech)
+	mb.SubWait(MinerMsg, "MinerID01", ech)
+	<-ech
+	<-ech
+
+	stats := mb.Stats()
+	if stats.Records[MinerMsg] != 2 || stats.Subscribers[MinerMsg] != 2 {
+		t.Errorf("unexpected counts: records %v subscribers %v", stats.Records, stats.Subscribers)
+	}
+	if stats.Latency[string(opPub)].Count != 3 {
+		t.Errorf("expected 3 timed pubs, got %+v", stats.Latency[string(opPub)])
+	}
+	if stats.Commands < 6 || stats.Delivered != 2 {
+		t.Errorf("unexpected totals: %+v", stats)
+	}
+	// Served as is by the external api
+	if _, err := json.Marshal(stats); err != nil {
+		t.Errorf("Stats can not be encoded: %s", err)
+	}
+
+	mb.RemoveAndCloseEventChanWait(ech)
+	stats = mb.Stats()
+	if stats.Subscribers[MinerMsg] != 0 || stats.Delivered != 2 || len(stats.EventChans) != 0 {
+		t.Errorf("closed channel not accounted for: %+v", stats)
+	}
+}
+
+func TestStatsStuckSubscriber(t *testing.T) {
+	mb := New(1, l)
+
+	ech := NewEventChan()
+	mb.ConfigureDeliveryWait(ech, DeliveryConfig{Capacity: 1, Overflow: OverflowBlock})
+	mb.SubWait(DestMsg, "", ech)
+
+	// Nobody reads ech, the third publish blocks the registry
+	for i, id := range []IDString{"DestID01", "DestID02", "DestID03", "DestID04"} {
+		go mb.PubWait(DestMsg, id, Dest{ID: DestID(id)})
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan Stats)
+	go func() { done <- mb.Stats() }()
+
+	select {
+	case stats := <-done:
+		if stats.QueueDepth == 0 {
+			t.Errorf("expected queued commands, got %+v", stats)
+		}
+		if len(stats.EventChans) != 1 || stats.EventChans[0].Waiting < 50*time.Millisecond {
+			t.Errorf("stuck subscriber not reported: %+v", stats.EventChans)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Stats blocked behind the registry")
+	}
+
+	// Reading again lets the registry carry on
+	go func() {
+		for range ech {
+		}
+	}()
+	mb.RemoveAndCloseEventChanWait(ech)
+}
@@ -0,0 +1,229 @@
+package msgbus
+
+import (
+	"context"
+	"reflect"
+)
+
+//
+// Options given to Sub and SubWait narrow what a subscription is sent and
+// how long it lasts:
+//
+//	ctx, cancel := context.WithCancel(parent)
+//	defer cancel()
+//	ps.Sub(MinerMsg, "", ech,
+//		OnlyEvents(PublishEvent, UpdateEvent, UnpublishEvent),
+//		OnlyFieldChanges("State", "Dest", "Contracts"),
+//		WithContext(ctx))
+//
+// Filters are applied in the registry, so a filtered out event never takes
+// up room in the subscriber's queue. Events answering the subscriber's own
+// commands are always delivered.
+//
+type SubOption func(*subscription)
+
+type subscription struct {
+	// events delivered, nil delivers every event type
+	events map[EventType]bool
+	// changed decides whether an UpdateEvent is delivered given the record
+	// before and after the set
+	changed func(old, new interface{}) bool
+	ctx     context.Context
+	// stop ends the goroutine watching ctx once the subscription is gone
+	stop chan struct{}
+}
+
+type subKey struct {
+	msg MsgType
+	id  IDString
+	ech EventChan
+}
+
+//--------------------------------------------------------------------------------
+// OnlyEvents delivers only the listed event types
+//--------------------------------------------------------------------------------
+func OnlyEvents(types ...EventType) SubOption {
+	return func(s *subscription) {
+		if s.events == nil {
+			s.events = make(map[EventType]bool)
+		}
+		for _, t := range types {
+			s.events[t] = true
+		}
+	}
+}
+
+//--------------------------------------------------------------------------------
+// OnlyChanges delivers an UpdateEvent only if changed returns true for the
+// record as it was before and after the set
+//--------------------------------------------------------------------------------
+func OnlyChanges(changed func(old, new interface{}) bool) SubOption {
+	return func(s *subscription) {
+		s.changed = changed
+	}
+}
+
+//--------------------------------------------------------------------------------
+// OnlyFieldChanges delivers an UpdateEvent only if one of the named fields
+// of the record changed, e.g. to leave out the CurrentHashRate writes that
+// follow every share when watching a Miner's State and Dest
+//--------------------------------------------------------------------------------
+func OnlyFieldChanges(fields ...string) SubOption {
+	return OnlyChanges(func(old, new interface{}) bool {
+		return fieldsChanged(old, new, fields)
+	})
+}
+
+//--------------------------------------------------------------------------------
+// WithContext removes the event channel from every subscription and closes
+// it once ctx is done, so a watcher that returns on cancellation does not
+// need to clean up after itself
+//--------------------------------------------------------------------------------
+func WithContext(ctx context.Context) SubOption {
+	return func(s *subscription) {
+		s.ctx = ctx
+	}
+}
+
+func newSubscription(opts []SubOption) *subscription {
+	if len(opts) == 0 {
+		return nil
+	}
+	s := &subscription{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.ctx != nil {
+		s.stop = make(chan struct{})
+	}
+	return s
+}
+
+//-----------------------------------------
+// watch closes ech when the subscription's context is done, unless the
+// subscription is removed first
+//-----------------------------------------
+func (s *subscription) watch(ps *PubSub, ech EventChan) {
+	if s == nil || s.ctx == nil {
+		return
+	}
+	ctx, stop := s.ctx, s.stop
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Carries the subscription so nothing is done if the channel
+			// has already been removed, e.g. by another subscription on ctx
+			ps.dispatch(&cmd{
+				op:      opRemove,
+				msg:     NoMsg,
+				data:    s,
+				eventch: ech,
+			})
+		case <-stop:
+		}
+	}()
+}
+
+func (s *subscription) end() {
+	if s != nil && s.stop != nil {
+		close(s.stop)
+	}
+}
+
+func (s *subscription) wants(event *Event, old interface{}) bool {
+	if s == nil {
+		return true
+	}
+	if s.events != nil && !s.events[event.EventType] {
+		return false
+	}
+	if s.changed != nil && event.EventType == UpdateEvent {
+		return s.changed(old, event.Data)
+	}
+	return true
+}
+
+//-----------------------------------------
+// notifySub delivers event to ech if its subscription to msg/id wants it,
+// old is the record before an UpdateEvent
+//-----------------------------------------
+func (reg *registry) notifySub(msg MsgType, id IDString, ech EventChan, event *Event, old interface{}) {
+	if reg.subscribed(msg, id, ech).wants(event, old) {
+		reg.deliver(ech, event)
+	}
+}
+
+func (reg *registry) subscribed(msg MsgType, id IDString, ech EventChan) *subscription {
+	reg.subscriptionsMu.RLock()
+	defer reg.subscriptionsMu.RUnlock()
+
+	return reg.subscriptions[subKey{msg: msg, id: id, ech: ech}]
+}
+
+//-----------------------------------------
+// active reports whether s is still one of the subscriptions of ech
+//-----------------------------------------
+func (reg *registry) active(s *subscription, ech EventChan) bool {
+	reg.subscriptionsMu.RLock()
+	defer reg.subscriptionsMu.RUnlock()
+
+	for key, sub := range reg.subscriptions {
+		if key.ech == ech && sub == s {
+			return true
+		}
+	}
+	return false
+}
+
+//-----------------------------------------
+// endSub drops the options of one subscription
+//-----------------------------------------
+func (reg *registry) endSub(msg MsgType, id IDString, ech EventChan) {
+	reg.subscriptionsMu.Lock()
+	defer reg.subscriptionsMu.Unlock()
+
+	key := subKey{msg: msg, id: id, ech: ech}
+	if s, ok := reg.subscriptions[key]; ok {
+		s.end()
+		delete(reg.subscriptions, key)
+	}
+}
+
+//-----------------------------------------
+// endSubs drops the options of every subscription of ech
+//-----------------------------------------
+func (reg *registry) endSubs(ech EventChan) {
+	reg.subscriptionsMu.Lock()
+	defer reg.subscriptionsMu.Unlock()
+
+	for key, s := range reg.subscriptions {
+		if key.ech == ech {
+			s.end()
+			delete(reg.subscriptions, key)
+		}
+	}
+}
+
+//-----------------------------------------
+// fieldsChanged reports whether any of the named fields differs between two
+// records, records that are not structs holding the fields count as changed
+//-----------------------------------------
+func fieldsChanged(old, new interface{}, fields []string) bool {
+	ov := reflect.Indirect(reflect.ValueOf(old))
+	nv := reflect.Indirect(reflect.ValueOf(new))
+	if !ov.IsValid() || !nv.IsValid() || ov.Kind() != reflect.Struct || ov.Type() != nv.Type() {
+		return true
+	}
+
+	for _, name := range fields {
+		of := ov.FieldByName(name)
+		nf := nv.FieldByName(name)
+		if !of.IsValid() || !of.CanInterface() {
+			return true
+		}
+		if !reflect.DeepEqual(of.Interface(), nf.Interface()) {
+			return true
+		}
+	}
+	return false
+}
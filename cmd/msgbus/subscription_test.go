@@ -0,0 +1,122 @@
+package msgbus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSubFilter(t *testing.T) {
+	mb := New(1, l)
+
+	miner := Miner{ID: "MinerID01", State: OnlineState, Contracts: map[ContractID]float64{}}
+	mb.MinerPubWait(miner)
+
+	ech := NewEventChan()
+	if _, err := mb.SubWait(MinerMsg, "", ech, OnlyEvents(UpdateEvent), OnlyFieldChanges("State", "Dest")); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+	// The answer to the subscribe itself is never filtered
+	if e := <-ech; e.EventType != SubscribedEvent {
+		t.Fatalf("expected SubscribedEvent, got %+v", e)
+	}
+
+	// Filtered out: a publish, and an update only touching the hashrate
+	mb.MinerPubWait(Miner{ID: "MinerID02", State: OnlineState})
+	for i := 1; i <= 5; i++ {
+		miner.CurrentHashRate = i
+		mb.MinerSetWait(miner)
+	}
+
+	miner.Dest = "DestID01"
+	mb.MinerSetWait(miner)
+
+	select {
+	case e := <-ech:
+		if e.EventType != UpdateEvent || e.Data.(Miner).Dest != "DestID01" {
+			t.Errorf("expected the dest update, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("dest update not delivered")
+	}
+
+	select {
+	case e := <-ech:
+		t.Errorf("unexpected event %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The same filter applies to changes made in a transaction
+	miner.CurrentHashRate = 10
+	mb.Txn().Set(MinerMsg, IDString(miner.ID), miner).CommitWait()
+	miner.State = OfflineState
+	mb.Txn().Set(MinerMsg, IDString(miner.ID), miner).CommitWait()
+
+	select {
+	case e := <-ech:
+		if e.Data.(Miner).State != OfflineState {
+			t.Errorf("expected the state update, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("state update not delivered")
+	}
+}
+
+func TestSubContext(t *testing.T) {
+	mb := New(1, l)
+
+	contract := Contract{ID: "ContractID01", State: ContAvailableState}
+	if _, err := mb.PubWait(ContractMsg, IDString(contract.ID), contract); err != nil {
+		t.Fatalf("PubWait returned error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ech := NewEventChan()
+	if _, err := mb.SubWait(ContractMsg, IDString(contract.ID), ech, WithContext(ctx)); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+	if _, err := mb.SubWait(ContractMsg, "", ech, WithContext(ctx)); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+
+	cancel()
+
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ech:
+			if ok {
+				continue
+			}
+		case <-deadline:
+			t.Fatalf("event channel not closed on cancel")
+		}
+		break
+	}
+
+	if len(mb.reg.notify[ContractMsg]) != 0 || len(mb.reg.data[ContractMsg][IDString(contract.ID)].sub.eventchan) != 0 {
+		t.Errorf("subscriptions left behind after cancel")
+	}
+
+	// Publishing after the channel is gone must not reach it
+	if _, err := mb.SetWait(ContractMsg, IDString(contract.ID), contract); err != nil {
+		t.Fatalf("SetWait returned error: %s", err)
+	}
+
+	// A subscription removed before its context ends leaves the channel open
+	ctx, cancel = context.WithCancel(context.Background())
+	ech = NewEventChan()
+	mb.SubWait(ContractMsg, IDString(contract.ID), ech, WithContext(ctx))
+	mb.UnsubWait(ContractMsg, IDString(contract.ID), ech)
+	cancel()
+
+	go mb.SetWait(ContractMsg, IDString(contract.ID), contract)
+	select {
+	case _, ok := <-ech:
+		if !ok {
+			t.Errorf("unsubscribed channel was closed")
+		}
+	case <-time.After(200 * time.Millisecond):
+	}
+}
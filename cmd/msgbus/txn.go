@@ -0,0 +1,313 @@
+package msgbus
+
+import (
+	"fmt"
+
+	"github.com/daniel-888/proxy-router/cmd/log"
+)
+
+//
+// Txn stages Pub, Set and Unpub operations, possibly across message types,
+// to be applied by the registry in one step. Either every operation is
+// applied or none are, and subscribers only see the resulting events once
+// the whole transaction has been applied.
+//
+//	_, err := ps.Txn().
+//		Set(ContractMsg, IDString(contract.ID), contract).
+//		Set(NodeOperatorMsg, IDString(nodeOperator.ID), nodeOperator).
+//		CommitWait()
+//
+type Txn struct {
+	ps  *PubSub
+	ops []txnOp
+	err error
+}
+
+type txnOp struct {
+	op   operation
+	msg  MsgType
+	id   IDString
+	data interface{}
+	// rev is the expected revision for opSetIf, and the revision the
+	// record ends up at once the transaction is applied
+	rev uint64
+}
+
+type txnKey struct {
+	msg MsgType
+	id  IDString
+}
+
+// txnDelivery is an event held back until the transaction is applied
+type txnDelivery struct {
+	ech   EventChan
+	event *Event
+}
+
+//--------------------------------------------------------------------------------
+// Txn starts an empty transaction
+//--------------------------------------------------------------------------------
+func (ps *PubSub) Txn() *Txn {
+	return &Txn{ps: ps}
+}
+
+//--------------------------------------------------------------------------------
+//
+//--------------------------------------------------------------------------------
+func (t *Txn) Pub(msg MsgType, id IDString, data interface{}) *Txn {
+	if data == nil {
+		t.fail(getCommandError(MsgBusErrNoData))
+	}
+	return t.stage(txnOp{op: opPub, msg: msg, id: id, data: data})
+}
+
+//--------------------------------------------------------------------------------
+//
+//--------------------------------------------------------------------------------
+func (t *Txn) Set(msg MsgType, id IDString, data interface{}) *Txn {
+	if data == nil {
+		t.fail(getCommandError(MsgBusErrNoData))
+	}
+	return t.stage(txnOp{op: opSet, msg: msg, id: id, data: data})
+}
+
+//--------------------------------------------------------------------------------
+// SetIfRevision fails the whole transaction with ErrRevisionConflict if the
+// record is not at revision rev when the transaction is applied.
+//--------------------------------------------------------------------------------
+func (t *Txn) SetIfRevision(msg MsgType, id IDString, rev uint64, data interface{}) *Txn {
+	if data == nil {
+		t.fail(getCommandError(MsgBusErrNoData))
+	}
+	return t.stage(txnOp{op: opSetIf, msg: msg, id: id, data: data, rev: rev})
+}
+
+//--------------------------------------------------------------------------------
+//
+//--------------------------------------------------------------------------------
+func (t *Txn) Unpub(msg MsgType, id IDString) *Txn {
+	return t.stage(txnOp{op: opUnpub, msg: msg, id: id})
+}
+
+//--------------------------------------------------------------------------------
+// CommitWait applies the staged operations. The returned event Data is a
+// []*Event with the result of each operation, in the order they were staged.
+//--------------------------------------------------------------------------------
+func (t *Txn) CommitWait() (e *Event, err error) {
+
+	if t.err != nil {
+		return e, t.err
+	}
+
+	if len(t.ops) == 0 {
+		return e, getCommandError(MsgBusErrNoData)
+	}
+
+	c := cmd{
+		op:      opTxn,
+		sync:    true,
+		msg:     NoMsg,
+		data:    append([]txnOp(nil), t.ops...),
+		eventch: nil,
+	}
+
+	return t.ps.dispatch(&c)
+}
+
+func (t *Txn) stage(op txnOp) *Txn {
+	if op.msg == NoMsg {
+		t.fail(getCommandError(MsgBusErrNoMsg))
+	}
+	if op.id == "" {
+		t.fail(getCommandError(MsgBusErrNoID))
+	}
+	t.ops = append(t.ops, op)
+	return t
+}
+
+// fail keeps the first error, which CommitWait returns without applying anything
+func (t *Txn) fail(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// journalOp is the operation replayed from the journal, a conditional set
+// has already been checked by the time it is written
+func (op txnOp) journalOp() operation {
+	if op.op == opSetIf {
+		return opSet
+	}
+	return op.op
+}
+
+//-----------------------------------------
+// txn checks every staged operation against the registry as it will be
+// when the operations before it have been applied, then applies them all.
+//-----------------------------------------
+func (reg *registry) txn(c *cmd) {
+
+	event := Event{
+		EventType: TxnEvent,
+		Msg:       c.msg,
+		RequestID: c.requestID,
+		Data:      nil,
+		Err:       nil,
+	}
+
+	var deliveries []txnDelivery
+
+	ops, ok := c.data.([]txnOp)
+	if !ok {
+		event.Err = getCommandError(MsgBusErrBadData)
+	} else if err := reg.checkTxn(ops); err != nil {
+		event.Err = err
+	} else {
+		event.Data, deliveries = reg.applyTxn(ops)
+		if reg.store != nil {
+			if err := reg.store.appendTxn(reg, ops); err != nil && reg.store.logger != nil {
+				reg.store.logger.Logf(log.LevelError, "MSGBUS: persisting transaction: %s", err)
+			}
+		}
+	}
+
+	if c.sync {
+		reg.reply(c, &event)
+	}
+
+	if c.eventch != nil {
+		reg.deliver(c.eventch, &event)
+	}
+
+	for _, d := range deliveries {
+		reg.deliver(d.ech, d.event)
+	}
+}
+
+//-----------------------------------------
+//
+//-----------------------------------------
+func (reg *registry) checkTxn(ops []txnOp) error {
+
+	// revision of each record touched so far, 0 once unpublished
+	staged := make(map[txnKey]uint64)
+
+	current := func(k txnKey) (rev uint64, ok bool) {
+		if rev, ok := staged[k]; ok {
+			return rev, rev != 0
+		}
+		if rd, ok := reg.data[k.msg][k.id]; ok {
+			return rd.rev, true
+		}
+		return 0, false
+	}
+
+	for i, op := range ops {
+		k := txnKey{msg: op.msg, id: op.id}
+
+		if _, ok := reg.data[op.msg]; !ok || streamMsgTypes[op.msg] {
+			return fmt.Errorf("%w: txn op %d %s %s", getCommandError(MsgBusErrBadMsg), i, op.op, op.msg)
+		}
+
+		rev, exists := current(k)
+
+		switch op.op {
+		case opPub:
+			if exists {
+				return fmt.Errorf("%w: txn op %d %s %s/%s", getCommandError(MsgBusErrDupData), i, op.op, op.msg, op.id)
+			}
+			staged[k] = 1
+		case opSet, opSetIf:
+			if !exists {
+				return fmt.Errorf("%w: txn op %d %s %s/%s", getCommandError(MsgBusErrBadID), i, op.op, op.msg, op.id)
+			}
+			if op.op == opSetIf && rev != op.rev {
+				return fmt.Errorf("%w: txn op %d %s %s/%s at revision %d", ErrRevisionConflict, i, op.op, op.msg, op.id, rev)
+			}
+			staged[k] = rev + 1
+		case opUnpub:
+			if !exists {
+				return fmt.Errorf("%w: txn op %d %s %s/%s", getCommandError(MsgBusErrBadID), i, op.op, op.msg, op.id)
+			}
+			staged[k] = 0
+		default:
+			return fmt.Errorf("%w: txn op %d %s", getCommandError(MsgBusErrBadData), i, op.op)
+		}
+	}
+
+	return nil
+}
+
+//-----------------------------------------
+// applyTxn makes the changes of a checked transaction and returns the
+// event for each operation along with the notifications to send.
+//-----------------------------------------
+func (reg *registry) applyTxn(ops []txnOp) (events []*Event, deliveries []txnDelivery) {
+
+	events = make([]*Event, 0, len(ops))
+
+	notify := func(event *Event, old interface{}, subs map[EventChan]int) {
+		for ech := range reg.notify[event.Msg] {
+			if reg.subscribed(event.Msg, "", ech).wants(event, old) {
+				deliveries = append(deliveries, txnDelivery{ech: ech, event: event})
+			}
+		}
+		for ech := range subs {
+			if reg.subscribed(event.Msg, event.ID, ech).wants(event, old) {
+				deliveries = append(deliveries, txnDelivery{ech: ech, event: event})
+			}
+		}
+	}
+
+	for i := range ops {
+		op := &ops[i]
+
+		event := &Event{
+			Msg:  op.msg,
+			ID:   op.id,
+			Data: op.data,
+		}
+
+		switch op.op {
+		case opPub:
+			event.EventType = PublishEvent
+			reg.data[op.msg][op.id] = registryData{
+				sub:  Subscribers{eventchan: make(map[EventChan]int)},
+				data: op.data,
+				rev:  1,
+			}
+			reg.reindex(op.msg, op.id, nil, op.data)
+			op.rev = 1
+			notify(event, nil, nil)
+
+		case opSet, opSetIf:
+			event.EventType = UpdateEvent
+			d := reg.data[op.msg][op.id]
+			old := d.data
+			reg.reindex(op.msg, op.id, d.data, op.data)
+			d.data = op.data
+			d.rev++
+			reg.data[op.msg][op.id] = d
+			op.rev = d.rev
+			notify(event, old, d.sub.eventchan)
+
+		case opUnpub:
+			event.EventType = UnpublishEvent
+			d := reg.data[op.msg][op.id]
+			reg.reindex(op.msg, op.id, d.data, nil)
+			delete(reg.data[op.msg], op.id)
+			op.rev = 0
+			notify(event, nil, d.sub.eventchan)
+			for ech := range d.sub.eventchan {
+				reg.endSub(op.msg, op.id, ech)
+				reg.endSubscription(ech, true)
+			}
+		}
+		reg.publish(op.msg, op.id)
+
+		event.Revision = op.rev
+		events = append(events, event)
+	}
+
+	return events, deliveries
+}
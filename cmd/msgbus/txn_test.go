@@ -0,0 +1,138 @@
+package msgbus
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTxnCommit(t *testing.T) {
+	mb := New(1, l)
+
+	contract := Contract{ID: "ContractID01", State: ContAvailableState}
+	nodeOperator := NodeOperator{ID: "NodeOperatorID01", Contracts: map[ContractID]ContractState{}}
+	if _, err := mb.PubWait(ContractMsg, IDString(contract.ID), contract); err != nil {
+		t.Fatalf("PubWait returned error: %s", err)
+	}
+	if _, err := mb.PubWait(NodeOperatorMsg, IDString(nodeOperator.ID), nodeOperator); err != nil {
+		t.Fatalf("PubWait returned error: %s", err)
+	}
+
+	ech := NewEventChan()
+	if _, err := mb.SubWait(ContractMsg, "", ech); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+	if _, err := mb.SubWait(NodeOperatorMsg, "", ech); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		<-ech
+	}
+
+	contract.State = ContRunningState
+	nodeOperator.Contracts[contract.ID] = ContRunningState
+	dest := Dest{ID: "DestID01", NetUrl: DestNetUrl(testurl)}
+
+	event, err := mb.Txn().
+		Set(ContractMsg, IDString(contract.ID), contract).
+		Set(NodeOperatorMsg, IDString(nodeOperator.ID), nodeOperator).
+		Pub(DestMsg, IDString(dest.ID), dest).
+		CommitWait()
+	if err != nil {
+		t.Fatalf("CommitWait returned error: %s", err)
+	}
+
+	events := event.Data.([]*Event)
+	if len(events) != 3 || events[0].Revision != 2 || events[1].Revision != 2 || events[2].Revision != 1 {
+		t.Fatalf("unexpected txn events: %+v", events)
+	}
+
+	for _, want := range []MsgType{ContractMsg, NodeOperatorMsg} {
+		select {
+		case e := <-ech:
+			if e.EventType != UpdateEvent || e.Msg != want {
+				t.Errorf("expected update for %s, got %+v", want, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no update for %s", want)
+		}
+	}
+}
+
+func TestTxnAllOrNothing(t *testing.T) {
+	mb := New(1, l)
+
+	contract := Contract{ID: "ContractID01", State: ContAvailableState}
+	if _, err := mb.PubWait(ContractMsg, IDString(contract.ID), contract); err != nil {
+		t.Fatalf("PubWait returned error: %s", err)
+	}
+
+	running := contract
+	running.State = ContRunningState
+
+	// The second operation conflicts, the first must not be applied
+	_, err := mb.Txn().
+		Set(ContractMsg, IDString(contract.ID), running).
+		SetIfRevision(ContractMsg, IDString(contract.ID), 1, running).
+		CommitWait()
+	if !errors.Is(err, ErrRevisionConflict) {
+		t.Fatalf("expected ErrRevisionConflict, got %v", err)
+	}
+
+	_, err = mb.Txn().
+		Unpub(ContractMsg, IDString(contract.ID)).
+		Set(ContractMsg, IDString(contract.ID), running).
+		CommitWait()
+	if err == nil {
+		t.Fatalf("expected set after unpub in the same txn to fail")
+	}
+
+	event, err := mb.GetWait(ContractMsg, IDString(contract.ID))
+	if err != nil {
+		t.Fatalf("GetWait returned error: %s", err)
+	}
+	if event.Data.(Contract).State != ContAvailableState || event.Revision != 1 {
+		t.Errorf("failed txn changed the record: %+v rev %d", event.Data, event.Revision)
+	}
+
+	if _, err = mb.Txn().Unpub(ContractMsg, IDString(contract.ID)).Pub(ContractMsg, IDString(contract.ID), running).CommitWait(); err != nil {
+		t.Fatalf("CommitWait returned error: %s", err)
+	}
+	event, _ = mb.GetWait(ContractMsg, IDString(contract.ID))
+	if event.Data.(Contract).State != ContRunningState || event.Revision != 1 {
+		t.Errorf("unexpected record after republish: %+v rev %d", event.Data, event.Revision)
+	}
+}
+
+func TestPersistTxn(t *testing.T) {
+	dir := t.TempDir()
+
+	mb, err := NewPersistent(1, l, PersistConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewPersistent returned error: %s", err)
+	}
+
+	contract := Contract{ID: "ContractID01", State: ContRunningState}
+	nodeOperator := NodeOperator{ID: "NodeOperatorID01", Contracts: map[ContractID]ContractState{contract.ID: ContRunningState}}
+	if _, err = mb.Txn().
+		Pub(ContractMsg, IDString(contract.ID), contract).
+		Pub(NodeOperatorMsg, IDString(nodeOperator.ID), nodeOperator).
+		CommitWait(); err != nil {
+		t.Fatalf("CommitWait returned error: %s", err)
+	}
+
+	restored, err := NewPersistent(1, l, PersistConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewPersistent returned error on reload: %s", err)
+	}
+
+	for _, id := range []IDString{IDString(contract.ID), IDString(nodeOperator.ID)} {
+		msg := ContractMsg
+		if id == IDString(nodeOperator.ID) {
+			msg = NodeOperatorMsg
+		}
+		if event, err := restored.GetWait(msg, id); err != nil || event.Data == nil {
+			t.Errorf("%s/%s not restored: %v", msg, id, err)
+		}
+	}
+}
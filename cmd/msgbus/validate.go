@@ -111,9 +111,9 @@ func (ps *PubSub) SendValidateSubmit(ctx context.Context, workername string, m M
 	id := getValidateID()
 	validate := newValidate(id, string(m), string(d), submit)
 
-	_, e := ps.Pub(ValidateMsg, IDString(id), validate)
+	_, e := ps.Stream(ValidateMsg, IDString(id), validate)
 	if e != nil {
-		panic(fmt.Sprintf(lumerinlib.FileLineFunc()+" Pub() error:%s", e))
+		panic(fmt.Sprintf(lumerinlib.FileLineFunc()+" Stream() error:%s", e))
 	}
 }
 
@@ -126,9 +126,9 @@ func (ps *PubSub) SendValidateNotify(ctx context.Context, m MinerID, d DestID, u
 	id := getValidateID()
 	validate := newValidate(id, string(m), string(d), notify)
 
-	_, e := ps.Pub(ValidateMsg, IDString(id), validate)
+	_, e := ps.Stream(ValidateMsg, IDString(id), validate)
 	if e != nil {
-		panic(fmt.Sprintf(lumerinlib.FileLineFunc()+" Pub() error:%s", e))
+		panic(fmt.Sprintf(lumerinlib.FileLineFunc()+" Stream() error:%s", e))
 	}
 }
 
@@ -141,8 +141,8 @@ func (ps *PubSub) SendValidateSetDiff(ctx context.Context, m MinerID, d DestID,
 	id := getValidateID()
 	validate := newValidate(id, string(m), string(d), setdiff)
 
-	_, e := ps.Pub(ValidateMsg, IDString(id), validate)
+	_, e := ps.Stream(ValidateMsg, IDString(id), validate)
 	if e != nil {
-		panic(fmt.Sprintf(lumerinlib.FileLineFunc()+" Pub() error:%s", e))
+		panic(fmt.Sprintf(lumerinlib.FileLineFunc()+" Stream() error:%s", e))
 	}
 }
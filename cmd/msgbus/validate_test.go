@@ -0,0 +1,57 @@
+package msgbus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSendValidateIsNotStored(t *testing.T) {
+	mb := New(1, l)
+
+	ech := NewEventChan()
+	if _, err := mb.SubWait(ValidateMsg, "", ech); err != nil {
+		t.Fatalf("SubWait returned error: %s", err)
+	}
+
+	// drain the subscribed event
+	<-ech
+
+	for i := 0; i < 100; i++ {
+		mb.SendValidateSubmit(context.Background(), "worker01", "MinerID01", "DestID01", "job", "00", "00", "00")
+	}
+
+	for i := 0; i < 100; i++ {
+		select {
+		case event := <-ech:
+			if event.EventType != StreamEvent {
+				t.Fatalf("expected %s, got %s", StreamEvent, event.EventType)
+			}
+			v, ok := event.Data.(*Validate)
+			if !ok {
+				t.Fatalf("unexpected data %T", event.Data)
+			}
+			if _, ok := v.Data.(*Submit); !ok {
+				t.Fatalf("unexpected validate data %T", v.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for stream event %d", i)
+		}
+	}
+
+	event, err := mb.GetWait(ValidateMsg, "")
+	if err != nil {
+		t.Fatalf("GetWait returned error: %s", err)
+	}
+	if len(event.Data.(IDIndex)) != 0 {
+		t.Errorf("stream records were stored: %d", len(event.Data.(IDIndex)))
+	}
+}
+
+func TestStreamRejectsStoredMsgType(t *testing.T) {
+	mb := New(1, l)
+
+	if _, err := mb.Stream(MinerMsg, "MinerID01", Miner{}); err == nil {
+		t.Errorf("Stream accepted a stored message type")
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+//
+// msgbusreplay feeds a msgbus operation log (see msgbus.SetOpLogWait) into a
+// fresh PubSub with the connection scheduler attached, so the decisions it
+// made in SetMinerTarget can be reproduced away from the miners and the
+// contracts that drove them.
+//
+// The scheduler's own writes to the recorded miners (Dest, Contracts and
+// TimeSlice) are left out of the replay, the replayed scheduler makes them
+// again. Every miner assignment the replayed scheduler makes is printed
+// alongside the one that was recorded.
+//
+//	msgbusreplay -oplog /tmp/msgbus.oplog -speed 10 -lag 10
+//
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/daniel-888/proxy-router/cmd/connectionscheduler"
+	"github.com/daniel-888/proxy-router/cmd/log"
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	"github.com/daniel-888/proxy-router/connections"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+func main() {
+	oplog := flag.String("oplog", "", "Operation log to replay")
+	out := flag.String("out", "", "Write the operation log of the replayed bus to this file")
+	speed := flag.Float64("speed", 1, "Replay speed relative to the recording, 0 replays without pausing")
+	lag := flag.Int("lag", 0, "Hashrate calculation lag time in seconds given to the scheduler")
+	passthrough := flag.Bool("passthrough", false, "Run the scheduler in passthrough mode")
+	settle := flag.Duration("settle", 2*time.Second, "How long to let the scheduler run after the last command")
+	level := flag.Int("loglevel", int(log.LevelWarn), "Log level")
+	flag.Parse()
+
+	if *oplog == "" {
+		fmt.Fprintf(os.Stderr, "msgbusreplay: -oplog not provided\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	l := log.New()
+	l.SetLevel(log.Level(*level))
+
+	in, err := os.Open(*oplog)
+	if err != nil {
+		l.Logf(log.LevelFatal, "error opening operation log: %v", err)
+	}
+	defer in.Close()
+
+	ps := msgbus.New(10, l)
+
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			l.Logf(log.LevelFatal, "error creating %s: %v", *out, err)
+		}
+		defer f.Close()
+		if err = ps.SetOpLogWait(f); err != nil {
+			l.Logf(log.LevelFatal, "error starting operation log: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = context.WithValue(ctx, contextlib.ContextKey, contextlib.NewContextStruct(nil, ps, l, nil, nil))
+
+	ech := msgbus.NewEventChan()
+	if _, err = ps.SubWait(msgbus.MinerMsg, "", ech); err != nil {
+		l.Logf(log.LevelFatal, "error subscribing to miners: %v", err)
+	}
+	go watch(ctx, ech)
+
+	r := &replayer{
+		ps:          ps,
+		ctx:         ctx,
+		l:           l,
+		lag:         *lag,
+		passthrough: *passthrough,
+	}
+
+	n, err := ps.Replay(in, msgbus.ReplayConfig{Rewrite: r.rewrite, Speed: *speed})
+	if err != nil {
+		l.Logf(log.LevelError, "replay stopped after %d commands: %v", n, err)
+	}
+	if !r.started {
+		l.Logf(log.LevelError, "no node operator in %s, the scheduler was not started", *oplog)
+	}
+
+	time.Sleep(*settle + time.Duration(*lag)*time.Second)
+
+	fmt.Printf("replayed %d commands\n", n)
+}
+
+type replayer struct {
+	ps          *msgbus.PubSub
+	ctx         context.Context
+	l           *log.Logger
+	lag         int
+	passthrough bool
+	started     bool
+}
+
+//-----------------------------------------
+// rewrite starts the scheduler on the first node operator and drops what
+// the recorded scheduler wrote to the miners
+//-----------------------------------------
+func (r *replayer) rewrite(msg msgbus.MsgType, id msgbus.IDString, data interface{}) (interface{}, bool) {
+	switch msg {
+	case msgbus.NodeOperatorMsg:
+		if !r.started {
+			nodeOperator, ok := data.(msgbus.NodeOperator)
+			if !ok {
+				r.l.Logf(log.LevelWarn, "node operator %s record of type %T skipped", id, data)
+				return nil, false
+			}
+			r.startScheduler(&nodeOperator)
+		}
+
+	case msgbus.MinerMsg:
+		miner, ok := minerRecord(data)
+		if !ok {
+			r.l.Logf(log.LevelWarn, "miner %s record of type %T skipped", id, data)
+			return nil, false
+		}
+
+		event, err := r.ps.GetWait(msgbus.MinerMsg, id)
+		if err != nil || event.Data == nil {
+			// New miner, published as recorded
+			return data, true
+		}
+		current, ok := minerRecord(event.Data)
+		if !ok {
+			r.l.Logf(log.LevelWarn, "miner %s stored as %T, published as recorded", id, event.Data)
+			return data, true
+		}
+
+		if miner.Dest != current.Dest || !reflect.DeepEqual(miner.Contracts, current.Contracts) {
+			fmt.Printf("recorded  %s\n", assignment(&miner))
+		}
+
+		miner.Dest = current.Dest
+		miner.Contracts = current.Contracts
+		miner.TimeSlice = current.TimeSlice
+		if reflect.DeepEqual(miner, current) {
+			return nil, false
+		}
+		return miner, true
+	}
+
+	return data, true
+}
+
+func (r *replayer) startScheduler(nodeOperator *msgbus.NodeOperator) {
+	r.started = true
+
+	cs, err := connectionscheduler.New(&r.ctx, nodeOperator, r.passthrough, r.lag, connections.CreateConnectionCollection())
+	if err != nil {
+		r.l.Logf(log.LevelFatal, "Schedule manager failed: %v", err)
+	}
+	if err = cs.Start(); err != nil {
+		r.l.Logf(log.LevelFatal, "Schedule manager failed to start: %v", err)
+	}
+}
+
+//-----------------------------------------
+// watch prints every change the replayed scheduler makes to a miner's
+// assignment
+//-----------------------------------------
+func watch(ctx context.Context, ech msgbus.EventChan) {
+	last := make(map[msgbus.IDString]string)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-ech:
+			if event.Err != nil {
+				continue
+			}
+			switch event.EventType {
+			case msgbus.PublishEvent, msgbus.UpdateEvent:
+				miner, ok := minerRecord(event.Data)
+				if !ok {
+					continue
+				}
+				a := assignment(&miner)
+				if last[event.ID] != a {
+					if _, seen := last[event.ID]; seen {
+						fmt.Printf("replayed  %s\n", a)
+					}
+					last[event.ID] = a
+				}
+			case msgbus.UnpublishEvent:
+				delete(last, event.ID)
+			}
+		}
+	}
+}
+
+//-----------------------------------------
+// minerRecord reads a miner record stored by value or by pointer, false for
+// anything else such as the IDIndex of a Get without an ID or the nil data
+// of an Unpub
+//-----------------------------------------
+func minerRecord(data interface{}) (miner msgbus.Miner, ok bool) {
+	switch m := data.(type) {
+	case msgbus.Miner:
+		return m, true
+	case *msgbus.Miner:
+		if m != nil {
+			return *m, true
+		}
+	}
+	return miner, false
+}
+
+func assignment(miner *msgbus.Miner) string {
+	contracts := make([]string, 0, len(miner.Contracts))
+	for id, slice := range miner.Contracts {
+		contracts = append(contracts, fmt.Sprintf("%s:%g", id, slice))
+	}
+	sort.Strings(contracts)
+
+	return fmt.Sprintf("miner %s dest %s contracts [%s]", miner.ID, miner.Dest, strings.Join(contracts, " "))
+}
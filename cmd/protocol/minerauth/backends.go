@@ -0,0 +1,149 @@
+package minerauth
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+//
+// Allowlist
+// Worker names and their passwords, a worker without a password may use any
+//
+type Allowlist map[string]*string
+
+//
+// NewAllowlistFile()
+// Reads one "worker [password]" per line, blank lines and lines starting
+// with # are skipped
+//
+func NewAllowlistFile(path string) (a Allowlist, e error) {
+
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, fmt.Errorf("minerauth: allowlist file: %w", e)
+	}
+	defer f.Close()
+
+	return ReadAllowlist(f)
+}
+
+//
+// ReadAllowlist()
+//
+func ReadAllowlist(r io.Reader) (a Allowlist, e error) {
+
+	a = make(Allowlist)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		switch len(fields) {
+		case 1:
+			a[fields[0]] = nil
+		case 2:
+			password := fields[1]
+			a[fields[0]] = &password
+		default:
+			return nil, fmt.Errorf("minerauth: allowlist line %d: expected \"worker [password]\"", line)
+		}
+	}
+
+	return a, scanner.Err()
+}
+
+func (a Allowlist) Authenticate(ctx context.Context, r *Request) error {
+	password, ok := a[r.Worker]
+	if !ok {
+		return rejected("worker %q not in the allowlist", r.Worker)
+	}
+	if password != nil && subtle.ConstantTimeCompare([]byte(*password), []byte(r.Password)) != 1 {
+		return rejected("bad password for worker %q", r.Worker)
+	}
+	return nil
+}
+
+//
+// CIDR
+// Networks miners may connect from
+//
+type CIDR []*net.IPNet
+
+//
+// NewCIDR()
+// A plain IP stands for just that address
+//
+func NewCIDR(cidrs []string) (c CIDR, e error) {
+
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("minerauth: bad CIDR %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			c = append(c, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, e := net.ParseCIDR(s)
+		if e != nil {
+			return nil, fmt.Errorf("minerauth: bad CIDR %q: %w", s, e)
+		}
+		c = append(c, n)
+	}
+
+	return c, nil
+}
+
+func (c CIDR) Authenticate(ctx context.Context, r *Request) error {
+	if r.IP == nil {
+		return rejected("remote address of worker %q unknown", r.Worker)
+	}
+	for _, n := range c {
+		if n.Contains(r.IP) {
+			return nil
+		}
+	}
+	return rejected("worker %q connected from %s", r.Worker, r.IP)
+}
+
+//
+// Regex
+// Pattern the whole worker name has to match
+//
+type Regex struct {
+	re *regexp.Regexp
+}
+
+//
+// NewRegex()
+//
+func NewRegex(pattern string) (r *Regex, e error) {
+
+	re, e := regexp.Compile(`^(?:` + pattern + `)$`)
+	if e != nil {
+		return nil, fmt.Errorf("minerauth: worker regex: %w", e)
+	}
+
+	return &Regex{re: re}, nil
+}
+
+func (x *Regex) Authenticate(ctx context.Context, r *Request) error {
+	if !x.re.MatchString(r.Worker) {
+		return rejected("worker %q does not match %s", r.Worker, x.re)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package minerauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//
+// HTTP
+// POSTs every request to a callback as JSON:
+//   {"worker": "...", "password": "...", "ip": "..."}
+// A 2xx status accepts the miner, 401 and 403 refuse it. Anything else,
+// including a timeout, is an error and the miner is refused as well.
+//
+type HTTP struct {
+	url    string
+	client *http.Client
+}
+
+type httpRequest struct {
+	Worker   string `json:"worker"`
+	Password string `json:"password"`
+	IP       string `json:"ip,omitempty"`
+}
+
+//
+// NewHTTP()
+//
+func NewHTTP(callback string, timeout time.Duration) (h *HTTP, e error) {
+
+	u, e := url.Parse(callback)
+	if e != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("minerauth: bad callback URL %q", callback)
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	return &HTTP{url: callback, client: &http.Client{Timeout: timeout}}, nil
+}
+
+func (h *HTTP) Authenticate(ctx context.Context, r *Request) (e error) {
+
+	body := httpRequest{Worker: r.Worker, Password: r.Password}
+	if r.IP != nil {
+		body.IP = r.IP.String()
+	}
+	data, e := json.Marshal(body)
+	if e != nil {
+		return e
+	}
+
+	req, e := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(data))
+	if e != nil {
+		return e
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, e := h.client.Do(req)
+	if e != nil {
+		return fmt.Errorf("minerauth: callback: %w", e)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return rejected("callback refused worker %q", r.Worker)
+	default:
+		return fmt.Errorf("minerauth: callback status %s", resp.Status)
+	}
+}
@@ -0,0 +1,135 @@
+package minerauth
+
+//
+// minerauth decides which miners may attach to the proxy. A stratum listener
+// hands every mining.authorize (or Stratum V2 channel open) to an
+// Authenticator before the Miner record is published, and answers the miner
+// with an error if it is refused.
+//
+// The built in backends are a static allowlist file of worker names and
+// passwords, a list of CIDRs the miner has to connect from, a regex on the
+// worker name and an HTTP callback. Several of them can be configured at
+// once, the miner then has to pass all of them.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+var ErrRejected = errors.New("minerauth: rejected")
+var ErrUnknownMethod = errors.New("minerauth: unknown method")
+
+// Reason is sent to refused miners, the details only go to the log
+const Reason = "Unauthorized worker"
+
+const (
+	MethodAllowlist = "allowlist"
+	MethodCIDR      = "cidr"
+	MethodRegex     = "regex"
+	MethodHTTP      = "http"
+)
+
+// DefaultTimeout bounds the HTTP callback when the config does not
+const DefaultTimeout = 5 * time.Second
+
+type Request struct {
+	Worker   string
+	Password string // Empty for Stratum V2 miners
+	IP       net.IP // nil if the remote address is unknown
+}
+
+type Authenticator interface {
+	// Authenticate returns nil if the miner may attach, an error wrapping
+	// ErrRejected if it may not, and any other error if it could not be decided
+	Authenticate(ctx context.Context, r *Request) error
+}
+
+type Config struct {
+	Methods       []string      // Backends to use, all of them have to accept
+	AllowlistFile string        // allowlist: file of "worker [password]" lines
+	CIDRs         []string      // cidr: networks miners may connect from
+	WorkerRegex   string        // regex: pattern the whole worker name has to match
+	URL           string        // http: callback the request is POSTed to
+	Timeout       time.Duration // http: 0 uses DefaultTimeout
+}
+
+//
+// New()
+// Builds the Authenticator for the configured methods, nil if there are none
+//
+func New(config Config) (a Authenticator, e error) {
+
+	var auths []Authenticator
+	for _, method := range config.Methods {
+		var auth Authenticator
+		switch strings.ToLower(strings.TrimSpace(method)) {
+		case "", "none":
+			continue
+		case MethodAllowlist:
+			auth, e = NewAllowlistFile(config.AllowlistFile)
+		case MethodCIDR:
+			auth, e = NewCIDR(config.CIDRs)
+		case MethodRegex:
+			auth, e = NewRegex(config.WorkerRegex)
+		case MethodHTTP:
+			auth, e = NewHTTP(config.URL, config.Timeout)
+		default:
+			e = fmt.Errorf("%w: %s", ErrUnknownMethod, method)
+		}
+		if e != nil {
+			return nil, e
+		}
+		auths = append(auths, auth)
+	}
+
+	switch len(auths) {
+	case 0:
+		return nil, nil
+	case 1:
+		return auths[0], nil
+	default:
+		return All(auths), nil
+	}
+}
+
+//
+// All
+// Accepts a miner only if every Authenticator in it does
+//
+type All []Authenticator
+
+func (all All) Authenticate(ctx context.Context, r *Request) (e error) {
+	for _, a := range all {
+		if e = a.Authenticate(ctx, r); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+//
+// RemoteIP()
+// The IP of a remote address as the listeners report it
+//
+func RemoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return a.IP
+	}
+	host, _, e := net.SplitHostPort(addr.String())
+	if e != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+func rejected(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrRejected}, args...)...)
+}
@@ -0,0 +1,161 @@
+package minerauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAllowlist(t *testing.T) {
+
+	a, e := ReadAllowlist(strings.NewReader("# workers\nrig1 secret\n\nrig2\n"))
+	if e != nil {
+		t.Fatalf("ReadAllowlist() error:%s", e)
+	}
+
+	tests := []struct {
+		worker, password string
+		ok               bool
+	}{
+		{"rig1", "secret", true},
+		{"rig1", "wrong", false},
+		{"rig2", "anything", true},
+		{"rig3", "", false},
+	}
+	for _, test := range tests {
+		e := a.Authenticate(context.Background(), &Request{Worker: test.worker, Password: test.password})
+		if (e == nil) != test.ok || (e != nil && !errors.Is(e, ErrRejected)) {
+			t.Errorf("Authenticate(%s, %s) got:%v", test.worker, test.password, e)
+		}
+	}
+
+	if _, e = ReadAllowlist(strings.NewReader("rig1 a b\n")); e == nil {
+		t.Errorf("ReadAllowlist() took a bad line")
+	}
+}
+
+func TestCIDR(t *testing.T) {
+
+	c, e := NewCIDR([]string{"10.0.0.0/8", "192.168.1.5", "fd00::/8"})
+	if e != nil {
+		t.Fatalf("NewCIDR() error:%s", e)
+	}
+
+	for ip, ok := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.5": true,
+		"192.168.1.6": false,
+		"fd00::1":     true,
+		"2001:db8::1": false,
+	} {
+		e := c.Authenticate(context.Background(), &Request{Worker: "rig", IP: net.ParseIP(ip)})
+		if (e == nil) != ok {
+			t.Errorf("Authenticate(%s) got:%v", ip, e)
+		}
+	}
+
+	if e = c.Authenticate(context.Background(), &Request{Worker: "rig"}); !errors.Is(e, ErrRejected) {
+		t.Errorf("Authenticate() without an IP got:%v", e)
+	}
+
+	if _, e = NewCIDR([]string{"10.0.0.0/33"}); e == nil {
+		t.Errorf("NewCIDR() took a bad CIDR")
+	}
+}
+
+func TestRegex(t *testing.T) {
+
+	r, e := NewRegex(`acct\.[a-z0-9]+`)
+	if e != nil {
+		t.Fatalf("NewRegex() error:%s", e)
+	}
+
+	if e = r.Authenticate(context.Background(), &Request{Worker: "acct.rig1"}); e != nil {
+		t.Errorf("Authenticate(acct.rig1) got:%v", e)
+	}
+	// The whole name has to match
+	if e = r.Authenticate(context.Background(), &Request{Worker: "other.acct.rig1"}); !errors.Is(e, ErrRejected) {
+		t.Errorf("Authenticate(other.acct.rig1) got:%v", e)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body httpRequest
+		if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case body.Worker == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case body.Worker == "rig1" && body.Password == "secret" && body.IP == "10.0.0.1":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	h, e := NewHTTP(server.URL, 0)
+	if e != nil {
+		t.Fatalf("NewHTTP() error:%s", e)
+	}
+
+	ip := net.ParseIP("10.0.0.1")
+	if e = h.Authenticate(context.Background(), &Request{Worker: "rig1", Password: "secret", IP: ip}); e != nil {
+		t.Errorf("Authenticate(rig1) got:%v", e)
+	}
+	if e = h.Authenticate(context.Background(), &Request{Worker: "rig2", IP: ip}); !errors.Is(e, ErrRejected) {
+		t.Errorf("Authenticate(rig2) got:%v", e)
+	}
+	if e = h.Authenticate(context.Background(), &Request{Worker: "broken", IP: ip}); e == nil || errors.Is(e, ErrRejected) {
+		t.Errorf("Authenticate(broken) got:%v", e)
+	}
+
+	if _, e = NewHTTP("ftp://example.com", 0); e == nil {
+		t.Errorf("NewHTTP() took a non HTTP URL")
+	}
+}
+
+func TestNew(t *testing.T) {
+
+	a, e := New(Config{})
+	if e != nil || a != nil {
+		t.Errorf("New() without methods got:%v %v", a, e)
+	}
+
+	a, e = New(Config{Methods: []string{"cidr", "regex"}, CIDRs: []string{"10.0.0.0/8"}, WorkerRegex: "rig[0-9]"})
+	if e != nil {
+		t.Fatalf("New() error:%s", e)
+	}
+	if e = a.Authenticate(context.Background(), &Request{Worker: "rig1", IP: net.ParseIP("10.0.0.1")}); e != nil {
+		t.Errorf("Authenticate() passing both got:%v", e)
+	}
+	if e = a.Authenticate(context.Background(), &Request{Worker: "rig1", IP: net.ParseIP("11.0.0.1")}); e == nil {
+		t.Errorf("Authenticate() failing the CIDR was accepted")
+	}
+
+	if _, e = New(Config{Methods: []string{"ldap"}}); !errors.Is(e, ErrUnknownMethod) {
+		t.Errorf("New() with an unknown method got:%v", e)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+
+	if ip := RemoteIP(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 3333}); !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("RemoteIP(TCPAddr) got:%s", ip)
+	}
+	if ip := RemoteIP(&net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 3333}); !ip.Equal(net.ParseIP("fd00::1")) {
+		t.Errorf("RemoteIP(UDPAddr) got:%s", ip)
+	}
+	if ip := RemoteIP(nil); ip != nil {
+		t.Errorf("RemoteIP(nil) got:%s", ip)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
 	"github.com/daniel-888/proxy-router/cmd/msgbus"
@@ -315,6 +316,15 @@ func (ps *ProtocolStruct) AsyncReDial(uid simple.ConnUniqueID) (e error) {
 	return e
 }
 
+//
+// AsyncReDialDest()
+// moves the connection to a new destination after wait
+//
+func (ps *ProtocolStruct) AsyncReDialDest(uid simple.ConnUniqueID, dst *msgbus.Dest, wait time.Duration) (e error) {
+	e = ps.simple.AsyncReDialDest(uid, dst, wait)
+	return e
+}
+
 //
 // SetDefaultRouteUID()
 // Set the SIMPL layer default route
@@ -445,8 +455,10 @@ func (ps *ProtocolStruct) CloseDst(index simple.ConnUniqueID) (e error) {
 
 //
 // CloseSrc()
+// Closes the Src and Dst sockets, not only the context
 //
 func (ps *ProtocolStruct) CloseSrc() {
+	ps.simple.CloseConnection(-1)
 	ps.Close()
 }
 
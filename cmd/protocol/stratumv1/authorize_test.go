@@ -0,0 +1,95 @@
+package stratumv1
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daniel-888/proxy-router/cmd/protocol/minerauth"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+	"github.com/daniel-888/proxy-router/lumerinlib/testinglib"
+)
+
+//
+// A refused mining.authorize gets a stratum error and no Miner record,
+// the miner may then authorize another worker
+//
+func TestNewSrcAuthorizeRefused(t *testing.T) {
+
+	localport := testinglib.GetRandPort()
+	nodeaddr := net.JoinHostPort(localhost, strconv.Itoa(localport))
+
+	poolListener, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolListener.Close()
+
+	defdest := createDest("LocalPriPoolDestID", fmt.Sprintf("stratum+tcp://poolworker:password@%s/", poolListener.Addr()))
+	ctx := newContextStruct(t, nodeaddr, defdest)
+
+	auth, e := minerauth.NewRegex(`good\.[0-9]+`)
+	if e != nil {
+		t.Fatalf("NewRegex() error:%s", e)
+	}
+
+	// Set before Run(), so it covers the first miner
+	sls, e := NewListener(ctx, contextlib.GetContextStruct(ctx).GetSrc(), defdest)
+	if e != nil {
+		t.Fatalf("NewListener() error:%s", e)
+	}
+	defer sls.Cancel()
+	sls.SetAuthenticator(auth)
+	sls.Run()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, e = net.Dial("tcp", nodeaddr); e == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if e != nil {
+		t.Fatalf("Dial() error:%s", e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	miner := bufio.NewReader(conn)
+
+	call := func(msg string) (m map[string]interface{}) {
+		if _, e := conn.Write([]byte(msg + "\n")); e != nil {
+			t.Fatalf("Write() error:%s", e)
+		}
+		line, e := miner.ReadBytes('\n')
+		if e != nil {
+			t.Fatalf("ReadBytes() error:%s", e)
+		}
+		if e = json.Unmarshal(line, &m); e != nil {
+			t.Fatalf("Unmarshal(%s) error:%s", line, e)
+		}
+		return m
+	}
+
+	call(`{"id":1,"method":"mining.subscribe","params":["test/1.0"]}`)
+
+	if auth := call(`{"id":2,"method":"mining.authorize","params":["bad.1",""]}`); auth["result"] != false || auth["error"] != minerauth.Reason {
+		t.Fatalf("bad authorize response for a refused worker:%v", auth)
+	}
+
+	ps := contextlib.GetContextStruct(ctx).GetMsgBus()
+	if miners, e := ps.MinerGetAllWait(); e != nil || len(miners) != 0 {
+		t.Fatalf("refused worker published miners:%v error:%v", miners, e)
+	}
+
+	if auth := call(`{"id":3,"method":"mining.authorize","params":["good.1",""]}`); auth["result"] != true {
+		t.Fatalf("bad authorize response:%v", auth)
+	}
+
+	if miners, e := ps.MinerGetAllWait(); e != nil || len(miners) != 1 {
+		t.Fatalf("accepted worker published miners:%v error:%v", miners, e)
+	}
+}
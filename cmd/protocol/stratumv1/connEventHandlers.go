@@ -5,7 +5,10 @@ import (
 
 	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
 	"github.com/daniel-888/proxy-router/cmd/lumerinnetwork/connectionmanager"
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
 	"github.com/daniel-888/proxy-router/cmd/protocol"
+	"github.com/daniel-888/proxy-router/cmd/protocol/minerauth"
+	"github.com/daniel-888/proxy-router/cmd/protocol/stratumv2"
 	"github.com/daniel-888/proxy-router/lumerinlib"
 	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
 )
@@ -41,6 +44,15 @@ func (svs *StratumV1Struct) handleConnOpenEvent(scoe *simple.SimpleConnOpenEvent
 	uid := scoe.UniqueID()
 	dest := scoe.Dest()
 
+	// A redialed connection keeps its Dest
+	if dest == nil {
+		dest = svs.dstDest[uid]
+	}
+	if dest == nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d has no Dest", uid)
+		return fmt.Errorf(lumerinlib.FileLineFunc()+" UID:%d has no Dest", uid)
+	}
+
 	// Need a new Dst Conn Connection Record.
 
 	e = svs.protocol.GetDstStruct().NewProtocolDstStruct(scoe)
@@ -50,6 +62,8 @@ func (svs *StratumV1Struct) handleConnOpenEvent(scoe *simple.SimpleConnOpenEvent
 	}
 	svs.dstState[uid] = DstStateNew
 	svs.dstDest[uid] = dest
+	svs.dropSubmits(uid)
+	svs.dropJobs(uid)
 
 	dstconn, e := svs.protocol.GetDstConn(uid)
 	if e != nil {
@@ -58,6 +72,21 @@ func (svs *StratumV1Struct) handleConnOpenEvent(scoe *simple.SimpleConnOpenEvent
 	}
 	dstconn.SetState(protocol.ConnStateReady)
 
+	//
+	// A SV2 pool gets the Noise handshake instead of a subscribe
+	//
+	if stratumv2.IsV2Dest(dest) {
+		return svs.sv2Open(uid)
+	}
+	delete(svs.dstSV2, uid)
+	delete(svs.dstVersionMask, uid)
+
+	// Ask for version rolling ahead of the subscribe
+	if e = svs.sendConfigure(uid); e != nil {
+		svs.SetDstStateUid(uid, DstStateError)
+		return e
+	}
+
 	// Send initialization subscribe message here
 	// Set state to DstStateSubscribing
 
@@ -142,6 +171,10 @@ func (svs *StratumV1Struct) handleConnReadEvent(scre *simple.SimpleConnReadEvent
 		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" scre had no data")
 	}
 
+	if uid >= 0 && svs.dstSV2[uid] != nil {
+		return svs.handleSV2ReadEvent(uid, data)
+	}
+
 	pcs.AddBuf(data)
 
 	// -- Move above code to Protocol section --
@@ -183,6 +216,11 @@ func (svs *StratumV1Struct) handleConnReadEvent(scre *simple.SimpleConnReadEvent
 		if e != nil {
 			break
 		}
+
+		// The message closed the session, the rest of the buffer is dropped
+		if svs.ctx.Err() != nil {
+			break
+		}
 	}
 
 	return e
@@ -325,6 +363,13 @@ func (svs *StratumV1Struct) handleResponse(uid simple.ConnUniqueID, response *st
 
 		contextlib.Logf(svs.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" DST UID:%d State:%s", uid, dststate)
 
+		// The proxy's own configure, never passed on to the miner
+		if response.ID == versionRollingConfigureID {
+			return svs.handleDstConfigureResponse(uid, response)
+		}
+
+		share := svs.shareResult(uid, response.ID, response.getShareResult())
+
 		// Notate the Error, and pass it on to the miner
 		if response.Error != nil {
 			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Dst UID:%d, State:%s, error:%s, %v", uid, dststate, *response.Error, response)
@@ -395,10 +440,33 @@ func (svs *StratumV1Struct) handleResponse(uid simple.ConnUniqueID, response *st
 
 			svs.SetDstStateUid(uid, DstStateStandBy)
 
+			// A redialed default route picks the miner back up
+			if defRouteUid, _ := svs.protocol.GetDefaultRouteUID(); defRouteUid == uid {
+				svs.resumeDest(uid)
+				return nil
+			}
+
 			if svs.scheduler == OnDemand {
 				svs.switchDest()
 			}
 
+		//
+		// A Dst the miner left still answers the shares for its jobs
+		//
+		case DstStateStandBy:
+
+			if !share {
+				msg, e := response.createResponseMsg()
+				if e != nil {
+					contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" createResponseMsg() error:%s", e)
+				}
+				LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_DROP_DST, msg)
+
+				contextlib.Logf(svs.Ctx(), contextlib.LevelDebug, lumerinlib.FileLineFunc()+" state not handled yet:%s", dststate)
+				break
+			}
+			fallthrough
+
 		//
 		// Pass response messages when in Running State
 		//
@@ -428,16 +496,6 @@ func (svs *StratumV1Struct) handleResponse(uid simple.ConnUniqueID, response *st
 			// Send configure Here?
 			//
 
-		case DstStateStandBy:
-
-			msg, e := response.createResponseMsg()
-			if e != nil {
-				contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" createResponseMsg() error:%s", e)
-			}
-			LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_DROP_DST, msg)
-
-			contextlib.Logf(svs.Ctx(), contextlib.LevelDebug, lumerinlib.FileLineFunc()+" state not handled yet:%s", dststate)
-
 		case DstStateError:
 
 			e = svs.DstRedialUid(uid)
@@ -480,8 +538,8 @@ func (svs *StratumV1Struct) handleNotice(uid simple.ConnUniqueID, notice *stratu
 			svs.handleDstNoticeSetExtranonce(uid, notice)
 		case string(SERVER_MINING_SET_DIFFICULTY):
 			svs.handleDstNoticeSetDifficulty(uid, notice)
-		//case string(SERVER_MINING_SET_VERSION_MASK):
-		//	svs.handleDstNoticeSetVersionMask(uid, notice)
+		case string(SERVER_MINING_SET_VERSION_MASK):
+			svs.handleDstNoticeSetVersionMask(uid, notice)
 		case string(SERVER_RECONNECT):
 			svs.handleDstNoticeReconnect(uid, notice)
 		default:
@@ -536,7 +594,7 @@ func (svs *StratumV1Struct) handleSrcReqSubscribe(request *stratumRequest) (e er
 	}
 
 	response := &stratumResponse{}
-	msg, e := response.createSrcSubscribeResponseMsg(request.ID)
+	msg, e := response.createSrcSubscribeResponseMsg(request.ID, svs.srcExtranonce1, srcExtranonce2Size)
 	if e != nil {
 		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createResponseMsg error:%s", e)
 		return e
@@ -584,6 +642,16 @@ func (svs *StratumV1Struct) handleSrcReqAuthorize(request *stratumRequest) (e er
 		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Src state:%s", state)
 	}
 
+	//
+	// A refused miner stays subscribed, it may authorize another worker
+	//
+	e = svs.authenticate(request)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelWarn, lumerinlib.FileLineFunc()+" Miner:%s authorize refused:%s", svs.minerRec.ID, e)
+		reason := minerauth.Reason
+		return svs.writeSrcResponse(JSON_SEND_STOR2SRC, request.ID, &reason)
+	}
+
 	if svs.srcAuthRequest == nil {
 		r := *request
 		svs.srcAuthRequest = &r
@@ -669,74 +737,70 @@ func (svs *StratumV1Struct) handleSrcReqConfigure(request *stratumRequest) (e er
 	}
 
 	//
-	// Get the current default route UID
+	// The miner is answered here, each V1 Dst is asked for the granted bits
+	// on its own
 	//
-	uid, _ := svs.protocol.GetDefaultRouteUID()
-	if uid < 0 {
-		// Need to store this for later use
-		msg, e := request.createRequestMsg()
-		if e != nil {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createRequestMsg error:%s", e)
-			return e
-		}
-
-		LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_STOR_SRC, msg)
-
-		svs.srcConfigure = request
+	msg, e := request.createRequestMsg()
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createRequestMsg error:%s", e)
+		return e
+	}
 
-		response := &stratumResponse{
-			ID:     request.ID,
-			Error:  nil,
-			Result: nil,
-			Reject: nil,
-		}
+	LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_STOR_SRC, msg)
 
-		respmsg, e := response.createSrcConfigureResponseMsg()
-		if e != nil {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createResponsMsg() error:%s", e)
-			return e
-		}
+	mask, minBitCount, e := request.getConfigureVersionRolling()
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" getConfigureVersionRolling() error:%s", e)
+		return e
+	}
 
-		LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_STOR2SRC, respmsg)
+	response := &stratumResponse{
+		ID:     request.ID,
+		Error:  nil,
+		Result: nil,
+		Reject: nil,
+	}
 
-		count, e := svs.protocol.WriteSrc(respmsg)
-		if e != nil {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write error:%s", e)
-			return e
-		}
-		if count != len(respmsg) {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write bad count:%d, %d", count, len(msg))
-			e = fmt.Errorf(lumerinlib.FileLineFunc()+" WriteSrc bad count:%d, %d", count, len(msg))
-			return e
-		}
+	respmsg, e := response.createSrcConfigureResponseMsg(mask)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createResponsMsg() error:%s", e)
+		return e
+	}
 
-		r := *request
-		svs.srcConfigure = &r
+	LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_STOR2SRC, respmsg)
 
+	count, e := svs.protocol.WriteSrc(respmsg)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write error:%s", e)
 		return e
-	} else {
-
-		// Move this to JSON file
+	}
+	if count != len(respmsg) {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write bad count:%d, %d", count, len(respmsg))
+		e = fmt.Errorf(lumerinlib.FileLineFunc()+" WriteSrc bad count:%d, %d", count, len(respmsg))
+		return e
+	}
 
-		msg, e := request.createRequestMsg()
-		if e != nil {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createRequestMsg error:%s", e)
-			return e
-		}
+	r := *request
+	svs.srcConfigure = &r
+	svs.srcVersionMask = mask
+	svs.srcVersionMinBits = minBitCount
+	svs.srcVersionMaskSent = mask
 
-		LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_SRC2DST, msg)
-		count, e := svs.protocol.Write(msg)
-		if e != nil {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write error:%s", e)
-			return e
-		}
-		if count != len(msg) {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write bad count:%d, %d", count, len(msg))
-			e = fmt.Errorf(lumerinlib.FileLineFunc()+" WriteSrc bad count:%d, %d", count, len(msg))
-			return e
+	//
+	// Dsts already open negotiate again, the default route sends the
+	// miner its mask once the pool answers
+	//
+	for uid, state := range svs.dstState {
+		switch state {
+		case DstStateSubscribing, DstStateAuthorizing, DstStateStandBy, DstStateRunning:
+			if svs.dstSV2[uid] != nil {
+				continue
+			}
+			svs.dstVersionMask[uid] = 0
+			svs.sendConfigure(uid)
 		}
-
 	}
+
 	return nil
 }
 
@@ -765,13 +829,38 @@ func (svs *StratumV1Struct) handleSrcReqSubmit(request *stratumRequest) (e error
 		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Src state:%s", state)
 	}
 
+	// Shares the proxy refuses itself still move an OnSubmit miner along
+	reject := func(result msgbus.ShareResult, code stratumErrors, reason string) error {
+		e := svs.rejectShare(request.ID, result, code, reason)
+		if svs.scheduler == OnSubmit {
+			svs.switchDest()
+		}
+		return e
+	}
+
+	p, e := parseSubmit(request)
+	if e != nil {
+		return reject(msgbus.ShareMalformed, SErrOther, "Malformed share, "+e.Error())
+	}
+
 	//
-	// Get the current default route UID
+	// The share goes to the Dst that issued its job, which need not be the
+	// default route after a switch. No Dst to take it, the share is stale.
 	//
-	uid, e := svs.protocol.GetDefaultRouteUID()
-	if e != nil {
-		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Default Route error:%s", e)
-		return e
+	job, ok := svs.jobOwner(p.jobID)
+	if !ok {
+		if job == nil {
+			return reject(msgbus.ShareUnknownJob, SErrJobNotFound, "Job not found")
+		}
+		return reject(msgbus.ShareStale, SErrJobNotFound, "Stale share, job not found")
+	}
+	uid := job.uid
+	if defRouteUid, _ := svs.protocol.GetDefaultRouteUID(); defRouteUid != uid {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelDebug, lumerinlib.FileLineFunc()+" job:%s share to UID:%d, default route UID:%d", p.jobID, uid, defRouteUid)
+	}
+
+	if result, code, reason, ok := svs.checkSubmit(job, &p); !ok {
+		return reject(result, code, reason)
 	}
 
 	//
@@ -780,34 +869,66 @@ func (svs *StratumV1Struct) handleSrcReqSubmit(request *stratumRequest) (e error
 
 	// Is validator running?
 
-	// Lots of error checking needed here, or a better way of pulling out parameters in a controlled manner
 	username := svs.dstDest[uid].Username()
 	minerID := svs.minerRec.ID
-	destID := svs.minerRec.Dest
-	jobID := request.Params[1].(string)
-	extranonce := request.Params[2].(string)
-	ntime := request.Params[3].(string)
-	nonce := request.Params[4].(string)
+	destID := svs.dstDest[uid].ID
+	dstRequest := svs.dstSubmitRequest(uid, request)
+	jobID := p.jobID
+	extranonce, _ := dstRequest.Params[2].(string)
+	ntime := dstRequest.Params[3].(string)
+	nonce := p.nonce
+
+	//
+	// With vardiff the proxy answers the shares the pool does not want
+	//
+	if svs.vardiff != nil {
+		forward, e := svs.vardiffSubmit(uid, request)
+		if e != nil {
+			return e
+		}
+		if !forward {
+			if svs.scheduler == OnSubmit {
+				svs.switchDest()
+			}
+			return nil
+		}
+	}
 
+	// The validator counts the shares that go to the pool
 	cs := contextlib.GetContextStruct(svs.Ctx())
 	ps := cs.GetMsgBus()
 	ps.SendValidateSubmit(svs.Ctx(), username, minerID, destID, jobID, extranonce, ntime, nonce)
 
+	//
+	// SV2 Dsts get the share as SubmitSharesExtended
+	//
+	if svs.dstSV2[uid] != nil {
+		e = svs.sv2Submit(uid, dstRequest)
+		if e != nil {
+			return e
+		}
+		svs.trackSubmit(uid, request.ID)
+		if svs.scheduler == OnSubmit {
+			svs.switchDest()
+		}
+		return nil
+	}
+
 	//
 	// Get the username of the default route
 	//
 
 	// msg, e := request.createRequestMsg()
-	msg, e := request.createSubmitRequestMsg(username)
+	msg, e := dstRequest.createSubmitRequestMsg(username)
 	if e != nil {
 		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" createRequestMsg() error:%s", e)
 	}
 
-	// Write to the current destination
+	// Write to the destination of the job
 
 	LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_SRC2DST, msg)
 
-	count, e := svs.protocol.Write(msg)
+	count, e := svs.protocol.WriteDst(uid, msg)
 	if e != nil {
 		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteSrc error:%s", e)
 		return e
@@ -818,6 +939,8 @@ func (svs *StratumV1Struct) handleSrcReqSubmit(request *stratumRequest) (e error
 		return e
 	}
 
+	svs.trackSubmit(uid, request.ID)
+
 	// Call switchDest to change destinations if needed and we are set for OnSubmit
 	if svs.scheduler == OnSubmit {
 		svs.switchDest()
@@ -846,7 +969,10 @@ func (svs *StratumV1Struct) handleSrcReqDifficulty(request *stratumRequest) (e e
 }
 
 //
-//
+// handleSrcReqExtranonce()
+// The proxy answers mining.extranonce.subscribe itself, from now on the
+// miner is told the extranonce of its Dst instead of having its jobs and
+// shares rewritten
 //
 func (svs *StratumV1Struct) handleSrcReqExtranonce(request *stratumRequest) (e error) {
 
@@ -856,7 +982,7 @@ func (svs *StratumV1Struct) handleSrcReqExtranonce(request *stratumRequest) (e e
 	// Validate the current sstate of the SRC connection
 	switch state {
 	case SrcStateNew:
-		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Got Configure")
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Got Extranonce Subscribe, expecting Subscribe")
 		return ErrBadSrcState
 	case SrcStateSubscribed:
 	case SrcStateAuthorized:
@@ -865,80 +991,57 @@ func (svs *StratumV1Struct) handleSrcReqExtranonce(request *stratumRequest) (e e
 		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Src state:%s", state)
 	}
 
-	//
-	// Get the current default route UID
-	//
-	uid, _ := svs.protocol.GetDefaultRouteUID()
-	if uid < 0 {
-		// Need to store this for later use
-		msg, e := request.createRequestMsg()
-		if e != nil {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createRequestMsg error:%s", e)
-			return e
-		}
-
-		LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_STOR_SRC, msg)
-
-		svs.srcConfigure = request
-
-		response := &stratumResponse{
-			ID:     request.ID,
-			Error:  nil,
-			Result: nil,
-			Reject: nil,
-		}
-
-		respmsg, e := response.createSrcExtranonceResponseMsg()
-		if e != nil {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createResponsMsg() error:%s", e)
-			return e
-		}
+	r := *request
+	svs.srcExtranonce = &r
+	LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_STOR_SRC, svs.srcExtranonce)
 
-		LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_STOR2SRC, respmsg)
+	response := &stratumResponse{
+		ID:     request.ID,
+		Error:  nil,
+		Result: nil,
+		Reject: nil,
+	}
 
-		count, e := svs.protocol.WriteSrc(respmsg)
-		if e != nil {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write error:%s", e)
-			return e
-		}
-		if count != len(respmsg) {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write bad count:%d, %d", count, len(msg))
-			e = fmt.Errorf(lumerinlib.FileLineFunc()+" WriteSrc bad count:%d, %d", count, len(msg))
-			return e
-		}
+	msg, e := response.createSrcExtranonceResponseMsg()
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createSrcExtranonceResponseMsg() error:%s", e)
+		return e
+	}
 
-		r := *request
-		svs.srcConfigure = &r
+	LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_STOR2SRC, msg)
 
+	count, e := svs.protocol.WriteSrc(msg)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write error:%s", e)
 		return e
-	} else {
+	}
+	if count != len(msg) {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write bad count:%d, %d", count, len(msg))
+		return fmt.Errorf(lumerinlib.FileLineFunc()+" WriteSrc bad count:%d, %d", count, len(msg))
+	}
 
-		dstID := contextlib.GetDest(svs.Ctx())
-		if dstID == nil {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" GetDest() returned nil")
-		}
+	if svs.srcSetExtranonce {
+		return nil
+	}
 
-		msg, e := request.createRequestMsg()
-		if e != nil {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createRequestMsg error:%s", e)
-			return e
-		}
+	//
+	// A miner already working on the rewritten extranonce moves to the
+	// Dst's own with the last job
+	//
+	uid, _ := svs.protocol.GetDefaultRouteUID()
+	rewrite := uid >= 0 && svs.GetDstStateUid(uid) == DstStateRunning && svs.extranonceRewrite(uid)
+
+	svs.srcSetExtranonce = true
 
-		LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_SRC2DST, msg)
-		count, e := svs.protocol.Write(msg)
+	if rewrite {
+		e = svs.sendSetExtranonceNotice(uid)
 		if e != nil {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write error:%s", e)
-			return e
-		}
-		if count != len(msg) {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write bad count:%d, %d", count, len(msg))
-			e = fmt.Errorf(lumerinlib.FileLineFunc()+" WriteSrc bad count:%d, %d", count, len(msg))
 			return e
 		}
-
+		e = svs.sendLastMiningNotice(uid)
 	}
-	return e
 
+	return e
 }
 
 //
@@ -966,6 +1069,9 @@ func (svs *StratumV1Struct) handleDstReqNotify(uid simple.ConnUniqueID, request
 
 	msg, e := request.createReqMiningNotify()
 
+	// A clean job from the pool makes its earlier ones stale
+	svs.retireJobs(uid, request.Params)
+
 	if e != nil {
 		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" createResponseMsg() error:%s", e)
 	} else {
@@ -1008,8 +1114,18 @@ func (svs *StratumV1Struct) handleDstReqNotify(uid simple.ConnUniqueID, request
 			ps := cs.GetMsgBus()
 			ps.SendValidateNotify(svs.Ctx(), minerID, destID, username, jobID, prevblock, gen1, gen2, merkel, version, nbits, ntime, clean)
 
-			LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_DST2SRC, msg)
 			svs.dstLastReqNotify[uid] = request
+
+			src := *request
+			src.Params = svs.srcNotifyParams(uid, request.Params)
+			msg, e = src.createReqMiningNotify()
+			if e != nil {
+				contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createReqMiningNotify() error:%s", e)
+				return e
+			}
+
+			LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_DST2SRC, msg)
+			svs.recordSrcJob(uid, src.Params)
 			svs.protocol.WriteSrc(msg)
 
 		// case DstStateError:
@@ -1108,6 +1224,10 @@ func (svs *StratumV1Struct) handleDstReqSetDifficulty(uid simple.ConnUniqueID, r
 	defRouteUid, _ := svs.protocol.GetDefaultRouteUID()
 	// This is the default route
 	if defRouteUid == uid {
+		if svs.vardiff != nil {
+			return svs.vardiffPoolDifficulty(uid)
+		}
+
 		diff, e := request.getSetDifficulty()
 		if e != nil {
 			return e
@@ -1115,7 +1235,7 @@ func (svs *StratumV1Struct) handleDstReqSetDifficulty(uid simple.ConnUniqueID, r
 
 		cs := contextlib.GetContextStruct(svs.Ctx())
 		ps := cs.GetMsgBus()
-		ps.SendValidateSetDiff(svs.Ctx(), svs.minerRec.ID, svs.dstDest[uid].ID, diff)
+		ps.SendValidateSetDiff(svs.Ctx(), svs.minerRec.ID, svs.dstDest[uid].ID, int(diff))
 
 		msg, e := request.createRequestSetDifficultyMsg()
 		if e != nil {
@@ -1148,6 +1268,11 @@ func (svs *StratumV1Struct) handleDstNoticeNotify(uid simple.ConnUniqueID, notic
 
 	msg, e := notice.createNoticeMiningNotify()
 
+	// A clean job from the pool makes its earlier ones stale
+	if n, ok := notice.Params.([]interface{}); ok {
+		svs.retireJobs(uid, n)
+	}
+
 	// is uid the current default destination?
 	// If not, store the notify?
 	// If so, pass it to the Src
@@ -1185,12 +1310,20 @@ func (svs *StratumV1Struct) handleDstNoticeNotify(uid simple.ConnUniqueID, notic
 			ps := cs.GetMsgBus()
 			ps.SendValidateNotify(svs.Ctx(), minerID, destID, username, jobID, prevblock, gen1, gen2, merkel, version, nbits, ntime, clean)
 
-			LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_DST2SRC, msg)
-			svs.protocol.WriteSrc(msg)
+			src := svs.srcMiningNotice(uid, notice)
+			msg, e = src.createNoticeMiningNotify()
 			if e != nil {
 				contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createNoticeMiningNotify() returned error:%s", e)
 				return e
 			}
+
+			LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_DST2SRC, msg)
+			svs.recordSrcJob(uid, src.Params.([]interface{}))
+			_, e = svs.protocol.WriteSrc(msg)
+			if e != nil {
+				contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteSrc error:%s", e)
+				return e
+			}
 		} else {
 			contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" UID[%d] is running but not default UID[%d]", uid, defRouteUid)
 		}
@@ -1264,6 +1397,9 @@ func (svs *StratumV1Struct) handleDstNoticeSetDifficulty(uid simple.ConnUniqueID
 
 	// This is the default route
 	if defRouteUid == uid {
+		if svs.vardiff != nil {
+			return svs.vardiffPoolDifficulty(uid)
+		}
 
 		diff, e := notice.getSetDifficulty()
 		if e != nil {
@@ -1272,7 +1408,7 @@ func (svs *StratumV1Struct) handleDstNoticeSetDifficulty(uid simple.ConnUniqueID
 
 		cs := contextlib.GetContextStruct(svs.Ctx())
 		ps := cs.GetMsgBus()
-		ps.SendValidateSetDiff(svs.Ctx(), svs.minerRec.ID, svs.dstDest[uid].ID, diff)
+		ps.SendValidateSetDiff(svs.Ctx(), svs.minerRec.ID, svs.dstDest[uid].ID, int(diff))
 
 		msg, e := notice.createNoticeSetDifficultyMsg()
 		if e != nil {
@@ -1347,7 +1483,10 @@ func (svs *StratumV1Struct) handleDstNoticeSetExtranonce(uid simple.ConnUniqueID
 	}
 
 	// This is the default route
-	if defRouteUid == uid {
+	if defRouteUid == uid && svs.extranonceRewrite(uid) {
+		// The pool's next jobs carry the new extranonce1 in the miner's coinb1
+		contextlib.Logf(svs.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+" uid:%d extranonce:%s size:%d rewritten for the miner", uid, e1, e2size)
+	} else if defRouteUid == uid {
 
 		msg, e := notice.createNoticeMsg()
 		if e != nil {
@@ -1367,54 +1506,86 @@ func (svs *StratumV1Struct) handleDstNoticeSetExtranonce(uid simple.ConnUniqueID
 }
 
 //
+// handleDstNoticeSetVersionMask()
+// The pool changed its version rolling mask, the miner hears of it when the
+// effective mask of the default route changes
+//
+func (svs *StratumV1Struct) handleDstNoticeSetVersionMask(uid simple.ConnUniqueID, notice *stratumNotice) (e error) {
+
+	contextlib.Logf(svs.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" enter")
+
+	mask, e := notice.getSetVersionMask()
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" getSetVersionMask() error:%s", e)
+		return e
+	}
+
+	svs.dstVersionMask[uid] = mask & svs.srcVersionMask
+
+	if defRouteUid, _ := svs.protocol.GetDefaultRouteUID(); defRouteUid == uid {
+		return svs.sendVersionMaskNotice(uid)
+	}
+
+	return nil
+}
+
 //
+// handleDstNoticeReconnect()
+// The pool moves the Dst to another endpoint. The proxy redials the UID there
+// itself, the miner stays connected and is picked back up once the Dst is
+// authorized again.
 //
 func (svs *StratumV1Struct) handleDstNoticeReconnect(uid simple.ConnUniqueID, notice *stratumNotice) (e error) {
 
 	contextlib.Logf(svs.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" enter")
 
-	// is index the current default destination?
-	// If not, store the notify?
-	// If so, pass it to the Src
-
 	dststate := svs.GetDstStateUid(uid)
 	switch dststate {
 	case DstStateSubscribing:
-		fallthrough
 	case DstStateAuthorizing:
-		fallthrough
-	case DstStateRunning:
-		contextlib.Logf(svs.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+" passing set diff for state:%s", dststate)
 	case DstStateStandBy:
-		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" state not handled yet:%s", dststate)
-	// case DstStateError:
-	// case DstStateNew:
+	case DstStateRunning:
 	case DstStateClosed:
 		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Connecton is Marked closed, ignore reopen")
 		return fmt.Errorf("connection is marked closed, cant reopen")
 	default:
-		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+"  state:%s not handled", dststate)
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d state:%s, ignoring reconnect", uid, dststate)
+		return nil
 	}
 
-	defRouteUid, _ := svs.protocol.GetDefaultRouteUID()
+	host, port, wait, e := notice.getReconnect()
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" getReconnect() error:%s", e)
+		return e
+	}
 
-	// This is the default route
-	if defRouteUid == uid {
-		// msg, e := notice.createNoticeSetDifficultyMsg()
-		msg, e := notice.createNoticeMsg()
-		if e != nil {
-			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createNoticeSetDifficultyMsg() returned error:%s", e)
-			return e
-		}
+	dest := *svs.dstDest[uid]
+	if host == "" {
+		host = dest.Host()
+	}
+	if port == "" {
+		port = dest.Port()
+	}
+	e = dest.SetHostPort(host, port)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" SetHostPort() error:%s", e)
+		return e
+	}
 
-		LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_DST2SRC, msg)
+	contextlib.Logf(svs.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+" UID:%d Dest:%s reconnecting to %s:%s in %s", uid, dest.ID, host, port, wait)
 
-		svs.protocol.WriteSrc(msg)
-	} else {
-		// Store or drop the message?
-		contextlib.Logf(svs.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+" uid:%d is not the default dst:%d, should we store or drop the message", uid, defRouteUid)
+	cs := contextlib.GetContextStruct(svs.Ctx())
+	ps := cs.GetMsgBus()
+	_, e = ps.Dests().Update(dest.ID, func(d *msgbus.Dest) error {
+		d.NetUrl = dest.NetUrl
+		return nil
+	})
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelWarn, lumerinlib.FileLineFunc()+" Dest:%s update error:%s", dest.ID, e)
 	}
 
-	return e
+	svs.dstDest[uid] = &dest
+	svs.SetDstStateUid(uid, DstStateRedialing)
 
+	return svs.protocol.AsyncReDialDest(uid, &dest, wait)
 }
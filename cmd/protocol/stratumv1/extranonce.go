@@ -0,0 +1,156 @@
+package stratumv1
+
+import (
+	"fmt"
+	"strings"
+
+	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
+	"github.com/daniel-888/proxy-router/lumerinlib"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+//
+// Extranonce rewriting
+//
+// The proxy subscribes every miner itself, with a proxy assigned extranonce1
+// and extranonce2_size. A miner that sent mining.extranonce.subscribe is
+// told the extranonce of each Dst it is switched to. Any other miner keeps
+// the proxy's values for good and the Dst's extranonce2 space is split:
+//
+//   pool coinbase:  coinb1 | extranonce1 | extranonce2             | coinb2
+//   miner coinbase: coinb1 | extranonce1 | pad | proxy extranonce1 | miner extranonce2 | coinb2
+//
+// The pool's extranonce1 and the zero pad go at the end of the coinb1 the
+// miner gets, the pad and the proxy extranonce1 in front of the extranonce2
+// the pool gets, so both hash the same coinbase. A Dst whose extranonce2
+// space is too small to split is passed to the miner as is, a miner that
+// cannot take it is sent client.reconnect and dropped.
+//
+
+const (
+	srcExtranonce1Size = 1 // Bytes of the proxy assigned extranonce1
+	srcExtranonce2Size = 3 // extranonce2_size the miner is subscribed with
+)
+
+//
+// newSrcExtranonce1()
+// The proxy assigned extranonce1 of the miner numbered count
+//
+func newSrcExtranonce1(count int) string {
+	return fmt.Sprintf("%0*x", srcExtranonce1Size*2, count&(1<<(8*srcExtranonce1Size)-1))
+}
+
+//
+// extranonceRewrite()
+// True when the miner works on the Dst with the proxy's extranonce
+//
+func (svs *StratumV1Struct) extranonceRewrite(uid simple.ConnUniqueID) bool {
+	if svs.srcSetExtranonce {
+		return false
+	}
+	return svs.dstExtranonce2size[uid] >= srcExtranonce1Size+srcExtranonce2Size
+}
+
+//
+// extranoncePad()
+// Hex zeros filling the Dst's extranonce2 above the miner's
+//
+func (svs *StratumV1Struct) extranoncePad(uid simple.ConnUniqueID) string {
+	return strings.Repeat("00", svs.dstExtranonce2size[uid]-srcExtranonce1Size-srcExtranonce2Size)
+}
+
+//
+// minerExtranonce1()
+// The extranonce1 the miner works with on the Dst
+//
+func (svs *StratumV1Struct) minerExtranonce1(uid simple.ConnUniqueID) string {
+	if svs.extranonceRewrite(uid) {
+		return svs.srcExtranonce1
+	}
+	return svs.dstExtranonce[uid]
+}
+
+//
+// srcNotifyParams()
+// The mining.notify params of the Dst as the miner gets them
+//
+func (svs *StratumV1Struct) srcNotifyParams(uid simple.ConnUniqueID, params []interface{}) []interface{} {
+
+	if !svs.extranonceRewrite(uid) || len(params) < 3 {
+		return params
+	}
+
+	coinb1, ok := params[2].(string)
+	if !ok {
+		return params
+	}
+
+	p := make([]interface{}, len(params))
+	copy(p, params)
+	p[2] = coinb1 + svs.dstExtranonce[uid] + svs.extranoncePad(uid)
+
+	return p
+}
+
+//
+// srcMiningNotice()
+// The Dst's mining.notify as the miner gets it
+//
+func (svs *StratumV1Struct) srcMiningNotice(uid simple.ConnUniqueID, notice *stratumNotice) *stratumNotice {
+
+	params, ok := notice.Params.([]interface{})
+	if !ok || !svs.extranonceRewrite(uid) {
+		return notice
+	}
+
+	n := *notice
+	n.Params = svs.srcNotifyParams(uid, params)
+
+	return &n
+}
+
+//
+// dstSubmitRequest()
+// The miner's mining.submit as the Dst gets it
+//
+func (svs *StratumV1Struct) dstSubmitRequest(uid simple.ConnUniqueID, request *stratumRequest) *stratumRequest {
+
+	if !svs.extranonceRewrite(uid) || len(request.Params) < 3 {
+		return request
+	}
+
+	extranonce2, ok := request.Params[2].(string)
+	if !ok {
+		return request
+	}
+	if len(extranonce2) != srcExtranonce2Size*2 {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelWarn, lumerinlib.FileLineFunc()+" UID:%d extranonce2:%s not %d bytes", uid, extranonce2, srcExtranonce2Size)
+	}
+
+	r := *request
+	r.Params = make([]interface{}, len(request.Params))
+	copy(r.Params, request.Params)
+	r.Params[2] = svs.extranoncePad(uid) + svs.srcExtranonce1 + extranonce2
+
+	return &r
+}
+
+//
+// reconnectSrc()
+// Asks the miner to reconnect, and closes the session
+//
+func (svs *StratumV1Struct) reconnectSrc() {
+
+	msg, e := createReconnectNoticeMsg()
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createReconnectNoticeMsg error:%s", e)
+	} else {
+		LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_STOR2SRC, msg)
+		if _, e = svs.protocol.WriteSrc(msg); e != nil {
+			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteSrc error:%s", e)
+		}
+	}
+
+	svs.protocol.CloseSrc()
+	svs.Cancel()
+}
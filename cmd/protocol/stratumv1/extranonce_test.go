@@ -0,0 +1,288 @@
+package stratumv1
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
+	"github.com/daniel-888/proxy-router/lumerinlib/testinglib"
+)
+
+//
+// The miner's coinbase, built on the rewritten job with the proxy's
+// extranonce, is the pool's coinbase for the rewritten share
+//
+func TestExtranonceRewrite(t *testing.T) {
+
+	uid := simple.ConnUniqueID(1)
+	svs := &StratumV1Struct{
+		srcExtranonce1:     newSrcExtranonce1(0x1234),
+		dstExtranonce:      map[simple.ConnUniqueID]string{uid: "ee01ee02"},
+		dstExtranonce2size: map[simple.ConnUniqueID]int{uid: 6},
+	}
+
+	if svs.srcExtranonce1 != "34" {
+		t.Fatalf("newSrcExtranonce1() got:%s", svs.srcExtranonce1)
+	}
+
+	job := []interface{}{"1", "00", "c1c1", "c2c2", []interface{}{}, "20000000", "1d00ffff", "6553f100", true}
+	params := svs.srcNotifyParams(uid, job)
+	if params[2] != "c1c1ee01ee020000" || job[2] != "c1c1" {
+		t.Fatalf("srcNotifyParams() got:%v job:%v", params[2], job[2])
+	}
+
+	submit := &stratumRequest{ID: 4, Method: string(CLIENT_MINING_SUBMIT), Params: []interface{}{"w", "1", "0a0b0c", "6553f101", "0000002a"}}
+	dst := svs.dstSubmitRequest(uid, submit)
+	if dst.Params[2] != "0000340a0b0c" || submit.Params[2] != "0a0b0c" {
+		t.Fatalf("dstSubmitRequest() got:%v submit:%v", dst.Params[2], submit.Params[2])
+	}
+
+	miner := params[2].(string) + svs.minerExtranonce1(uid) + submit.Params[2].(string) + params[3].(string)
+	pool := job[2].(string) + svs.dstExtranonce[uid] + dst.Params[2].(string) + job[3].(string)
+	if miner != pool {
+		t.Fatalf("coinbase miner:%s pool:%s", miner, pool)
+	}
+
+	// No room for the proxy's extranonce, the pool's is passed on
+	svs.dstExtranonce2size[uid] = 2
+	if svs.extranonceRewrite(uid) || svs.dstSubmitRequest(uid, submit) != submit {
+		t.Fatalf("rewrote into extranonce2_size 2")
+	}
+
+	// Miners taking mining.set_extranonce are never rewritten
+	svs.dstExtranonce2size[uid] = 6
+	svs.srcSetExtranonce = true
+	if svs.extranonceRewrite(uid) || svs.minerExtranonce1(uid) != "ee01ee02" {
+		t.Fatalf("rewrote for a miner subscribed to extranonce")
+	}
+}
+
+//
+// A miner that never sent mining.extranonce.subscribe keeps the proxy's
+// extranonce, it gets the pool's jobs and the pool its shares rewritten
+//
+func TestNewSrc2PoolExtranonceRewrite(t *testing.T) {
+
+	localport := testinglib.GetRandPort()
+	nodeaddr := net.JoinHostPort(localhost, strconv.Itoa(localport))
+
+	poolListener, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolListener.Close()
+
+	defdest := createDest("LocalPriPoolDestID", fmt.Sprintf("stratum+tcp://poolworker:password@%s/", poolListener.Addr()))
+	ctx := newContextStruct(t, nodeaddr, defdest)
+
+	sls := newStratumConnection(t, ctx)
+	defer sls.Cancel()
+
+	submitted := make(chan string, 1)
+	poolErr := make(chan error, 1)
+	go func() { poolErr <- fakeV1ExtranoncePool(poolListener, 8, submitted) }()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, e = net.Dial("tcp", nodeaddr); e == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if e != nil {
+		t.Fatalf("Dial() error:%s", e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	miner := bufio.NewReader(conn)
+
+	send := func(msg string) {
+		if _, e := conn.Write([]byte(msg + "\n")); e != nil {
+			t.Fatalf("Write() error:%s", e)
+		}
+	}
+	recv := func() (m map[string]interface{}) {
+		line, e := miner.ReadBytes('\n')
+		if e != nil {
+			t.Fatalf("ReadBytes() error:%s", e)
+		}
+		if e = json.Unmarshal(line, &m); e != nil {
+			t.Fatalf("Unmarshal(%s) error:%s", line, e)
+		}
+		return m
+	}
+
+	send(`{"id":1,"method":"mining.subscribe","params":["test/1.0"]}`)
+	subscribe, _ := recv()["result"].([]interface{})
+	if len(subscribe) != 3 || subscribe[2] != float64(srcExtranonce2Size) {
+		t.Fatalf("bad subscribe response:%v", subscribe)
+	}
+	extranonce1, _ := subscribe[1].(string)
+	if len(extranonce1) != srcExtranonce1Size*2 {
+		t.Fatalf("bad subscribe extranonce1:%s", extranonce1)
+	}
+
+	send(`{"id":2,"method":"mining.authorize","params":["minerworker",""]}`)
+	if auth := recv(); auth["result"] != true {
+		t.Fatalf("bad authorize response:%v", auth)
+	}
+
+	for notified := false; !notified; {
+		m := recv()
+		params, _ := m["params"].([]interface{})
+		switch m["method"] {
+		case string(SERVER_MINING_SET_EXTRANONCE):
+			t.Fatalf("set_extranonce sent to the miner:%v", m)
+		case string(SERVER_MINING_NOTIFY):
+			if params[2] != "01ee0100000000" {
+				t.Fatalf("notify coinb1 got:%v", params[2])
+			}
+			notified = true
+		}
+	}
+
+	send(`{"id":4,"method":"mining.submit","params":["minerworker","1","0a0b0c","6553f101","0000002a"]}`)
+	if submit := recv(); submit["id"] != float64(4) || submit["result"] != true {
+		t.Fatalf("bad submit response:%v", submit)
+	}
+
+	if e = <-poolErr; e != nil {
+		t.Fatalf("pool error:%s", e)
+	}
+	if extranonce2 := <-submitted; extranonce2 != "00000000"+extranonce1+"0a0b0c" {
+		t.Fatalf("pool got extranonce2:%s", extranonce2)
+	}
+}
+
+//
+// A miner that never sent mining.extranonce.subscribe cannot work on a pool
+// whose extranonce2 is too small to split, it is sent client.reconnect and
+// dropped rather than set_extranonce it would ignore
+//
+func TestNewSrc2PoolExtranonceReconnect(t *testing.T) {
+
+	localport := testinglib.GetRandPort()
+	nodeaddr := net.JoinHostPort(localhost, strconv.Itoa(localport))
+
+	poolListener, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolListener.Close()
+
+	defdest := createDest("LocalPriPoolDestID", fmt.Sprintf("stratum+tcp://poolworker:password@%s/", poolListener.Addr()))
+	ctx := newContextStruct(t, nodeaddr, defdest)
+
+	sls := newStratumConnection(t, ctx)
+	defer sls.Cancel()
+
+	go fakeV1ExtranoncePool(poolListener, 2, make(chan string, 1))
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, e = net.Dial("tcp", nodeaddr); e == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if e != nil {
+		t.Fatalf("Dial() error:%s", e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	miner := bufio.NewReader(conn)
+
+	send := func(msg string) {
+		if _, e := conn.Write([]byte(msg + "\n")); e != nil {
+			t.Fatalf("Write() error:%s", e)
+		}
+	}
+
+	send(`{"id":1,"method":"mining.subscribe","params":["test/1.0"]}`)
+	send(`{"id":2,"method":"mining.authorize","params":["minerworker",""]}`)
+
+	reconnected := false
+	for {
+		line, e := miner.ReadBytes('\n')
+		if e != nil {
+			break
+		}
+		var m map[string]interface{}
+		if e = json.Unmarshal(line, &m); e != nil {
+			t.Fatalf("Unmarshal(%s) error:%s", line, e)
+		}
+		switch m["method"] {
+		case string(SERVER_MINING_SET_EXTRANONCE), string(SERVER_MINING_NOTIFY):
+			t.Fatalf("miner got:%v", m)
+		case string(SERVER_RECONNECT):
+			reconnected = true
+		}
+	}
+
+	if !reconnected {
+		t.Fatalf("miner closed without client.reconnect")
+	}
+}
+
+//
+// fakeV1ExtranoncePool()
+// Subscribes the proxy with an n2size byte extranonce2, sends one job and
+// passes on the extranonce2 of the share it gets
+//
+func fakeV1ExtranoncePool(l net.Listener, n2size int, submitted chan<- string) (e error) {
+
+	conn, e := l.Accept()
+	if e != nil {
+		return e
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	write := func(m interface{}) error {
+		msg, e := json.Marshal(m)
+		if e != nil {
+			return e
+		}
+		_, e = conn.Write(append(msg, '\n'))
+		return e
+	}
+
+	for {
+		line, e := reader.ReadBytes('\n')
+		if e != nil {
+			return e
+		}
+		var request stratumRequest
+		if e = json.Unmarshal(line, &request); e != nil {
+			return e
+		}
+
+		switch request.Method {
+		case string(CLIENT_MINING_SUBSCRIBE):
+			e = write(&stratumResponse{ID: request.ID, Result: []interface{}{[]interface{}{}, "ee01", n2size}})
+		case string(CLIENT_MINING_AUTHORIZE):
+			if e = write(&stratumResponse{ID: request.ID, Result: true}); e != nil {
+				return e
+			}
+			if e = write(&stratumNotice{Method: string(SERVER_MINING_SET_DIFFICULTY), Params: []interface{}{1024}}); e != nil {
+				return e
+			}
+			e = write(&stratumNotice{Method: string(SERVER_MINING_NOTIFY), Params: []interface{}{"1", "0000000000000000000000000000000000000000000000000000000000000000", "01", "02", []interface{}{}, "20000000", "1d00ffff", "6553f100", true}})
+		case string(CLIENT_MINING_SUBMIT):
+			extranonce2, _ := request.Params[2].(string)
+			submitted <- extranonce2
+			return write(&stratumResponse{ID: request.ID, Result: true})
+		default:
+			return fmt.Errorf("pool got:%s", line)
+		}
+		if e != nil {
+			return e
+		}
+	}
+}
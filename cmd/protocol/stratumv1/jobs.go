@@ -0,0 +1,118 @@
+package stratumv1
+
+import (
+	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
+	"github.com/daniel-888/proxy-router/lumerinlib"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+//
+// Job ownership
+//
+// Every job sent to the miner is registered under its job ID with the Dst
+// that issued it. A share goes to the Dst owning its job, even after the
+// miner was switched away from it, as long as that Dst is still up. A
+// pool's clean_jobs makes the jobs it issued before stale, they are
+// forgotten at the clean_jobs after that, and a reopened Dst loses all of
+// its jobs: shares for those are answered by the proxy and never reach a
+// pool. When two pools use the same job ID the one that sent it last owns it.
+//
+
+type minerJob struct {
+	uid   simple.ConnUniqueID
+	ntime uint32 // ntime of the mining.notify, 0 when unreadable
+	stale bool   // The pool cleaned its jobs since
+}
+
+//
+// registerJob()
+// Records the Dst of a mining.notify on its way to the miner
+//
+func (svs *StratumV1Struct) registerJob(uid simple.ConnUniqueID, params []interface{}) {
+	if len(params) == 0 {
+		return
+	}
+	jobID, ok := params[0].(string)
+	if !ok {
+		return
+	}
+
+	job := &minerJob{uid: uid}
+	if len(params) == 9 {
+		if s, ok := params[7].(string); ok {
+			job.ntime, _ = parseHex32(s)
+		}
+	}
+
+	svs.jobs[jobID] = job
+}
+
+//
+// recordSrcJob()
+// Records a mining.notify on its way to the miner, params as the miner
+// gets them, for the share routing and vardiff alike
+//
+func (svs *StratumV1Struct) recordSrcJob(uid simple.ConnUniqueID, params []interface{}) {
+	svs.vardiffJob(params)
+	svs.registerJob(uid, params)
+}
+
+//
+// retireJobs()
+// Makes the jobs of the Dst stale when its pool sends a mining.notify with
+// clean_jobs set, the ones already stale are forgotten
+//
+func (svs *StratumV1Struct) retireJobs(uid simple.ConnUniqueID, params []interface{}) {
+	if len(params) != 9 {
+		return
+	}
+	if clean, _ := params[8].(bool); !clean {
+		return
+	}
+	for jobID, job := range svs.jobs {
+		if job.uid != uid {
+			continue
+		}
+		if job.stale {
+			delete(svs.jobs, jobID)
+		} else {
+			job.stale = true
+		}
+	}
+}
+
+//
+// dropJobs()
+// Forgets every job of the Dst
+//
+func (svs *StratumV1Struct) dropJobs(uid simple.ConnUniqueID) {
+	for jobID, job := range svs.jobs {
+		if job.uid == uid {
+			delete(svs.jobs, jobID)
+		}
+	}
+}
+
+//
+// jobOwner()
+// The job and the Dst its shares go to, false when the job is stale or no
+// Dst is up to take it. job is nil for a job the miner never got.
+//
+func (svs *StratumV1Struct) jobOwner(jobID string) (job *minerJob, ok bool) {
+
+	job, ok = svs.jobs[jobID]
+	if !ok {
+		return nil, false
+	}
+	if job.stale {
+		return job, false
+	}
+
+	switch state := svs.GetDstStateUid(job.uid); state {
+	case DstStateRunning, DstStateStandBy:
+		return job, true
+	default:
+		contextlib.Logf(svs.Ctx(), contextlib.LevelDebug, lumerinlib.FileLineFunc()+" job:%s UID:%d state:%s", jobID, job.uid, state)
+		return job, false
+	}
+}
@@ -0,0 +1,247 @@
+package stratumv1
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+	"github.com/daniel-888/proxy-router/lumerinlib/testinglib"
+)
+
+//
+// After a switch the shares for the first pool's job still go to it, until
+// the pool cleans its jobs and they are answered by the proxy as stale
+//
+func TestNewSrc2PoolJobRouting(t *testing.T) {
+
+	localport := testinglib.GetRandPort()
+	nodeaddr := net.JoinHostPort(localhost, strconv.Itoa(localport))
+
+	poolA, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolA.Close()
+	poolB, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolB.Close()
+
+	defdest := createDest("LocalPriPoolDestID", fmt.Sprintf("stratum+tcp://poolworker:password@%s/", poolA.Addr()))
+	secdest := createDest("LocalSecPoolDestID", fmt.Sprintf("stratum+tcp://poolworker:password@%s/", poolB.Addr()))
+	ctx := newContextStruct(t, nodeaddr, defdest)
+
+	sls := newStratumConnection(t, ctx)
+	defer sls.Cancel()
+
+	sharesA := make(chan string, 4)
+	sharesB := make(chan string, 4)
+	cleanA := make(chan struct{})
+	cleaned := make(chan struct{})
+	go fakeV1JobPool(poolA, "1", sharesA, cleanA, cleaned)
+	go fakeV1JobPool(poolB, "2", sharesB, nil, nil)
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, e = net.Dial("tcp", nodeaddr); e == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if e != nil {
+		t.Fatalf("Dial() error:%s", e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	miner := bufio.NewReader(conn)
+
+	send := func(msg string) {
+		if _, e := conn.Write([]byte(msg + "\n")); e != nil {
+			t.Fatalf("Write() error:%s", e)
+		}
+	}
+	recv := func() (m map[string]interface{}) {
+		line, e := miner.ReadBytes('\n')
+		if e != nil {
+			t.Fatalf("ReadBytes() error:%s", e)
+		}
+		if e = json.Unmarshal(line, &m); e != nil {
+			t.Fatalf("Unmarshal(%s) error:%s", line, e)
+		}
+		return m
+	}
+	recvJob := func(job string) {
+		for {
+			m := recv()
+			if params, _ := m["params"].([]interface{}); m["method"] == string(SERVER_MINING_NOTIFY) && params[0] == job {
+				return
+			}
+		}
+	}
+	submit := func(id int, job string) map[string]interface{} {
+		send(fmt.Sprintf(`{"id":%d,"method":"mining.submit","params":["minerworker","%s","0a0b0c","6553f101","0000002a"]}`, id, job))
+		for {
+			if m := recv(); m["id"] == float64(id) {
+				return m
+			}
+		}
+	}
+
+	send(`{"id":1,"method":"mining.subscribe","params":["test/1.0"]}`)
+	recv()
+	send(`{"id":2,"method":"mining.authorize","params":["minerworker",""]}`)
+	if auth := recv(); auth["result"] != true {
+		t.Fatalf("bad authorize response:%v", auth)
+	}
+	recvJob("1")
+
+	//
+	// Move the miner to the second pool
+	//
+	ps := contextlib.GetContextStruct(ctx).GetMsgBus()
+	if _, e = ps.DestPubWait(*secdest); e != nil {
+		t.Fatalf("DestPubWait() error:%s", e)
+	}
+	miners, e := ps.MinerGetAllWait()
+	if e != nil || len(miners) != 1 {
+		t.Fatalf("MinerGetAllWait() got:%v error:%v", miners, e)
+	}
+	if _, e = ps.MinerSetDestWait(miners[0], secdest.ID); e != nil {
+		t.Fatalf("MinerSetDestWait() error:%s", e)
+	}
+	recvJob("2")
+
+	if r := submit(10, "1"); r["result"] != true || <-sharesA != "1" {
+		t.Fatalf("share for the first pool's job:%v", r)
+	}
+	if r := submit(11, "2"); r["result"] != true || <-sharesB != "2" {
+		t.Fatalf("share for the second pool's job:%v", r)
+	}
+
+	// The first pool moves on, its job is stale
+	close(cleanA)
+	<-cleaned
+	time.Sleep(200 * time.Millisecond)
+
+	if r := submit(12, "1"); r["result"] != false || r["error"] == nil {
+		t.Fatalf("stale share answered:%v", r)
+	}
+	if r := submit(13, "9"); r["result"] != false || r["error"] == nil {
+		t.Fatalf("share for an unknown job answered:%v", r)
+	}
+
+	select {
+	case job := <-sharesA:
+		t.Fatalf("first pool got a stale share for job:%s", job)
+	case job := <-sharesB:
+		t.Fatalf("second pool got a share for job:%s", job)
+	default:
+	}
+}
+
+//
+// A job the pool sends as a notice is recorded with the params the miner
+// gets, the same as one sent as a request
+//
+func TestRecordSrcJobNotice(t *testing.T) {
+
+	uid := simple.ConnUniqueID(1)
+	svs := &StratumV1Struct{
+		srcExtranonce1:     newSrcExtranonce1(0x1234),
+		dstExtranonce:      map[simple.ConnUniqueID]string{uid: "ee01ee02"},
+		dstExtranonce2size: map[simple.ConnUniqueID]int{uid: 6},
+		jobs:               make(map[string]*minerJob),
+		vardiff:            newVardiff(VardiffConfig{}, time.Now()),
+	}
+
+	job := []interface{}{"1", "00", "c1c1", "c2c2", []interface{}{}, "20000000", "1d00ffff", "6553f100", true}
+	notice := &stratumNotice{Method: string(SERVER_MINING_NOTIFY), Params: job}
+	request := &stratumRequest{Method: string(SERVER_MINING_NOTIFY), Params: job}
+
+	src := svs.srcMiningNotice(uid, notice)
+	svs.recordSrcJob(uid, src.Params.([]interface{}))
+	fromNotice := svs.vardiff.jobs["1"]
+
+	svs.recordSrcJob(uid, svs.srcNotifyParams(uid, request.Params))
+	fromRequest := svs.vardiff.jobs["1"]
+
+	if fromNotice[2] != "c1c1ee01ee020000" || fromNotice[2] != fromRequest[2] || job[2] != "c1c1" {
+		t.Errorf("recordSrcJob() coinb1 notice:%v request:%v pool:%v", fromNotice[2], fromRequest[2], job[2])
+	}
+	if j, ok := svs.jobs["1"]; !ok || j.uid != uid || j.ntime != 0x6553f100 {
+		t.Errorf("recordSrcJob() job:%+v", j)
+	}
+}
+
+//
+// fakeV1JobPool()
+// Serves one proxy connection a job and accepts every share, passing on
+// its job ID. Closing clean has the pool send a new clean job.
+//
+func fakeV1JobPool(l net.Listener, job string, shares chan<- string, clean <-chan struct{}, cleaned chan<- struct{}) {
+
+	conn, e := l.Accept()
+	if e != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	write := func(m interface{}) error {
+		msg, e := json.Marshal(m)
+		if e != nil {
+			return e
+		}
+		_, e = conn.Write(append(msg, '\n'))
+		return e
+	}
+	notify := func(job string) error {
+		return write(&stratumNotice{Method: string(SERVER_MINING_NOTIFY), Params: []interface{}{job, "0000000000000000000000000000000000000000000000000000000000000000", "01", "02", []interface{}{}, "20000000", "1d00ffff", "6553f100", true}})
+	}
+
+	if clean != nil {
+		go func() {
+			<-clean
+			notify(job + "c")
+			close(cleaned)
+		}()
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, e := reader.ReadBytes('\n')
+		if e != nil {
+			return
+		}
+		var request stratumRequest
+		if e = json.Unmarshal(line, &request); e != nil {
+			return
+		}
+
+		switch request.Method {
+		case string(CLIENT_MINING_SUBSCRIBE):
+			e = write(&stratumResponse{ID: request.ID, Result: []interface{}{[]interface{}{}, "ee0" + job, 4}})
+		case string(CLIENT_MINING_AUTHORIZE):
+			if e = write(&stratumResponse{ID: request.ID, Result: true}); e != nil {
+				return
+			}
+			if e = write(&stratumNotice{Method: string(SERVER_MINING_SET_DIFFICULTY), Params: []interface{}{1024}}); e != nil {
+				return
+			}
+			e = notify(job)
+		case string(CLIENT_MINING_SUBMIT):
+			shares <- request.Params[1].(string)
+			e = write(&stratumResponse{ID: request.ID, Result: true})
+		}
+		if e != nil {
+			return
+		}
+	}
+}
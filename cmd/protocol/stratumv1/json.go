@@ -14,6 +14,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/daniel-888/proxy-router/lumerinlib"
 	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
@@ -34,6 +35,12 @@ const (
 	SErrSigUnavail     stratumErrors = "-21"
 	SErrUnkSigTyp      stratumErrors = "-22"
 	SErrBadSig         stratumErrors = "-23"
+	SErrOther          stratumErrors = "20"
+	SErrJobNotFound    stratumErrors = "21"
+	SErrDuplicateShare stratumErrors = "22"
+	SErrLowDiffShare   stratumErrors = "23"
+	SErrUnauthorized   stratumErrors = "24"
+	SErrNotSubscribed  stratumErrors = "25"
 )
 
 const (
@@ -102,10 +109,10 @@ type stratumRequest struct {
 }
 
 type stratumSetDifficultyRequest struct {
-	ID      int    `json:"id"`
-	Method  string `json:"method"`
-	Params  []int  `json:"params"`
-	Jsonrpc string `json:"jsonrpc,omitempty"`
+	ID      int       `json:"id"`
+	Method  string    `json:"method"`
+	Params  []float64 `json:"params"`
+	Jsonrpc string    `json:"jsonrpc,omitempty"`
 }
 
 // notice ID is always null
@@ -117,10 +124,10 @@ type stratumNotice struct {
 }
 
 type noticeMiningSetDifficulty struct {
-	ID      *string `json:"id"`
-	Method  string  `json:"method"`
-	Params  []int   `json:"params"`
-	Jsonrpc string  `json:"jsonrpc,omitempty"`
+	ID      *string   `json:"id"`
+	Method  string    `json:"method"`
+	Params  []float64 `json:"params"`
+	Jsonrpc string    `json:"jsonrpc,omitempty"`
 }
 
 type noticeMiningSetExtranonce struct {
@@ -164,6 +171,13 @@ type stratumResponse struct {
 	Jsonrpc string      `json:"jsonrpc,omitempty"`
 }
 
+// Response carrying a stratum [code, message, traceback] error
+type stratumErrorResponse struct {
+	ID     int           `json:"id"`
+	Result interface{}   `json:"result"`
+	Error  []interface{} `json:"error"`
+}
+
 type stratumConfigureResponse struct {
 	ID      int            `json:"id"`
 	Error   *string        `json:"error"`
@@ -394,7 +408,7 @@ func (r *stratumRequest) getAuthName() (name string, err error) {
 //
 // {"id":0,"jsonrpc":"2.0","method":"mining.set_difficulty","params":[65535]}
 //------------------------------------------------------
-func (r *stratumRequest) getSetDifficulty() (difficulty int, err error) {
+func (r *stratumRequest) getSetDifficulty() (difficulty float64, err error) {
 
 	difficulty = 0
 
@@ -405,12 +419,12 @@ func (r *stratumRequest) getSetDifficulty() (difficulty int, err error) {
 		switch t := r.Params[0].(type) {
 		case string:
 			if s, err := strconv.ParseFloat(r.Params[0].(string), 64); err == nil {
-				difficulty = int(s)
+				difficulty = s
 			}
 		case float32:
-			difficulty = int(r.Params[0].(float64))
+			difficulty = float64(r.Params[0].(float32))
 		case float64:
-			difficulty = int(r.Params[0].(float64))
+			difficulty = r.Params[0].(float64)
 		default:
 			err = fmt.Errorf(lumerinlib.FileLineFunc()+" Error bad type:%T\n", t)
 		}
@@ -557,8 +571,8 @@ func (r *stratumRequest) createRequestSetDifficultyMsg() (msg []byte, err error)
 		panic("")
 	}
 
-	p := make([]int, 1)
-	p[0] = int(f)
+	p := make([]float64, 1)
+	p[0] = f
 	sd := &stratumSetDifficultyRequest{
 		ID:      id,
 		Method:  method,
@@ -601,7 +615,7 @@ func (r *stratumRequest) createRequestMsg() (msg []byte, err error) {
 //
 // -->> {"id":0,"jsonrpc":"2.0","method":"mining.set_difficulty","params":[65535]}
 //------------------------------------------------------
-func (n *stratumNotice) getSetDifficulty() (difficulty int, err error) {
+func (n *stratumNotice) getSetDifficulty() (difficulty float64, err error) {
 
 	difficulty = 0
 
@@ -612,19 +626,19 @@ func (n *stratumNotice) getSetDifficulty() (difficulty int, err error) {
 		switch t := n.Params.(type) {
 		case string:
 			if s, err := strconv.ParseFloat(n.Params.(string), 64); err == nil {
-				difficulty = int(s)
+				difficulty = s
 			}
 		case int:
-			difficulty = n.Params.(int)
+			difficulty = float64(n.Params.(int))
 		case float32:
-			difficulty = int(n.Params.(float64))
+			difficulty = float64(n.Params.(float32))
 		case float64:
-			difficulty = int(n.Params.(float64))
+			difficulty = n.Params.(float64)
 			// This is what is used.
 		case interface{}:
 			v := n.Params
 			arr := v.([]interface{})
-			difficulty = int(arr[0].(float64))
+			difficulty = arr[0].(float64)
 		default:
 			err = fmt.Errorf(lumerinlib.FileLineFunc()+" Error bad type:%T\n", t)
 		}
@@ -715,7 +729,7 @@ func (n *stratumNotice) createNoticeSetDifficultyMsg() (msg []byte, err error) {
 	var nsd noticeMiningSetDifficulty
 	nsd.ID = n.ID
 	nsd.Method = n.Method
-	nsd.Params = make([]int, 0)
+	nsd.Params = make([]float64, 0)
 
 	var p interface{}
 	var ok bool = false
@@ -733,15 +747,15 @@ func (n *stratumNotice) createNoticeSetDifficultyMsg() (msg []byte, err error) {
 
 	switch p.(type) {
 	case float32:
-		nsd.Params = append(nsd.Params, int(p.(float32)))
+		nsd.Params = append(nsd.Params, float64(p.(float32)))
 	case float64:
-		nsd.Params = append(nsd.Params, int(p.(float64)))
+		nsd.Params = append(nsd.Params, p.(float64))
 	case int:
-		nsd.Params = append(nsd.Params, p.(int))
+		nsd.Params = append(nsd.Params, float64(p.(int)))
 	case int32:
-		nsd.Params = append(nsd.Params, int(p.(int32)))
+		nsd.Params = append(nsd.Params, float64(p.(int32)))
 	case int64:
-		nsd.Params = append(nsd.Params, int(p.(int64)))
+		nsd.Params = append(nsd.Params, float64(p.(int64)))
 	default:
 		panic(fmt.Sprintf(lumerinlib.FileLineFunc()+" type:%t not supported", n.Params))
 	}
@@ -782,6 +796,99 @@ func (n *stratumNotice) createNoticeSetExtranonceMsg() (msg []byte, err error) {
 	return msg, err
 }
 
+//------------------------------------------------------
+//
+// -->> {"id":null,"method":"client.reconnect","params":["pool.example.com",3333,10]}
+// Every param may be left out, an empty host or port keeps the current one
+//------------------------------------------------------
+func (n *stratumNotice) getReconnect() (host string, port string, wait time.Duration, err error) {
+
+	if n.Method != string(SERVER_RECONNECT) {
+		err = fmt.Errorf(lumerinlib.FileLineFunc()+" wrong method, expetecting client.reconnect, got: %s", n.Method)
+		return
+	}
+
+	var params []interface{}
+	switch p := n.Params.(type) {
+	case []interface{}:
+		params = p
+	case nil:
+	default:
+		err = fmt.Errorf(lumerinlib.FileLineFunc()+" Params wrong type:%T", n.Params)
+		return
+	}
+
+	if len(params) > 0 && params[0] != nil {
+		s, ok := params[0].(string)
+		if !ok {
+			err = fmt.Errorf(lumerinlib.FileLineFunc()+" Error bad host type:%T", params[0])
+			return
+		}
+		host = s
+	}
+
+	if len(params) > 1 && params[1] != nil {
+		switch p := params[1].(type) {
+		case string:
+			port = p
+		case float64:
+			port = strconv.Itoa(int(p))
+		default:
+			err = fmt.Errorf(lumerinlib.FileLineFunc()+" Error bad port type:%T", params[1])
+			return
+		}
+		if n, e := strconv.Atoi(port); port != "" && (e != nil || n <= 0 || n > 65535) {
+			err = fmt.Errorf(lumerinlib.FileLineFunc()+" Error bad port:%s", port)
+			return
+		}
+	}
+
+	if len(params) > 2 && params[2] != nil {
+		switch w := params[2].(type) {
+		case float64:
+			wait = time.Duration(w) * time.Second
+		case string:
+			s, e := strconv.Atoi(w)
+			if e != nil {
+				err = fmt.Errorf(lumerinlib.FileLineFunc()+" Error bad wait:%s", w)
+				return
+			}
+			wait = time.Duration(s) * time.Second
+		default:
+			err = fmt.Errorf(lumerinlib.FileLineFunc()+" Error bad wait type:%T", params[2])
+			return
+		}
+	}
+
+	return
+}
+
+//------------------------------------------------------
+//
+// -->> {"id":null,"method":"mining.set_version_mask","params":["1fffe000"]}
+//------------------------------------------------------
+func (n *stratumNotice) getSetVersionMask() (mask uint32, err error) {
+
+	if n.Method != string(SERVER_MINING_SET_VERSION_MASK) {
+		err = fmt.Errorf(lumerinlib.FileLineFunc()+" wrong method, expetecting mining.set_version_mask, got: %s", n.Method)
+		return
+	}
+
+	params, ok := n.Params.([]interface{})
+	if !ok || len(params) < 1 {
+		err = fmt.Errorf(lumerinlib.FileLineFunc()+" Params wrong type:%T", n.Params)
+		return
+	}
+
+	s, ok := params[0].(string)
+	if !ok {
+		err = fmt.Errorf(lumerinlib.FileLineFunc()+" Error bad type:%T", params[0])
+		return
+	}
+
+	return parseVersionMask(s)
+}
+
 //------------------------------------------------------
 //
 //------------------------------------------------------
@@ -789,8 +896,6 @@ func (n *stratumNotice) createNoticeSetVersionMaskMsg() (msg []byte, err error)
 
 	err = nil
 
-	panic(fmt.Sprintf(lumerinlib.FileLineFunc() + " not plemented"))
-
 	var nsv noticeMiningSetVersionMask
 	nsv.ID = n.ID
 	nsv.Method = n.Method
@@ -1025,6 +1130,35 @@ func (r *stratumResponse) createResponseMsg() (msg []byte, err error) {
 	return msg, err
 }
 
+//------------------------------------------------------
+// createSrcErrorResponseMsg
+//
+// {"id": 4, "result": false, "error": [22, "Duplicate share", null]}
+//
+//------------------------------------------------------
+func createSrcErrorResponseMsg(id int, code stratumErrors, message string) (msg []byte, err error) {
+
+	c, err := strconv.Atoi(string(code))
+	if err != nil {
+		return nil, fmt.Errorf(lumerinlib.FileLineFunc()+" bad error code:%s", code)
+	}
+
+	response := &stratumErrorResponse{
+		ID:     id,
+		Result: false,
+		Error:  []interface{}{c, message, nil},
+	}
+
+	msg, err = json.Marshal(response)
+	if err != nil {
+		fmt.Printf(lumerinlib.FileLineFunc()+"Error Marshaling Response Err:%s\n", err)
+		return nil, err
+	}
+
+	msg = []byte(string(msg) + "\n")
+	return msg, err
+}
+
 //------------------------------------------------------
 // createSrcSubscribeResponseMsg
 //
@@ -1044,12 +1178,7 @@ func (r *stratumResponse) createResponseMsg() (msg []byte, err error) {
 //  ExtraNonce2_size. - The number of bytes that the miner users for its ExtraNonce2 counter.
 //
 //------------------------------------------------------
-func (r *stratumResponse) createSrcSubscribeResponseMsg(id int) (msg []byte, err error) {
-
-	// Move this to JSON file
-
-	extranonce := "deadbeef"
-	extranonce2 := 2 // 0 will result in subscribe erroring out
+func (r *stratumResponse) createSrcSubscribeResponseMsg(id int, extranonce string, extranonce2 int) (msg []byte, err error) {
 
 	notify := make([]string, 2)
 	notify[0] = string(SERVER_MINING_NOTIFY)
@@ -1090,14 +1219,17 @@ func (r *stratumResponse) createSrcSubscribeResponseMsg(id int) (msg []byte, err
 // createSrcConfigureResponseMsg
 //
 //------------------------------------------------------
-func (r *stratumResponse) createSrcConfigureResponseMsg() (msg []byte, err error) {
+func (r *stratumResponse) createSrcConfigureResponseMsg(mask uint32) (msg []byte, err error) {
 
 	// Move this to JSON file
 
 	result := make(map[string]interface{})
 	result["minimum-difficulty"] = false
 	result["version-rolling"] = false
-	// result["version-rolling.mask"] = "0"
+	if mask != 0 {
+		result["version-rolling"] = true
+		result["version-rolling.mask"] = fmt.Sprintf("%08x", mask)
+	}
 
 	response := &stratumResponse{
 		ID:     r.ID,
@@ -1162,10 +1294,26 @@ func createSetExtranonceNoticeMsg(n1 string, n2size int) (msg []byte, e error) {
 
 }
 
+//
+// createReconnectNoticeMsg()
+// client.reconnect without params, back to the same host and port
+//
+func createReconnectNoticeMsg() (msg []byte, e error) {
+
+	notice := &stratumNotice{
+		ID:     nil,
+		Method: string(SERVER_RECONNECT),
+		Params: []interface{}{},
+	}
+
+	return notice.createNoticeMsg()
+
+}
+
 //
 // sendDifficultyNoticeMsg()
 //
-func createSetDifficultyNoticeMsg(diff int) (msg []byte, e error) {
+func createSetDifficultyNoticeMsg(diff float64) (msg []byte, e error) {
 
 	params := make([]interface{}, 1)
 	params[0] = diff
@@ -1180,6 +1328,44 @@ func createSetDifficultyNoticeMsg(diff int) (msg []byte, e error) {
 
 }
 
+//
+// createSetVersionMaskNoticeMsg()
+//
+func createSetVersionMaskNoticeMsg(mask uint32) (msg []byte, e error) {
+
+	params := make([]interface{}, 1)
+	params[0] = fmt.Sprintf("%08x", mask)
+
+	notice := &stratumNotice{
+		ID:     nil,
+		Method: string(SERVER_MINING_SET_VERSION_MASK),
+		Params: params,
+	}
+
+	return notice.createNoticeSetVersionMaskMsg()
+
+}
+
+//
+// createDstConfigureRequestMsg()
+// The proxy's own mining.configure toward a pool, asking only for version
+// rolling on the bits the miner was granted
+//
+func createDstConfigureRequestMsg(mask uint32, minBitCount int) (msg []byte, e error) {
+
+	options := make(map[string]interface{})
+	options["version-rolling.mask"] = fmt.Sprintf("%08x", mask)
+	options["version-rolling.min-bit-count"] = minBitCount
+
+	request := &stratumRequest{
+		ID:     versionRollingConfigureID,
+		Method: string(CLIENT_MINING_CONFIGURE),
+		Params: []interface{}{[]interface{}{"version-rolling"}, options},
+	}
+
+	return request.createRequestMsg()
+}
+
 //
 //
 //
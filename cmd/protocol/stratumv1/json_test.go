@@ -3,6 +3,7 @@ package stratumv1
 import (
 	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -134,6 +135,32 @@ func TestUnmarshalSetDifficulty(t *testing.T) {
 	}
 }
 
+//
+// A fractional pool difficulty is kept as is
+//
+func TestUnmarshalSetDifficultyFractional(t *testing.T) {
+
+	ret, err := unmarshalMsg([]byte(`{"id":null,"method":"mining.set_difficulty","params":[1.5]}`))
+	if err != nil {
+		t.Fatalf("unmarshalMsg failed: %s", err)
+	}
+	notice, ok := ret.(*stratumNotice)
+	if !ok {
+		t.Fatalf("unmarshalMsg wrong type returned: %T", ret)
+	}
+	if diff, err := notice.getSetDifficulty(); err != nil || diff != 1.5 {
+		t.Errorf("getSetDifficulty() got:%g error:%v", diff, err)
+	}
+
+	msg, err := createSetDifficultyNoticeMsg(0.5)
+	if err != nil {
+		t.Fatalf("createSetDifficultyNoticeMsg() error:%s", err)
+	}
+	if !strings.Contains(string(msg), `"params":[0.5]`) {
+		t.Errorf("createSetDifficultyNoticeMsg() got:%s", msg)
+	}
+}
+
 //
 //
 //
@@ -0,0 +1,228 @@
+package stratumv1
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	"github.com/daniel-888/proxy-router/lumerinlib"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+	"github.com/daniel-888/proxy-router/lumerinlib/testinglib"
+)
+
+//
+// Two listeners on one context each send their miners to their own
+// default Dest, and record it on the miner
+//
+func TestNewListenerDefaultDests(t *testing.T) {
+
+	poolA, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolA.Close()
+	poolB, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolB.Close()
+
+	nodeaddrA := net.JoinHostPort(localhost, strconv.Itoa(testinglib.GetRandPort()))
+	nodeaddrB := net.JoinHostPort(localhost, strconv.Itoa(testinglib.GetRandPort()))
+
+	destA := createDest("LocalPoolADestID", fmt.Sprintf("stratum+tcp://poolworker:password@%s/", poolA.Addr()))
+	destB := createDest("LocalPoolBDestID", fmt.Sprintf("stratum+tcp://poolworker:password@%s/", poolB.Addr()))
+	ctx := newContextStruct(t, nodeaddrA, destA)
+
+	ps := contextlib.GetContextStruct(ctx).GetMsgBus()
+	if _, e = ps.DestPubWait(*destB); e != nil {
+		t.Fatalf("DestPubWait() error:%s", e)
+	}
+
+	for _, l := range []struct {
+		addr string
+		dest *msgbus.Dest
+	}{{nodeaddrA, destA}, {nodeaddrB, destB}} {
+		sls, e := NewListener(ctx, lumerinlib.NewNetAddr(lumerinlib.TCP, l.addr), l.dest)
+		if e != nil {
+			t.Fatalf("NewListener() error:%s", e)
+		}
+		defer sls.Cancel()
+		sls.Run()
+	}
+
+	// The listeners left the Dest of the shared context alone
+	if contextlib.GetContextStruct(ctx).GetDest().ID != destA.ID {
+		t.Fatalf("context Dest changed to:%s", contextlib.GetContextStruct(ctx).GetDest().ID)
+	}
+
+	sharesA := make(chan string, 4)
+	sharesB := make(chan string, 4)
+	go fakeV1JobPool(poolA, "1", sharesA, nil, nil)
+	go fakeV1JobPool(poolB, "2", sharesB, nil, nil)
+
+	mine := func(nodeaddr string, job string) {
+		var conn net.Conn
+		for i := 0; i < 50; i++ {
+			if conn, e = net.Dial("tcp", nodeaddr); e == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if e != nil {
+			t.Fatalf("Dial() error:%s", e)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		miner := bufio.NewReader(conn)
+
+		send := func(msg string) {
+			if _, e := conn.Write([]byte(msg + "\n")); e != nil {
+				t.Fatalf("Write() error:%s", e)
+			}
+		}
+		recv := func() (m map[string]interface{}) {
+			line, e := miner.ReadBytes('\n')
+			if e != nil {
+				t.Fatalf("ReadBytes() error:%s", e)
+			}
+			if e = json.Unmarshal(line, &m); e != nil {
+				t.Fatalf("Unmarshal(%s) error:%s", line, e)
+			}
+			return m
+		}
+
+		send(`{"id":1,"method":"mining.subscribe","params":["test/1.0"]}`)
+		recv()
+		send(`{"id":2,"method":"mining.authorize","params":["minerworker",""]}`)
+		if auth := recv(); auth["result"] != true {
+			t.Fatalf("bad authorize response:%v", auth)
+		}
+		for {
+			m := recv()
+			if params, _ := m["params"].([]interface{}); m["method"] == string(SERVER_MINING_NOTIFY) && params[0] == job {
+				break
+			}
+		}
+
+		send(fmt.Sprintf(`{"id":3,"method":"mining.submit","params":["minerworker","%s","0a0b0c","6553f101","0000002a"]}`, job))
+		for {
+			if m := recv(); m["id"] == float64(3) {
+				if m["result"] != true {
+					t.Fatalf("share for job %s refused:%v", job, m)
+				}
+				return
+			}
+		}
+	}
+
+	mine(nodeaddrA, "1")
+	mine(nodeaddrB, "2")
+
+	if job := <-sharesA; job != "1" {
+		t.Errorf("first pool got a share for job:%s", job)
+	}
+	if job := <-sharesB; job != "2" {
+		t.Errorf("second pool got a share for job:%s", job)
+	}
+
+	miners, e := ps.MinerGetAllWait()
+	if e != nil || len(miners) != 2 {
+		t.Fatalf("MinerGetAllWait() got:%v error:%v", miners, e)
+	}
+	defaults := make(map[msgbus.DestID]int)
+	for _, id := range miners {
+		m, e := ps.MinerGetWait(id)
+		if e != nil {
+			t.Fatalf("MinerGetWait() error:%s", e)
+		}
+		if m.Dest != m.DefaultDest {
+			t.Errorf("miner %s Dest:%s DefaultDest:%s", m.ID, m.Dest, m.DefaultDest)
+		}
+		defaults[m.DefaultDest]++
+	}
+	if defaults[destA.ID] != 1 || defaults[destB.ID] != 1 {
+		t.Errorf("miner default Dests:%v", defaults)
+	}
+}
+
+//
+// Behind a load balancer the miner record carries the address of the PROXY
+// protocol header
+//
+func TestNewListenerProxyProtocol(t *testing.T) {
+
+	pool, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer pool.Close()
+
+	nodeaddr := net.JoinHostPort(localhost, strconv.Itoa(testinglib.GetRandPort()))
+	dest := createDest("LocalPoolDestID", fmt.Sprintf("stratum+tcp://poolworker:password@%s/", pool.Addr()))
+	ctx := newContextStruct(t, nodeaddr, dest)
+
+	sls, e := NewListener(ctx, lumerinlib.NewProxyListenAddr(lumerinlib.NewNetAddr(lumerinlib.TCP, nodeaddr)), dest)
+	if e != nil {
+		t.Fatalf("NewListener() error:%s", e)
+	}
+	defer sls.Cancel()
+	sls.Run()
+
+	go fakeV1JobPool(pool, "1", make(chan string, 1), nil, nil)
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, e = net.Dial("tcp", nodeaddr); e == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if e != nil {
+		t.Fatalf("Dial() error:%s", e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, e = conn.Write([]byte("PROXY TCP6 2001:db8::7 2001:db8::1 4001 3333\r\n" + `{"id":1,"method":"mining.subscribe","params":["test/1.0"]}` + "\n")); e != nil {
+		t.Fatalf("Write() error:%s", e)
+	}
+	miner := bufio.NewReader(conn)
+	recv := func() (m map[string]interface{}) {
+		line, e := miner.ReadBytes('\n')
+		if e != nil {
+			t.Fatalf("ReadBytes() error:%s", e)
+		}
+		if e = json.Unmarshal(line, &m); e != nil {
+			t.Fatalf("Unmarshal(%s) error:%s", line, e)
+		}
+		return m
+	}
+	recv()
+
+	// The miner record is published once the miner is authorized
+	if _, e = conn.Write([]byte(`{"id":2,"method":"mining.authorize","params":["minerworker",""]}` + "\n")); e != nil {
+		t.Fatalf("Write() error:%s", e)
+	}
+	if auth := recv(); auth["result"] != true {
+		t.Fatalf("bad authorize response:%v", auth)
+	}
+
+	ps := contextlib.GetContextStruct(ctx).GetMsgBus()
+	miners, e := ps.MinerGetAllWait()
+	if e != nil || len(miners) != 1 {
+		t.Fatalf("MinerGetAllWait() got:%v error:%v", miners, e)
+	}
+	rec, e := ps.MinerGetWait(miners[0])
+	if e != nil {
+		t.Fatalf("MinerGetWait() error:%s", e)
+	}
+	if rec.IP != "2001:db8::7" || rec.Port != 4001 {
+		t.Errorf("miner address got:%s port:%d", rec.IP, rec.Port)
+	}
+}
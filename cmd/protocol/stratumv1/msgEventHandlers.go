@@ -53,6 +53,9 @@ func (svs *StratumV1Struct) handleMsgBusEvent(event *simple.SimpleMsgBusEvent) {
 	case simple.MsgRemovedEvent:
 		svs.handleMsgRemovedEvent(event)
 		return
+	case simple.MsgStreamEvent:
+		svs.handleMsgStreamEvent(event)
+		return
 
 	default:
 		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
@@ -283,9 +286,6 @@ func (svs *StratumV1Struct) handleMsgPublishEvent(event *simple.SimpleMsgBusEven
 			contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" event message:%s:%s, subscribe", event.EventType, event.ID)
 		}
 
-	case simple.ValidateMsg:
-		contextlib.Logf(svs.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" event message:%s:%s, subscribe", event.EventType, event.ID)
-
 	default:
 		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
 	}
@@ -364,3 +364,21 @@ func (svs *StratumV1Struct) handleMsgRemovedEvent(event *simple.SimpleMsgBusEven
 	}
 
 }
+
+//
+// handleMsgStreamEvent()
+// Stream events are not stored on the bus, there is no request to match up
+//
+func (svs *StratumV1Struct) handleMsgStreamEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(svs.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	switch event.Msg {
+	case simple.ValidateMsg:
+		contextlib.Logf(svs.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" event message:%s:%s", event.EventType, event.ID)
+
+	default:
+		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+
+}
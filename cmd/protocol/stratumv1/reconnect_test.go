@@ -0,0 +1,220 @@
+package stratumv1
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+	"github.com/daniel-888/proxy-router/lumerinlib/testinglib"
+)
+
+func TestGetReconnect(t *testing.T) {
+
+	tests := []struct {
+		params interface{}
+		host   string
+		port   string
+		wait   time.Duration
+		ok     bool
+	}{
+		{[]interface{}{"pool.example.com", float64(3333), float64(10)}, "pool.example.com", "3333", 10 * time.Second, true},
+		{[]interface{}{"pool.example.com", "3334"}, "pool.example.com", "3334", 0, true},
+		{[]interface{}{}, "", "", 0, true},
+		{nil, "", "", 0, true},
+		{[]interface{}{"pool.example.com", float64(70000)}, "", "", 0, false},
+		{[]interface{}{float64(1)}, "", "", 0, false},
+	}
+	for _, test := range tests {
+		n := &stratumNotice{Method: string(SERVER_RECONNECT), Params: test.params}
+		host, port, wait, e := n.getReconnect()
+		if (e == nil) != test.ok {
+			t.Errorf("getReconnect(%v) error:%v", test.params, e)
+			continue
+		}
+		if test.ok && (host != test.host || port != test.port || wait != test.wait) {
+			t.Errorf("getReconnect(%v) got:%s %s %s", test.params, host, port, wait)
+		}
+	}
+}
+
+//
+// The pool's client.reconnect moves the Dst to a second pool, the miner
+// stays connected and gets the new pool's extranonce and jobs
+//
+func TestNewSrc2PoolReconnect(t *testing.T) {
+
+	localport := testinglib.GetRandPort()
+	nodeaddr := net.JoinHostPort(localhost, strconv.Itoa(localport))
+
+	poolA, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolA.Close()
+	poolB, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolB.Close()
+	_, portB, _ := net.SplitHostPort(poolB.Addr().String())
+
+	defdest := createDest("LocalPriPoolDestID", fmt.Sprintf("stratum+tcp://poolworker:password@%s/", poolA.Addr()))
+	ctx := newContextStruct(t, nodeaddr, defdest)
+
+	sls := newStratumConnection(t, ctx)
+	defer sls.Cancel()
+
+	poolErr := make(chan error, 2)
+	go fakeV1ReconnectPool(poolA, "ee01", "1", []interface{}{localhost, portB, 0}, poolErr)
+	go fakeV1ReconnectPool(poolB, "ee02", "2", nil, poolErr)
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, e = net.Dial("tcp", nodeaddr); e == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if e != nil {
+		t.Fatalf("Dial() error:%s", e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(20 * time.Second))
+	miner := bufio.NewReader(conn)
+
+	send := func(msg string) {
+		if _, e := conn.Write([]byte(msg + "\n")); e != nil {
+			t.Fatalf("Write() error:%s", e)
+		}
+	}
+	recv := func() (m map[string]interface{}) {
+		line, e := miner.ReadBytes('\n')
+		if e != nil {
+			t.Fatalf("ReadBytes() error:%s", e)
+		}
+		if e = json.Unmarshal(line, &m); e != nil {
+			t.Fatalf("Unmarshal(%s) error:%s", line, e)
+		}
+		return m
+	}
+
+	send(`{"id":1,"method":"mining.subscribe","params":["test/1.0"]}`)
+	recv()
+	send(`{"id":3,"method":"mining.extranonce.subscribe","params":[]}`)
+	recv()
+	send(`{"id":2,"method":"mining.authorize","params":["minerworker",""]}`)
+	if auth := recv(); auth["result"] != true {
+		t.Fatalf("bad authorize response:%v", auth)
+	}
+
+	extranonce := ""
+	for {
+		m := recv()
+		params, _ := m["params"].([]interface{})
+		switch m["method"] {
+		case string(SERVER_RECONNECT):
+			t.Fatalf("client.reconnect passed to the miner:%v", m)
+		case string(SERVER_MINING_SET_EXTRANONCE):
+			extranonce, _ = params[0].(string)
+		case string(SERVER_MINING_NOTIFY):
+			if params[0] != "2" {
+				continue
+			}
+			if extranonce != "ee02" {
+				t.Fatalf("job of the new pool with extranonce:%s", extranonce)
+			}
+			ps := contextlib.GetContextStruct(ctx).GetMsgBus()
+			dest, e := ps.Dests().Get(defdest.ID)
+			if e != nil || !strings.Contains(string(dest.NetUrl), net.JoinHostPort(localhost, portB)) || dest.Username() != "poolworker" {
+				t.Fatalf("Dest not updated:%v error:%v", dest, e)
+			}
+			for i := 0; i < 2; i++ {
+				if e = <-poolErr; e != nil {
+					t.Fatalf("pool error:%s", e)
+				}
+			}
+			return
+		}
+	}
+}
+
+//
+// fakeV1ReconnectPool()
+// Serves one proxy connection a job, then sends it reconnect when given.
+// The outcome goes to served, the connection stays up until the proxy
+// hangs up.
+//
+func fakeV1ReconnectPool(l net.Listener, extranonce string, job string, reconnect []interface{}, served chan<- error) {
+
+	conn, e := l.Accept()
+	if e != nil {
+		served <- e
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(20 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	write := func(m interface{}) error {
+		msg, e := json.Marshal(m)
+		if e != nil {
+			return e
+		}
+		_, e = conn.Write(append(msg, '\n'))
+		return e
+	}
+
+	serve := func() (e error) {
+		for authorized := false; !authorized; {
+			line, e := reader.ReadBytes('\n')
+			if e != nil {
+				return e
+			}
+			var request stratumRequest
+			if e = json.Unmarshal(line, &request); e != nil {
+				return e
+			}
+
+			switch request.Method {
+			case string(CLIENT_MINING_SUBSCRIBE):
+				e = write(&stratumResponse{ID: request.ID, Result: []interface{}{[]interface{}{}, extranonce, 4}})
+			case string(CLIENT_MINING_AUTHORIZE):
+				if request.Params[0] != "poolworker" {
+					return fmt.Errorf("pool got authorize:%s", line)
+				}
+				e = write(&stratumResponse{ID: request.ID, Result: true})
+				authorized = true
+			default:
+				return fmt.Errorf("pool got:%s", line)
+			}
+			if e != nil {
+				return e
+			}
+		}
+
+		if e = write(&stratumNotice{Method: string(SERVER_MINING_SET_DIFFICULTY), Params: []interface{}{1024}}); e != nil {
+			return e
+		}
+		if e = write(&stratumNotice{Method: string(SERVER_MINING_NOTIFY), Params: []interface{}{job, "0000000000000000000000000000000000000000000000000000000000000000", "01", "02", []interface{}{}, "20000000", "1d00ffff", "6553f100", true}}); e != nil {
+			return e
+		}
+		if reconnect != nil {
+			e = write(&stratumNotice{Method: string(SERVER_RECONNECT), Params: reconnect})
+		}
+		return e
+	}
+
+	served <- serve()
+
+	for {
+		if _, e = reader.ReadBytes('\n'); e != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package stratumv1
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	"github.com/daniel-888/proxy-router/lumerinlib"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+//
+// Share checks
+//
+// A mining.submit is checked before it goes anywhere: its params have to be
+// well formed hex of the right lengths, its ntime within what its job allows
+// and the share new. The proxy answers the others itself with the stratum
+// error code and counts them on the miner record as local rejects. The last
+// shareCacheSize shares are remembered to spot the duplicates.
+//
+
+const (
+	maxNtimeRoll   = 7200 // Seconds a share's ntime may run ahead of its job's
+	shareCacheSize = 4096 // Shares remembered for duplicate detection
+)
+
+//
+// params: worker, job ID, extranonce2, ntime, nonce[, version bits]
+//
+type submitParams struct {
+	worker      string
+	jobID       string
+	extranonce2 string
+	ntime       uint32
+	nonce       string
+	versionBits string
+}
+
+//
+// parseSubmit()
+// Checks the params of a mining.submit, the hex ones come back lower case
+//
+func parseSubmit(request *stratumRequest) (p submitParams, e error) {
+
+	if len(request.Params) < 5 || len(request.Params) > 6 {
+		return p, fmt.Errorf("%d params", len(request.Params))
+	}
+
+	var str [6]string
+	for i, param := range request.Params {
+		s, ok := param.(string)
+		if !ok {
+			return p, fmt.Errorf("param %d not a string", i)
+		}
+		str[i] = strings.ToLower(s)
+	}
+
+	p.worker = request.Params[0].(string)
+	p.jobID = request.Params[1].(string)
+	if p.jobID == "" {
+		return p, fmt.Errorf("empty job ID")
+	}
+
+	if _, e = hex.DecodeString(str[2]); e != nil || str[2] == "" {
+		return p, fmt.Errorf("bad extranonce2:%q", str[2])
+	}
+	p.extranonce2 = str[2]
+
+	if len(str[3]) != 8 {
+		return p, fmt.Errorf("bad ntime:%q", str[3])
+	}
+	if p.ntime, e = parseHex32(str[3]); e != nil {
+		return p, fmt.Errorf("bad ntime:%q", str[3])
+	}
+
+	if _, e = parseHex32(str[4]); e != nil || len(str[4]) != 8 {
+		return p, fmt.Errorf("bad nonce:%q", str[4])
+	}
+	p.nonce = str[4]
+
+	if len(request.Params) == 6 {
+		if _, e = parseHex32(str[5]); e != nil || len(str[5]) != 8 {
+			return p, fmt.Errorf("bad version bits:%q", str[5])
+		}
+		p.versionBits = str[5]
+	}
+
+	return p, nil
+}
+
+//
+// Bounded set of the shares seen, the oldest make room for the new ones
+//
+type shareCache struct {
+	seen  map[string]struct{}
+	order []string
+	next  int
+}
+
+func newShareCache(size int) *shareCache {
+	return &shareCache{
+		seen:  make(map[string]struct{}, size),
+		order: make([]string, size),
+	}
+}
+
+//
+// add()
+// Remembers the share, returns true if it was already there
+//
+func (c *shareCache) add(key string) (dup bool) {
+
+	if _, dup = c.seen[key]; dup {
+		return true
+	}
+
+	if old := c.order[c.next]; old != "" {
+		delete(c.seen, old)
+	}
+	c.order[c.next] = key
+	c.next = (c.next + 1) % len(c.order)
+	c.seen[key] = struct{}{}
+
+	return false
+}
+
+//
+// shareKey()
+// What makes a share unique on the Dst of its job
+//
+func (p *submitParams) shareKey(uid simple.ConnUniqueID) string {
+	return fmt.Sprintf("%d:%s:%s:%08x:%s:%s", uid, p.jobID, p.extranonce2, p.ntime, p.nonce, p.versionBits)
+}
+
+//
+// minerExtranonce2Size()
+// The extranonce2_size the miner works with on the Dst, 0 when unknown
+//
+func (svs *StratumV1Struct) minerExtranonce2Size(uid simple.ConnUniqueID) int {
+	if svs.extranonceRewrite(uid) {
+		return srcExtranonce2Size
+	}
+	return svs.dstExtranonce2size[uid]
+}
+
+//
+// checkSubmit()
+// Checks a well formed share against its job, ok false with the result,
+// code and reason to refuse it with
+//
+func (svs *StratumV1Struct) checkSubmit(job *minerJob, p *submitParams) (result msgbus.ShareResult, code stratumErrors, reason string, ok bool) {
+
+	if size := svs.minerExtranonce2Size(job.uid); size > 0 && len(p.extranonce2) != 2*size {
+		return msgbus.ShareMalformed, SErrOther, fmt.Sprintf("Malformed share, extranonce2 is not %d bytes", size), false
+	}
+
+	if job.ntime != 0 && (p.ntime < job.ntime || p.ntime > job.ntime+maxNtimeRoll) {
+		return msgbus.ShareMalformed, SErrOther, "Malformed share, ntime out of range", false
+	}
+
+	if svs.shares.add(p.shareKey(job.uid)) {
+		return msgbus.ShareDuplicate, SErrDuplicateShare, "Duplicate share", false
+	}
+
+	return msgbus.ShareAccepted, SErrNull, "", true
+}
+
+//
+// rejectShare()
+// Answers a share the proxy refuses itself, and counts it
+//
+func (svs *StratumV1Struct) rejectShare(id int, result msgbus.ShareResult, code stratumErrors, reason string) (e error) {
+
+	contextlib.Logf(svs.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+" share ID:%d %s:%s", id, result, reason)
+
+	cs := contextlib.GetContextStruct(svs.Ctx())
+	ps := cs.GetMsgBus()
+	if _, e := ps.MinerAddLocalRejectWait(svs.minerRec.ID, result); e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" MinerAddLocalRejectWait() error:%s", e)
+	}
+
+	msg, e := createSrcErrorResponseMsg(id, code, reason)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createSrcErrorResponseMsg() error:%s", e)
+		return e
+	}
+
+	LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_STOR2SRC, msg)
+
+	count, e := svs.protocol.WriteSrc(msg)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteSrc error:%s", e)
+		return e
+	}
+	if count != len(msg) {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteSrc bad count:%d, %d", count, len(msg))
+		return fmt.Errorf(lumerinlib.FileLineFunc()+" WriteSrc bad count:%d, %d", count, len(msg))
+	}
+
+	return nil
+}
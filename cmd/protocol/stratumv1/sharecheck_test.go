@@ -0,0 +1,205 @@
+package stratumv1
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+	"github.com/daniel-888/proxy-router/lumerinlib/testinglib"
+)
+
+func TestParseSubmit(t *testing.T) {
+
+	tests := []struct {
+		params []interface{}
+		ok     bool
+	}{
+		{[]interface{}{"w", "1", "0A0b0c", "6553f101", "0000002a"}, true},
+		{[]interface{}{"w", "1", "0a0b0c", "6553f101", "0000002a", "00002000"}, true},
+		{[]interface{}{"w", "1", "0a0b0c", "6553f101"}, false},
+		{[]interface{}{"w", "1", "0a0b0c", "6553f101", "0000002a", "00002000", "x"}, false},
+		{[]interface{}{"w", 1, "0a0b0c", "6553f101", "0000002a"}, false},
+		{[]interface{}{"w", "", "0a0b0c", "6553f101", "0000002a"}, false},
+		{[]interface{}{"w", "1", "0a0b0", "6553f101", "0000002a"}, false},
+		{[]interface{}{"w", "1", "", "6553f101", "0000002a"}, false},
+		{[]interface{}{"w", "1", "0a0b0c", "6553f1", "0000002a"}, false},
+		{[]interface{}{"w", "1", "0a0b0c", "6553f101", "zz00002a"}, false},
+		{[]interface{}{"w", "1", "0a0b0c", "6553f101", "0000002a", "2000"}, false},
+	}
+	for _, test := range tests {
+		p, e := parseSubmit(&stratumRequest{Method: string(CLIENT_MINING_SUBMIT), Params: test.params})
+		if (e == nil) != test.ok {
+			t.Errorf("parseSubmit(%v) error:%v", test.params, e)
+		}
+		if e == nil && (p.extranonce2 != "0a0b0c" || p.ntime != 0x6553f101 || p.nonce != "0000002a") {
+			t.Errorf("parseSubmit(%v) got:%+v", test.params, p)
+		}
+	}
+}
+
+func TestShareCache(t *testing.T) {
+
+	c := newShareCache(2)
+	if c.add("a") || c.add("b") || !c.add("a") {
+		t.Fatalf("add() missed a duplicate")
+	}
+	// "a" makes room for "c"
+	if c.add("c") || c.add("a") {
+		t.Fatalf("add() kept more than its size")
+	}
+	if len(c.seen) != 2 {
+		t.Fatalf("cache holds %d shares", len(c.seen))
+	}
+}
+
+func TestCreateSrcErrorResponseMsg(t *testing.T) {
+
+	msg, e := createSrcErrorResponseMsg(4, SErrDuplicateShare, "Duplicate share")
+	if e != nil || string(msg) != `{"id":4,"result":false,"error":[22,"Duplicate share",null]}`+"\n" {
+		t.Fatalf("createSrcErrorResponseMsg() got:%s error:%v", msg, e)
+	}
+
+	// The pool side reads it back as the same share result
+	response, e := unmarshalMsg(msg)
+	if e != nil {
+		t.Fatalf("unmarshalMsg() error:%s", e)
+	}
+	if r, ok := response.(*stratumResponse); !ok || r.getShareResult() != msgbus.ShareDuplicate {
+		t.Fatalf("unmarshalMsg() got:%v", response)
+	}
+}
+
+//
+// Malformed and duplicate shares are answered by the proxy with their
+// stratum error codes, counted as local rejects and kept from the pool
+//
+func TestNewSrc2PoolShareCheck(t *testing.T) {
+
+	localport := testinglib.GetRandPort()
+	nodeaddr := net.JoinHostPort(localhost, strconv.Itoa(localport))
+
+	poolListener, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolListener.Close()
+
+	defdest := createDest("LocalPriPoolDestID", fmt.Sprintf("stratum+tcp://poolworker:password@%s/", poolListener.Addr()))
+	ctx := newContextStruct(t, nodeaddr, defdest)
+
+	sls := newStratumConnection(t, ctx)
+	defer sls.Cancel()
+
+	shares := make(chan string, 8)
+	go fakeV1JobPool(poolListener, "1", shares, nil, nil)
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, e = net.Dial("tcp", nodeaddr); e == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if e != nil {
+		t.Fatalf("Dial() error:%s", e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	miner := bufio.NewReader(conn)
+
+	send := func(msg string) {
+		if _, e := conn.Write([]byte(msg + "\n")); e != nil {
+			t.Fatalf("Write() error:%s", e)
+		}
+	}
+	// Skips notices up to the response for id
+	recvResponse := func(id int) (m map[string]interface{}) {
+		for {
+			line, e := miner.ReadBytes('\n')
+			if e != nil {
+				t.Fatalf("ReadBytes() error:%s", e)
+			}
+			m = nil
+			if e = json.Unmarshal(line, &m); e != nil {
+				t.Fatalf("Unmarshal(%s) error:%s", line, e)
+			}
+			if m["id"] == float64(id) {
+				return m
+			}
+		}
+	}
+
+	send(`{"id":1,"method":"mining.subscribe","params":["test/1.0"]}`)
+	recvResponse(1)
+	send(`{"id":2,"method":"mining.authorize","params":["minerworker",""]}`)
+	if auth := recvResponse(2); auth["result"] != true {
+		t.Fatalf("bad authorize response:%v", auth)
+	}
+
+	// Wait for the pool's job before submitting
+	for {
+		line, e := miner.ReadBytes('\n')
+		if e != nil {
+			t.Fatalf("ReadBytes() error:%s", e)
+		}
+		var m map[string]interface{}
+		json.Unmarshal(line, &m)
+		if m["method"] == string(SERVER_MINING_NOTIFY) {
+			break
+		}
+	}
+
+	tests := []struct {
+		params string
+		code   stratumErrors
+	}{
+		{`["minerworker","1","0a0b0c","6553f101","0000002a"]`, SErrNull},
+		{`["minerworker","1","0A0B0C","6553f101","0000002A"]`, SErrDuplicateShare},
+		{`["minerworker","1","0a0b0c","6553f101","0000002b"]`, SErrNull},
+		{`["minerworker","1","0a0b0c0d","6553f101","0000002c"]`, SErrOther},
+		{`["minerworker","1","0a0b0c","6553f0ff","0000002c"]`, SErrOther},
+		{`["minerworker","1","0a0b0c","6554f101","0000002c"]`, SErrOther},
+		{`["minerworker","1","0a0b0c","6553f101"]`, SErrOther},
+		{`["minerworker",1,"0a0b0c","6553f101","0000002c"]`, SErrOther},
+		{`["minerworker","2","0a0b0c","6553f101","0000002c"]`, SErrJobNotFound},
+	}
+	for i, test := range tests {
+		id := 10 + i
+		send(fmt.Sprintf(`{"id":%d,"method":"mining.submit","params":%s}`, id, test.params))
+		r := recvResponse(id)
+		if test.code == SErrNull {
+			if r["result"] != true {
+				t.Errorf("share %s refused:%v", test.params, r)
+			}
+			continue
+		}
+		code := strconv.Itoa(int(r["error"].([]interface{})[0].(float64)))
+		if r["result"] != false || stratumErrors(code) != test.code {
+			t.Errorf("share %s got:%v want code:%s", test.params, r, test.code)
+		}
+	}
+
+	if len(shares) != 2 {
+		t.Errorf("pool got %d shares", len(shares))
+	}
+
+	ps := contextlib.GetContextStruct(ctx).GetMsgBus()
+	miners, e := ps.MinerGetAllWait()
+	if e != nil || len(miners) != 1 {
+		t.Fatalf("MinerGetAllWait() got:%v error:%v", miners, e)
+	}
+	m, e := ps.MinerGetWait(miners[0])
+	if e != nil {
+		t.Fatalf("MinerGetWait() error:%s", e)
+	}
+	want := msgbus.ShareStats{Duplicate: 1, Malformed: 5, UnknownJob: 1}
+	if m.LocalRejects != want {
+		t.Errorf("LocalRejects got:%+v want:%+v", m.LocalRejects, want)
+	}
+}
@@ -0,0 +1,159 @@
+package stratumv1
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	"github.com/daniel-888/proxy-router/lumerinlib"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+//
+// Share tracking
+//
+// Every share sent to a Dest waits in a pending table under its request ID
+// and the Dest's UID until the pool answers. The answer is classified and
+// counted on the miner record under the Dest the share went to, an accepted
+// share adds the pool difficulty it was sent at to the accepted work. Shares
+// the proxy answers itself never reached a pool and are not counted.
+//
+
+// Pending shares older than this are taken as never answered
+const submitTimeout = 5 * time.Minute
+
+type submitKey struct {
+	uid simple.ConnUniqueID
+	id  int
+}
+
+type pendingSubmit struct {
+	dest msgbus.DestID
+	diff float64 // Pool difficulty the share was sent at
+	sent time.Time
+}
+
+//
+// trackSubmit()
+// Records a share sent to the Dest
+//
+func (svs *StratumV1Struct) trackSubmit(uid simple.ConnUniqueID, id int) {
+
+	now := time.Now()
+	for k, p := range svs.submits {
+		if now.Sub(p.sent) > submitTimeout {
+			contextlib.Logf(svs.Ctx(), contextlib.LevelWarn, lumerinlib.FileLineFunc()+" UID:%d share ID:%d never answered", k.uid, k.id)
+			delete(svs.submits, k)
+		}
+	}
+
+	if svs.dstDest[uid] == nil {
+		return
+	}
+
+	svs.submits[submitKey{uid: uid, id: id}] = &pendingSubmit{
+		dest: svs.dstDest[uid].ID,
+		diff: svs.dstLastSetDiff[uid],
+		sent: now,
+	}
+}
+
+//
+// dropSubmits()
+// Forgets the shares of a Dst connection that is gone
+//
+func (svs *StratumV1Struct) dropSubmits(uid simple.ConnUniqueID) {
+	for k := range svs.submits {
+		if k.uid == uid {
+			delete(svs.submits, k)
+		}
+	}
+}
+
+//
+// shareResult()
+// Counts the pool's answer to a pending share, returns false when the ID is
+// not a share sent to the Dest
+//
+func (svs *StratumV1Struct) shareResult(uid simple.ConnUniqueID, id int, result msgbus.ShareResult) bool {
+
+	key := submitKey{uid: uid, id: id}
+	p, ok := svs.submits[key]
+	if !ok {
+		return false
+	}
+	delete(svs.submits, key)
+
+	contextlib.Logf(svs.Ctx(), contextlib.LevelDebug, lumerinlib.FileLineFunc()+" UID:%d share ID:%d Dest:%s %s", uid, id, p.dest, result)
+
+	cs := contextlib.GetContextStruct(svs.Ctx())
+	ps := cs.GetMsgBus()
+	if _, e := ps.MinerAddShareWait(svs.minerRec.ID, p.dest, result, p.diff); e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" MinerAddShareWait() error:%s", e)
+	}
+
+	return true
+}
+
+//
+// getShareResult()
+// Classifies a pool's response to mining.submit
+//
+func (r *stratumResponse) getShareResult() msgbus.ShareResult {
+
+	if r.Error == nil && r.Result == true {
+		return msgbus.ShareAccepted
+	}
+
+	reason := ""
+	if r.Error != nil {
+		reason = *r.Error
+	}
+	if s, ok := r.Reject.(string); ok {
+		reason += " " + s
+	}
+
+	// unmarshalMsg() turns [code, message, data] into " Error: code, message"
+	var code float64
+	if _, e := fmt.Sscanf(reason, " Error: %f,", &code); e == nil {
+		switch int(code) {
+		case 21:
+			return msgbus.ShareUnknownJob
+		case 22:
+			return msgbus.ShareDuplicate
+		case 23:
+			return msgbus.ShareLowDifficulty
+		}
+	}
+
+	return getShareReasonResult(reason)
+}
+
+//
+// getShareReasonResult()
+// Classifies the reason a share was refused, SV1 messages and SV2 error codes
+//
+func getShareReasonResult(reason string) msgbus.ShareResult {
+
+	reason = strings.ToLower(reason)
+
+	switch {
+	case strings.Contains(reason, "stale"):
+		return msgbus.ShareStale
+	case strings.Contains(reason, "duplicate"):
+		return msgbus.ShareDuplicate
+	case strings.Contains(reason, "low diff"),
+		strings.Contains(reason, "difficulty-too-low"),
+		strings.Contains(reason, "above target"),
+		strings.Contains(reason, "high-hash"):
+		return msgbus.ShareLowDifficulty
+	case strings.Contains(reason, "job not found"),
+		strings.Contains(reason, "unknown job"),
+		strings.Contains(reason, "invalid-job-id"):
+		return msgbus.ShareUnknownJob
+	default:
+		return msgbus.ShareRejected
+	}
+}
@@ -0,0 +1,217 @@
+package stratumv1
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+	"github.com/daniel-888/proxy-router/lumerinlib/testinglib"
+)
+
+func TestShareResult(t *testing.T) {
+
+	reason := func(s string) *string { return &s }
+
+	tests := []struct {
+		response stratumResponse
+		result   msgbus.ShareResult
+	}{
+		{stratumResponse{Result: true}, msgbus.ShareAccepted},
+		{stratumResponse{Result: false, Error: reason(" Error: 21.000000, Job not found")}, msgbus.ShareUnknownJob},
+		{stratumResponse{Result: false, Error: reason(" Error: 22.000000, Duplicate share")}, msgbus.ShareDuplicate},
+		{stratumResponse{Result: false, Error: reason(" Error: 23.000000, Low difficulty share")}, msgbus.ShareLowDifficulty},
+		{stratumResponse{Result: false, Error: reason(" Error: 20.000000, Stale share")}, msgbus.ShareStale},
+		{stratumResponse{Result: false, Reject: "high-hash"}, msgbus.ShareLowDifficulty},
+		{stratumResponse{Result: false, Error: reason("Unauthorized worker")}, msgbus.ShareRejected},
+	}
+	for _, test := range tests {
+		if result := test.response.getShareResult(); result != test.result {
+			t.Errorf("getShareResult(%v) got:%s want:%s", test.response, result, test.result)
+		}
+	}
+
+	for reason, result := range map[string]msgbus.ShareResult{
+		"stale-share":        msgbus.ShareStale,
+		"difficulty-too-low": msgbus.ShareLowDifficulty,
+		"invalid-job-id":     msgbus.ShareUnknownJob,
+		"invalid-channel-id": msgbus.ShareRejected,
+	} {
+		if got := getShareReasonResult(reason); got != result {
+			t.Errorf("getShareReasonResult(%s) got:%s want:%s", reason, got, result)
+		}
+	}
+}
+
+//
+// Shares forwarded to the pool are counted on the miner record by the
+// pool's answer, accepted ones at the pool difficulty
+//
+func TestNewSrc2PoolShareTracking(t *testing.T) {
+
+	localport := testinglib.GetRandPort()
+	nodeaddr := net.JoinHostPort(localhost, strconv.Itoa(localport))
+
+	poolListener, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolListener.Close()
+
+	defdest := createDest("LocalPriPoolDestID", fmt.Sprintf("stratum+tcp://poolworker:password@%s/", poolListener.Addr()))
+	ctx := newContextStruct(t, nodeaddr, defdest)
+
+	sls := newStratumConnection(t, ctx)
+	defer sls.Cancel()
+
+	poolErr := make(chan error, 1)
+	go func() { poolErr <- fakeV1SharePool(poolListener) }()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, e = net.Dial("tcp", nodeaddr); e == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if e != nil {
+		t.Fatalf("Dial() error:%s", e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	miner := bufio.NewReader(conn)
+
+	send := func(msg string) {
+		if _, e := conn.Write([]byte(msg + "\n")); e != nil {
+			t.Fatalf("Write() error:%s", e)
+		}
+	}
+	// Skips notices up to the response for id
+	recvResponse := func(id int) (m map[string]interface{}) {
+		for {
+			line, e := miner.ReadBytes('\n')
+			if e != nil {
+				t.Fatalf("ReadBytes() error:%s", e)
+			}
+			m = nil
+			if e = json.Unmarshal(line, &m); e != nil {
+				t.Fatalf("Unmarshal(%s) error:%s", line, e)
+			}
+			if m["id"] == float64(id) {
+				return m
+			}
+		}
+	}
+
+	send(`{"id":1,"method":"mining.subscribe","params":["test/1.0"]}`)
+	recvResponse(1)
+	send(`{"id":2,"method":"mining.authorize","params":["minerworker",""]}`)
+	if auth := recvResponse(2); auth["result"] != true {
+		t.Fatalf("bad authorize response:%v", auth)
+	}
+
+	// Wait for the pool's job before submitting
+	for {
+		line, e := miner.ReadBytes('\n')
+		if e != nil {
+			t.Fatalf("ReadBytes() error:%s", e)
+		}
+		var m map[string]interface{}
+		json.Unmarshal(line, &m)
+		if m["method"] == string(SERVER_MINING_NOTIFY) {
+			break
+		}
+	}
+
+	for id := 10; id < 13; id++ {
+		send(fmt.Sprintf(`{"id":%d,"method":"mining.submit","params":["minerworker","1","0a0b0c","6553f101","%08x"]}`, id, id))
+		recvResponse(id)
+	}
+
+	ps := contextlib.GetContextStruct(ctx).GetMsgBus()
+	miners, e := ps.MinerGetAllWait()
+	if e != nil || len(miners) != 1 {
+		t.Fatalf("MinerGetAllWait() got:%v error:%v", miners, e)
+	}
+	m, e := ps.MinerGetWait(miners[0])
+	if e != nil {
+		t.Fatalf("MinerGetWait() error:%s", e)
+	}
+
+	want := msgbus.ShareStats{Accepted: 2, Duplicate: 1, AcceptedWork: 2048}
+	if stats := m.Shares[defdest.ID]; stats != want {
+		t.Errorf("Shares got:%+v want:%+v", stats, want)
+	}
+
+	if e = <-poolErr; e != nil {
+		t.Fatalf("pool error:%s", e)
+	}
+}
+
+//
+// fakeV1SharePool()
+// Accepts the shares with an even nonce, refuses the others as duplicates
+//
+func fakeV1SharePool(l net.Listener) (e error) {
+
+	conn, e := l.Accept()
+	if e != nil {
+		return e
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	write := func(m interface{}) error {
+		msg, e := json.Marshal(m)
+		if e != nil {
+			return e
+		}
+		_, e = conn.Write(append(msg, '\n'))
+		return e
+	}
+
+	for shares := 0; shares < 3; {
+		line, e := reader.ReadBytes('\n')
+		if e != nil {
+			return e
+		}
+		var request stratumRequest
+		if e = json.Unmarshal(line, &request); e != nil {
+			return e
+		}
+
+		switch request.Method {
+		case string(CLIENT_MINING_SUBSCRIBE):
+			e = write(&stratumResponse{ID: request.ID, Result: []interface{}{[]interface{}{}, "ee01", 4}})
+		case string(CLIENT_MINING_AUTHORIZE):
+			if e = write(&stratumResponse{ID: request.ID, Result: true}); e != nil {
+				return e
+			}
+			if e = write(&stratumNotice{Method: string(SERVER_MINING_SET_DIFFICULTY), Params: []interface{}{1024}}); e != nil {
+				return e
+			}
+			e = write(&stratumNotice{Method: string(SERVER_MINING_NOTIFY), Params: []interface{}{"1", "0000000000000000000000000000000000000000000000000000000000000000", "01", "02", []interface{}{}, "20000000", "1d00ffff", "6553f100", true}})
+		case string(CLIENT_MINING_SUBMIT):
+			shares++
+			nonce, _ := strconv.ParseUint(request.Params[4].(string), 16, 32)
+			if nonce%2 == 0 {
+				e = write(&stratumResponse{ID: request.ID, Result: true})
+			} else {
+				e = write(map[string]interface{}{"id": request.ID, "result": false, "error": []interface{}{22, "Duplicate share", nil}})
+			}
+		default:
+			return fmt.Errorf("pool got:%s", line)
+		}
+		if e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"net"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
 	"github.com/daniel-888/proxy-router/cmd/msgbus"
 	"github.com/daniel-888/proxy-router/cmd/protocol"
+	"github.com/daniel-888/proxy-router/cmd/protocol/minerauth"
 	"github.com/daniel-888/proxy-router/lumerinlib"
 	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
 )
@@ -19,6 +21,7 @@ var ErrBadSrcState = errors.New("StratumV1: Bad Src State")
 var ErrSrcReqNotSupported = errors.New("StratumV1: SRC Request Not Supported")
 var ErrDstReqNotSupported = errors.New("StratumV1: DST Request Not Supported")
 var ErrMaxRedialExceeded = errors.New("StratumV1: DST Maximum number of redials attempted")
+var ErrExtranonceUndeliverable = errors.New("StratumV1: miner cannot take the DST extranonce")
 
 type SrcState string
 type DstState string
@@ -54,9 +57,15 @@ const DstStateNotFound DstState = "stateNotFound"
 
 const MaxRedials int = 5
 
+// BIP320 general purpose version bits
+const versionRollingMask uint32 = 0x1fffe000
+
 type StratumV1ListenStruct struct {
 	protocollisten *protocol.ProtocolListenStruct
 	scheduler      StratumConnectionScheduler
+	mu             sync.Mutex              // Guards vardiff and auth, which may change while accepting
+	vardiff        *VardiffConfig          // nil passes the pool's difficulty to the miner
+	auth           minerauth.Authenticator // nil accepts every miner
 }
 
 type StratumV1Struct struct {
@@ -69,16 +78,27 @@ type StratumV1Struct struct {
 	srcAuthRequest      *stratumRequest // Copy of recieved Authorize Request from Source
 	srcConfigure        *stratumRequest // Copy of recieved Configure Request from Source
 	srcExtranonce       *stratumRequest // Copy of recieved Extranonce Request from Source
+	srcExtranonce1      string          // Proxy assigned extranonce1 the miner is subscribed with
+	srcSetExtranonce    bool            // Miner subscribed to mining.set_extranonce
+	srcVersionMask      uint32          // Version rolling mask granted to the miner, 0 for none
+	srcVersionMinBits   int             // version-rolling.min-bit-count the miner asked for
+	srcVersionMaskSent  uint32          // Version rolling mask the miner was last told
 	srcState            SrcState
 	dstState            map[simple.ConnUniqueID]DstState
 	dstDest             map[simple.ConnUniqueID]*msgbus.Dest
 	dstReDialCount      map[simple.ConnUniqueID]int
 	dstExtranonce       map[simple.ConnUniqueID]string
 	dstExtranonce2size  map[simple.ConnUniqueID]int
-	dstVersionMask      map[simple.ConnUniqueID]string
-	dstLastSetDiff      map[simple.ConnUniqueID]int
+	dstVersionMask      map[simple.ConnUniqueID]uint32 // Pool granted mask within srcVersionMask
+	dstLastSetDiff      map[simple.ConnUniqueID]float64
 	dstLastMiningNotice map[simple.ConnUniqueID]*stratumNotice
 	dstLastReqNotify    map[simple.ConnUniqueID]*stratumRequest
+	dstSV2              map[simple.ConnUniqueID]*sv2Dst // Dsts speaking Stratum V2
+	submits             map[submitKey]*pendingSubmit    // Shares waiting for the pool's answer
+	jobs                map[string]*minerJob            // Dst that issued each job the miner got
+	shares              *shareCache                     // Recent shares, for duplicate detection
+	vardiff             *vardiff                        // nil when the miner gets the pool's difficulty
+	auth                minerauth.Authenticator         // nil accepts every miner
 	switchToDestID      msgbus.DestID
 
 	// Add in stratum state information here
@@ -114,8 +134,11 @@ func NewListener(ctx context.Context, src net.Addr, dest *msgbus.Dest) (sls *Str
 		contextlib.Logf(ctx, contextlib.LevelPanic, lumerinlib.FileLineFunc()+" ContextStruct no MsgBus * defined")
 	}
 
-	cs.SetSrc(src)
-	cs.SetDest(dest)
+	// The listeners share the rest of the context, but not the Src and Dest
+	listencs := *cs
+	listencs.SetSrc(src)
+	listencs.SetDest(dest)
+	ctx = contextlib.SetContextStruct(ctx, &listencs)
 
 	protocollisten, e := protocol.NewListen(ctx)
 	if e != nil {
@@ -145,6 +168,44 @@ func (s *StratumV1ListenStruct) GetScheduler() (scheduler StratumConnectionSched
 	return scheduler
 }
 
+//
+// SetVardiff()
+// Turns on proxy managed difficulty for the miners accepted from now on,
+// nil turns it off
+//
+func (s *StratumV1ListenStruct) SetVardiff(config *VardiffConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vardiff = config
+}
+
+//
+// SetAuthenticator()
+// Checks the mining.authorize of the miners accepted from now on,
+// nil accepts every miner. Set it before Run() for it to cover the
+// first miners.
+//
+func (s *StratumV1ListenStruct) SetAuthenticator(auth minerauth.Authenticator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth = auth
+}
+
+//
+// newSession()
+// The session of an accepted miner, with the listener's current settings
+//
+func (s *StratumV1ListenStruct) newSession(ps *protocol.ProtocolStruct) (ss *StratumV1Struct) {
+	ss = NewStratumV1Struct(s.Ctx(), ps, s.scheduler)
+	if ss != nil {
+		s.mu.Lock()
+		ss.SetVardiff(s.vardiff)
+		ss.SetAuthenticator(s.auth)
+		s.mu.Unlock()
+	}
+	return ss
+}
+
 //
 //
 //
@@ -162,8 +223,7 @@ FORLOOP:
 			contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" context canceled")
 			break FORLOOP
 		case ps := <-protocolStructChan:
-			ss := NewStratumV1Struct(s.Ctx(), ps, s.scheduler)
-			if ss != nil {
+			if ss := s.newSession(ps); ss != nil {
 				ss.Run()
 			}
 		}
@@ -185,8 +245,7 @@ func (s *StratumV1ListenStruct) goListenAcceptOnce() {
 	case <-s.Ctx().Done():
 		contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" context canceled")
 	case ps := <-protocolStructChan:
-		ss := NewStratumV1Struct(s.Ctx(), ps, s.scheduler)
-		if ss != nil {
+		if ss := s.newSession(ps); ss != nil {
 			ss.Run()
 		}
 	}
@@ -252,11 +311,13 @@ func NewStratumV1Struct(ctx context.Context, ps *protocol.ProtocolStruct, schedu
 	rd := make(map[simple.ConnUniqueID]int)
 	de := make(map[simple.ConnUniqueID]string)
 	de2 := make(map[simple.ConnUniqueID]int)
-	lsd := make(map[simple.ConnUniqueID]int)
-	vm := make(map[simple.ConnUniqueID]string)
+	lsd := make(map[simple.ConnUniqueID]float64)
+	vm := make(map[simple.ConnUniqueID]uint32)
 	lmn := make(map[simple.ConnUniqueID]*stratumNotice)
 	lrn := make(map[simple.ConnUniqueID]*stratumRequest)
-	id := fmt.Sprintf("MinerID:%d", <-MinerCountChan)
+	sv2 := make(map[simple.ConnUniqueID]*sv2Dst)
+	count := <-MinerCountChan
+	id := fmt.Sprintf("MinerID:%d", count)
 	defdest := contextlib.GetContextStruct(ctx).GetDest()
 	if defdest == nil {
 		contextlib.Logf(ctx, contextlib.LevelPanic, lumerinlib.FileLineFunc()+" GetDest() return nil")
@@ -268,12 +329,15 @@ func NewStratumV1Struct(ctx context.Context, ps *protocol.ProtocolStruct, schedu
 		return nil
 	}
 
-	addrstr := strings.Split(addr.String(), ":")
-	ip := addrstr[0]
-	port, e := strconv.Atoi(addrstr[1])
+	// An IPv6 address, as a PROXY protocol header may carry, has colons of its own
+	ip, portstr, e := net.SplitHostPort(addr.String())
+	if e != nil {
+		ip = addr.String()
+	}
+	port, e := strconv.Atoi(portstr)
 	if e != nil {
 		port = 0
-		contextlib.Logf(ctx, contextlib.LevelError, lumerinlib.FileLineFunc()+" strconv.Atoi() for str:%s error:%s", addrstr, e)
+		contextlib.Logf(ctx, contextlib.LevelError, lumerinlib.FileLineFunc()+" strconv.Atoi() for str:%s error:%s", addr.String(), e)
 	}
 
 	miner := &msgbus.Miner{
@@ -285,6 +349,7 @@ func NewStratumV1Struct(ctx context.Context, ps *protocol.ProtocolStruct, schedu
 		State:                   msgbus.OnlineState,
 		Contracts:               make(map[msgbus.ContractID]float64),
 		Dest:                    defdest.ID,
+		DefaultDest:             defdest.ID,
 		InitialMeasuredHashRate: 0,
 		CurrentHashRate:         0,
 	}
@@ -299,6 +364,7 @@ func NewStratumV1Struct(ctx context.Context, ps *protocol.ProtocolStruct, schedu
 		srcAuthRequest:      nil,
 		srcConfigure:        nil,
 		srcExtranonce:       nil,
+		srcExtranonce1:      newSrcExtranonce1(count),
 		srcState:            SrcStateNew,
 		dstState:            ds,
 		dstDest:             dd,
@@ -309,6 +375,10 @@ func NewStratumV1Struct(ctx context.Context, ps *protocol.ProtocolStruct, schedu
 		dstVersionMask:      vm,
 		dstLastMiningNotice: lmn,
 		dstLastReqNotify:    lrn,
+		dstSV2:              sv2,
+		submits:             make(map[submitKey]*pendingSubmit),
+		jobs:                make(map[string]*minerJob),
+		shares:              newShareCache(shareCacheSize),
 		switchToDestID:      "",
 	}
 
@@ -323,6 +393,26 @@ func (svs *StratumV1Struct) GetScheduler() (scheduler StratumConnectionScheduler
 	return scheduler
 }
 
+//
+// SetVardiff()
+// nil passes the pool's difficulty to the miner
+//
+func (svs *StratumV1Struct) SetVardiff(config *VardiffConfig) {
+	if config == nil {
+		svs.vardiff = nil
+		return
+	}
+	svs.vardiff = newVardiff(*config, time.Now())
+}
+
+//
+// SetAuthenticator()
+// nil accepts every miner
+//
+func (svs *StratumV1Struct) SetAuthenticator(auth minerauth.Authenticator) {
+	svs.auth = auth
+}
+
 //
 // Run() inialize the stratum running struct
 //
@@ -394,6 +484,12 @@ func (s *StratumV1Struct) goEvent() {
 			contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+"[Closing] eventHandler() returned error:%s", e)
 			break
 		}
+
+		// The handler closed the session, nothing more goes to the miner
+		if s.ctx.Err() != nil {
+			contextlib.Logf(s.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+"[Closing] session closed")
+			break
+		}
 	}
 	s.Close()
 }
@@ -574,6 +670,31 @@ func (s *StratumV1Struct) GetSrcState() (state SrcState) {
 	return s.srcState
 }
 
+//
+// authenticate()
+// Runs the worker and password of a mining.authorize past the Authenticator
+//
+func (s *StratumV1Struct) authenticate(request *stratumRequest) (e error) {
+
+	if s.auth == nil {
+		return nil
+	}
+
+	r := &minerauth.Request{}
+	if len(request.Params) > 0 {
+		r.Worker, _ = request.Params[0].(string)
+	}
+	if len(request.Params) > 1 {
+		r.Password, _ = request.Params[1].(string)
+	}
+	addr, e := s.protocol.GetSrcRemoteAddr()
+	if e == nil {
+		r.IP = minerauth.RemoteIP(addr)
+	}
+
+	return s.auth.Authenticate(s.Ctx(), r)
+}
+
 //
 //
 //
@@ -668,7 +789,10 @@ func (s *StratumV1Struct) switchDest() {
 		// Goose the miner to the correct Extranonce settings.
 		// Then set the difficulty, the feed the last mining notice in
 		//
-		s.sendSetExtranonceNotice(newUID)
+		if e := s.sendSetExtranonceNotice(newUID); e == ErrExtranonceUndeliverable {
+			return
+		}
+		s.sendVersionMaskNotice(newUID)
 		s.sendLastSetDifficultyNotice(newUID)
 		s.sendLastMiningNotice(newUID)
 		s.sendLastReqNotify(newUID)
@@ -693,30 +817,21 @@ func (s *StratumV1Struct) switchDest() {
 }
 
 //
-// sendConfigure()
+// resumeDest()
+// Puts the default route back to work after it was redialed, the miner gets
+// the settings of the new connection, the jobs follow from the pool
 //
-func (s *StratumV1Struct) sendConfigure() {
-
-	if s.srcConfigure == nil {
-		return
-	}
-
-	configure := s.srcConfigure
+func (s *StratumV1Struct) resumeDest(uid simple.ConnUniqueID) {
 
-	msg, e := configure.createRequestMsg()
-	if e != nil {
-		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" createRequestMsg() error:%e ", e)
-	}
+	contextlib.Logf(s.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+" UID:%d back to Running", uid)
 
-	LogJson(s.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_STOR2DST, msg)
+	s.dstState[uid] = DstStateRunning
 
-	count, e := s.protocol.Write(msg)
-	if e != nil {
-		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" WriteSrc error:%s", e)
-	}
-	if count != len(msg) {
-		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" WriteSrc bad count:%d, %d", count, len(msg))
+	if e := s.sendSetExtranonceNotice(uid); e == ErrExtranonceUndeliverable {
+		return
 	}
+	s.sendVersionMaskNotice(uid)
+	s.sendLastSetDifficultyNotice(uid)
 }
 
 //
@@ -821,6 +936,19 @@ func (svs *StratumV1Struct) sendSetExtranonceNotice(uid simple.ConnUniqueID) (e
 		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" dstExtranonce2size[%d] DNE ", uid)
 	}
 
+	// The miner keeps the proxy's extranonce, the jobs and shares are rewritten
+	if svs.extranonceRewrite(uid) {
+		return nil
+	}
+
+	// The miner would ignore mining.set_extranonce and hash on with the
+	// old extranonce, it is reconnected instead
+	if !svs.srcSetExtranonce {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d extranonce2_size:%d too small to split, miner did not subscribe to extranonce, reconnecting it", uid, svs.dstExtranonce2size[uid])
+		svs.reconnectSrc()
+		return ErrExtranonceUndeliverable
+	}
+
 	msg, e := createSetExtranonceNoticeMsg(svs.dstExtranonce[uid], svs.dstExtranonce2size[uid])
 
 	if e != nil {
@@ -890,9 +1018,16 @@ func (svs *StratumV1Struct) sendLastSetDifficultyNotice(uid simple.ConnUniqueID)
 		return nil
 	}
 
+	// The miner keeps its own difficulty, at most the pool's
+	if svs.vardiff != nil {
+		svs.validatePoolDifficulty(uid)
+		svs.vardiff.setPoolDiff(diff)
+		return svs.sendMinerDifficulty(uid)
+	}
+
 	cs := contextlib.GetContextStruct(svs.Ctx())
 	ps := cs.GetMsgBus()
-	ps.SendValidateSetDiff(svs.Ctx(), svs.minerRec.ID, svs.dstDest[uid].ID, diff)
+	ps.SendValidateSetDiff(svs.Ctx(), svs.minerRec.ID, svs.dstDest[uid].ID, int(diff))
 
 	msg, e := createSetDifficultyNoticeMsg(diff)
 
@@ -951,6 +1086,8 @@ func (svs *StratumV1Struct) sendLastMiningNotice(uid simple.ConnUniqueID) (e err
 	}
 
 	notice := svs.dstLastMiningNotice[uid]
+	src := svs.srcMiningNotice(uid, notice)
+	svs.recordSrcJob(uid, src.Params.([]interface{}))
 	minerID := svs.minerRec.ID
 	destID := svs.minerRec.Dest
 	username := svs.dstDest[uid].Username()
@@ -969,7 +1106,7 @@ func (svs *StratumV1Struct) sendLastMiningNotice(uid simple.ConnUniqueID) (e err
 	ps := cs.GetMsgBus()
 	ps.SendValidateNotify(svs.Ctx(), minerID, destID, username, jobID, prevblock, gen1, gen2, merkel, version, nbits, ntime, clean)
 
-	msg, e := notice.createNoticeMsg()
+	msg, e := src.createNoticeMsg()
 
 	if e != nil {
 		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createLastMiningNoticeMsg() error:%s", e)
@@ -1023,7 +1160,9 @@ func (svs *StratumV1Struct) sendLastReqNotify(uid simple.ConnUniqueID) (e error)
 		return nil
 	}
 
-	request := svs.dstLastReqNotify[uid]
+	request := *svs.dstLastReqNotify[uid]
+	request.Params = svs.srcNotifyParams(uid, request.Params)
+	svs.recordSrcJob(uid, request.Params)
 
 	msg, e := request.createRequestMsg()
 
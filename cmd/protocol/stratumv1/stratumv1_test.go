@@ -322,7 +322,7 @@ func TestNewSrc2PoolConnectionsOpened(t *testing.T) {
 	//{"id":1,"error":null,"result":[[["mining.notify","0"]],"1",1]}
 	//
 	response := &stratumResponse{}
-	msg, e = response.createSrcSubscribeResponseMsg(1)
+	msg, e = response.createSrcSubscribeResponseMsg(1, "deadbeef", 2)
 	if e != nil {
 		t.Fatalf("Subscribe createRequestMsg() error:%s", e)
 	}
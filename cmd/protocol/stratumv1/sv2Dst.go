@@ -0,0 +1,534 @@
+package stratumv1
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	"github.com/daniel-888/proxy-router/cmd/protocol/stratumv2"
+	"github.com/daniel-888/proxy-router/lumerinlib"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+//
+// Stratum V2 Dsts
+//
+// A Dest with a stratum2+tcp:// URL is a SV2 pool. The miner keeps talking
+// Stratum V1 to the proxy, while the proxy runs the Noise handshake with the
+// pool and opens one extended channel on it as the Dest's user:
+//
+//	subscribe        -> SetupConnection
+//	authorize        -> OpenExtendedMiningChannel
+//	set_extranonce   <- extranonce prefix and size of the channel
+//	set_difficulty   <- SetTarget and the channel's initial target
+//	notify           <- NewExtendedMiningJob + SetNewPrevHash
+//	submit           -> SubmitSharesExtended
+//	submit response  <- SubmitShares.Success / SubmitShares.Error
+//
+// SV2 Dsts go through the same DstStates as V1 Dsts and record their
+// extranonce, difficulty and last notify in the same per UID maps, so
+// switchDest() moves the miner between V1 and V2 Dsts alike.
+//
+
+var ErrSV2BadSubmit = errors.New("StratumV1: Submit can not be translated for a SV2 Dst")
+
+const sv2ExtranonceSize uint16 = 4
+const sv2OpenRequestID uint32 = 1
+
+type sv2Dst struct {
+	codec          *stratumv2.Codec
+	channelID      uint32
+	extranonceSize uint16
+	jobs           map[uint32]*stratumv2.NewExtendedMiningJob
+	prevHash       *stratumv2.SetNewPrevHash
+	seq            uint32
+	submits        map[uint32]int // Submit Sequence Number -> Src Request ID
+}
+
+//
+// sv2Open()
+// Creates the SV2 state of a freshly opened Dst and sends the first
+// handshake message
+// State Transition: DstStateNew -> DstStateSubscribing
+//
+func (svs *StratumV1Struct) sv2Open(uid simple.ConnUniqueID) (e error) {
+
+	dest := svs.dstDest[uid]
+
+	authority, e := stratumv2.DestAuthorityKey(dest)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d error:%s", uid, e)
+		svs.SetDstStateUid(uid, DstStateError)
+		return e
+	}
+	if authority == nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelWarn, lumerinlib.FileLineFunc()+" Dest:%s has no authority key, the pool certificate is not checked", dest.ID)
+	}
+
+	codec, act1, e := stratumv2.NewInitiator(authority)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" NewInitiator() error:%s", e)
+		svs.SetDstStateUid(uid, DstStateError)
+		return e
+	}
+
+	svs.dstSV2[uid] = &sv2Dst{
+		codec:   codec,
+		jobs:    make(map[uint32]*stratumv2.NewExtendedMiningJob),
+		submits: make(map[uint32]int),
+	}
+
+	count, e := svs.protocol.WriteDst(uid, act1)
+	if e != nil || count != len(act1) {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteDst count:%d, %d error:%v", count, len(act1), e)
+		svs.SetDstStateUid(uid, DstStateError)
+		return e
+	}
+
+	svs.SetDstStateUid(uid, DstStateSubscribing)
+
+	return nil
+}
+
+//
+// handleSV2ReadEvent()
+// Runs data from a SV2 Dst through its codec and handles the messages
+//
+func (svs *StratumV1Struct) handleSV2ReadEvent(uid simple.ConnUniqueID, data []byte) (e error) {
+
+	sv2 := svs.dstSV2[uid]
+	ready := sv2.codec.Ready()
+
+	msgs, _, e := sv2.codec.Feed(data)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d Feed() error:%s", uid, e)
+		svs.SetDstStateUid(uid, DstStateError)
+		svs.CloseUid(uid)
+		return nil
+	}
+
+	//
+	// Handshake finished
+	//
+	if !ready && sv2.codec.Ready() {
+		e = svs.sv2SendSetupConnection(uid)
+		if e != nil {
+			return e
+		}
+	}
+
+	for _, m := range msgs {
+		stratumv2.LogMsg(svs.Ctx(), lumerinlib.FileLineFunc(), stratumv2.MSG_RECV_DST, m)
+		e = svs.handleSV2Msg(uid, m)
+		if e != nil {
+			break
+		}
+	}
+
+	return e
+}
+
+//
+// sv2SendSetupConnection()
+//
+func (svs *StratumV1Struct) sv2SendSetupConnection(uid simple.ConnUniqueID) (e error) {
+
+	dest := svs.dstDest[uid]
+
+	setup := &stratumv2.SetupConnection{
+		Protocol:     stratumv2.ProtocolMining,
+		MinVersion:   stratumv2.ProtocolVersion,
+		MaxVersion:   stratumv2.ProtocolVersion,
+		EndpointHost: dest.Host(),
+		Vendor:       "proxy-router",
+	}
+	if port, e := strconv.ParseUint(dest.Port(), 10, 16); e == nil {
+		setup.EndpointPort = uint16(port)
+	}
+
+	stratumv2.LogMsg(svs.Ctx(), lumerinlib.FileLineFunc(), stratumv2.MSG_SEND_STOR2DST, setup)
+
+	return svs.sv2Write(uid, setup)
+}
+
+//
+// handleSV2Msg()
+//
+func (svs *StratumV1Struct) handleSV2Msg(uid simple.ConnUniqueID, m stratumv2.Message) (e error) {
+
+	sv2 := svs.dstSV2[uid]
+	dststate := svs.GetDstStateUid(uid)
+
+	contextlib.Logf(svs.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" DST UID:%d State:%s Msg:%s", uid, dststate, m.Type())
+
+	if cm, ok := m.(stratumv2.ChannelMessage); ok && sv2.channelID != 0 && cm.Channel() != sv2.channelID {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d message for unknown channel:%d", uid, cm.Channel())
+		stratumv2.LogMsg(svs.Ctx(), lumerinlib.FileLineFunc(), stratumv2.MSG_DROP_DST, m)
+		return nil
+	}
+
+	switch m := m.(type) {
+
+	//
+	// Got the response to the SetupConnection, open the channel now
+	// State Transition: DstStateSubscribing -> DstStateAuthorizing
+	//
+	case *stratumv2.SetupConnectionSuccess:
+		if dststate != DstStateSubscribing {
+			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d Got %s in state:%s", uid, m.Type(), dststate)
+			return nil
+		}
+
+		open := &stratumv2.OpenExtendedMiningChannel{
+			RequestID:         sv2OpenRequestID,
+			UserIdentity:      svs.dstDest[uid].Username(),
+			MaxTarget:         stratumv2.DifficultyToTarget(0),
+			MinExtranonceSize: sv2ExtranonceSize,
+		}
+
+		svs.SetDstStateUid(uid, DstStateAuthorizing)
+
+		stratumv2.LogMsg(svs.Ctx(), lumerinlib.FileLineFunc(), stratumv2.MSG_SEND_STOR2DST, open)
+		return svs.sv2Write(uid, open)
+
+	case *stratumv2.SetupConnectionError:
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d error:%s", uid, m.ErrorCode)
+		svs.SetDstStateUid(uid, DstStateError)
+		svs.CloseUid(uid)
+
+	//
+	// Channel is open, the extranonce and difficulty are known now
+	// State Transition: DstStateAuthorizing -> DstStateStandBy
+	//
+	case *stratumv2.OpenExtendedMiningChannelSuccess:
+		if dststate != DstStateAuthorizing {
+			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d Got %s in state:%s", uid, m.Type(), dststate)
+			return nil
+		}
+
+		sv2.channelID = m.ChannelID
+		sv2.extranonceSize = m.ExtranonceSize
+		svs.dstExtranonce[uid] = hex.EncodeToString(m.ExtranoncePrefix)
+		svs.dstExtranonce2size[uid] = int(m.ExtranonceSize)
+		svs.dstLastSetDiff[uid] = float64(sv2Difficulty(m.Target))
+		svs.dstReDialCount[uid] = 0
+
+		svs.SetDstStateUid(uid, DstStateStandBy)
+
+		defRouteUid, _ := svs.protocol.GetDefaultRouteUID()
+		if svs.scheduler == OnDemand || defRouteUid < 0 {
+			svs.switchDest()
+		}
+
+	case *stratumv2.OpenMiningChannelError:
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d error:%s", uid, m.ErrorCode)
+		svs.SetDstStateUid(uid, DstStateError)
+		svs.CloseUid(uid)
+
+	case *stratumv2.SetTarget:
+		svs.dstLastSetDiff[uid] = float64(sv2Difficulty(m.MaximumTarget))
+		if svs.sv2IsRunning(uid) {
+			return svs.sendLastSetDifficultyNotice(uid)
+		}
+
+	case *stratumv2.SetExtranoncePrefix:
+		svs.dstExtranonce[uid] = hex.EncodeToString(m.ExtranoncePrefix)
+		if svs.sv2IsRunning(uid) {
+			return svs.sendSetExtranonceNotice(uid)
+		}
+
+	case *stratumv2.NewExtendedMiningJob:
+		sv2.jobs[m.JobID] = m
+		if m.MinNTime != nil && sv2.prevHash != nil {
+			return svs.sv2Notify(uid, m, false)
+		}
+
+	case *stratumv2.SetNewPrevHash:
+		sv2.prevHash = m
+		job, ok := sv2.jobs[m.JobID]
+		if !ok {
+			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d SetNewPrevHash for unknown job:%d", uid, m.JobID)
+			return nil
+		}
+		// Every other job is stale now
+		for id := range sv2.jobs {
+			if id != m.JobID {
+				delete(sv2.jobs, id)
+			}
+		}
+		return svs.sv2Notify(uid, job, true)
+
+	case *stratumv2.SubmitSharesSuccess:
+		for seq, id := range sv2.submits {
+			if seq <= m.LastSequenceNumber {
+				delete(sv2.submits, seq)
+				svs.shareResult(uid, id, msgbus.ShareAccepted)
+				svs.writeSrcResponse(JSON_SEND_DST2SRC, id, nil)
+			}
+		}
+
+	case *stratumv2.SubmitSharesError:
+		id, ok := sv2.submits[m.SequenceNumber]
+		if !ok {
+			contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d SubmitShares.Error for unknown sequence:%d", uid, m.SequenceNumber)
+			return nil
+		}
+		delete(sv2.submits, m.SequenceNumber)
+		reason := m.ErrorCode
+		svs.shareResult(uid, id, getShareReasonResult(reason))
+		svs.writeSrcResponse(JSON_SEND_DST2SRC, id, &reason)
+
+	case *stratumv2.CloseChannel:
+		contextlib.Logf(svs.Ctx(), contextlib.LevelWarn, lumerinlib.FileLineFunc()+" UID:%d channel closed:%s -> Redialing", uid, m.ReasonCode)
+		return svs.DstRedialUid(uid)
+
+	default:
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d Recieved:%s, IGNORING", uid, m.Type())
+		stratumv2.LogMsg(svs.Ctx(), lumerinlib.FileLineFunc(), stratumv2.MSG_DROP_DST, m)
+	}
+
+	return nil
+}
+
+//
+// sv2IsRunning()
+// True if the SV2 Dst is the one the miner is working for
+//
+func (svs *StratumV1Struct) sv2IsRunning(uid simple.ConnUniqueID) bool {
+	defRouteUid, _ := svs.protocol.GetDefaultRouteUID()
+	return defRouteUid == uid && svs.GetDstStateUid(uid) == DstStateRunning
+}
+
+//
+// sv2Route()
+// True if the miner's shares go to a SV2 Dst, uid being the default route
+//
+func (svs *StratumV1Struct) sv2Route(uid simple.ConnUniqueID) bool {
+	if uid >= 0 {
+		return svs.dstSV2[uid] != nil
+	}
+	return stratumv2.IsV2Dest(contextlib.GetDest(svs.Ctx()))
+}
+
+//
+// sv2Notify()
+// Records the job as the last mining.notify of the Dst and passes it to
+// the miner if the Dst is running
+//
+func (svs *StratumV1Struct) sv2Notify(uid simple.ConnUniqueID, job *stratumv2.NewExtendedMiningJob, clean bool) (e error) {
+
+	notice := sv2NotifyNotice(job, svs.dstSV2[uid].prevHash, clean)
+
+	// A job on a new prevhash makes the earlier ones stale
+	if clean {
+		svs.dropJobs(uid)
+	}
+
+	svs.setLastMiningNotice(uid, notice)
+
+	if svs.sv2IsRunning(uid) {
+		e = svs.sendLastMiningNotice(uid)
+	} else {
+		LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_STOR_DST, notice)
+	}
+
+	// Replayed after a switch, the job has to replace the miner's work
+	notice.setNoticeMiningNotifyCleanJobsTrue()
+
+	return e
+}
+
+//
+// sv2Submit()
+// Sends a mining.submit from the miner as SubmitSharesExtended, the
+// response is sent when the pool answers
+//
+func (svs *StratumV1Struct) sv2Submit(uid simple.ConnUniqueID, request *stratumRequest) (e error) {
+
+	sv2 := svs.dstSV2[uid]
+
+	submit, e := sv2SubmitShares(sv2, request)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d error:%s", uid, e)
+		reason := e.Error()
+		svs.writeSrcResponse(JSON_SEND_STOR2SRC, request.ID, &reason)
+		return nil
+	}
+
+	sv2.seq++
+	submit.SequenceNumber = sv2.seq
+	sv2.submits[submit.SequenceNumber] = request.ID
+
+	stratumv2.LogMsg(svs.Ctx(), lumerinlib.FileLineFunc(), stratumv2.MSG_SEND_SRC2DST, submit)
+
+	return svs.sv2Write(uid, submit)
+}
+
+//
+// sv2Write()
+//
+func (svs *StratumV1Struct) sv2Write(uid simple.ConnUniqueID, m stratumv2.Message) (e error) {
+
+	sv2 := svs.dstSV2[uid]
+	if sv2 == nil {
+		return fmt.Errorf(lumerinlib.FileLineFunc()+" UID:%d is not a SV2 Dst", uid)
+	}
+
+	msg, e := sv2.codec.Encode(m)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Encode() error:%s", e)
+		return e
+	}
+
+	count, e := svs.protocol.WriteDst(uid, msg)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteDst error:%s", e)
+		svs.SetDstStateUid(uid, DstStateError)
+		return e
+	}
+	if count != len(msg) {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteDst bad count:%d, %d", count, len(msg))
+		e = fmt.Errorf(lumerinlib.FileLineFunc()+" WriteDst bad count:%d, %d", count, len(msg))
+	}
+
+	return e
+}
+
+// -------------------------------------------------------------------------
+// Translation
+// -------------------------------------------------------------------------
+
+//
+// sv2Difficulty()
+// Stratum V1 difficulty for a SV2 target, at least 1. Rounded up, shares
+// easier than the target would be rejected by the pool.
+//
+func sv2Difficulty(target stratumv2.U256) int {
+	diff := math.Ceil(stratumv2.TargetToDifficulty(target) - 1e-6)
+	if diff < 1 {
+		return 1
+	}
+	if diff > float64(1<<62) {
+		return 1 << 62
+	}
+	return int(diff)
+}
+
+//
+// sv2NotifyNotice()
+// The mining.notify for an extended job on top of prevHash
+//
+// SV2 hashes are in internal byte order, V1 sends the previous block hash
+// with every 32 bit word byte swapped and the merkle branches as they are.
+//
+func sv2NotifyNotice(job *stratumv2.NewExtendedMiningJob, prevHash *stratumv2.SetNewPrevHash, clean bool) (notice *stratumNotice) {
+
+	var prev [32]byte
+	for i := 0; i < 32; i += 4 {
+		prev[i], prev[i+1], prev[i+2], prev[i+3] = prevHash.PrevHash[i+3], prevHash.PrevHash[i+2], prevHash.PrevHash[i+1], prevHash.PrevHash[i]
+	}
+
+	merkle := make([]interface{}, len(job.MerklePath))
+	for i := range job.MerklePath {
+		merkle[i] = hex.EncodeToString(job.MerklePath[i][:])
+	}
+
+	ntime := prevHash.MinNTime
+	if job.MinNTime != nil && *job.MinNTime > ntime {
+		ntime = *job.MinNTime
+	}
+
+	params := []interface{}{
+		sv2JobID(job.JobID),
+		hex.EncodeToString(prev[:]),
+		hex.EncodeToString(job.CoinbaseTxPrefix),
+		hex.EncodeToString(job.CoinbaseTxSuffix),
+		merkle,
+		fmt.Sprintf("%08x", job.Version),
+		fmt.Sprintf("%08x", prevHash.NBits),
+		fmt.Sprintf("%08x", ntime),
+		clean,
+	}
+
+	return &stratumNotice{
+		ID:     nil,
+		Method: string(SERVER_MINING_NOTIFY),
+		Params: params,
+	}
+}
+
+//
+// sv2JobID()
+//
+func sv2JobID(id uint32) string {
+	return fmt.Sprintf("%x", id)
+}
+
+//
+// sv2SubmitShares()
+// The SubmitSharesExtended for a mining.submit, without a sequence number
+// params: worker, job ID, extranonce2, ntime, nonce[, version bits]
+//
+func sv2SubmitShares(sv2 *sv2Dst, request *stratumRequest) (submit *stratumv2.SubmitSharesExtended, e error) {
+
+	if len(request.Params) < 5 {
+		return nil, ErrSV2BadSubmit
+	}
+
+	var str [6]string
+	for i := 1; i < len(request.Params) && i < len(str); i++ {
+		s, ok := request.Params[i].(string)
+		if !ok {
+			return nil, ErrSV2BadSubmit
+		}
+		str[i] = s
+	}
+
+	jobID, e := strconv.ParseUint(str[1], 16, 32)
+	if e != nil {
+		return nil, ErrSV2BadSubmit
+	}
+	job, ok := sv2.jobs[uint32(jobID)]
+	if !ok {
+		return nil, fmt.Errorf("job not found:%s", str[1])
+	}
+
+	extranonce, e := hex.DecodeString(str[2])
+	if e != nil || len(extranonce) != int(sv2.extranonceSize) {
+		return nil, ErrSV2BadSubmit
+	}
+
+	ntime, e := hex.DecodeString(str[3])
+	if e != nil || len(ntime) != 4 {
+		return nil, ErrSV2BadSubmit
+	}
+	nonce, e := hex.DecodeString(str[4])
+	if e != nil || len(nonce) != 4 {
+		return nil, ErrSV2BadSubmit
+	}
+
+	version := job.Version
+	if str[5] != "" && job.VersionRollingAllowed {
+		bits, e := strconv.ParseUint(str[5], 16, 32)
+		if e != nil {
+			return nil, ErrSV2BadSubmit
+		}
+		version = (version &^ versionRollingMask) | (uint32(bits) & versionRollingMask)
+	}
+
+	submit = &stratumv2.SubmitSharesExtended{
+		ChannelID:  sv2.channelID,
+		JobID:      job.JobID,
+		Nonce:      binary.BigEndian.Uint32(nonce),
+		NTime:      binary.BigEndian.Uint32(ntime),
+		Version:    version,
+		Extranonce: extranonce,
+	}
+
+	return submit, nil
+}
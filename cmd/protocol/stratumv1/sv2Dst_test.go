@@ -0,0 +1,279 @@
+package stratumv1
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daniel-888/proxy-router/cmd/protocol/stratumv2"
+	"github.com/daniel-888/proxy-router/lumerinlib/testinglib"
+)
+
+//
+// A V1 miner working for a SV2 pool: the proxy opens an extended channel
+// and translates extranonce, difficulty, jobs and shares
+//
+func TestNewSrc2SV2PoolTranslation(t *testing.T) {
+
+	localport := testinglib.GetRandPort()
+	nodeaddr := net.JoinHostPort(localhost, strconv.Itoa(localport))
+
+	poolIdentity, e := stratumv2.NewIdentity(nil)
+	if e != nil {
+		t.Fatalf("NewIdentity() error:%s", e)
+	}
+
+	poolListener, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolListener.Close()
+
+	poolurl := fmt.Sprintf("stratum2+tcp://poolworker:password@%s/%s", poolListener.Addr(), hex.EncodeToString(poolIdentity.AuthorityPubKey()))
+	defdest := createDest("LocalPriPoolDestID", poolurl)
+
+	ctx := newContextStruct(t, nodeaddr, defdest)
+
+	sls := newStratumConnection(t, ctx)
+	defer sls.Cancel()
+
+	poolErr := make(chan error, 1)
+	go func() { poolErr <- fakeSV2Pool(poolListener, poolIdentity) }()
+
+	// --------------------------------------
+	// Miner connects, subscribes and authorizes
+	// --------------------------------------
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, e = net.Dial("tcp", nodeaddr); e == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if e != nil {
+		t.Fatalf("Dial() error:%s", e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	miner := bufio.NewReader(conn)
+
+	send := func(msg string) {
+		if _, e := conn.Write([]byte(msg + "\n")); e != nil {
+			t.Fatalf("Write() error:%s", e)
+		}
+	}
+	recv := func() (m map[string]interface{}) {
+		line, e := miner.ReadBytes('\n')
+		if e != nil {
+			t.Fatalf("ReadBytes() error:%s", e)
+		}
+		if e = json.Unmarshal(line, &m); e != nil {
+			t.Fatalf("Unmarshal(%s) error:%s", line, e)
+		}
+		return m
+	}
+
+	send(`{"id":1,"method":"mining.configure","params":[["version-rolling"],{"version-rolling.mask":"ffffffff"}]}`)
+	configure := recv()
+	result, _ := configure["result"].(map[string]interface{})
+	if result["version-rolling"] != true || result["version-rolling.mask"] != "1fffe000" {
+		t.Fatalf("bad configure response:%v", configure)
+	}
+
+	send(`{"id":2,"method":"mining.subscribe","params":["test/1.0"]}`)
+	recv()
+	send(`{"id":6,"method":"mining.extranonce.subscribe","params":[]}`)
+	recv()
+	send(`{"id":3,"method":"mining.authorize","params":["minerworker",""]}`)
+	if auth := recv(); auth["result"] != true {
+		t.Fatalf("bad authorize response:%v", auth)
+	}
+
+	expect := map[string]string{
+		"mining.set_extranonce": `["ee01",4]`,
+		"mining.set_difficulty": `[256]`,
+		"mining.notify":         `["7","0000000200000003000000000000000000000000000000000000000000000000","01","02",["0500000000000000000000000000000000000000000000000000000000000000"],"20000000","1d00ffff","6553f100",true]`,
+	}
+	for len(expect) > 0 {
+		m := recv()
+		method, _ := m["method"].(string)
+		want, ok := expect[method]
+		if !ok {
+			t.Fatalf("unexpected message:%v", m)
+		}
+		params, _ := json.Marshal(m["params"])
+		if string(params) != want {
+			t.Fatalf("%s got:%s want:%s", method, params, want)
+		}
+		delete(expect, method)
+	}
+
+	// --------------------------------------
+	// Share with rolled version bits
+	// --------------------------------------
+	send(`{"id":4,"method":"mining.submit","params":["minerworker","7","0a0b0c0d","6553f101","0000002a","00002000"]}`)
+	if submit := recv(); submit["id"] != float64(4) || submit["result"] != true {
+		t.Fatalf("bad submit response:%v", submit)
+	}
+
+	send(`{"id":5,"method":"mining.submit","params":["minerworker","9","0a0b0c0d","6553f101","0000002a"]}`)
+	if submit := recv(); submit["id"] != float64(5) || submit["result"] != false || submit["error"] == nil {
+		t.Fatalf("bad submit response for an unknown job:%v", submit)
+	}
+
+	if e = <-poolErr; e != nil {
+		t.Fatalf("pool error:%s", e)
+	}
+}
+
+//
+// sv2Difficulty() keeps the V1 difficulty usable
+//
+func TestSV2Difficulty(t *testing.T) {
+
+	if d := sv2Difficulty(stratumv2.DifficultyToTarget(1024)); d != 1024 {
+		t.Errorf("sv2Difficulty(1024) got:%d", d)
+	}
+	if d := sv2Difficulty(stratumv2.DifficultyToTarget(0)); d != 1 {
+		t.Errorf("sv2Difficulty(max target) got:%d", d)
+	}
+	if d := sv2Difficulty(stratumv2.U256{}); d <= 0 {
+		t.Errorf("sv2Difficulty(zero target) got:%d", d)
+	}
+}
+
+//
+// Version bits are only rolled on jobs that allow it
+//
+func TestSV2SubmitShares(t *testing.T) {
+
+	sv2 := &sv2Dst{
+		channelID:      3,
+		extranonceSize: 2,
+		jobs: map[uint32]*stratumv2.NewExtendedMiningJob{
+			0x1a: {JobID: 0x1a, Version: 0x20000004, VersionRollingAllowed: true},
+			0x1b: {JobID: 0x1b, Version: 0x20000004},
+		},
+	}
+
+	request := &stratumRequest{
+		ID:     9,
+		Method: string(CLIENT_MINING_SUBMIT),
+		Params: []interface{}{"worker", "1a", "beef", "6553f101", "0000002a", "e0006000"},
+	}
+
+	submit, e := sv2SubmitShares(sv2, request)
+	if e != nil {
+		t.Fatalf("sv2SubmitShares() error:%s", e)
+	}
+	if submit.ChannelID != 3 || submit.JobID != 0x1a || submit.NTime != 0x6553f101 || submit.Nonce != 42 || submit.Version != 0x20006004 || hex.EncodeToString(submit.Extranonce) != "beef" {
+		t.Errorf("sv2SubmitShares() got:%+v", submit)
+	}
+
+	request.Params[1] = "1b"
+	if submit, e = sv2SubmitShares(sv2, request); e != nil || submit.Version != 0x20000004 {
+		t.Errorf("sv2SubmitShares() without version rolling got:%+v %v", submit, e)
+	}
+
+	request.Params[2] = "beefbeef"
+	if _, e = sv2SubmitShares(sv2, request); e == nil {
+		t.Errorf("sv2SubmitShares() with a bad extranonce size did not fail")
+	}
+}
+
+// ---------------------------------------------------------------------------
+
+//
+// fakeSV2Pool() serves one proxy connection: opens channel 42, sends a job
+// and answers one share
+//
+func fakeSV2Pool(l net.Listener, identity *stratumv2.Identity) (e error) {
+
+	conn, e := l.Accept()
+	if e != nil {
+		return e
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	codec := stratumv2.NewResponder(identity)
+	var pending []stratumv2.Message
+	buf := make([]byte, 4096)
+
+	recv := func() (m stratumv2.Message, e error) {
+		for len(pending) == 0 {
+			n, e := conn.Read(buf)
+			if e != nil {
+				return nil, e
+			}
+			msgs, reply, e := codec.Feed(buf[:n])
+			if e != nil {
+				return nil, e
+			}
+			if reply != nil {
+				if _, e = conn.Write(reply); e != nil {
+					return nil, e
+				}
+			}
+			pending = append(pending, msgs...)
+		}
+		m, pending = pending[0], pending[1:]
+		return m, nil
+	}
+	send := func(m stratumv2.Message) (e error) {
+		data, e := codec.Encode(m)
+		if e != nil {
+			return e
+		}
+		_, e = conn.Write(data)
+		return e
+	}
+
+	m, e := recv()
+	if e != nil {
+		return e
+	}
+	if setup, ok := m.(*stratumv2.SetupConnection); !ok || setup.Protocol != stratumv2.ProtocolMining {
+		return fmt.Errorf("expected SetupConnection, got:%+v", m)
+	}
+	if e = send(&stratumv2.SetupConnectionSuccess{UsedVersion: 2}); e != nil {
+		return e
+	}
+
+	m, e = recv()
+	if e != nil {
+		return e
+	}
+	open, ok := m.(*stratumv2.OpenExtendedMiningChannel)
+	if !ok || open.UserIdentity != "poolworker" {
+		return fmt.Errorf("expected OpenExtendedMiningChannel as poolworker, got:%+v", m)
+	}
+
+	prevhash := stratumv2.U256{2, 0, 0, 0, 3}
+	msgs := []stratumv2.Message{
+		&stratumv2.OpenExtendedMiningChannelSuccess{RequestID: open.RequestID, ChannelID: 42, Target: stratumv2.DifficultyToTarget(256), ExtranonceSize: 4, ExtranoncePrefix: []byte{0xee, 1}},
+		&stratumv2.NewExtendedMiningJob{ChannelID: 42, JobID: 7, Version: 0x20000000, VersionRollingAllowed: true, MerklePath: []stratumv2.U256{{5}}, CoinbaseTxPrefix: []byte{1}, CoinbaseTxSuffix: []byte{2}},
+		&stratumv2.SetNewPrevHash{ChannelID: 42, JobID: 7, PrevHash: prevhash, MinNTime: 0x6553f100, NBits: 0x1d00ffff},
+	}
+	for _, m := range msgs {
+		if e = send(m); e != nil {
+			return e
+		}
+	}
+
+	m, e = recv()
+	if e != nil {
+		return e
+	}
+	submit, ok := m.(*stratumv2.SubmitSharesExtended)
+	if !ok || submit.ChannelID != 42 || submit.JobID != 7 || submit.Nonce != 42 || submit.NTime != 0x6553f101 || submit.Version != 0x20002000 || hex.EncodeToString(submit.Extranonce) != "0a0b0c0d" {
+		return fmt.Errorf("expected SubmitSharesExtended for job 7, got:%+v", m)
+	}
+
+	return send(&stratumv2.SubmitSharesSuccess{ChannelID: 42, LastSequenceNumber: submit.SequenceNumber, NewSubmitsAcceptedCount: 1, NewSharesSum: 256})
+}
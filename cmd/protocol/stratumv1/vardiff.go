@@ -0,0 +1,446 @@
+package stratumv1
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	"github.com/daniel-888/proxy-router/cmd/protocol/stratumv2"
+	"github.com/daniel-888/proxy-router/lumerinlib"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+//
+// Variable difficulty
+//
+// With vardiff on, the proxy picks the difficulty the miner works at instead
+// of passing on the pool's mining.set_difficulty. The miner's difficulty is
+// retargeted every RetargetWindow toward one share per ShareInterval, and
+// never goes above the difficulty of the default route, so every share the
+// pool wants is still found. Shares are hashed locally, only the ones
+// meeting the difficulty of the Dst that issued their job are sent upstream,
+// the others are answered by the proxy. The validator only sees the shares
+// sent upstream and counts them at the pool's difficulty, it stays the one
+// writer of the miner's CurrentHashRate.
+//
+
+var ErrShareUnknownJob = errors.New("StratumV1: Share for unknown job")
+var ErrShareBadParams = errors.New("StratumV1: Share params can not be parsed")
+
+// Retargets move the difficulty by at most this factor
+const vardiffMaxStep float64 = 4
+
+// Jobs kept for hashing shares when the pool never cleans them, oldest go first
+const vardiffMaxJobs int = 64
+
+type VardiffConfig struct {
+	ShareInterval  time.Duration // Time between shares the miner is tuned to
+	RetargetWindow time.Duration // Time the share rate is measured over
+}
+
+type vardiff struct {
+	config      VardiffConfig
+	diff        int     // Difficulty the miner works at
+	prevDiff    int     // Difficulty before the last change, shares in flight may use it
+	poolDiff    float64 // Difficulty of the default route
+	windowStart time.Time
+	shares      int
+	jobs        map[string][]interface{} // mining.notify params of the jobs the miner works on
+	jobOrder    []string                 // IDs of jobs, oldest first
+}
+
+//
+// newVardiff()
+//
+func newVardiff(config VardiffConfig, now time.Time) *vardiff {
+	return &vardiff{
+		config:      config,
+		windowStart: now,
+		jobs:        make(map[string][]interface{}),
+	}
+}
+
+//
+// setPoolDiff()
+// Records the difficulty of the default route, lowering the miner's
+// difficulty to it if needed. Returns true if the miner's difficulty changed.
+//
+func (v *vardiff) setPoolDiff(diff float64) (changed bool) {
+	v.poolDiff = diff
+	if v.diff == 0 || float64(v.diff) > diff {
+		return v.setDiff(v.maxDiff())
+	}
+	return false
+}
+
+//
+// maxDiff()
+// Highest whole difficulty the miner may work at, at most the pool's and
+// at least 1
+//
+func (v *vardiff) maxDiff() int {
+	if v.poolDiff < 1 {
+		return 1
+	}
+	return int(v.poolDiff)
+}
+
+//
+// setDiff()
+//
+func (v *vardiff) setDiff(diff int) (changed bool) {
+	if diff == v.diff {
+		return false
+	}
+	v.prevDiff = v.diff
+	v.diff = diff
+	return true
+}
+
+//
+// minDiff()
+// Lowest difficulty a share from the miner is accepted at
+//
+func (v *vardiff) minDiff() float64 {
+	if v.prevDiff > 0 && v.prevDiff < v.diff {
+		return float64(v.prevDiff)
+	}
+	return float64(v.diff)
+}
+
+//
+// recordJob()
+// Keeps the params of a mining.notify sent to the miner
+//
+func (v *vardiff) recordJob(params []interface{}) {
+	if len(params) != 9 {
+		return
+	}
+	jobID, ok := params[0].(string)
+	if !ok {
+		return
+	}
+	if clean, _ := params[8].(bool); clean {
+		v.jobs = make(map[string][]interface{})
+		v.jobOrder = nil
+	}
+	if _, ok := v.jobs[jobID]; !ok {
+		v.jobOrder = append(v.jobOrder, jobID)
+	}
+	v.jobs[jobID] = params
+
+	for len(v.jobOrder) > vardiffMaxJobs {
+		delete(v.jobs, v.jobOrder[0])
+		v.jobOrder = v.jobOrder[1:]
+	}
+}
+
+//
+// share()
+// Counts an accepted share, at the end of the window retargets the
+// difficulty. Returns true if the difficulty changed.
+//
+func (v *vardiff) share(now time.Time) (retarget bool) {
+
+	v.shares++
+
+	elapsed := now.Sub(v.windowStart)
+	if elapsed < v.config.RetargetWindow {
+		return false
+	}
+
+	factor := float64(v.shares) * v.config.ShareInterval.Seconds() / elapsed.Seconds()
+	if factor > vardiffMaxStep {
+		factor = vardiffMaxStep
+	}
+	if factor < 1/vardiffMaxStep {
+		factor = 1 / vardiffMaxStep
+	}
+
+	diff := int(float64(v.diff) * factor)
+	if diff > v.maxDiff() {
+		diff = v.maxDiff()
+	}
+	if diff < 1 {
+		diff = 1
+	}
+
+	v.windowStart = now
+	v.shares = 0
+
+	return v.setDiff(diff)
+}
+
+// -------------------------------------------------------------------------
+// StratumV1Struct hooks
+// -------------------------------------------------------------------------
+
+//
+// vardiffPoolDifficulty()
+// The default route changed its difficulty, tell the miner only if its own
+// difficulty has to follow
+//
+func (svs *StratumV1Struct) vardiffPoolDifficulty(uid simple.ConnUniqueID) (e error) {
+
+	svs.validatePoolDifficulty(uid)
+
+	if svs.vardiff.setPoolDiff(svs.dstLastSetDiff[uid]) {
+		return svs.sendMinerDifficulty(uid)
+	}
+
+	contextlib.Logf(svs.Ctx(), contextlib.LevelDebug, lumerinlib.FileLineFunc()+" UID:%d pool difficulty:%g, miner stays at:%d", uid, svs.vardiff.poolDiff, svs.vardiff.diff)
+	return nil
+}
+
+//
+// vardiffSubmit()
+// Checks a mining.submit against the difficulties, uid is the Dst that
+// issued the share's job
+// Returns true if the share has to go to the pool
+//
+func (svs *StratumV1Struct) vardiffSubmit(uid simple.ConnUniqueID, request *stratumRequest) (forward bool, e error) {
+
+	v := svs.vardiff
+
+	diff, e := v.shareDifficulty(svs.minerExtranonce1(uid), svs.versionMask(uid), request)
+	if e != nil {
+		// Let the pool decide
+		contextlib.Logf(svs.Ctx(), contextlib.LevelWarn, lumerinlib.FileLineFunc()+" UID:%d shareDifficulty() error:%s", uid, e)
+		return true, nil
+	}
+
+	if diff < v.minDiff() {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+" UID:%d share difficulty:%f below:%f", uid, diff, v.minDiff())
+		return false, svs.rejectShare(request.ID, msgbus.ShareLowDifficulty, SErrLowDiffShare, "Low difficulty share")
+	}
+
+	if v.share(time.Now()) {
+		e = svs.sendMinerDifficulty(uid)
+		if e != nil {
+			return false, e
+		}
+	}
+
+	// A Dst that has not sent its difficulty yet gets every share
+	if diff >= svs.dstLastSetDiff[uid] {
+		return true, nil
+	}
+
+	return false, svs.writeSrcResponse(JSON_SEND_STOR2SRC, request.ID, nil)
+}
+
+//
+// vardiffJob()
+// Records a mining.notify on its way to the miner
+//
+func (svs *StratumV1Struct) vardiffJob(params []interface{}) {
+	if svs.vardiff == nil {
+		return
+	}
+	svs.vardiff.recordJob(params)
+}
+
+//
+// sendMinerDifficulty()
+// Sends the miner's vardiff difficulty
+//
+func (svs *StratumV1Struct) sendMinerDifficulty(uid simple.ConnUniqueID) (e error) {
+
+	diff := svs.vardiff.diff
+
+	msg, e := createSetDifficultyNoticeMsg(float64(diff))
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createSetDifficultyNoticeMsg() error:%s", e)
+		return e
+	}
+
+	LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_STOR2SRC, msg)
+
+	count, e := svs.protocol.WriteSrc(msg)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write error:%s", e)
+		return e
+	}
+	if count != len(msg) {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write bad count:%d, %d", count, len(msg))
+		e = errors.New(lumerinlib.FileLineFunc() + " WriteSrc bad count")
+	}
+
+	return e
+}
+
+//
+// validatePoolDifficulty()
+// Sends the difficulty of the Dst to the validator, it only gets the shares
+// that reach the pool and counts them at it
+//
+func (svs *StratumV1Struct) validatePoolDifficulty(uid simple.ConnUniqueID) {
+
+	cs := contextlib.GetContextStruct(svs.Ctx())
+	ps := cs.GetMsgBus()
+	ps.SendValidateSetDiff(svs.Ctx(), svs.minerRec.ID, svs.dstDest[uid].ID, int(svs.dstLastSetDiff[uid]))
+}
+
+//
+// writeSrcResponse()
+// Answers a miner request from the proxy, reason nil accepts it
+//
+func (svs *StratumV1Struct) writeSrcResponse(direction jsonDirection, id int, reason *string) (e error) {
+
+	response := &stratumResponse{
+		ID:     id,
+		Result: reason == nil,
+		Error:  reason,
+	}
+
+	msg, e := response.createResponseMsg()
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" createResponseMsg() error:%s", e)
+	}
+
+	LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), direction, msg)
+
+	count, e := svs.protocol.WriteSrc(msg)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteSrc error:%s", e)
+		return e
+	}
+	if count != len(msg) {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteSrc bad count:%d, %d", count, len(msg))
+		e = errors.New(lumerinlib.FileLineFunc() + " WriteSrc bad count")
+	}
+
+	return e
+}
+
+// -------------------------------------------------------------------------
+// Share hashing
+// -------------------------------------------------------------------------
+
+//
+// shareDifficulty()
+// Difficulty of the block header a mining.submit stands for, mask is the
+// version rolling mask the miner works with
+//
+func (v *vardiff) shareDifficulty(extranonce1 string, mask uint32, request *stratumRequest) (diff float64, e error) {
+
+	if len(request.Params) < 5 {
+		return 0, ErrShareBadParams
+	}
+	var submit [6]string
+	for i := 1; i < len(request.Params) && i < len(submit); i++ {
+		s, ok := request.Params[i].(string)
+		if !ok {
+			return 0, ErrShareBadParams
+		}
+		submit[i] = s
+	}
+
+	job, ok := v.jobs[submit[1]]
+	if !ok {
+		return 0, ErrShareUnknownJob
+	}
+
+	hash, e := shareHash(job, extranonce1, submit[2], submit[3], submit[4], submit[5], mask)
+	if e != nil {
+		return 0, e
+	}
+
+	return stratumv2.TargetToDifficulty(stratumv2.U256(hash)), nil
+}
+
+//
+// shareHash()
+// Double SHA256 of the block header, in internal byte order
+// job is the mining.notify params:
+// job ID, prevhash, coinb1, coinb2, merkle branches, version, nbits, ntime, clean
+//
+func shareHash(job []interface{}, extranonce1, extranonce2, ntime, nonce, versionBits string, mask uint32) (hash [32]byte, e error) {
+
+	var str [7]string
+	for i, p := range []int{1, 2, 3, 5, 6} {
+		s, ok := job[p].(string)
+		if !ok {
+			return hash, ErrShareBadParams
+		}
+		str[i] = s
+	}
+	branches, ok := job[4].([]interface{})
+	if !ok {
+		return hash, ErrShareBadParams
+	}
+
+	coinbase, e := hex.DecodeString(str[1] + extranonce1 + extranonce2 + str[2])
+	if e != nil {
+		return hash, ErrShareBadParams
+	}
+	root := sha256d(coinbase)
+	for _, b := range branches {
+		s, _ := b.(string)
+		branch, e := hex.DecodeString(s)
+		if e != nil || len(branch) != 32 {
+			return hash, ErrShareBadParams
+		}
+		root = sha256d(append(root[:], branch...))
+	}
+
+	prev, e := hex.DecodeString(str[0])
+	if e != nil || len(prev) != 32 {
+		return hash, ErrShareBadParams
+	}
+
+	version, e := parseHex32(str[3])
+	if e != nil {
+		return hash, e
+	}
+	if versionBits != "" {
+		bits, e := parseHex32(versionBits)
+		if e != nil {
+			return hash, e
+		}
+		version = (version &^ mask) | (bits & mask)
+	}
+	nbits, e := parseHex32(str[4])
+	if e != nil {
+		return hash, e
+	}
+	t, e := parseHex32(ntime)
+	if e != nil {
+		return hash, e
+	}
+	n, e := parseHex32(nonce)
+	if e != nil {
+		return hash, e
+	}
+
+	header := make([]byte, 80)
+	binary.LittleEndian.PutUint32(header[0:], version)
+	// V1 sends the previous block hash with its 32 bit words byte swapped
+	for i := 0; i < 32; i += 4 {
+		binary.LittleEndian.PutUint32(header[4+i:], binary.BigEndian.Uint32(prev[i:]))
+	}
+	copy(header[36:], root[:])
+	binary.LittleEndian.PutUint32(header[68:], t)
+	binary.LittleEndian.PutUint32(header[72:], nbits)
+	binary.LittleEndian.PutUint32(header[76:], n)
+
+	return sha256d(header), nil
+}
+
+func sha256d(data []byte) [32]byte {
+	h := sha256.Sum256(data)
+	return sha256.Sum256(h[:])
+}
+
+func parseHex32(s string) (v uint32, e error) {
+	u, e := strconv.ParseUint(s, 16, 32)
+	if e != nil {
+		return 0, ErrShareBadParams
+	}
+	return uint32(u), nil
+}
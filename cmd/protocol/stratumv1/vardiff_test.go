@@ -0,0 +1,202 @@
+package stratumv1
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
+)
+
+// Bitcoin genesis block coinbase, split where a pool puts the extranonces
+const genesisCoinbase = "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+
+//
+// The genesis block header hashed from mining.notify and mining.submit params
+//
+func TestShareDifficulty(t *testing.T) {
+
+	coinb1 := genesisCoinbase[:100]
+	en1 := genesisCoinbase[100:108]
+	en2 := genesisCoinbase[108:116]
+	coinb2 := genesisCoinbase[116:]
+
+	v := newVardiff(VardiffConfig{ShareInterval: time.Second, RetargetWindow: time.Minute}, time.Now())
+	v.recordJob([]interface{}{"1", "0000000000000000000000000000000000000000000000000000000000000000", coinb1, coinb2, []interface{}{}, "00000001", "1d00ffff", "495fab29", true})
+
+	request := &stratumRequest{
+		ID:     1,
+		Method: string(CLIENT_MINING_SUBMIT),
+		Params: []interface{}{"worker", "1", en2, "495fab29", "7c2bac1d"},
+	}
+
+	diff, e := v.shareDifficulty(en1, 0, request)
+	if e != nil {
+		t.Fatalf("shareDifficulty() error:%s", e)
+	}
+	if math.Abs(diff-2536.4262984453103) > 1e-6 {
+		t.Errorf("shareDifficulty() got:%f", diff)
+	}
+
+	// Version bits outside the negotiated mask leave the header alone
+	rolled := &stratumRequest{
+		ID:     2,
+		Method: string(CLIENT_MINING_SUBMIT),
+		Params: []interface{}{"worker", "1", en2, "495fab29", "7c2bac1d", "00002000"},
+	}
+	if d, e := v.shareDifficulty(en1, 0, rolled); e != nil || d != diff {
+		t.Errorf("shareDifficulty() with no mask got:%f error:%v", d, e)
+	}
+	if d, e := v.shareDifficulty(en1, 0x00004000, rolled); e != nil || d != diff {
+		t.Errorf("shareDifficulty() with bits outside the mask got:%f error:%v", d, e)
+	}
+	if d, _ := v.shareDifficulty(en1, versionRollingMask, rolled); d > 1 {
+		t.Errorf("shareDifficulty() with rolled version got:%f", d)
+	}
+
+	request.Params[4] = "7c2bac1e"
+	if diff, _ = v.shareDifficulty(en1, 0, request); diff > 1 {
+		t.Errorf("shareDifficulty() with a bad nonce got:%f", diff)
+	}
+
+	request.Params[1] = "2"
+	if _, e = v.shareDifficulty(en1, 0, request); e != ErrShareUnknownJob {
+		t.Errorf("shareDifficulty() for an unknown job got:%v", e)
+	}
+}
+
+//
+// Retargets follow the share rate, step at most vardiffMaxStep and never
+// go above the pool's difficulty
+//
+func TestVardiffRetarget(t *testing.T) {
+
+	start := time.Now()
+	v := newVardiff(VardiffConfig{ShareInterval: 10 * time.Second, RetargetWindow: time.Minute}, start)
+
+	if !v.setPoolDiff(2048) || v.diff != 2048 {
+		t.Fatalf("setPoolDiff() did not set the first difficulty:%d", v.diff)
+	}
+	if v.setPoolDiff(4096) || v.diff != 2048 {
+		t.Errorf("setPoolDiff() raised the miner difficulty:%d", v.diff)
+	}
+	if !v.setPoolDiff(1024) || v.diff != 1024 || v.setPoolDiff(1024) {
+		t.Errorf("setPoolDiff() did not lower the miner difficulty:%d", v.diff)
+	}
+
+	// One share a minute, six expected: lowered by the max step
+	if retarget := v.share(start.Add(time.Minute)); !retarget || v.diff != 256 {
+		t.Errorf("share() too slow got diff:%d retarget:%t", v.diff, retarget)
+	}
+	if v.minDiff() != 256 {
+		t.Errorf("minDiff() got:%f", v.minDiff())
+	}
+
+	// Twelve shares a minute: doubled
+	now := start.Add(time.Minute)
+	for i := 0; i < 11; i++ {
+		if v.share(now.Add(time.Second)) {
+			t.Fatalf("share() retargeted inside the window")
+		}
+	}
+	if retarget := v.share(now.Add(time.Minute)); !retarget || v.diff != 512 || v.minDiff() != 256 {
+		t.Errorf("share() too fast got diff:%d min:%f", v.diff, v.minDiff())
+	}
+
+	// Far too fast, capped at the pool
+	now = now.Add(time.Minute)
+	for i := 0; i < 100; i++ {
+		v.share(now.Add(time.Second))
+	}
+	if v.share(now.Add(time.Minute)); v.diff != 1024 {
+		t.Errorf("share() went above the pool difficulty:%d", v.diff)
+	}
+}
+
+//
+// A fractional pool difficulty is kept, the miner works at the whole
+// difficulty under it and at least 1
+//
+func TestVardiffFractionalPoolDiff(t *testing.T) {
+
+	v := newVardiff(VardiffConfig{ShareInterval: 10 * time.Second, RetargetWindow: time.Minute}, time.Now())
+
+	if !v.setPoolDiff(1.5) || v.diff != 1 || v.poolDiff != 1.5 {
+		t.Fatalf("setPoolDiff(1.5) got diff:%d pool:%g", v.diff, v.poolDiff)
+	}
+	if v.setPoolDiff(0.5) || v.diff != 1 || v.poolDiff != 0.5 {
+		t.Errorf("setPoolDiff(0.5) got diff:%d pool:%g", v.diff, v.poolDiff)
+	}
+}
+
+//
+// A share goes to the pool when it meets the difficulty of the Dst that
+// issued its job, even one below the default route's
+//
+func TestVardiffSubmitJobDst(t *testing.T) {
+
+	defRoute, standby, fresh := simple.ConnUniqueID(1), simple.ConnUniqueID(2), simple.ConnUniqueID(3)
+	en1 := genesisCoinbase[100:108]
+
+	svs := &StratumV1Struct{
+		srcSetExtranonce: true,
+		dstExtranonce:    map[simple.ConnUniqueID]string{defRoute: en1, standby: en1, fresh: en1},
+		dstLastSetDiff:   map[simple.ConnUniqueID]float64{defRoute: 4096, standby: 2048},
+		vardiff:          newVardiff(VardiffConfig{ShareInterval: time.Second, RetargetWindow: time.Minute}, time.Now()),
+	}
+	svs.vardiff.setPoolDiff(4096)
+	svs.vardiff.setDiff(1024)
+	svs.vardiff.recordJob([]interface{}{"1", "0000000000000000000000000000000000000000000000000000000000000000", genesisCoinbase[:100], genesisCoinbase[116:], []interface{}{}, "00000001", "1d00ffff", "495fab29", true})
+
+	// The genesis share is difficulty 2536
+	request := &stratumRequest{
+		ID:     1,
+		Method: string(CLIENT_MINING_SUBMIT),
+		Params: []interface{}{"worker", "1", genesisCoinbase[108:116], "495fab29", "7c2bac1d"},
+	}
+	for _, uid := range []simple.ConnUniqueID{standby, fresh} {
+		if forward, e := svs.vardiffSubmit(uid, request); !forward || e != nil {
+			t.Errorf("vardiffSubmit() UID:%d forward:%t error:%v", uid, forward, e)
+		}
+	}
+}
+
+//
+// A clean job drops the jobs before it, past vardiffMaxJobs the oldest go
+//
+func TestVardiffRecordJob(t *testing.T) {
+
+	v := newVardiff(VardiffConfig{}, time.Now())
+
+	job := func(id string, clean bool) []interface{} {
+		return []interface{}{id, "", "", "", []interface{}{}, "", "", "", clean}
+	}
+
+	v.recordJob(job("a", false))
+	v.recordJob(job("b", false))
+	if len(v.jobs) != 2 {
+		t.Errorf("recordJob() got:%d jobs", len(v.jobs))
+	}
+
+	v.recordJob(job("c", true))
+	if _, ok := v.jobs["a"]; ok || len(v.jobs) != 1 {
+		t.Errorf("recordJob() kept jobs after a clean job:%v", v.jobs)
+	}
+
+	v.recordJob([]interface{}{"d"})
+	if len(v.jobs) != 1 {
+		t.Errorf("recordJob() took bad params")
+	}
+
+	// A pool that never cleans its jobs
+	for i := 0; i < 2*vardiffMaxJobs; i++ {
+		v.recordJob(job(strconv.Itoa(i), false))
+	}
+	if _, ok := v.jobs["c"]; ok || len(v.jobs) != vardiffMaxJobs || len(v.jobOrder) != vardiffMaxJobs {
+		t.Errorf("recordJob() kept:%d jobs", len(v.jobs))
+	}
+	if _, ok := v.jobs[strconv.Itoa(2*vardiffMaxJobs-1)]; !ok {
+		t.Errorf("recordJob() dropped the newest job")
+	}
+}
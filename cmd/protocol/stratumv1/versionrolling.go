@@ -0,0 +1,195 @@
+package stratumv1
+
+import (
+	"fmt"
+	"strconv"
+
+	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
+	"github.com/daniel-888/proxy-router/lumerinlib"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+//
+// Version rolling (BIP310)
+//
+// The proxy answers the miner's mining.configure itself, granting the bits
+// the miner asked for within the BIP320 mask. Every V1 Dst is then sent its
+// own mining.configure for those bits before the subscribe, and the mask the
+// pool grants, intersected with the miner's, is kept per Dst. SV2 Dsts carry
+// the full version of every share and take the whole grant. Whenever the
+// default route changes to a Dst with a different mask, or the pool changes
+// it with mining.set_version_mask, the miner is sent the new mask.
+//
+
+// Request ID of the proxy's own mining.configure, kept clear of miner IDs
+const versionRollingConfigureID int = 0x7fff0310
+
+//
+// parseVersionMask()
+//
+func parseVersionMask(s string) (mask uint32, e error) {
+	m, e := strconv.ParseUint(s, 16, 32)
+	if e != nil {
+		return 0, fmt.Errorf(lumerinlib.FileLineFunc()+" bad version mask:%q", s)
+	}
+	return uint32(m), nil
+}
+
+//
+// getConfigureVersionRolling()
+// Picks the version-rolling mask and min-bit-count out of a miner's
+// mining.configure, mask is 0 when version rolling is not asked for
+//
+func (r *stratumRequest) getConfigureVersionRolling() (mask uint32, minBitCount int, e error) {
+
+	if len(r.Params) < 2 {
+		return 0, 0, nil
+	}
+
+	extensions, _ := r.Params[0].([]interface{})
+	options, _ := r.Params[1].(map[string]interface{})
+
+	for _, ext := range extensions {
+		if ext != "version-rolling" {
+			continue
+		}
+		mask = versionRollingMask
+		if s, ok := options["version-rolling.mask"].(string); ok {
+			m, e := parseVersionMask(s)
+			if e != nil {
+				return 0, 0, e
+			}
+			mask &= m
+		}
+		if n, ok := options["version-rolling.min-bit-count"].(float64); ok {
+			minBitCount = int(n)
+		}
+	}
+
+	return mask, minBitCount, nil
+}
+
+//
+// getConfigureVersionMask()
+// The mask granted by a pool's mining.configure response, 0 when refused
+//
+func (r *stratumResponse) getConfigureVersionMask() (mask uint32) {
+
+	if r.Error != nil {
+		return 0
+	}
+
+	result, ok := r.Result.(map[string]interface{})
+	if !ok || result["version-rolling"] != true {
+		return 0
+	}
+
+	s, ok := result["version-rolling.mask"].(string)
+	if !ok {
+		return 0
+	}
+
+	mask, e := parseVersionMask(s)
+	if e != nil {
+		return 0
+	}
+
+	return mask
+}
+
+//
+// versionMask()
+// Effective mask of the miner working for a Dst
+//
+func (svs *StratumV1Struct) versionMask(uid simple.ConnUniqueID) uint32 {
+	if svs.dstSV2[uid] != nil {
+		return svs.srcVersionMask & versionRollingMask
+	}
+	return svs.dstVersionMask[uid] & svs.srcVersionMask
+}
+
+//
+// sendConfigure()
+// Asks a V1 Dst for version rolling on the bits granted to the miner
+//
+func (svs *StratumV1Struct) sendConfigure(uid simple.ConnUniqueID) (e error) {
+
+	if svs.srcVersionMask == 0 || svs.dstSV2[uid] != nil {
+		return nil
+	}
+
+	msg, e := createDstConfigureRequestMsg(svs.srcVersionMask, svs.srcVersionMinBits)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createDstConfigureRequestMsg() error:%s", e)
+		return e
+	}
+
+	LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_STOR2DST, msg)
+
+	count, e := svs.protocol.WriteDst(uid, msg)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteDst error:%s", e)
+		return e
+	}
+	if count != len(msg) {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteDst bad count:%d, %d", count, len(msg))
+		return fmt.Errorf(lumerinlib.FileLineFunc()+" WriteDst bad count:%d, %d", count, len(msg))
+	}
+
+	return nil
+}
+
+//
+// handleDstConfigureResponse()
+// Records the mask a V1 Dst granted, a refusal or an error leaves it 0
+//
+func (svs *StratumV1Struct) handleDstConfigureResponse(uid simple.ConnUniqueID, response *stratumResponse) (e error) {
+
+	svs.dstVersionMask[uid] = response.getConfigureVersionMask() & svs.srcVersionMask
+
+	contextlib.Logf(svs.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+" UID:%d version mask:%08x", uid, svs.dstVersionMask[uid])
+
+	if defRouteUid, _ := svs.protocol.GetDefaultRouteUID(); defRouteUid == uid {
+		return svs.sendVersionMaskNotice(uid)
+	}
+
+	return nil
+}
+
+//
+// sendVersionMaskNotice()
+// Tells the miner the mask of the Dst when it differs from the last one it got
+//
+func (svs *StratumV1Struct) sendVersionMaskNotice(uid simple.ConnUniqueID) (e error) {
+
+	if svs.srcVersionMask == 0 {
+		return nil
+	}
+
+	mask := svs.versionMask(uid)
+	if mask == svs.srcVersionMaskSent {
+		return nil
+	}
+
+	msg, e := createSetVersionMaskNoticeMsg(mask)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" createSetVersionMaskNoticeMsg() error:%s", e)
+		return e
+	}
+
+	LogJson(svs.Ctx(), lumerinlib.FileLineFunc(), JSON_SEND_STOR2SRC, msg)
+
+	count, e := svs.protocol.WriteSrc(msg)
+	if e != nil {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write error:%s", e)
+		return e
+	}
+	if count != len(msg) {
+		contextlib.Logf(svs.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Write bad count:%d, %d", count, len(msg))
+		return fmt.Errorf(lumerinlib.FileLineFunc()+" WriteSrc bad count:%d, %d", count, len(msg))
+	}
+
+	svs.srcVersionMaskSent = mask
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package stratumv1
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daniel-888/proxy-router/lumerinlib/testinglib"
+)
+
+func TestConfigureVersionRolling(t *testing.T) {
+
+	request := &stratumRequest{
+		ID:     1,
+		Method: string(CLIENT_MINING_CONFIGURE),
+		Params: []interface{}{
+			[]interface{}{"minimum-difficulty", "version-rolling"},
+			map[string]interface{}{"version-rolling.mask": "ffffffff", "version-rolling.min-bit-count": float64(2)},
+		},
+	}
+	mask, minBitCount, e := request.getConfigureVersionRolling()
+	if e != nil || mask != versionRollingMask || minBitCount != 2 {
+		t.Errorf("getConfigureVersionRolling() got:%08x %d %v", mask, minBitCount, e)
+	}
+
+	request.Params[0] = []interface{}{"minimum-difficulty"}
+	if mask, _, e = request.getConfigureVersionRolling(); e != nil || mask != 0 {
+		t.Errorf("getConfigureVersionRolling() without version-rolling got:%08x %v", mask, e)
+	}
+
+	request.Params[0] = []interface{}{"version-rolling"}
+	request.Params[1] = map[string]interface{}{"version-rolling.mask": "zz"}
+	if _, _, e = request.getConfigureVersionRolling(); e == nil {
+		t.Errorf("getConfigureVersionRolling() took a bad mask")
+	}
+
+	response := &stratumResponse{ID: 1, Result: map[string]interface{}{"version-rolling": true, "version-rolling.mask": "00ffe000"}}
+	if mask = response.getConfigureVersionMask(); mask != 0x00ffe000 {
+		t.Errorf("getConfigureVersionMask() got:%08x", mask)
+	}
+
+	response.Result = map[string]interface{}{"version-rolling": false}
+	if mask = response.getConfigureVersionMask(); mask != 0 {
+		t.Errorf("getConfigureVersionMask() refused got:%08x", mask)
+	}
+
+	reason := "Method not found"
+	response = &stratumResponse{ID: 1, Error: &reason}
+	if mask = response.getConfigureVersionMask(); mask != 0 {
+		t.Errorf("getConfigureVersionMask() error got:%08x", mask)
+	}
+}
+
+//
+// The miner is granted the BIP320 bits, the pool only part of them: the
+// miner is told the narrower mask once the pool is its route, and the
+// pool's later mining.set_version_mask is passed on
+//
+func TestNewSrc2PoolVersionRolling(t *testing.T) {
+
+	localport := testinglib.GetRandPort()
+	nodeaddr := net.JoinHostPort(localhost, strconv.Itoa(localport))
+
+	poolListener, e := net.Listen("tcp", fmt.Sprintf("%s:0", localhost))
+	if e != nil {
+		t.Fatalf("Listen() error:%s", e)
+	}
+	defer poolListener.Close()
+
+	defdest := createDest("LocalPriPoolDestID", fmt.Sprintf("stratum+tcp://poolworker:password@%s/", poolListener.Addr()))
+	ctx := newContextStruct(t, nodeaddr, defdest)
+
+	sls := newStratumConnection(t, ctx)
+	defer sls.Cancel()
+
+	widen := make(chan struct{})
+	poolErr := make(chan error, 1)
+	go func() { poolErr <- fakeV1VersionRollingPool(poolListener, widen) }()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, e = net.Dial("tcp", nodeaddr); e == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if e != nil {
+		t.Fatalf("Dial() error:%s", e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	miner := bufio.NewReader(conn)
+
+	send := func(msg string) {
+		if _, e := conn.Write([]byte(msg + "\n")); e != nil {
+			t.Fatalf("Write() error:%s", e)
+		}
+	}
+	recv := func() (m map[string]interface{}) {
+		line, e := miner.ReadBytes('\n')
+		if e != nil {
+			t.Fatalf("ReadBytes() error:%s", e)
+		}
+		if e = json.Unmarshal(line, &m); e != nil {
+			t.Fatalf("Unmarshal(%s) error:%s", line, e)
+		}
+		return m
+	}
+	recvVersionMask := func() string {
+		for {
+			m := recv()
+			if m["method"] == string(SERVER_MINING_SET_VERSION_MASK) {
+				params, _ := m["params"].([]interface{})
+				if len(params) != 1 {
+					t.Fatalf("bad set_version_mask:%v", m)
+				}
+				s, _ := params[0].(string)
+				return s
+			}
+		}
+	}
+
+	send(`{"id":1,"method":"mining.configure","params":[["version-rolling"],{"version-rolling.mask":"ffffffff","version-rolling.min-bit-count":2}]}`)
+	configure := recv()
+	result, _ := configure["result"].(map[string]interface{})
+	if result["version-rolling"] != true || result["version-rolling.mask"] != "1fffe000" {
+		t.Fatalf("bad configure response:%v", configure)
+	}
+
+	send(`{"id":2,"method":"mining.subscribe","params":["test/1.0"]}`)
+	recv()
+	send(`{"id":3,"method":"mining.authorize","params":["minerworker",""]}`)
+	if auth := recv(); auth["result"] != true {
+		t.Fatalf("bad authorize response:%v", auth)
+	}
+
+	if mask := recvVersionMask(); mask != "00ffe000" {
+		t.Fatalf("set_version_mask on switch got:%s", mask)
+	}
+
+	close(widen)
+	if mask := recvVersionMask(); mask != "1fffe000" {
+		t.Fatalf("set_version_mask from the pool got:%s", mask)
+	}
+
+	if e = <-poolErr; e != nil {
+		t.Fatalf("pool error:%s", e)
+	}
+}
+
+//
+// fakeV1VersionRollingPool()
+// Grants 00ffe000 to the proxy's configure, then widens the mask to the
+// BIP320 bits when widen is closed
+//
+func fakeV1VersionRollingPool(l net.Listener, widen chan struct{}) (e error) {
+
+	conn, e := l.Accept()
+	if e != nil {
+		return e
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	write := func(m interface{}) error {
+		msg, e := json.Marshal(m)
+		if e != nil {
+			return e
+		}
+		_, e = conn.Write(append(msg, '\n'))
+		return e
+	}
+
+	for authorized := false; !authorized; {
+		line, e := reader.ReadBytes('\n')
+		if e != nil {
+			return e
+		}
+		var request stratumRequest
+		if e = json.Unmarshal(line, &request); e != nil {
+			return e
+		}
+
+		switch request.Method {
+		case string(CLIENT_MINING_CONFIGURE):
+			options, _ := request.Params[1].(map[string]interface{})
+			if options["version-rolling.mask"] != "1fffe000" || options["version-rolling.min-bit-count"] != float64(2) {
+				return fmt.Errorf("pool got configure:%s", line)
+			}
+			e = write(&stratumResponse{ID: request.ID, Result: map[string]interface{}{"version-rolling": true, "version-rolling.mask": "00ffe000"}})
+		case string(CLIENT_MINING_SUBSCRIBE):
+			e = write(&stratumResponse{ID: request.ID, Result: []interface{}{[]interface{}{}, "ee01", 4}})
+		case string(CLIENT_MINING_AUTHORIZE):
+			e = write(&stratumResponse{ID: request.ID, Result: true})
+			authorized = true
+		default:
+			return fmt.Errorf("pool got:%s", line)
+		}
+		if e != nil {
+			return e
+		}
+	}
+
+	if e = write(&stratumNotice{Method: string(SERVER_MINING_SET_DIFFICULTY), Params: []interface{}{1024}}); e != nil {
+		return e
+	}
+
+	<-widen
+	return write(&stratumNotice{Method: string(SERVER_MINING_SET_VERSION_MASK), Params: []interface{}{"1fffe000"}})
+}
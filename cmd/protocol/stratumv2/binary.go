@@ -0,0 +1,220 @@
+package stratumv2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+//
+// Stratum V2 binary data types
+//
+// Every integer is little endian. Variable length fields carry their length
+// in front of them: one byte for STR0_255, B0_32, B0_255 and SEQ0_255, two
+// bytes for B0_64K.
+//
+
+var ErrShortMessage = errors.New("StratumV2: message too short")
+var ErrFieldTooLong = errors.New("StratumV2: field too long")
+
+type U256 [32]byte
+
+//
+// encoder appends fields to buf, the first error sticks
+//
+type encoder struct {
+	buf []byte
+	err error
+}
+
+func (e *encoder) u8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.u8(1)
+	} else {
+		e.u8(0)
+	}
+}
+
+func (e *encoder) u16(v uint16) {
+	e.buf = append(e.buf, byte(v), byte(v>>8))
+}
+
+func (e *encoder) u24(v uint32) {
+	e.buf = append(e.buf, byte(v), byte(v>>8), byte(v>>16))
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = append(e.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.u32(uint32(v))
+	e.u32(uint32(v >> 32))
+}
+
+func (e *encoder) f32(v float32) {
+	e.u32(math.Float32bits(v))
+}
+
+func (e *encoder) u256(v U256) {
+	e.buf = append(e.buf, v[:]...)
+}
+
+func (e *encoder) bytes(b []byte, max int, lenSize int) {
+	if len(b) > max {
+		if e.err == nil {
+			e.err = fmt.Errorf("%w: %d bytes, max %d", ErrFieldTooLong, len(b), max)
+		}
+		return
+	}
+	if lenSize == 1 {
+		e.u8(uint8(len(b)))
+	} else {
+		e.u16(uint16(len(b)))
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) str0_255(s string) { e.bytes([]byte(s), 255, 1) }
+func (e *encoder) b0_32(b []byte)    { e.bytes(b, 32, 1) }
+func (e *encoder) b0_64k(b []byte)   { e.bytes(b, 65535, 2) }
+
+func (e *encoder) optionU32(v *uint32) {
+	if v == nil {
+		e.u8(0)
+		return
+	}
+	e.u8(1)
+	e.u32(*v)
+}
+
+func (e *encoder) seq0_255U256(v []U256) {
+	if len(v) > 255 {
+		if e.err == nil {
+			e.err = fmt.Errorf("%w: %d items, max 255", ErrFieldTooLong, len(v))
+		}
+		return
+	}
+	e.u8(uint8(len(v)))
+	for _, u := range v {
+		e.u256(u)
+	}
+}
+
+//
+// decoder reads fields off buf, once it runs short every read returns the
+// zero value and err is set
+//
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = ErrShortMessage
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) bool() bool {
+	return d.u8()&1 == 1
+}
+
+func (d *decoder) u16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (d *decoder) u24() uint32 {
+	b := d.next(3)
+	if b == nil {
+		return 0
+	}
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func (d *decoder) u32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) u64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (d *decoder) f32() float32 {
+	return math.Float32frombits(d.u32())
+}
+
+func (d *decoder) u256() (v U256) {
+	copy(v[:], d.next(32))
+	return v
+}
+
+func (d *decoder) bytes(max int, lenSize int) []byte {
+	var n int
+	if lenSize == 1 {
+		n = int(d.u8())
+	} else {
+		n = int(d.u16())
+	}
+	if n > max && d.err == nil {
+		d.err = fmt.Errorf("%w: %d bytes, max %d", ErrFieldTooLong, n, max)
+	}
+	b := d.next(n)
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (d *decoder) str0_255() string { return string(d.bytes(255, 1)) }
+func (d *decoder) b0_32() []byte    { return d.bytes(32, 1) }
+func (d *decoder) b0_64k() []byte   { return d.bytes(65535, 2) }
+
+func (d *decoder) optionU32() *uint32 {
+	if d.u8() == 0 {
+		return nil
+	}
+	v := d.u32()
+	return &v
+}
+
+func (d *decoder) seq0_255U256() []U256 {
+	n := int(d.u8())
+	v := make([]U256, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		v = append(v, d.u256())
+	}
+	return v
+}
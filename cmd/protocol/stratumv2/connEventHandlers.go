@@ -0,0 +1,501 @@
+package stratumv2
+
+import (
+	"fmt"
+	"strconv"
+
+	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
+	"github.com/daniel-888/proxy-router/cmd/lumerinnetwork/connectionmanager"
+	"github.com/daniel-888/proxy-router/cmd/protocol"
+	"github.com/daniel-888/proxy-router/lumerinlib"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+//
+// handleConnOpenEvent()
+// UID is the unique ID of the DST connection
+// UID is what is fed to the connection functions like Write
+// New connection starts off in the new state, immediatly send the first
+// handshake message
+//
+func (s *StratumV2Struct) handleConnOpenEvent(scoe *simple.SimpleConnOpenEvent) (e error) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" called")
+
+	e = scoe.Err()
+	if nil != e {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" scre had an error:%v", scoe)
+		return e
+	}
+
+	uid := scoe.UniqueID()
+	dest := scoe.Dest()
+
+	// A redialed connection comes back without its Dest
+	if dest == nil {
+		dest = s.dstDest[uid]
+	}
+	if dest == nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d has no Dest", uid)
+		return fmt.Errorf(lumerinlib.FileLineFunc()+" UID:%d has no Dest", uid)
+	}
+
+	e = s.protocol.GetDstStruct().NewProtocolDstStruct(scoe)
+	if e != nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" NewProtocolDstStruct() error:%s", e)
+		return e
+	}
+	s.dstState[uid] = DstStateNew
+	s.dstDest[uid] = dest
+
+	dstconn, e := s.protocol.GetDstConn(uid)
+	if e != nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" GetDstConn() bad index:%d", uid)
+		return e
+	}
+	dstconn.SetState(protocol.ConnStateReady)
+
+	return s.startDstHandshake(uid)
+}
+
+//
+// startDstHandshake()
+// Sends the first handshake message to the Dst
+// State Transition: DstStateNew -> DstStateHandshaking
+//
+func (s *StratumV2Struct) startDstHandshake(uid simple.ConnUniqueID) (e error) {
+
+	dest := s.dstDest[uid]
+
+	authority, e := DestAuthorityKey(dest)
+	if e != nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d error:%s", uid, e)
+		s.SetDstStateUid(uid, DstStateError)
+		return e
+	}
+	if authority == nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelWarn, lumerinlib.FileLineFunc()+" Dest:%s has no authority key, the pool certificate is not checked", dest.ID)
+	}
+
+	codec, act1, e := NewInitiator(authority)
+	if e != nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" NewInitiator() error:%s", e)
+		s.SetDstStateUid(uid, DstStateError)
+		return e
+	}
+	s.dstCodec[uid] = codec
+
+	count, e := s.protocol.WriteDst(uid, act1)
+	if e != nil || count != len(act1) {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteDst count:%d, %d error:%v", count, len(act1), e)
+		s.SetDstStateUid(uid, DstStateError)
+		return e
+	}
+
+	s.SetDstStateUid(uid, DstStateHandshaking)
+
+	return nil
+}
+
+//
+// handleConnReadEvent()
+// Look up the connection index
+// Pass the data through the connection's codec
+// Run the messages through a handle routine
+//
+func (s *StratumV2Struct) handleConnReadEvent(scre *simple.SimpleConnReadEvent) (e error) {
+
+	uid := scre.UniqueID()
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called UID:%d", uid)
+
+	e = scre.Err()
+	if nil != e {
+		switch e {
+		case connectionmanager.ErrConnMgrClosed:
+			contextlib.Logf(s.Ctx(), contextlib.LevelDebug, lumerinlib.FileLineFunc()+" Connection Manager Closed, closing down the stratum connection here")
+			s.Cancel()
+			return nil
+		case connectionmanager.ErrConnDstClosed:
+			contextlib.Logf(s.Ctx(), contextlib.LevelDebug, lumerinlib.FileLineFunc()+" Dst:%d Closed -> Redialing", uid)
+			return s.DstRedialUid(uid)
+		default:
+			contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Dst:%d  Error not handled:%s", uid, e)
+		}
+
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" scre had an error:%s", e)
+	}
+
+	data := scre.Data()
+	if len(data) == 0 {
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" scre had no data")
+	}
+
+	var codec *Codec
+	if uid < 0 {
+		codec = s.srcCodec
+	} else {
+		codec = s.dstCodec[uid]
+	}
+	if codec == nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d has no codec, dropping %d bytes", uid, len(data))
+		return nil
+	}
+
+	ready := codec.Ready()
+
+	msgs, reply, e := codec.Feed(data)
+	if e != nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d Feed() error:%s", uid, e)
+		if uid < 0 {
+			s.SetSrcState(SrcStateError)
+			return e
+		}
+		s.SetDstStateUid(uid, DstStateError)
+		s.CloseUid(uid)
+		return nil
+	}
+
+	//
+	// Handshake finished
+	//
+	if !ready && codec.Ready() {
+		if uid < 0 {
+			count, e := s.protocol.WriteSrc(reply)
+			if e != nil || count != len(reply) {
+				contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" WriteSrc count:%d, %d error:%v", count, len(reply), e)
+				return fmt.Errorf(lumerinlib.FileLineFunc()+" WriteSrc bad count:%d, %d", count, len(reply))
+			}
+			s.SetSrcState(SrcStateSecured)
+		} else {
+			e = s.sendDstSetupConnection(uid)
+			if e != nil {
+				return e
+			}
+		}
+	}
+
+	for _, m := range msgs {
+		if uid < 0 {
+			LogMsg(s.Ctx(), lumerinlib.FileLineFunc(), MSG_RECV_SRC, m)
+			e = s.handleSrcMsg(m)
+		} else {
+			LogMsg(s.Ctx(), lumerinlib.FileLineFunc(), MSG_RECV_DST, m)
+			e = s.handleDstMsg(uid, m)
+		}
+		if e != nil {
+			break
+		}
+	}
+
+	return e
+}
+
+// -------------------------------------------------------------------------
+// Incoming Conn SRC Messages
+// -------------------------------------------------------------------------
+
+//
+// handleSrcMsg()
+//
+func (s *StratumV2Struct) handleSrcMsg(m Message) (e error) {
+
+	switch m := m.(type) {
+	case *SetupConnection:
+		e = s.handleSrcSetupConnection(m)
+	case *OpenStandardMiningChannel:
+		e = s.handleSrcOpenChannel(m, m.RequestID)
+	case *OpenExtendedMiningChannel:
+		e = s.handleSrcOpenChannel(m, m.RequestID)
+	case *SubmitSharesStandard:
+		e = s.handleSrcSubmit(m)
+	case *SubmitSharesExtended:
+		e = s.handleSrcSubmit(m)
+	case *CloseChannel:
+		contextlib.Logf(s.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+" Src closed its channel:%s", m.ReasonCode)
+		e = ErrSrcChannelClosed
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Recieved:%s, IGNORING", m.Type())
+		LogMsg(s.Ctx(), lumerinlib.FileLineFunc(), MSG_DROP_SRC, m)
+	}
+
+	return e
+}
+
+//
+// handleSrcSetupConnection()
+// State Transition: SrcStateSecured -> SrcStateSetup
+//
+func (s *StratumV2Struct) handleSrcSetupConnection(m *SetupConnection) (e error) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" enter")
+
+	state := s.GetSrcState()
+	if state != SrcStateSecured {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Got SetupConnection in state:%s", state)
+		return ErrBadSrcState
+	}
+
+	var code string
+	switch {
+	case m.Protocol != ProtocolMining:
+		code = "unsupported-protocol"
+	case m.MinVersion > ProtocolVersion || m.MaxVersion < ProtocolVersion:
+		code = "protocol-version-mismatch"
+	}
+
+	if code != "" {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" SetupConnection rejected:%s", code)
+		s.writeSrc(MSG_SEND_STOR2SRC, &SetupConnectionError{Flags: 0, ErrorCode: code})
+		return ErrSrcReqNotSupported
+	}
+
+	r := *m
+	s.srcSetup = &r
+	s.SetSrcState(SrcStateSetup)
+
+	return s.writeSrc(MSG_SEND_STOR2SRC, &SetupConnectionSuccess{UsedVersion: ProtocolVersion, Flags: 0})
+}
+
+//
+// handleSrcOpenChannel()
+// State Transition: SrcStateSetup -> SrcStateOpening
+// Open Comm to Default Dst Here, the miner gets its channel once the Dst
+// opened one
+//
+func (s *StratumV2Struct) handleSrcOpenChannel(m Message, requestID uint32) (e error) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" enter")
+
+	state := s.GetSrcState()
+	if state != SrcStateSetup {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Got %s in state:%s, only one channel is supported", m.Type(), state)
+		s.writeSrc(MSG_SEND_STOR2SRC, &OpenMiningChannelError{RequestID: requestID, ErrorCode: "max-channels-reached"})
+		return nil
+	}
+
+	//
+	// A refused miner may try another user identity
+	//
+	e = s.authenticate(m)
+	if e != nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelWarn, lumerinlib.FileLineFunc()+" Miner:%s channel refused:%s", s.minerRec.ID, e)
+		return s.writeSrc(MSG_SEND_STOR2SRC, &OpenMiningChannelError{RequestID: requestID, ErrorCode: "unknown-user"})
+	}
+
+	s.srcOpen = m
+	s.SetSrcState(SrcStateOpening)
+
+	//
+	// Sets up mining record in the MsgBus
+	//
+	s.newMinerRecordPub()
+
+	//
+	// Open up the default pool connection
+	//
+	return s.openDefaultConnection()
+}
+
+//
+// handleSrcSubmit()
+// Passes the share to the default route on its channel
+//
+func (s *StratumV2Struct) handleSrcSubmit(m ChannelMessage) (e error) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" enter")
+
+	state := s.GetSrcState()
+	if state != SrcStateRunning {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Got Submit in state:%s", state)
+		return ErrBadSrcState
+	}
+
+	uid, e := s.protocol.GetDefaultRouteUID()
+	if e != nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Default Route error:%s", e)
+		return e
+	}
+
+	ch := s.dstChannel[uid]
+	if ch == nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Default Route UID:%d has no channel", uid)
+		LogMsg(s.Ctx(), lumerinlib.FileLineFunc(), MSG_DROP_SRC, m)
+		return nil
+	}
+
+	m.SetChannel(ch.id)
+
+	e = s.writeDst(uid, MSG_SEND_SRC2DST, m)
+	if e != nil {
+		return e
+	}
+
+	// Call switchDest to change destinations if needed and we are set for OnSubmit
+	if s.scheduler == OnSubmit {
+		s.switchDest()
+	}
+
+	return nil
+}
+
+// -------------------------------------------------------------------------
+// Incoming Conn DST Messages
+// -------------------------------------------------------------------------
+
+//
+// sendDstSetupConnection()
+// State Transition: DstStateHandshaking -> DstStateSettingUp
+//
+func (s *StratumV2Struct) sendDstSetupConnection(uid simple.ConnUniqueID) (e error) {
+
+	if s.srcSetup == nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" UID:%d no SetupConnection from the Src", uid)
+	}
+
+	// The miner's SetupConnection, pointed at the Dest
+	setup := *s.srcSetup
+	dest := s.dstDest[uid]
+	setup.EndpointHost = dest.Host()
+	if port, e := strconv.ParseUint(dest.Port(), 10, 16); e == nil {
+		setup.EndpointPort = uint16(port)
+	}
+
+	s.SetDstStateUid(uid, DstStateSettingUp)
+
+	e = s.writeDst(uid, MSG_SEND_STOR2DST, &setup)
+	if e != nil {
+		s.SetDstStateUid(uid, DstStateError)
+	}
+
+	return e
+}
+
+//
+// handleDstMsg()
+//
+func (s *StratumV2Struct) handleDstMsg(uid simple.ConnUniqueID, m Message) (e error) {
+
+	dststate := s.GetDstStateUid(uid)
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" DST UID:%d State:%s Msg:%s", uid, dststate, m.Type())
+
+	switch m := m.(type) {
+	case *SetupConnectionSuccess:
+		if dststate != DstStateSettingUp {
+			contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d Got %s in state:%s", uid, m.Type(), dststate)
+			return nil
+		}
+		return s.sendDstOpenChannel(uid)
+
+	case *SetupConnectionError:
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d error:%s", uid, m.ErrorCode)
+		s.SetDstStateUid(uid, DstStateError)
+		s.CloseUid(uid)
+		return nil
+
+	case *OpenStandardMiningChannelSuccess, *OpenExtendedMiningChannelSuccess:
+		if dststate != DstStateOpening {
+			contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d Got %s in state:%s", uid, m.Type(), dststate)
+			return nil
+		}
+
+		s.dstChannel[uid] = newDstChannel(m)
+		s.dstReDialCount[uid] = 0
+		s.SetDstStateUid(uid, DstStateStandBy)
+
+		if s.scheduler == OnDemand || s.GetSrcState() == SrcStateOpening {
+			s.switchDest()
+		}
+		return nil
+
+	case *OpenMiningChannelError:
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d error:%s", uid, m.ErrorCode)
+		s.SetDstStateUid(uid, DstStateError)
+		s.CloseUid(uid)
+		return nil
+
+	case ChannelMessage:
+		return s.handleDstChannelMsg(uid, m)
+
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d Recieved:%s, IGNORING", uid, m.Type())
+		LogMsg(s.Ctx(), lumerinlib.FileLineFunc(), MSG_DROP_DST, m)
+	}
+
+	return nil
+}
+
+//
+// sendDstOpenChannel()
+// Opens the same kind of channel the Src asked for, as the Dest's user
+// State Transition: DstStateSettingUp -> DstStateOpening
+//
+func (s *StratumV2Struct) sendDstOpenChannel(uid simple.ConnUniqueID) (e error) {
+
+	username := s.dstDest[uid].Username()
+
+	var open Message
+	switch o := s.srcOpen.(type) {
+	case *OpenStandardMiningChannel:
+		r := *o
+		r.UserIdentity = username
+		open = &r
+	case *OpenExtendedMiningChannel:
+		r := *o
+		r.UserIdentity = username
+		open = &r
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" bad srcOpen:%T", s.srcOpen)
+	}
+
+	s.SetDstStateUid(uid, DstStateOpening)
+
+	e = s.writeDst(uid, MSG_SEND_STOR2DST, open)
+	if e != nil {
+		s.SetDstStateUid(uid, DstStateError)
+	}
+
+	return e
+}
+
+//
+// handleDstChannelMsg()
+// Jobs, targets and share results on the Dst's channel. They are recorded
+// for a later switch, and passed to the Src when the Dst is running.
+//
+func (s *StratumV2Struct) handleDstChannelMsg(uid simple.ConnUniqueID, m ChannelMessage) (e error) {
+
+	ch := s.dstChannel[uid]
+	if ch == nil || (m.Channel() != ch.id && m.Channel() != ch.groupID) {
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d message for unknown channel:%d", uid, m.Channel())
+		LogMsg(s.Ctx(), lumerinlib.FileLineFunc(), MSG_DROP_DST, m)
+		return nil
+	}
+
+	switch m.(type) {
+	case *SubmitSharesSuccess, *SubmitSharesError:
+		// Results for shares sent before a switch still go to the miner
+		m.SetChannel(SrcChannelID)
+		return s.writeSrc(MSG_SEND_DST2SRC, m)
+	case *CloseChannel:
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d Dst closed the channel", uid)
+		return s.DstRedialUid(uid)
+	}
+
+	ch.record(m)
+
+	dststate := s.GetDstStateUid(uid)
+	switch dststate {
+	case DstStateRunning:
+		m.SetChannel(SrcChannelID)
+		return s.writeSrc(MSG_SEND_DST2SRC, m)
+	case DstStateStandBy:
+		contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" State:%s... Store the message", dststate)
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" UID:%d state:%s not handled", uid, dststate)
+		LogMsg(s.Ctx(), lumerinlib.FileLineFunc(), MSG_DROP_DST, m)
+	}
+
+	return nil
+}
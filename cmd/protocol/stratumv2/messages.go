@@ -0,0 +1,680 @@
+package stratumv2
+
+import (
+	"errors"
+	"fmt"
+)
+
+//
+// Stratum V2 frames and the Mining Protocol messages the proxy handles
+//
+// A frame is a 6 byte header, extension_type U16, msg_type U8 and
+// msg_length U24, followed by msg_length bytes of payload. The top bit of
+// extension_type is set for messages addressed to a channel, their payload
+// starts with the channel_id.
+//
+
+var ErrUnknownMsgType = errors.New("StratumV2: unknown message type")
+var ErrUnknownExtension = errors.New("StratumV2: unknown extension type")
+var ErrTrailingData = errors.New("StratumV2: trailing data after message")
+
+const FrameHeaderLen int = 6
+const MaxPayloadLen int = 1<<24 - 1
+
+const channelMsgBit uint16 = 0x8000
+
+// Protocol values of SetupConnection
+const ProtocolMining uint8 = 0
+
+// The only version of the protocol there is
+const ProtocolVersion uint16 = 2
+
+type MsgType uint8
+
+const (
+	MsgSetupConnection                  MsgType = 0x00
+	MsgSetupConnectionSuccess           MsgType = 0x01
+	MsgSetupConnectionError             MsgType = 0x02
+	MsgOpenStandardMiningChannel        MsgType = 0x10
+	MsgOpenStandardMiningChannelSuccess MsgType = 0x11
+	MsgOpenMiningChannelError           MsgType = 0x12
+	MsgOpenExtendedMiningChannel        MsgType = 0x13
+	MsgOpenExtendedMiningChannelSuccess MsgType = 0x14
+	MsgNewMiningJob                     MsgType = 0x15
+	MsgCloseChannel                     MsgType = 0x18
+	MsgSetExtranoncePrefix              MsgType = 0x19
+	MsgSubmitSharesStandard             MsgType = 0x1a
+	MsgSubmitSharesExtended             MsgType = 0x1b
+	MsgSubmitSharesSuccess              MsgType = 0x1c
+	MsgSubmitSharesError                MsgType = 0x1d
+	MsgNewExtendedMiningJob             MsgType = 0x1f
+	MsgSetNewPrevHash                   MsgType = 0x20
+	MsgSetTarget                        MsgType = 0x21
+)
+
+var msgNames = map[MsgType]string{
+	MsgSetupConnection:                  "SetupConnection",
+	MsgSetupConnectionSuccess:           "SetupConnection.Success",
+	MsgSetupConnectionError:             "SetupConnection.Error",
+	MsgOpenStandardMiningChannel:        "OpenStandardMiningChannel",
+	MsgOpenStandardMiningChannelSuccess: "OpenStandardMiningChannel.Success",
+	MsgOpenMiningChannelError:           "OpenMiningChannel.Error",
+	MsgOpenExtendedMiningChannel:        "OpenExtendedMiningChannel",
+	MsgOpenExtendedMiningChannelSuccess: "OpenExtendedMiningChannel.Success",
+	MsgNewMiningJob:                     "NewMiningJob",
+	MsgCloseChannel:                     "CloseChannel",
+	MsgSetExtranoncePrefix:              "SetExtranoncePrefix",
+	MsgSubmitSharesStandard:             "SubmitSharesStandard",
+	MsgSubmitSharesExtended:             "SubmitSharesExtended",
+	MsgSubmitSharesSuccess:              "SubmitShares.Success",
+	MsgSubmitSharesError:                "SubmitShares.Error",
+	MsgNewExtendedMiningJob:             "NewExtendedMiningJob",
+	MsgSetNewPrevHash:                   "SetNewPrevHash",
+	MsgSetTarget:                        "SetTarget",
+}
+
+func (t MsgType) String() string {
+	if name, ok := msgNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MsgType(0x%02x)", uint8(t))
+}
+
+type FrameHeader struct {
+	ExtensionType uint16
+	MsgType       MsgType
+	MsgLength     uint32
+}
+
+//
+// Message is implemented by every message struct below
+//
+type Message interface {
+	Type() MsgType
+	encode(e *encoder)
+	decode(d *decoder)
+}
+
+//
+// ChannelMessage is a Message addressed to a channel, the proxy rewrites
+// the channel ID when relaying it
+//
+type ChannelMessage interface {
+	Message
+	Channel() uint32
+	SetChannel(id uint32)
+}
+
+type SetupConnection struct {
+	Protocol        uint8
+	MinVersion      uint16
+	MaxVersion      uint16
+	Flags           uint32
+	EndpointHost    string
+	EndpointPort    uint16
+	Vendor          string
+	HardwareVersion string
+	Firmware        string
+	DeviceID        string
+}
+
+type SetupConnectionSuccess struct {
+	UsedVersion uint16
+	Flags       uint32
+}
+
+type SetupConnectionError struct {
+	Flags     uint32
+	ErrorCode string
+}
+
+type OpenStandardMiningChannel struct {
+	RequestID       uint32
+	UserIdentity    string
+	NominalHashRate float32
+	MaxTarget       U256
+}
+
+type OpenStandardMiningChannelSuccess struct {
+	RequestID        uint32
+	ChannelID        uint32
+	Target           U256
+	ExtranoncePrefix []byte
+	GroupChannelID   uint32
+}
+
+type OpenMiningChannelError struct {
+	RequestID uint32
+	ErrorCode string
+}
+
+type OpenExtendedMiningChannel struct {
+	RequestID         uint32
+	UserIdentity      string
+	NominalHashRate   float32
+	MaxTarget         U256
+	MinExtranonceSize uint16
+}
+
+type OpenExtendedMiningChannelSuccess struct {
+	RequestID        uint32
+	ChannelID        uint32
+	Target           U256
+	ExtranonceSize   uint16
+	ExtranoncePrefix []byte
+}
+
+//
+// NewMiningJob with a nil MinNTime is a future job, started by the
+// SetNewPrevHash naming it
+//
+type NewMiningJob struct {
+	ChannelID  uint32
+	JobID      uint32
+	MinNTime   *uint32
+	Version    uint32
+	MerkleRoot U256
+}
+
+type NewExtendedMiningJob struct {
+	ChannelID             uint32
+	JobID                 uint32
+	MinNTime              *uint32
+	Version               uint32
+	VersionRollingAllowed bool
+	MerklePath            []U256
+	CoinbaseTxPrefix      []byte
+	CoinbaseTxSuffix      []byte
+}
+
+type CloseChannel struct {
+	ChannelID  uint32
+	ReasonCode string
+}
+
+type SetExtranoncePrefix struct {
+	ChannelID        uint32
+	ExtranoncePrefix []byte
+}
+
+type SubmitSharesStandard struct {
+	ChannelID      uint32
+	SequenceNumber uint32
+	JobID          uint32
+	Nonce          uint32
+	NTime          uint32
+	Version        uint32
+}
+
+type SubmitSharesExtended struct {
+	ChannelID      uint32
+	SequenceNumber uint32
+	JobID          uint32
+	Nonce          uint32
+	NTime          uint32
+	Version        uint32
+	Extranonce     []byte
+}
+
+type SubmitSharesSuccess struct {
+	ChannelID               uint32
+	LastSequenceNumber      uint32
+	NewSubmitsAcceptedCount uint32
+	NewSharesSum            uint64
+}
+
+type SubmitSharesError struct {
+	ChannelID      uint32
+	SequenceNumber uint32
+	ErrorCode      string
+}
+
+type SetNewPrevHash struct {
+	ChannelID uint32
+	JobID     uint32
+	PrevHash  U256
+	MinNTime  uint32
+	NBits     uint32
+}
+
+type SetTarget struct {
+	ChannelID     uint32
+	MaximumTarget U256
+}
+
+func (*SetupConnection) Type() MsgType                  { return MsgSetupConnection }
+func (*SetupConnectionSuccess) Type() MsgType           { return MsgSetupConnectionSuccess }
+func (*SetupConnectionError) Type() MsgType             { return MsgSetupConnectionError }
+func (*OpenStandardMiningChannel) Type() MsgType        { return MsgOpenStandardMiningChannel }
+func (*OpenStandardMiningChannelSuccess) Type() MsgType { return MsgOpenStandardMiningChannelSuccess }
+func (*OpenMiningChannelError) Type() MsgType           { return MsgOpenMiningChannelError }
+func (*OpenExtendedMiningChannel) Type() MsgType        { return MsgOpenExtendedMiningChannel }
+func (*OpenExtendedMiningChannelSuccess) Type() MsgType { return MsgOpenExtendedMiningChannelSuccess }
+func (*NewMiningJob) Type() MsgType                     { return MsgNewMiningJob }
+func (*NewExtendedMiningJob) Type() MsgType             { return MsgNewExtendedMiningJob }
+func (*CloseChannel) Type() MsgType                     { return MsgCloseChannel }
+func (*SetExtranoncePrefix) Type() MsgType              { return MsgSetExtranoncePrefix }
+func (*SubmitSharesStandard) Type() MsgType             { return MsgSubmitSharesStandard }
+func (*SubmitSharesExtended) Type() MsgType             { return MsgSubmitSharesExtended }
+func (*SubmitSharesSuccess) Type() MsgType              { return MsgSubmitSharesSuccess }
+func (*SubmitSharesError) Type() MsgType                { return MsgSubmitSharesError }
+func (*SetNewPrevHash) Type() MsgType                   { return MsgSetNewPrevHash }
+func (*SetTarget) Type() MsgType                        { return MsgSetTarget }
+
+func (m *NewMiningJob) Channel() uint32         { return m.ChannelID }
+func (m *NewExtendedMiningJob) Channel() uint32 { return m.ChannelID }
+func (m *CloseChannel) Channel() uint32         { return m.ChannelID }
+func (m *SetExtranoncePrefix) Channel() uint32  { return m.ChannelID }
+func (m *SubmitSharesStandard) Channel() uint32 { return m.ChannelID }
+func (m *SubmitSharesExtended) Channel() uint32 { return m.ChannelID }
+func (m *SubmitSharesSuccess) Channel() uint32  { return m.ChannelID }
+func (m *SubmitSharesError) Channel() uint32    { return m.ChannelID }
+func (m *SetNewPrevHash) Channel() uint32       { return m.ChannelID }
+func (m *SetTarget) Channel() uint32            { return m.ChannelID }
+
+func (m *NewMiningJob) SetChannel(id uint32)         { m.ChannelID = id }
+func (m *NewExtendedMiningJob) SetChannel(id uint32) { m.ChannelID = id }
+func (m *CloseChannel) SetChannel(id uint32)         { m.ChannelID = id }
+func (m *SetExtranoncePrefix) SetChannel(id uint32)  { m.ChannelID = id }
+func (m *SubmitSharesStandard) SetChannel(id uint32) { m.ChannelID = id }
+func (m *SubmitSharesExtended) SetChannel(id uint32) { m.ChannelID = id }
+func (m *SubmitSharesSuccess) SetChannel(id uint32)  { m.ChannelID = id }
+func (m *SubmitSharesError) SetChannel(id uint32)    { m.ChannelID = id }
+func (m *SetNewPrevHash) SetChannel(id uint32)       { m.ChannelID = id }
+func (m *SetTarget) SetChannel(id uint32)            { m.ChannelID = id }
+
+func (m *SetupConnection) encode(e *encoder) {
+	e.u8(m.Protocol)
+	e.u16(m.MinVersion)
+	e.u16(m.MaxVersion)
+	e.u32(m.Flags)
+	e.str0_255(m.EndpointHost)
+	e.u16(m.EndpointPort)
+	e.str0_255(m.Vendor)
+	e.str0_255(m.HardwareVersion)
+	e.str0_255(m.Firmware)
+	e.str0_255(m.DeviceID)
+}
+
+func (m *SetupConnection) decode(d *decoder) {
+	m.Protocol = d.u8()
+	m.MinVersion = d.u16()
+	m.MaxVersion = d.u16()
+	m.Flags = d.u32()
+	m.EndpointHost = d.str0_255()
+	m.EndpointPort = d.u16()
+	m.Vendor = d.str0_255()
+	m.HardwareVersion = d.str0_255()
+	m.Firmware = d.str0_255()
+	m.DeviceID = d.str0_255()
+}
+
+func (m *SetupConnectionSuccess) encode(e *encoder) {
+	e.u16(m.UsedVersion)
+	e.u32(m.Flags)
+}
+
+func (m *SetupConnectionSuccess) decode(d *decoder) {
+	m.UsedVersion = d.u16()
+	m.Flags = d.u32()
+}
+
+func (m *SetupConnectionError) encode(e *encoder) {
+	e.u32(m.Flags)
+	e.str0_255(m.ErrorCode)
+}
+
+func (m *SetupConnectionError) decode(d *decoder) {
+	m.Flags = d.u32()
+	m.ErrorCode = d.str0_255()
+}
+
+func (m *OpenStandardMiningChannel) encode(e *encoder) {
+	e.u32(m.RequestID)
+	e.str0_255(m.UserIdentity)
+	e.f32(m.NominalHashRate)
+	e.u256(m.MaxTarget)
+}
+
+func (m *OpenStandardMiningChannel) decode(d *decoder) {
+	m.RequestID = d.u32()
+	m.UserIdentity = d.str0_255()
+	m.NominalHashRate = d.f32()
+	m.MaxTarget = d.u256()
+}
+
+func (m *OpenStandardMiningChannelSuccess) encode(e *encoder) {
+	e.u32(m.RequestID)
+	e.u32(m.ChannelID)
+	e.u256(m.Target)
+	e.b0_32(m.ExtranoncePrefix)
+	e.u32(m.GroupChannelID)
+}
+
+func (m *OpenStandardMiningChannelSuccess) decode(d *decoder) {
+	m.RequestID = d.u32()
+	m.ChannelID = d.u32()
+	m.Target = d.u256()
+	m.ExtranoncePrefix = d.b0_32()
+	m.GroupChannelID = d.u32()
+}
+
+func (m *OpenMiningChannelError) encode(e *encoder) {
+	e.u32(m.RequestID)
+	e.str0_255(m.ErrorCode)
+}
+
+func (m *OpenMiningChannelError) decode(d *decoder) {
+	m.RequestID = d.u32()
+	m.ErrorCode = d.str0_255()
+}
+
+func (m *OpenExtendedMiningChannel) encode(e *encoder) {
+	e.u32(m.RequestID)
+	e.str0_255(m.UserIdentity)
+	e.f32(m.NominalHashRate)
+	e.u256(m.MaxTarget)
+	e.u16(m.MinExtranonceSize)
+}
+
+func (m *OpenExtendedMiningChannel) decode(d *decoder) {
+	m.RequestID = d.u32()
+	m.UserIdentity = d.str0_255()
+	m.NominalHashRate = d.f32()
+	m.MaxTarget = d.u256()
+	m.MinExtranonceSize = d.u16()
+}
+
+func (m *OpenExtendedMiningChannelSuccess) encode(e *encoder) {
+	e.u32(m.RequestID)
+	e.u32(m.ChannelID)
+	e.u256(m.Target)
+	e.u16(m.ExtranonceSize)
+	e.b0_32(m.ExtranoncePrefix)
+}
+
+func (m *OpenExtendedMiningChannelSuccess) decode(d *decoder) {
+	m.RequestID = d.u32()
+	m.ChannelID = d.u32()
+	m.Target = d.u256()
+	m.ExtranonceSize = d.u16()
+	m.ExtranoncePrefix = d.b0_32()
+}
+
+func (m *NewMiningJob) encode(e *encoder) {
+	e.u32(m.ChannelID)
+	e.u32(m.JobID)
+	e.optionU32(m.MinNTime)
+	e.u32(m.Version)
+	e.u256(m.MerkleRoot)
+}
+
+func (m *NewMiningJob) decode(d *decoder) {
+	m.ChannelID = d.u32()
+	m.JobID = d.u32()
+	m.MinNTime = d.optionU32()
+	m.Version = d.u32()
+	m.MerkleRoot = d.u256()
+}
+
+func (m *NewExtendedMiningJob) encode(e *encoder) {
+	e.u32(m.ChannelID)
+	e.u32(m.JobID)
+	e.optionU32(m.MinNTime)
+	e.u32(m.Version)
+	e.bool(m.VersionRollingAllowed)
+	e.seq0_255U256(m.MerklePath)
+	e.b0_64k(m.CoinbaseTxPrefix)
+	e.b0_64k(m.CoinbaseTxSuffix)
+}
+
+func (m *NewExtendedMiningJob) decode(d *decoder) {
+	m.ChannelID = d.u32()
+	m.JobID = d.u32()
+	m.MinNTime = d.optionU32()
+	m.Version = d.u32()
+	m.VersionRollingAllowed = d.bool()
+	m.MerklePath = d.seq0_255U256()
+	m.CoinbaseTxPrefix = d.b0_64k()
+	m.CoinbaseTxSuffix = d.b0_64k()
+}
+
+func (m *CloseChannel) encode(e *encoder) {
+	e.u32(m.ChannelID)
+	e.str0_255(m.ReasonCode)
+}
+
+func (m *CloseChannel) decode(d *decoder) {
+	m.ChannelID = d.u32()
+	m.ReasonCode = d.str0_255()
+}
+
+func (m *SetExtranoncePrefix) encode(e *encoder) {
+	e.u32(m.ChannelID)
+	e.b0_32(m.ExtranoncePrefix)
+}
+
+func (m *SetExtranoncePrefix) decode(d *decoder) {
+	m.ChannelID = d.u32()
+	m.ExtranoncePrefix = d.b0_32()
+}
+
+func (m *SubmitSharesStandard) encode(e *encoder) {
+	e.u32(m.ChannelID)
+	e.u32(m.SequenceNumber)
+	e.u32(m.JobID)
+	e.u32(m.Nonce)
+	e.u32(m.NTime)
+	e.u32(m.Version)
+}
+
+func (m *SubmitSharesStandard) decode(d *decoder) {
+	m.ChannelID = d.u32()
+	m.SequenceNumber = d.u32()
+	m.JobID = d.u32()
+	m.Nonce = d.u32()
+	m.NTime = d.u32()
+	m.Version = d.u32()
+}
+
+func (m *SubmitSharesExtended) encode(e *encoder) {
+	e.u32(m.ChannelID)
+	e.u32(m.SequenceNumber)
+	e.u32(m.JobID)
+	e.u32(m.Nonce)
+	e.u32(m.NTime)
+	e.u32(m.Version)
+	e.b0_32(m.Extranonce)
+}
+
+func (m *SubmitSharesExtended) decode(d *decoder) {
+	m.ChannelID = d.u32()
+	m.SequenceNumber = d.u32()
+	m.JobID = d.u32()
+	m.Nonce = d.u32()
+	m.NTime = d.u32()
+	m.Version = d.u32()
+	m.Extranonce = d.b0_32()
+}
+
+func (m *SubmitSharesSuccess) encode(e *encoder) {
+	e.u32(m.ChannelID)
+	e.u32(m.LastSequenceNumber)
+	e.u32(m.NewSubmitsAcceptedCount)
+	e.u64(m.NewSharesSum)
+}
+
+func (m *SubmitSharesSuccess) decode(d *decoder) {
+	m.ChannelID = d.u32()
+	m.LastSequenceNumber = d.u32()
+	m.NewSubmitsAcceptedCount = d.u32()
+	m.NewSharesSum = d.u64()
+}
+
+func (m *SubmitSharesError) encode(e *encoder) {
+	e.u32(m.ChannelID)
+	e.u32(m.SequenceNumber)
+	e.str0_255(m.ErrorCode)
+}
+
+func (m *SubmitSharesError) decode(d *decoder) {
+	m.ChannelID = d.u32()
+	m.SequenceNumber = d.u32()
+	m.ErrorCode = d.str0_255()
+}
+
+func (m *SetNewPrevHash) encode(e *encoder) {
+	e.u32(m.ChannelID)
+	e.u32(m.JobID)
+	e.u256(m.PrevHash)
+	e.u32(m.MinNTime)
+	e.u32(m.NBits)
+}
+
+func (m *SetNewPrevHash) decode(d *decoder) {
+	m.ChannelID = d.u32()
+	m.JobID = d.u32()
+	m.PrevHash = d.u256()
+	m.MinNTime = d.u32()
+	m.NBits = d.u32()
+}
+
+func (m *SetTarget) encode(e *encoder) {
+	e.u32(m.ChannelID)
+	e.u256(m.MaximumTarget)
+}
+
+func (m *SetTarget) decode(d *decoder) {
+	m.ChannelID = d.u32()
+	m.MaximumTarget = d.u256()
+}
+
+//
+// newMessage() returns an empty message of type t
+//
+func newMessage(t MsgType) (m Message, e error) {
+	switch t {
+	case MsgSetupConnection:
+		m = &SetupConnection{}
+	case MsgSetupConnectionSuccess:
+		m = &SetupConnectionSuccess{}
+	case MsgSetupConnectionError:
+		m = &SetupConnectionError{}
+	case MsgOpenStandardMiningChannel:
+		m = &OpenStandardMiningChannel{}
+	case MsgOpenStandardMiningChannelSuccess:
+		m = &OpenStandardMiningChannelSuccess{}
+	case MsgOpenMiningChannelError:
+		m = &OpenMiningChannelError{}
+	case MsgOpenExtendedMiningChannel:
+		m = &OpenExtendedMiningChannel{}
+	case MsgOpenExtendedMiningChannelSuccess:
+		m = &OpenExtendedMiningChannelSuccess{}
+	case MsgNewMiningJob:
+		m = &NewMiningJob{}
+	case MsgNewExtendedMiningJob:
+		m = &NewExtendedMiningJob{}
+	case MsgCloseChannel:
+		m = &CloseChannel{}
+	case MsgSetExtranoncePrefix:
+		m = &SetExtranoncePrefix{}
+	case MsgSubmitSharesStandard:
+		m = &SubmitSharesStandard{}
+	case MsgSubmitSharesExtended:
+		m = &SubmitSharesExtended{}
+	case MsgSubmitSharesSuccess:
+		m = &SubmitSharesSuccess{}
+	case MsgSubmitSharesError:
+		m = &SubmitSharesError{}
+	case MsgSetNewPrevHash:
+		m = &SetNewPrevHash{}
+	case MsgSetTarget:
+		m = &SetTarget{}
+	default:
+		e = fmt.Errorf("%w: %s", ErrUnknownMsgType, t)
+	}
+	return m, e
+}
+
+//
+// EncodeFrame() returns m as an unencrypted frame
+//
+func EncodeFrame(m Message) (frame []byte, e error) {
+	enc := &encoder{buf: make([]byte, FrameHeaderLen, 64)}
+	m.encode(enc)
+	if enc.err != nil {
+		return nil, fmt.Errorf("%s: %w", m.Type(), enc.err)
+	}
+
+	length := len(enc.buf) - FrameHeaderLen
+	if length > MaxPayloadLen {
+		return nil, fmt.Errorf("%s: %w: payload %d bytes", m.Type(), ErrFieldTooLong, length)
+	}
+
+	hdr := FrameHeader{MsgType: m.Type(), MsgLength: uint32(length)}
+	if _, ok := m.(ChannelMessage); ok {
+		hdr.ExtensionType = channelMsgBit
+	}
+	copy(enc.buf, hdr.encode())
+
+	return enc.buf, nil
+}
+
+func (h FrameHeader) encode() []byte {
+	enc := &encoder{buf: make([]byte, 0, FrameHeaderLen)}
+	enc.u16(h.ExtensionType)
+	enc.u8(uint8(h.MsgType))
+	enc.u24(h.MsgLength)
+	return enc.buf
+}
+
+//
+// decodeFrameHeader() reads the first FrameHeaderLen bytes of buf
+//
+func decodeFrameHeader(buf []byte) (h FrameHeader, e error) {
+	dec := &decoder{buf: buf}
+	h.ExtensionType = dec.u16()
+	h.MsgType = MsgType(dec.u8())
+	h.MsgLength = dec.u24()
+	return h, dec.err
+}
+
+//
+// DecodeMessage() parses the payload of a frame with header h
+//
+func DecodeMessage(h FrameHeader, payload []byte) (m Message, e error) {
+	if h.ExtensionType&^channelMsgBit != 0 {
+		return nil, fmt.Errorf("%w: 0x%04x", ErrUnknownExtension, h.ExtensionType)
+	}
+
+	m, e = newMessage(h.MsgType)
+	if e != nil {
+		return nil, e
+	}
+
+	dec := &decoder{buf: payload}
+	m.decode(dec)
+	if dec.err != nil {
+		return nil, fmt.Errorf("%s: %w", h.MsgType, dec.err)
+	}
+	if len(dec.buf) != 0 {
+		return nil, fmt.Errorf("%s: %w: %d bytes", h.MsgType, ErrTrailingData, len(dec.buf))
+	}
+
+	return m, nil
+}
+
+//
+// DecodeFrame() parses an unencrypted frame
+//
+func DecodeFrame(frame []byte) (m Message, e error) {
+	h, e := decodeFrameHeader(frame)
+	if e != nil {
+		return nil, e
+	}
+	payload := frame[FrameHeaderLen:]
+	if int(h.MsgLength) != len(payload) {
+		return nil, fmt.Errorf("%s: frame length %d, header says %d", h.MsgType, len(payload), h.MsgLength)
+	}
+	return DecodeMessage(h, payload)
+}
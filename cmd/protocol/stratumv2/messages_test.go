@@ -0,0 +1,98 @@
+package stratumv2
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeFrame(t *testing.T) {
+
+	submit := &SubmitSharesStandard{
+		ChannelID:      1,
+		SequenceNumber: 2,
+		JobID:          3,
+		Nonce:          0x04030201,
+		NTime:          5,
+		Version:        6,
+	}
+
+	frame, e := EncodeFrame(submit)
+	if e != nil {
+		t.Fatalf("EncodeFrame() error:%s", e)
+	}
+
+	expected := "00801a180000" + "01000000" + "02000000" + "03000000" + "01020304" + "05000000" + "06000000"
+	if hex.EncodeToString(frame) != expected {
+		t.Errorf("EncodeFrame() got:%x expected:%s", frame, expected)
+	}
+
+	setup := &SetupConnection{
+		Protocol:     ProtocolMining,
+		MinVersion:   2,
+		MaxVersion:   2,
+		EndpointHost: "pool.example.com",
+		EndpointPort: 3336,
+		Vendor:       "vendor",
+		DeviceID:     "some-device-uuid",
+	}
+
+	frame, _ = EncodeFrame(setup)
+	if frame[0] != 0 || frame[1] != 0 {
+		t.Errorf("EncodeFrame() SetupConnection is not a channel message:%x", frame[:FrameHeaderLen])
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+
+	minNTime := uint32(1700000000)
+	msgs := []Message{
+		&SetupConnection{Protocol: ProtocolMining, MinVersion: 2, MaxVersion: 2, Flags: 1, Vendor: "v"},
+		&SetupConnectionSuccess{UsedVersion: 2, Flags: 0},
+		&SetupConnectionError{ErrorCode: "unsupported-protocol"},
+		&OpenStandardMiningChannel{RequestID: 1, UserIdentity: "worker", NominalHashRate: 1e12, MaxTarget: U256{0xff}},
+		&OpenStandardMiningChannelSuccess{RequestID: 1, ChannelID: 9, ExtranoncePrefix: []byte{1, 2}},
+		&OpenExtendedMiningChannel{RequestID: 1, UserIdentity: "worker", MinExtranonceSize: 8},
+		&OpenExtendedMiningChannelSuccess{RequestID: 1, ChannelID: 9, ExtranonceSize: 8, ExtranoncePrefix: []byte{}},
+		&OpenMiningChannelError{RequestID: 1, ErrorCode: "unknown-user"},
+		&NewMiningJob{ChannelID: 9, JobID: 1, Version: 0x20000000, MerkleRoot: U256{1}},
+		&NewMiningJob{ChannelID: 9, JobID: 2, MinNTime: &minNTime},
+		&NewExtendedMiningJob{ChannelID: 9, JobID: 1, MerklePath: []U256{}, CoinbaseTxPrefix: []byte{1}, CoinbaseTxSuffix: []byte{}},
+		&SetNewPrevHash{ChannelID: 9, JobID: 1, PrevHash: U256{3}, MinNTime: 5, NBits: 0x1d00ffff},
+		&SetTarget{ChannelID: 9, MaximumTarget: U256{0, 0xff}},
+		&SetExtranoncePrefix{ChannelID: 9, ExtranoncePrefix: []byte{4}},
+		&SubmitSharesExtended{ChannelID: 9, Extranonce: []byte{1, 2, 3, 4}},
+		&SubmitSharesSuccess{ChannelID: 9, LastSequenceNumber: 4, NewSubmitsAcceptedCount: 4, NewSharesSum: 400},
+		&SubmitSharesError{ChannelID: 9, SequenceNumber: 5, ErrorCode: "stale-share"},
+		&CloseChannel{ChannelID: 9, ReasonCode: "bye"},
+	}
+
+	for _, m := range msgs {
+		frame, e := EncodeFrame(m)
+		if e != nil {
+			t.Fatalf("EncodeFrame(%s) error:%s", m.Type(), e)
+		}
+		got, e := DecodeFrame(frame)
+		if e != nil {
+			t.Fatalf("DecodeFrame(%s) error:%s", m.Type(), e)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("DecodeFrame(%s) got:%+v expected:%+v", m.Type(), got, m)
+		}
+	}
+
+	frame, _ := EncodeFrame(&SetTarget{ChannelID: 9})
+	if _, e := DecodeFrame(frame[:len(frame)-1]); e == nil {
+		t.Errorf("DecodeFrame() of a short frame did not fail")
+	}
+
+	frame[2] = 0x7e
+	if _, e := DecodeFrame(frame); !errors.Is(e, ErrUnknownMsgType) {
+		t.Errorf("DecodeFrame() of an unknown message got:%v", e)
+	}
+
+	if _, e := EncodeFrame(&SetExtranoncePrefix{ExtranoncePrefix: make([]byte, 33)}); !errors.Is(e, ErrFieldTooLong) {
+		t.Errorf("EncodeFrame() of a long prefix got:%v", e)
+	}
+}
@@ -0,0 +1,392 @@
+package stratumv2
+
+import (
+	"fmt"
+
+	simple "github.com/daniel-888/proxy-router/cmd/lumerinnetwork/SIMPL"
+	"github.com/daniel-888/proxy-router/cmd/msgbus"
+	"github.com/daniel-888/proxy-router/lumerinlib"
+	contextlib "github.com/daniel-888/proxy-router/lumerinlib/context"
+)
+
+//
+//
+//
+func (s *StratumV2Struct) handleMsgBusEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" called, Request ID:%d", event.RequestID)
+
+	switch event.EventType {
+	case simple.NoEvent:
+		fmt.Printf(lumerinlib.Funcname() + " NoEvent received, returning\n")
+		return
+	case simple.MsgUpdateEvent:
+		s.handleMsgUpdateEvent(event)
+		return
+	case simple.MsgDeleteEvent:
+		s.handleMsgDeleteEvent(event)
+		return
+	case simple.MsgGetEvent:
+		s.handleMsgGetEvent(event)
+		return
+	case simple.MsgGetIndexEvent:
+		s.handleMsgIndexEvent(event)
+		return
+	case simple.MsgSearchEvent:
+		s.handleMsgSearchEvent(event)
+		return
+	case simple.MsgSearchIndexEvent:
+		s.handleMsgSearchIndexEvent(event)
+		return
+	case simple.MsgPublishEvent:
+		s.handleMsgPublishEvent(event)
+		return
+	case simple.MsgUnpublishEvent:
+		s.handleMsgUnpublishEvent(event)
+		return
+	case simple.MsgSubscribedEvent:
+		s.handleMsgSubscribedEvent(event)
+		return
+	case simple.MsgUnsubscribedEvent:
+		s.handleMsgUnsubscribedEvent(event)
+		return
+	case simple.MsgRemovedEvent:
+		s.handleMsgRemovedEvent(event)
+		return
+	case simple.MsgStreamEvent:
+		s.handleMsgStreamEvent(event)
+		return
+
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+}
+
+//
+// handleMsgUpdateEvent()
+// Check the request ID to see if it was requested, pull the request off and handle the result
+// else
+// Check to see if this is a event that we care about, and handle it
+//
+func (s *StratumV2Struct) handleMsgUpdateEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	// Parse Event Msg
+
+	var minerrec msgbus.Miner
+	switch event.Msg {
+	case simple.MinerMsg:
+		switch event.Data.(type) {
+		case *msgbus.Miner:
+			minerrecptr := event.Data.(*msgbus.Miner)
+			minerrec = *minerrecptr
+		case msgbus.Miner:
+			minerrec = event.Data.(msgbus.Miner)
+		default:
+			contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" event.Data is not a msgbus.Miner struct")
+		}
+
+		// Check that we recieved the correct miner ID from the msgbus
+		if s.minerRec.ID != minerrec.ID {
+			contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" event.Data records do not match up")
+		}
+
+		// Did the Dest ID change?
+		if s.minerRec.Dest != minerrec.Dest {
+			contextlib.Logf(s.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+" Miner:%s Dest changed to: %s from %s", minerrec.ID, minerrec.Dest, s.minerRec.Dest)
+			//
+			// Destination has changed...
+			//
+			// If the destination has a connection open the uid will be greater then -1
+			//
+			switch_to_uid := s.GetDstUIDDestID(minerrec.Dest)
+			s.switchToDestID = minerrec.Dest
+
+			// Is Dest already open and running?
+			// No, open it
+			if switch_to_uid < 0 {
+				// Start the process of transitioning to a new Dest
+				_, e := s.protocol.Get(simple.DestMsg, simple.IDString(minerrec.Dest))
+				if e != nil {
+					contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Get() error:%s", e)
+				}
+
+				// Yes it is open
+			} else {
+				// Are we set to on demand, if so then switch now
+				if s.scheduler == OnDemand {
+					s.switchDest()
+				}
+
+				// if we are not set to on demand, then the next submit will trigger the change
+			}
+
+			// Update the minerRec
+			s.minerRec.Dest = minerrec.Dest
+
+		} else {
+			contextlib.Logf(s.Ctx(), contextlib.LevelError, lumerinlib.FileLineFunc()+" Recieved Miner update, but dest did not change:'%s':'%s'", event.EventType, event.ID)
+		}
+
+	case simple.ConnectionMsg:
+		contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Connection Record updated:%s:%s", event.EventType, event.ID)
+
+	// Ignore all others
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+
+}
+
+//
+// handleMsgDeleteEvent()
+// Check the request ID to see if it was requested, pull the request off and handle the result
+// else
+// Check to see if this is a event that we care about, and handle it
+//
+func (s *StratumV2Struct) handleMsgDeleteEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	switch event.Msg {
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+
+}
+
+//
+// handleMsgGetEvent()
+// Check the request ID to see if it was requested, pull the request off and handle the result
+// else error out
+//
+func (s *StratumV2Struct) handleMsgGetEvent(event *simple.SimpleMsgBusEvent) {
+	if s == nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" s is nil")
+	}
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	if event.Err != nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Event Err:%s", event.Err)
+		return
+	}
+
+	if event.Data == nil {
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Event Data is nil")
+		return
+	}
+
+	switch event.Msg {
+	case simple.DestMsg:
+		// Recieved a Dest Get()
+		// It would be used to setup the next dest connection
+		if event.ID == simple.IDString(s.switchToDestID) {
+			// Fire up the default destination connction here
+			// If default is not already set, set it
+			var dest msgbus.Dest
+			switch event.Data.(type) {
+			case msgbus.Dest:
+				dest = event.Data.(msgbus.Dest)
+			case *msgbus.Dest:
+				d := event.Data.(*msgbus.Dest)
+				if d == nil {
+					contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" DestMsg: is nil")
+				}
+				dest = *d
+			default:
+				contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" DestMsg: bad data:%t", event.Data)
+			}
+
+			id := dest.ID
+
+			uid := s.GetDstUIDDestID(id)
+			if 0 > uid {
+				// Open new Dest
+				s.SetDstStateUid(uid, DstStateDialing)
+				e := s.protocol.AsyncDial(&dest)
+				if e != nil {
+					contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" AsyncDial returned error:%s", e)
+				}
+			} else {
+				contextlib.Logf(s.Ctx(), contextlib.LevelWarn, lumerinlib.FileLineFunc()+" Dest already opened:%s", event.ID)
+			}
+		} else {
+			contextlib.Logf(s.Ctx(), contextlib.LevelWarn, lumerinlib.FileLineFunc()+" Recieved Dest Get(), but it does not match next dest, dropping it:%s", event.ID)
+		}
+
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+
+}
+
+//
+// handleMsgIndexEvent()
+// Check the request ID to see if it was requested, pull the request off and handle the result
+// else error out
+//
+func (s *StratumV2Struct) handleMsgIndexEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	switch event.Msg {
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+
+}
+
+//
+// handleMsgSearchEvent()
+// Check the request ID to see if it was requested, pull the request off and handle the result
+// else error out
+//
+func (s *StratumV2Struct) handleMsgSearchEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	switch event.Msg {
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+
+}
+
+//
+// handleMsgSearchEvent()
+// Check the request ID to see if it was requested, pull the request off and handle the result
+// else error out
+//
+func (s *StratumV2Struct) handleMsgSearchIndexEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	switch event.Msg {
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+
+}
+
+//
+// handleMsgPublishEvent()
+// Check the request ID to see if it was requested, pull the request off and handle the result
+// else
+// Check to see if this is a event that we care about, and handle it
+//
+func (s *StratumV2Struct) handleMsgPublishEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	switch event.Msg {
+	case simple.MinerMsg:
+		contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" event message:%s:%s, subscribe", event.EventType, event.ID)
+
+		_, e := s.protocol.Sub(simple.MinerMsg, event.ID)
+		if e != nil {
+			contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" event message:%s:%s, subscribe", event.EventType, event.ID)
+		}
+
+	case simple.ConnectionMsg:
+		contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Connection Record published:%s:%s", event.EventType, event.ID)
+
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+
+}
+
+//
+// handleMsgUnpublishEvent()
+// Check the request ID to see if it was requested, pull the request off and handle the result
+// else
+// Check to see if this is a event that we care about, and handle it
+//
+func (s *StratumV2Struct) handleMsgUnpublishEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	switch event.Msg {
+	case simple.MinerMsg:
+		contextlib.Logf(s.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+" Miner Record:%s:%s", event.EventType, event.ID)
+	case simple.ConnectionMsg:
+		contextlib.Logf(s.Ctx(), contextlib.LevelInfo, lumerinlib.FileLineFunc()+" Connection Record:%s:%s", event.EventType, event.ID)
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+}
+
+//
+// handleMsgSubscribedEvent()
+// Check the request ID to see if it was requested, pull the request off and handle the result
+// else
+// Check to see if this is a event that we care about, and handle it
+//
+func (s *StratumV2Struct) handleMsgSubscribedEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	switch event.Msg {
+	case simple.MinerMsg:
+		contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Subscribed event message:%s:%s", event.EventType, event.ID)
+
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+
+}
+
+//
+// handleMsgUnisubscribedEvent()
+// Check the request ID to see if it was requested, pull the request off and handle the result
+// else
+// Check to see if this is a event that we care about, and handle it
+//
+func (s *StratumV2Struct) handleMsgUnsubscribedEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	switch event.Msg {
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+
+}
+
+//
+// handleMsgRemovedEvent()
+// Check the request ID to see if it was requested, pull the request off and handle the result
+// else
+// Check to see if this is a event that we care about, and handle it
+//
+//
+func (s *StratumV2Struct) handleMsgRemovedEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	switch event.Msg {
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+
+}
+
+//
+// handleMsgStreamEvent()
+// Stream events are not stored on the bus, there is no request to match up
+//
+func (s *StratumV2Struct) handleMsgStreamEvent(event *simple.SimpleMsgBusEvent) {
+
+	contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" Called")
+
+	switch event.Msg {
+	case simple.ValidateMsg:
+		contextlib.Logf(s.Ctx(), contextlib.LevelTrace, lumerinlib.FileLineFunc()+" event message:%s:%s", event.EventType, event.ID)
+
+	default:
+		contextlib.Logf(s.Ctx(), contextlib.LevelPanic, lumerinlib.FileLineFunc()+" Unknown event message:%s:%s", event.EventType, event.ID)
+	}
+
+}
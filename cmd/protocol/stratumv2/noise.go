@@ -0,0 +1,545 @@
+package stratumv2
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+//
+// Noise NX handshake and encrypted transport
+//
+// The handshake is Noise_NX_Secp256k1+EllSwift_ChaChaPoly_SHA256, the
+// initiator (miner, or the proxy towards a pool) sends its ephemeral key and
+// the responder answers with its ephemeral key, its encrypted static key and
+// a certificate: the static key signed by an authority key the initiator
+// knows. Neither message is framed:
+//
+//	-> e                      64 bytes
+//	<- e, ee, s, es, cert     64 + 80 + 90 bytes
+//
+// Afterwards each frame is sent as its encrypted 6 byte header (22 bytes)
+// followed by the payload, encrypted in chunks of at most 65535 bytes
+// including the 16 byte MAC.
+//
+
+var ErrHandshake = errors.New("StratumV2: noise handshake failed")
+var ErrCertificate = errors.New("StratumV2: bad certificate")
+
+const protocolName string = "Noise_NX_Secp256k1+EllSwift_ChaChaPoly_SHA256"
+
+const macLen int = 16
+const maxChunkLen int = 65535
+const encryptedHeaderLen int = FrameHeaderLen + macLen
+const certLen int = 2 + 4 + 4 + 64
+const act1Len int = EllSwiftLen
+const act2Len int = EllSwiftLen + EllSwiftLen + macLen + certLen + macLen
+
+// How long a certificate handed out by a responder is valid
+const CertValidity time.Duration = time.Hour
+
+// -------------------------------------------------------------------------
+// cipherState
+// -------------------------------------------------------------------------
+
+type cipherState struct {
+	k      [32]byte
+	n      uint64
+	hasKey bool
+}
+
+func (c *cipherState) initializeKey(k []byte) {
+	copy(c.k[:], k)
+	c.n = 0
+	c.hasKey = true
+}
+
+func (c *cipherState) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.n)
+	return nonce
+}
+
+func (c *cipherState) encryptWithAd(ad, plaintext []byte) []byte {
+	if !c.hasKey {
+		return plaintext
+	}
+	aead, _ := chacha20poly1305.New(c.k[:])
+	ciphertext := aead.Seal(nil, c.nonce(), plaintext, ad)
+	c.n++
+	return ciphertext
+}
+
+func (c *cipherState) decryptWithAd(ad, ciphertext []byte) ([]byte, error) {
+	if !c.hasKey {
+		return ciphertext, nil
+	}
+	aead, _ := chacha20poly1305.New(c.k[:])
+	plaintext, e := aead.Open(nil, c.nonce(), ciphertext, ad)
+	if e != nil {
+		return nil, fmt.Errorf("%w: %s", ErrHandshake, e)
+	}
+	c.n++
+	return plaintext, nil
+}
+
+// -------------------------------------------------------------------------
+// symmetricState
+// -------------------------------------------------------------------------
+
+type symmetricState struct {
+	ck [32]byte
+	h  [32]byte
+	cs cipherState
+}
+
+func newSymmetricState() *symmetricState {
+	ss := &symmetricState{}
+	ss.h = sha256.Sum256([]byte(protocolName))
+	ss.ck = ss.h
+	// Empty prologue
+	ss.mixHash(nil)
+	return ss
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	ss.h = sha256.Sum256(append(ss.h[:], data...))
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) {
+	ck, k := hkdf2(ss.ck[:], ikm)
+	copy(ss.ck[:], ck)
+	ss.cs.initializeKey(k)
+}
+
+func (ss *symmetricState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := ss.cs.encryptWithAd(ss.h[:], plaintext)
+	ss.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, e := ss.cs.decryptWithAd(ss.h[:], ciphertext)
+	if e != nil {
+		return nil, e
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+//
+// split() returns the initiator to responder and responder to initiator
+// cipher states
+//
+func (ss *symmetricState) split() (c1, c2 *cipherState) {
+	k1, k2 := hkdf2(ss.ck[:], nil)
+	c1, c2 = &cipherState{}, &cipherState{}
+	c1.initializeKey(k1)
+	c2.initializeKey(k2)
+	return c1, c2
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	m := hmac.New(sha256.New, key)
+	for _, d := range data {
+		m.Write(d)
+	}
+	return m.Sum(nil)
+}
+
+func hkdf2(ck, ikm []byte) (out1, out2 []byte) {
+	temp := hmacSHA256(ck, ikm)
+	out1 = hmacSHA256(temp, []byte{1})
+	out2 = hmacSHA256(temp, out1, []byte{2})
+	return out1, out2
+}
+
+// -------------------------------------------------------------------------
+// Certificate
+// -------------------------------------------------------------------------
+
+//
+// Certificate is the SignatureNoiseMessage a responder sends with its static
+// key, signed by the authority key
+//
+type Certificate struct {
+	Version       uint16
+	ValidFrom     uint32
+	NotValidAfter uint32
+	Signature     []byte
+}
+
+func (c *Certificate) signedMsg(static []byte) []byte {
+	enc := &encoder{}
+	enc.u16(c.Version)
+	enc.u32(c.ValidFrom)
+	enc.u32(c.NotValidAfter)
+	h := sha256.Sum256(append(enc.buf, static...))
+	return h[:]
+}
+
+//
+// NewCertificate() signs the x-only static key with the authority key,
+// valid from now for validity
+//
+func NewCertificate(authority []byte, static []byte, now time.Time, validity time.Duration) (c *Certificate, e error) {
+	c = &Certificate{
+		Version:       0,
+		ValidFrom:     uint32(now.Unix()),
+		NotValidAfter: uint32(now.Add(validity).Unix()),
+	}
+	aux := make([]byte, 32)
+	if _, e = io.ReadFull(rand.Reader, aux); e != nil {
+		return nil, e
+	}
+	c.Signature, e = SchnorrSign(authority, c.signedMsg(static), aux)
+	return c, e
+}
+
+//
+// Verify() checks c was signed for static by the x-only authority key and is
+// valid at now
+//
+func (c *Certificate) Verify(authority []byte, static []byte, now time.Time) (e error) {
+	if c.Version != 0 {
+		return fmt.Errorf("%w: version %d", ErrCertificate, c.Version)
+	}
+	t := uint32(now.Unix())
+	if t < c.ValidFrom || t > c.NotValidAfter {
+		return fmt.Errorf("%w: valid %d to %d, now %d", ErrCertificate, c.ValidFrom, c.NotValidAfter, t)
+	}
+	if e = SchnorrVerify(authority, c.signedMsg(static), c.Signature); e != nil {
+		return fmt.Errorf("%w: %s", ErrCertificate, e)
+	}
+	return nil
+}
+
+func (c *Certificate) encode() []byte {
+	enc := &encoder{}
+	enc.u16(c.Version)
+	enc.u32(c.ValidFrom)
+	enc.u32(c.NotValidAfter)
+	enc.buf = append(enc.buf, c.Signature...)
+	return enc.buf
+}
+
+func decodeCertificate(buf []byte) (c *Certificate, e error) {
+	if len(buf) != certLen {
+		return nil, fmt.Errorf("%w: %d bytes", ErrCertificate, len(buf))
+	}
+	dec := &decoder{buf: buf}
+	c = &Certificate{
+		Version:       dec.u16(),
+		ValidFrom:     dec.u32(),
+		NotValidAfter: dec.u32(),
+	}
+	c.Signature = append([]byte{}, dec.next(64)...)
+	return c, dec.err
+}
+
+// -------------------------------------------------------------------------
+// Codec
+// -------------------------------------------------------------------------
+
+//
+// Identity is what a responder needs for the handshake, its static key and
+// the authority key signing it
+//
+type Identity struct {
+	Static    *KeyPair
+	Authority []byte
+}
+
+//
+// NewIdentity() creates a random static key signed by the authority
+// private key, a random authority key if authority is nil
+//
+func NewIdentity(authority []byte) (id *Identity, e error) {
+	if authority == nil {
+		if authority, e = newPrivKey(rand.Reader); e != nil {
+			return nil, e
+		}
+	}
+	static, e := NewKeyPair(rand.Reader)
+	if e != nil {
+		return nil, e
+	}
+	return &Identity{Static: static, Authority: authority}, nil
+}
+
+//
+// AuthorityPubKey() returns the x-only authority public key initiators
+// check the certificate with
+//
+func (id *Identity) AuthorityPubKey() []byte {
+	x, _ := secp.ScalarBaseMult(id.Authority)
+	return bytes32(x)
+}
+
+//
+// Codec runs the handshake for one end of a connection and then turns
+// messages into encrypted frames and back. Bytes read off the connection are
+// passed to Feed(), which buffers partial frames.
+//
+type Codec struct {
+	initiator bool
+	identity  *Identity // responder only
+	authority []byte    // initiator only, nil skips the certificate check
+	ss        *symmetricState
+	e         *KeyPair
+	re        EllSwift
+	send      *cipherState
+	recv      *cipherState
+	buf       []byte
+	hdr       *FrameHeader
+}
+
+//
+// NewInitiator() starts a handshake, returning act1 to write to the
+// responder. authority is the x-only key the responder's certificate must be
+// signed with, nil accepts any.
+//
+func NewInitiator(authority []byte) (c *Codec, act1 []byte, e error) {
+	c = &Codec{
+		initiator: true,
+		authority: authority,
+		ss:        newSymmetricState(),
+	}
+
+	c.e, e = NewKeyPair(rand.Reader)
+	if e != nil {
+		return nil, nil, e
+	}
+
+	c.ss.mixHash(c.e.Pub[:])
+	c.ss.encryptAndHash(nil)
+
+	return c, append([]byte{}, c.e.Pub[:]...), nil
+}
+
+//
+// NewResponder() waits for an initiator's act1
+//
+func NewResponder(identity *Identity) *Codec {
+	return &Codec{
+		identity: identity,
+		ss:       newSymmetricState(),
+	}
+}
+
+//
+// Ready() is true once the handshake is done
+//
+func (c *Codec) Ready() bool {
+	return c.send != nil
+}
+
+//
+// Feed() buffers data read off the connection and returns the messages it
+// completes. During the handshake reply holds the bytes to write back.
+//
+func (c *Codec) Feed(data []byte) (msgs []Message, reply []byte, e error) {
+	c.buf = append(c.buf, data...)
+
+	if !c.Ready() {
+		if c.initiator {
+			if len(c.buf) < act2Len {
+				return nil, nil, nil
+			}
+			e = c.readAct2(c.buf[:act2Len])
+			c.buf = c.buf[act2Len:]
+		} else {
+			if len(c.buf) < act1Len {
+				return nil, nil, nil
+			}
+			reply, e = c.readAct1(c.buf[:act1Len])
+			c.buf = c.buf[act1Len:]
+		}
+		if e != nil {
+			return nil, nil, e
+		}
+	}
+
+	for {
+		if c.hdr == nil {
+			if len(c.buf) < encryptedHeaderLen {
+				break
+			}
+			plain, e := c.recv.decryptWithAd(nil, c.buf[:encryptedHeaderLen])
+			if e != nil {
+				return msgs, reply, e
+			}
+			h, _ := decodeFrameHeader(plain)
+			c.hdr = &h
+			c.buf = c.buf[encryptedHeaderLen:]
+		}
+
+		n := encryptedLen(int(c.hdr.MsgLength))
+		if len(c.buf) < n {
+			break
+		}
+
+		payload, e := c.decryptPayload(c.buf[:n])
+		if e != nil {
+			return msgs, reply, e
+		}
+		c.buf = c.buf[n:]
+		h := *c.hdr
+		c.hdr = nil
+
+		m, e := DecodeMessage(h, payload)
+		if errors.Is(e, ErrUnknownMsgType) || errors.Is(e, ErrUnknownExtension) {
+			// Nothing the proxy relays, the connection carries on
+			continue
+		}
+		if e != nil {
+			return msgs, reply, e
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, reply, nil
+}
+
+//
+// Encode() returns m as an encrypted frame
+//
+func (c *Codec) Encode(m Message) (msg []byte, e error) {
+	if !c.Ready() {
+		return nil, fmt.Errorf("%w: %s before handshake", ErrHandshake, m.Type())
+	}
+
+	frame, e := EncodeFrame(m)
+	if e != nil {
+		return nil, e
+	}
+
+	msg = c.send.encryptWithAd(nil, frame[:FrameHeaderLen])
+	payload := frame[FrameHeaderLen:]
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > maxChunkLen-macLen {
+			n = maxChunkLen - macLen
+		}
+		msg = append(msg, c.send.encryptWithAd(nil, payload[:n])...)
+		payload = payload[n:]
+	}
+
+	return msg, nil
+}
+
+func encryptedLen(length int) int {
+	chunks := (length + maxChunkLen - macLen - 1) / (maxChunkLen - macLen)
+	return length + chunks*macLen
+}
+
+func (c *Codec) decryptPayload(buf []byte) (payload []byte, e error) {
+	for len(buf) > 0 {
+		n := len(buf)
+		if n > maxChunkLen {
+			n = maxChunkLen
+		}
+		plain, e := c.recv.decryptWithAd(nil, buf[:n])
+		if e != nil {
+			return nil, e
+		}
+		payload = append(payload, plain...)
+		buf = buf[n:]
+	}
+	return payload, nil
+}
+
+//
+// readAct1() is the responder side, returning act2
+//
+func (c *Codec) readAct1(act1 []byte) (act2 []byte, e error) {
+	ss := c.ss
+
+	copy(c.re[:], act1)
+	ss.mixHash(c.re[:])
+	if _, e = ss.decryptAndHash(nil); e != nil {
+		return nil, e
+	}
+
+	c.e, e = NewKeyPair(rand.Reader)
+	if e != nil {
+		return nil, e
+	}
+	act2 = append(act2, c.e.Pub[:]...)
+	ss.mixHash(c.e.Pub[:])
+
+	// ee
+	ss.mixKey(ellswiftXDH(c.e.Priv, c.re, c.e.Pub, false))
+
+	// s
+	static := c.identity.Static
+	act2 = append(act2, ss.encryptAndHash(static.Pub[:])...)
+
+	// es
+	ss.mixKey(ellswiftXDH(static.Priv, c.re, static.Pub, false))
+
+	cert, e := NewCertificate(c.identity.Authority, static.XOnly(), time.Now(), CertValidity)
+	if e != nil {
+		return nil, e
+	}
+	act2 = append(act2, ss.encryptAndHash(cert.encode())...)
+
+	c.recv, c.send = ss.split()
+	c.ss = nil
+
+	return act2, nil
+}
+
+//
+// readAct2() is the initiator side
+//
+func (c *Codec) readAct2(act2 []byte) (e error) {
+	ss := c.ss
+
+	copy(c.re[:], act2[:EllSwiftLen])
+	act2 = act2[EllSwiftLen:]
+	ss.mixHash(c.re[:])
+
+	// ee
+	ss.mixKey(ellswiftXDH(c.e.Priv, c.e.Pub, c.re, true))
+
+	// s
+	n := EllSwiftLen + macLen
+	plain, e := ss.decryptAndHash(act2[:n])
+	if e != nil {
+		return e
+	}
+	act2 = act2[n:]
+	var rs EllSwift
+	copy(rs[:], plain)
+
+	// es
+	ss.mixKey(ellswiftXDH(c.e.Priv, c.e.Pub, rs, true))
+
+	plain, e = ss.decryptAndHash(act2)
+	if e != nil {
+		return e
+	}
+
+	if c.authority != nil {
+		cert, e := decodeCertificate(plain)
+		if e != nil {
+			return e
+		}
+		if e = cert.Verify(c.authority, bytes32(ellswiftDecode(rs)), time.Now()); e != nil {
+			return e
+		}
+	}
+
+	c.send, c.recv = ss.split()
+	c.ss = nil
+
+	return nil
+}
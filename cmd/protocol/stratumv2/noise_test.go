@@ -0,0 +1,163 @@
+package stratumv2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+//
+// BIP340 test vector 0
+//
+func TestSchnorrSign(t *testing.T) {
+
+	priv, _ := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000003")
+	pub, _ := hex.DecodeString("F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9")
+	expected, _ := hex.DecodeString("E907831F80848D1069A5371B402410364BDF1C5F8307B0084C55F1CE2DCA821525F66A4A85EA8B71E482A74F382D2CE5EBEEE8FDB2172F477DF4900D310536C0")
+	msg := make([]byte, 32)
+	aux := make([]byte, 32)
+
+	sig, e := SchnorrSign(priv, msg, aux)
+	if e != nil {
+		t.Fatalf("SchnorrSign() error:%s", e)
+	}
+	if !bytes.Equal(sig, expected) {
+		t.Fatalf("SchnorrSign() got:%x expected:%x", sig, expected)
+	}
+
+	if e = SchnorrVerify(pub, msg, sig); e != nil {
+		t.Errorf("SchnorrVerify() error:%s", e)
+	}
+
+	msg[0] = 1
+	if e = SchnorrVerify(pub, msg, sig); !errors.Is(e, ErrBadSignature) {
+		t.Errorf("SchnorrVerify() of a changed message got:%v", e)
+	}
+}
+
+func TestEllSwift(t *testing.T) {
+
+	for i := 0; i < 16; i++ {
+		kp, e := NewKeyPair(rand.Reader)
+		if e != nil {
+			t.Fatalf("NewKeyPair() error:%s", e)
+		}
+		if x := ellswiftDecode(kp.Pub); !bytes.Equal(bytes32(x), kp.XOnly()) {
+			t.Fatalf("ellswiftDecode() got:%x expected:%x", bytes32(x), kp.XOnly())
+		}
+	}
+
+	a, _ := NewKeyPair(rand.Reader)
+	b, _ := NewKeyPair(rand.Reader)
+	if !bytes.Equal(ellswiftXDH(a.Priv, a.Pub, b.Pub, true), ellswiftXDH(b.Priv, a.Pub, b.Pub, false)) {
+		t.Errorf("ellswiftXDH() sides do not agree")
+	}
+
+	// Any 64 bytes decode to a point on the curve
+	var ell EllSwift
+	if x := ellswiftDecode(ell); !isValidX(x) {
+		t.Errorf("ellswiftDecode() of zeros got invalid x:%s", x)
+	}
+	if x := ellswiftDecode(ell); x.Cmp(big.NewInt(0)) == 0 {
+		t.Errorf("ellswiftDecode() of zeros got zero")
+	}
+}
+
+//
+// Run both ends of the handshake and pass frames in pieces
+//
+func TestNoiseHandshake(t *testing.T) {
+
+	identity, e := NewIdentity(nil)
+	if e != nil {
+		t.Fatalf("NewIdentity() error:%s", e)
+	}
+
+	miner, act1, e := NewInitiator(identity.AuthorityPubKey())
+	if e != nil {
+		t.Fatalf("NewInitiator() error:%s", e)
+	}
+	pool := NewResponder(identity)
+
+	_, act2, e := pool.Feed(act1)
+	if e != nil || len(act2) != act2Len || !pool.Ready() {
+		t.Fatalf("responder Feed() act2:%d error:%v", len(act2), e)
+	}
+
+	if _, _, e = miner.Feed(act2); e != nil || !miner.Ready() {
+		t.Fatalf("initiator Feed() error:%v", e)
+	}
+
+	job := &NewExtendedMiningJob{
+		ChannelID:        7,
+		JobID:            1,
+		Version:          0x20000000,
+		MerklePath:       []U256{{1}, {2}},
+		CoinbaseTxPrefix: bytes.Repeat([]byte{0xaa}, 40000),
+		CoinbaseTxSuffix: bytes.Repeat([]byte{0xbb}, 40000),
+	}
+	submit := &SubmitSharesStandard{ChannelID: 7, SequenceNumber: 1, JobID: 1, Nonce: 42}
+
+	data, e := pool.Encode(job)
+	if e != nil {
+		t.Fatalf("Encode() error:%s", e)
+	}
+
+	var got []Message
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		msgs, _, e := miner.Feed(data[:n])
+		if e != nil {
+			t.Fatalf("Feed() error:%s", e)
+		}
+		got = append(got, msgs...)
+		data = data[n:]
+	}
+	if len(got) != 1 {
+		t.Fatalf("Feed() got %d messages", len(got))
+	}
+	if j, ok := got[0].(*NewExtendedMiningJob); !ok || len(j.CoinbaseTxSuffix) != 40000 || j.MerklePath[1][0] != 2 {
+		t.Errorf("Feed() got:%v", got[0])
+	}
+
+	data, _ = miner.Encode(submit)
+	got, _, e = pool.Feed(data)
+	if e != nil || len(got) != 1 || got[0].(*SubmitSharesStandard).Nonce != 42 {
+		t.Errorf("Feed() got:%v error:%v", got, e)
+	}
+
+	// A flipped bit fails the MAC
+	data, _ = miner.Encode(submit)
+	data[3] ^= 1
+	if _, _, e = pool.Feed(data); !errors.Is(e, ErrHandshake) {
+		t.Errorf("Feed() of a corrupted frame got:%v", e)
+	}
+}
+
+func TestNoiseCertificate(t *testing.T) {
+
+	identity, _ := NewIdentity(nil)
+	other, _ := NewIdentity(nil)
+
+	miner, act1, _ := NewInitiator(other.AuthorityPubKey())
+	_, act2, _ := NewResponder(identity).Feed(act1)
+	if _, _, e := miner.Feed(act2); !errors.Is(e, ErrCertificate) {
+		t.Errorf("Feed() with the wrong authority got:%v", e)
+	}
+
+	now := time.Now()
+	cert, _ := NewCertificate(identity.Authority, identity.Static.XOnly(), now, time.Minute)
+	if e := cert.Verify(identity.AuthorityPubKey(), identity.Static.XOnly(), now.Add(2*time.Minute)); !errors.Is(e, ErrCertificate) {
+		t.Errorf("Verify() of an expired certificate got:%v", e)
+	}
+	if e := cert.Verify(identity.AuthorityPubKey(), identity.Static.XOnly(), now); e != nil {
+		t.Errorf("Verify() error:%s", e)
+	}
+}
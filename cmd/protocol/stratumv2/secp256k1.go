@@ -0,0 +1,368 @@
+package stratumv2
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+//
+// secp256k1 pieces of the SV2 handshake that btcec does not provide:
+// ElligatorSwift encoded public keys and the x-only ECDH over them from
+// BIP324, and BIP340 Schnorr signatures used for the pool certificate.
+// Everything is plain math/big on top of the btcec curve arithmetic.
+//
+
+var ErrBadSignature = errors.New("StratumV2: bad signature")
+var ErrBadPubKey = errors.New("StratumV2: bad public key")
+
+var secp = btcec.S256()
+
+var (
+	bigOne     = big.NewInt(1)
+	bigTwo     = big.NewInt(2)
+	bigSeven   = big.NewInt(7)
+	minus3Sqrt = fieldSqrt(new(big.Int).Sub(secp.P, big.NewInt(3)))
+)
+
+const EllSwiftLen int = 64
+
+type EllSwift [EllSwiftLen]byte
+
+func fieldMod(a *big.Int) *big.Int {
+	return a.Mod(a, secp.P)
+}
+
+func fieldAdd(a, b *big.Int) *big.Int {
+	return fieldMod(new(big.Int).Add(a, b))
+}
+
+func fieldSub(a, b *big.Int) *big.Int {
+	return fieldMod(new(big.Int).Sub(a, b))
+}
+
+func fieldMul(a, b *big.Int) *big.Int {
+	return fieldMod(new(big.Int).Mul(a, b))
+}
+
+func fieldNeg(a *big.Int) *big.Int {
+	return fieldMod(new(big.Int).Neg(a))
+}
+
+func fieldDiv(a, b *big.Int) *big.Int {
+	return fieldMul(a, new(big.Int).ModInverse(b, secp.P))
+}
+
+//
+// fieldSqrt() returns the square root a^((p+1)/4) of a, nil if a is not a square
+//
+func fieldSqrt(a *big.Int) *big.Int {
+	r := new(big.Int).Exp(a, secp.QPlus1Div4(), secp.P)
+	if fieldMul(r, r).Cmp(fieldMod(new(big.Int).Set(a))) != 0 {
+		return nil
+	}
+	return r
+}
+
+// x^3 + 7
+func curveRHS(x *big.Int) *big.Int {
+	return fieldAdd(fieldMul(fieldMul(x, x), x), bigSeven)
+}
+
+func isValidX(x *big.Int) bool {
+	return fieldSqrt(curveRHS(x)) != nil
+}
+
+func bytes32(v *big.Int) []byte {
+	b := make([]byte, 32)
+	v.FillBytes(b)
+	return b
+}
+
+//
+// taggedHash() is the BIP340 SHA256(SHA256(tag) || SHA256(tag) || msg...)
+//
+func taggedHash(tag string, msg ...[]byte) []byte {
+	t := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(t[:])
+	h.Write(t[:])
+	for _, m := range msg {
+		h.Write(m)
+	}
+	return h.Sum(nil)
+}
+
+//
+// xswiftec() maps the field elements u, t to an x coordinate on the curve
+//
+func xswiftec(u, t *big.Int) *big.Int {
+	if u.Sign() == 0 {
+		u = bigOne
+	}
+	if t.Sign() == 0 {
+		t = bigOne
+	}
+	u3 := fieldMul(fieldMul(u, u), u)
+	if fieldAdd(fieldAdd(u3, fieldMul(t, t)), bigSeven).Sign() == 0 {
+		t = fieldMul(t, bigTwo)
+	}
+
+	x := fieldDiv(fieldSub(fieldAdd(u3, bigSeven), fieldMul(t, t)), fieldMul(t, bigTwo))
+	y := fieldDiv(fieldAdd(x, t), fieldMul(minus3Sqrt, u))
+
+	candidates := []*big.Int{
+		fieldAdd(u, fieldMul(big.NewInt(4), fieldMul(y, y))),
+		fieldDiv(fieldSub(fieldNeg(fieldDiv(x, y)), u), bigTwo),
+		fieldDiv(fieldSub(fieldDiv(x, y), u), bigTwo),
+	}
+	for _, c := range candidates {
+		if isValidX(c) {
+			return c
+		}
+	}
+	panic("xswiftec: no valid x")
+}
+
+//
+// xswiftecInv() finds t so that xswiftec(u, t) == x, nil if this u and case
+// do not have one
+//
+func xswiftecInv(x, u *big.Int, c int) *big.Int {
+	var s, v *big.Int
+	u2 := fieldMul(u, u)
+	u3 := fieldMul(u2, u)
+
+	if c&2 == 0 {
+		if isValidX(fieldSub(fieldNeg(x), u)) {
+			return nil
+		}
+		v = x
+		s = fieldNeg(fieldDiv(fieldAdd(u3, bigSeven), fieldAdd(fieldAdd(u2, fieldMul(u, v)), fieldMul(v, v))))
+	} else {
+		s = fieldSub(x, u)
+		if s.Sign() == 0 {
+			return nil
+		}
+		inner := fieldAdd(fieldMul(big.NewInt(4), fieldAdd(u3, bigSeven)), fieldMul(fieldMul(big.NewInt(3), s), u2))
+		r := fieldSqrt(fieldNeg(fieldMul(s, inner)))
+		if r == nil {
+			return nil
+		}
+		if c&1 == 1 && r.Sign() == 0 {
+			return nil
+		}
+		v = fieldDiv(fieldAdd(fieldNeg(u), fieldDiv(r, s)), bigTwo)
+	}
+
+	w := fieldSqrt(s)
+	if w == nil {
+		return nil
+	}
+
+	plus := fieldDiv(fieldMul(u, fieldAdd(bigOne, minus3Sqrt)), bigTwo)
+	minus := fieldDiv(fieldMul(u, fieldSub(bigOne, minus3Sqrt)), bigTwo)
+
+	switch c & 5 {
+	case 0:
+		return fieldNeg(fieldMul(w, fieldAdd(minus, v)))
+	case 1:
+		return fieldMul(w, fieldAdd(plus, v))
+	case 4:
+		return fieldMul(w, fieldAdd(minus, v))
+	default:
+		return fieldNeg(fieldMul(w, fieldAdd(plus, v)))
+	}
+}
+
+//
+// ellswiftEncode() returns a random ElligatorSwift encoding of x
+//
+func ellswiftEncode(rand io.Reader, x *big.Int) (ell EllSwift, e error) {
+	var buf [33]byte
+	for {
+		if _, e = io.ReadFull(rand, buf[:]); e != nil {
+			return ell, e
+		}
+		u := fieldMod(new(big.Int).SetBytes(buf[:32]))
+		if u.Sign() == 0 {
+			continue
+		}
+		t := xswiftecInv(x, u, int(buf[32]&7))
+		if t == nil || t.Sign() == 0 {
+			continue
+		}
+		copy(ell[:32], bytes32(u))
+		copy(ell[32:], bytes32(t))
+		return ell, nil
+	}
+}
+
+//
+// ellswiftDecode() returns the x coordinate ell encodes
+//
+func ellswiftDecode(ell EllSwift) *big.Int {
+	u := fieldMod(new(big.Int).SetBytes(ell[:32]))
+	t := fieldMod(new(big.Int).SetBytes(ell[32:]))
+	return xswiftec(u, t)
+}
+
+//
+// newPrivKey() returns a random scalar in [1, n)
+//
+func newPrivKey(rand io.Reader) (priv []byte, e error) {
+	buf := make([]byte, 32)
+	for {
+		if _, e = io.ReadFull(rand, buf); e != nil {
+			return nil, e
+		}
+		k := new(big.Int).SetBytes(buf)
+		if k.Sign() > 0 && k.Cmp(secp.N) < 0 {
+			return buf, nil
+		}
+	}
+}
+
+//
+// KeyPair is a secp256k1 key with the ElligatorSwift encoding of its
+// public key, as sent in the handshake
+//
+type KeyPair struct {
+	Priv []byte
+	Pub  EllSwift
+}
+
+func NewKeyPair(rand io.Reader) (kp *KeyPair, e error) {
+	priv, e := newPrivKey(rand)
+	if e != nil {
+		return nil, e
+	}
+	x, _ := secp.ScalarBaseMult(priv)
+	pub, e := ellswiftEncode(rand, x)
+	if e != nil {
+		return nil, e
+	}
+	return &KeyPair{Priv: priv, Pub: pub}, nil
+}
+
+//
+// XOnly() returns the 32 byte x-only public key of kp
+//
+func (kp *KeyPair) XOnly() []byte {
+	x, _ := secp.ScalarBaseMult(kp.Priv)
+	return bytes32(x)
+}
+
+//
+// ellswiftXDH() is the BIP324 shared secret between priv and the other
+// side's public key, ellInit and ellResp being the initiator's and
+// responder's encoded public keys
+//
+func ellswiftXDH(priv []byte, ellInit, ellResp EllSwift, initiating bool) []byte {
+	theirs := ellResp
+	if !initiating {
+		theirs = ellInit
+	}
+
+	x := ellswiftDecode(theirs)
+	y := fieldSqrt(curveRHS(x))
+	sx, _ := secp.ScalarMult(x, y, priv)
+
+	return taggedHash("bip324_ellswift_xonly_ecdh", ellInit[:], ellResp[:], bytes32(sx))
+}
+
+//
+// liftX() returns the point with x coordinate x and an even y
+//
+func liftX(x *big.Int) (px, py *big.Int, e error) {
+	if x.Cmp(secp.P) >= 0 {
+		return nil, nil, ErrBadPubKey
+	}
+	y := fieldSqrt(curveRHS(x))
+	if y == nil {
+		return nil, nil, ErrBadPubKey
+	}
+	if y.Bit(0) == 1 {
+		y = fieldNeg(y)
+	}
+	return x, y, nil
+}
+
+//
+// SchnorrSign() signs the 32 byte msg with priv as in BIP340
+//
+func SchnorrSign(priv []byte, msg []byte, aux []byte) (sig []byte, e error) {
+	d := new(big.Int).SetBytes(priv)
+	if d.Sign() == 0 || d.Cmp(secp.N) >= 0 {
+		return nil, errors.New("StratumV2: bad private key")
+	}
+
+	px, py := secp.ScalarBaseMult(priv)
+	if py.Bit(0) == 1 {
+		d.Sub(secp.N, d)
+	}
+
+	t := taggedHash("BIP0340/aux", aux)
+	db := bytes32(d)
+	for i := range t {
+		t[i] ^= db[i]
+	}
+
+	k := new(big.Int).SetBytes(taggedHash("BIP0340/nonce", t, bytes32(px), msg))
+	k.Mod(k, secp.N)
+	if k.Sign() == 0 {
+		return nil, errors.New("StratumV2: bad nonce")
+	}
+
+	rx, ry := secp.ScalarBaseMult(bytes32(k))
+	if ry.Bit(0) == 1 {
+		k.Sub(secp.N, k)
+	}
+
+	ev := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", bytes32(rx), bytes32(px), msg))
+	ev.Mod(ev, secp.N)
+
+	s := new(big.Int).Mul(ev, d)
+	s.Add(s, k)
+	s.Mod(s, secp.N)
+
+	return append(bytes32(rx), bytes32(s)...), nil
+}
+
+//
+// SchnorrVerify() checks the BIP340 signature sig of msg by the x-only
+// public key pub
+//
+func SchnorrVerify(pub []byte, msg []byte, sig []byte) (e error) {
+	if len(pub) != 32 || len(sig) != 64 {
+		return ErrBadSignature
+	}
+
+	px, py, e := liftX(new(big.Int).SetBytes(pub))
+	if e != nil {
+		return e
+	}
+
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if r.Cmp(secp.P) >= 0 || s.Cmp(secp.N) >= 0 {
+		return ErrBadSignature
+	}
+
+	ev := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", sig[:32], pub, msg))
+	ev.Mod(ev, secp.N)
+	ev.Sub(secp.N, ev)
+
+	sx, sy := secp.ScalarBaseMult(sig[32:])
+	ex, ey := secp.ScalarMult(px, py, bytes32(ev))
+	rx, ry := secp.Add(sx, sy, ex, ey)
+
+	if (rx.Sign() == 0 && ry.Sign() == 0) || ry.Bit(0) == 1 || rx.Cmp(r) != 0 {
+		return ErrBadSignature
+	}
+
+	return nil
+}
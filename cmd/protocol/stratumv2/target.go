@@ -0,0 +1,73 @@
+package stratumv2
+
+import (
+	"math"
+	"math/big"
+)
+
+//
+// Targets and difficulty
+//
+// SV2 carries share targets as little endian U256, Stratum V1 as a pool
+// difficulty relative to the difficulty 1 target 0xffff * 2^208.
+//
+
+var diff1Target = new(big.Int).Lsh(big.NewInt(0xffff), 208)
+
+//
+// TargetToBig()
+//
+func TargetToBig(t U256) *big.Int {
+	var be [32]byte
+	for i := range t {
+		be[31-i] = t[i]
+	}
+	return new(big.Int).SetBytes(be[:])
+}
+
+//
+// BigToTarget()
+// Values that do not fit are capped at the maximum target
+//
+func BigToTarget(b *big.Int) (t U256) {
+	if b.Sign() <= 0 {
+		return t
+	}
+	be := b.Bytes()
+	if len(be) > 32 {
+		for i := range t {
+			t[i] = 0xff
+		}
+		return t
+	}
+	for i := range be {
+		t[i] = be[len(be)-1-i]
+	}
+	return t
+}
+
+//
+// TargetToDifficulty()
+// A zero target gives the largest float
+//
+func TargetToDifficulty(t U256) float64 {
+	b := TargetToBig(t)
+	if b.Sign() == 0 {
+		return math.MaxFloat64
+	}
+	d, _ := new(big.Float).Quo(new(big.Float).SetInt(diff1Target), new(big.Float).SetInt(b)).Float64()
+	return d
+}
+
+//
+// DifficultyToTarget()
+// Difficulties below 1 give targets above the difficulty 1 target
+//
+func DifficultyToTarget(d float64) U256 {
+	if d <= 0 || math.IsNaN(d) || math.IsInf(d, 0) {
+		return BigToTarget(new(big.Int).Lsh(big.NewInt(1), 256))
+	}
+	q := new(big.Float).Quo(new(big.Float).SetInt(diff1Target), big.NewFloat(d))
+	b, _ := q.Int(nil)
+	return BigToTarget(b)
+}
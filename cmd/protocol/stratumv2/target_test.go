@@ -0,0 +1,29 @@
+package stratumv2
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTargetDifficulty(t *testing.T) {
+
+	for _, d := range []float64{1, 2, 1024, 65536.5, 1e12} {
+		got := TargetToDifficulty(DifficultyToTarget(d))
+		if math.Abs(got-d)/d > 1e-9 {
+			t.Errorf("TargetToDifficulty(DifficultyToTarget(%f)) got:%f", d, got)
+		}
+	}
+
+	var diff1 U256
+	diff1[26], diff1[27] = 0xff, 0xff
+	if d := TargetToDifficulty(diff1); d != 1 {
+		t.Errorf("TargetToDifficulty(diff1) got:%f", d)
+	}
+
+	max := DifficultyToTarget(0)
+	for i := range max {
+		if max[i] != 0xff {
+			t.Fatalf("DifficultyToTarget(0) got:%x", max)
+		}
+	}
+}
@@ -197,7 +197,7 @@ func (v *MainValidator) validateHandler(ch msgbus.EventChan) {
 			return
 
 		case event := <-ch:
-			if event.EventType == msgbus.PublishEvent {
+			if event.EventType == msgbus.StreamEvent {
 				//id := msgbus.ValidateID(event.ID)
 				validateMsg := event.Data.(*msgbus.Validate)
 				minerID := msgbus.MinerID(validateMsg.MinerID)
@@ -344,9 +344,11 @@ func (v *MainValidator) validateHandler(ch msgbus.EventChan) {
 						contextlib.Logf(v.Ctx, log.LevelPanic, "Failed to convert hashrate string to int, Fileline::%s, Error::%v", lumerinlib.FileLine(), err)
 					}
 
-					// set hashrate in miner
-					miner.CurrentHashRate = hashCount
-					v.Ps.MinerSetWait(*miner)
+					// set hashrate in miner, leaving fields other writers own untouched
+					v.Ps.MinerUpdateWait(miner.ID, func(m *msgbus.Miner) error {
+						m.CurrentHashRate = hashCount
+						return nil
+					})
 				default:
 					contextlib.Logf(v.Ctx, log.LevelTrace, lumerinlib.Funcname()+" Got Validate Msg with different type: %v", event)
 				}
@@ -11,3 +11,22 @@ func TestLibFunctions(t *testing.T) {
 	fmt.Printf(Funcname() + "\n")
 
 }
+
+func TestParsePin(t *testing.T) {
+
+	hexpin := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	b64pin := "sha256/AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+
+	for _, s := range []string{hexpin, b64pin} {
+		pin, e := ParsePin(s)
+		if e != nil || fmt.Sprintf("%x", pin) != hexpin {
+			t.Errorf("ParsePin(%s) got:%x %v", s, pin, e)
+		}
+	}
+
+	for _, s := range []string{"", "0001", "sha256/AAEC"} {
+		if _, e := ParsePin(s); e == nil {
+			t.Errorf("ParsePin(%s) accepted a bad pin", s)
+		}
+	}
+}
@@ -1,5 +1,15 @@
 package lumerinlib
 
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
 type NetworkType string
 
 const TCP NetworkType = "tcp"
@@ -49,3 +59,81 @@ func NewNetAddr(net NetworkType, ip string) (na *NetAddr) {
 
 	return na
 }
+
+const TLS NetworkType = "tls"
+
+//
+// TLSNetAddr is a TCP address spoken to over TLS. Dialing checks the
+// server certificate for ServerName, or if there are Pins only that the
+// certificate's public key is one of them. Listening serves Config.
+//
+type TLSNetAddr struct {
+	NetAddr
+	ServerName string
+	Pins       [][]byte    // SHA-256 of the certificate SubjectPublicKeyInfo
+	Config     *tls.Config // Listener certificates
+}
+
+//
+// NewTLSNetAddr() returns an address to dial with TLS
+//
+func NewTLSNetAddr(ip string, serverName string, pins [][]byte) (na *TLSNetAddr) {
+
+	na = &TLSNetAddr{
+		NetAddr:    NetAddr{ipaddr: ip, network: TLS},
+		ServerName: serverName,
+		Pins:       pins,
+	}
+
+	return na
+}
+
+//
+// NewTLSListenAddr() returns an address to listen on with TLS
+//
+func NewTLSListenAddr(ip string, config *tls.Config) (na *TLSNetAddr) {
+
+	na = &TLSNetAddr{
+		NetAddr: NetAddr{ipaddr: ip, network: TLS},
+		Config:  config,
+	}
+
+	return na
+}
+
+//
+// ProxyListenAddr is a TCP or TLS address to listen on behind a load
+// balancer, its connections start with a HAProxy PROXY protocol header
+//
+type ProxyListenAddr struct {
+	net.Addr
+}
+
+//
+// NewProxyListenAddr() returns addr listening for PROXY protocol headers
+//
+func NewProxyListenAddr(addr net.Addr) (na *ProxyListenAddr) {
+	return &ProxyListenAddr{Addr: addr}
+}
+
+//
+// ParsePin() reads a certificate pin, the SHA-256 of its
+// SubjectPublicKeyInfo, as hex or as base64 with an optional "sha256/" prefix
+//
+func ParsePin(s string) (pin []byte, e error) {
+
+	s = strings.TrimPrefix(s, "sha256/")
+	if len(s) == 2*sha256.Size {
+		pin, e = hex.DecodeString(s)
+	} else {
+		pin, e = base64.StdEncoding.DecodeString(s)
+	}
+	if e == nil && len(pin) != sha256.Size {
+		e = fmt.Errorf("pin is %d bytes, expected %d", len(pin), sha256.Size)
+	}
+	if e != nil {
+		return nil, fmt.Errorf("bad certificate pin %q: %w", s, e)
+	}
+
+	return pin, nil
+}